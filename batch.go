@@ -0,0 +1,110 @@
+package gotalk
+
+import (
+  "context"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// A request sent with Sock.RequestBatch
+type BatchReq struct {
+  Op  string
+  In  interface{}
+  Out interface{}  // the result is decoded into this, unless nil
+}
+
+// The result of a request sent with Sock.RequestBatch
+type BatchResult struct {
+  Data []byte  // the result, encoded with the socket's codec
+  Err  error   // why the request failed, or nil
+}
+
+func (s *socket) RequestBatch(reqs []BatchReq) ([]BatchResult, error) {
+  codec := s.Codec()
+  bufs := make([][]byte, len(reqs))
+  for i, r := range reqs {
+    buf, err := encodeValue(codec, r.In)
+    if err != nil {
+      return nil, err
+    }
+    bufs[i] = buf
+  }
+
+  ids := make([]string, 0, len(reqs))
+  rcs := make([]*resChan, 0, len(reqs))
+  defer func() {
+    for _, id := range ids {
+      s.deallocResChan(id)
+    }
+  }()
+  for range reqs {
+    id, rc, err := s.allocResChan()
+    if err != nil {
+      return nil, err
+    }
+    ids = append(ids, id)
+    rcs = append(rcs, rc)
+  }
+
+  size := 0
+  for _, buf := range bufs {
+    size += len(buf)
+  }
+  atomic.AddInt64(&s.pendingBytes, int64(size))
+  err := s.writeBatch(ids, reqs, bufs)
+  atomic.AddInt64(&s.pendingBytes, -int64(size))
+  if err != nil {
+    return nil, err
+  }
+  atomic.AddUint64(&s.stats.requestsSent, uint64(len(reqs)))
+
+  // One timeout for the whole batch, closing timeoutc so that all waiting requests see it
+  var timeoutc <-chan time.Time
+  if timeout := s.RequestTimeout(); timeout > 0 {
+    c := make(chan time.Time)
+    timer := time.AfterFunc(timeout, func() { close(c) })
+    defer timer.Stop()
+    timeoutc = c
+  }
+
+  // Wait for the results concurrently, as the read loop waits for each result to be taken
+  results := make([]BatchResult, len(reqs))
+  var wg sync.WaitGroup
+  for i, rc := range rcs {
+    wg.Add(1)
+    go func(i int, rc *resChan) {
+      defer wg.Done()
+      res := &results[i]
+      res.Data, _, res.Err = s.waitResult(context.Background(), ids[i], rc, timeoutc)
+      if res.Err == nil && reqs[i].Out != nil {
+        res.Err = codec.Unmarshal(res.Data, reqs[i].Out)
+      }
+    }(i, rc)
+  }
+  wg.Wait()
+  return results, nil
+}
+
+// Writes the requests of a batch with a single write to the connection, unless compressed
+func (s *socket) writeBatch(ids []string, reqs []BatchReq, bufs [][]byte) error {
+  return s.write(func() error {
+    if s.compress {
+      for i, r := range reqs {
+        if err := s.writeMsgLocked(MsgTypeSingleReq, ids[i], r.Op, bufs[i]); err != nil {
+          return err
+        }
+      }
+      return nil
+    }
+    var b []byte
+    for i, r := range reqs {
+      b = append(b, MakeMsg(MsgTypeSingleReq, ids[i], r.Op, len(bufs[i]))...)
+      b = append(b, bufs[i]...)
+    }
+    if _, err := s.writer().Write(b); err != nil {
+      return err
+    }
+    return s.flushLocked(MsgTypeSingleReq)
+  })
+}
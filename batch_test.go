@@ -0,0 +1,68 @@
+package gotalk
+
+import (
+  "testing"
+  "time"
+)
+
+
+func TestRequestBatch(t *testing.T) {
+  h := NewHandlers()
+  // Later requests complete first
+  h.HandleRequest("square", func(n int) (int, error) {
+    time.Sleep(time.Duration(10 - n) * 5 * time.Millisecond)
+    if n < 0 {
+      return 0, Errorf(400, "negative")
+    }
+    return n * n, nil
+  })
+  s1, s2, err := PipeHandlers(NewHandlers(), h)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s1.Close()
+  defer s2.Close()
+
+  outs := make([]int, 4)
+  reqs := []BatchReq{
+    {"square", 1, &outs[0]},
+    {"square", 2, &outs[1]},
+    {"square", -1, &outs[2]},
+    {"nope", 3, &outs[3]},
+  }
+  results, err := s1.RequestBatch(reqs)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(results) != len(reqs) {
+    t.Fatalf("RequestBatch() => %d results, expected %d", len(results), len(reqs))
+  }
+  if results[0].Err != nil || outs[0] != 1 || string(results[0].Data) != "1" {
+    t.Errorf("result 0 => %+v, %d, expected 1", results[0], outs[0])
+  }
+  if results[1].Err != nil || outs[1] != 4 {
+    t.Errorf("result 1 => %+v, %d, expected 4", results[1], outs[1])
+  }
+  if e, ok := results[2].Err.(*RequestError); !ok || e.Code() != 400 {
+    t.Errorf("result 2 => %+v, expected error with code 400", results[2])
+  }
+  if results[3].Err == nil {
+    t.Errorf("result 3 => %+v, expected error for unknown operation", results[3])
+  }
+  if n := s1.InFlightRequests(); n != 0 {
+    t.Errorf("InFlightRequests() => %d after the batch, expected 0", n)
+  }
+
+  // The timeout applies to the whole batch
+  s1.SetRequestTimeout(20*time.Millisecond)
+  results, err = s1.RequestBatch([]BatchReq{{"square", 9, nil}, {"square", 0, nil}})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if results[0].Err != nil || string(results[0].Data) != "81" {
+    t.Errorf("result 0 => %+v, expected 81", results[0])
+  }
+  if results[1].Err != ErrTimeout {
+    t.Errorf("result 1 => %+v, expected ErrTimeout", results[1])
+  }
+}
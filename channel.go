@@ -0,0 +1,109 @@
+package gotalk
+
+import (
+  "context"
+  "sync/atomic"
+)
+
+// A logical channel of a socket, e.g. one per tenant, with its own handlers. Requests and
+// notifications sent on a channel are handled by the handlers of the channel with the same ID
+// at the other end, while those sent with the socket are handled as usual, so the socket
+// itself is the default channel. Results of requests are matched by request ID as usual.
+type Channel struct {
+  sock     *socket
+  id       string
+  handlers Handlers
+}
+
+type channelKey struct{}
+
+func (s *socket) Channel(id string) *Channel {
+  if id == "" {
+    panic("empty channel ID")
+  }
+  s.channelsMu.Lock()
+  defer s.channelsMu.Unlock()
+  if c := s.channels[id]; c != nil {
+    return c
+  }
+  if s.channels == nil {
+    s.channels = make(map[string]*Channel)
+  }
+  c := &Channel{sock:s, id:id, handlers:NewHandlers()}
+  s.channels[id] = c
+  return c
+}
+
+// Returns the channel `id` if it has been opened with Channel, or nil
+func (s *socket) findChannel(id string) *Channel {
+  s.channelsMu.Lock()
+  defer s.channelsMu.Unlock()
+  return s.channels[id]
+}
+
+func (s *socket) readChannelTag(size int) error {
+  buf := make([]byte, size)
+  if err := readn(s.rd, buf); err != nil {
+    return err
+  }
+  if len(buf) == 0 {
+    return &ProtocolError{msg:"empty channel ID"}
+  }
+  s.channelTag = string(buf)
+  return nil
+}
+
+func (c *Channel) ID() string { return c.id }
+func (c *Channel) Sock() Sock { return c.sock }
+
+// Handlers of requests and notifications sent on this channel by the peer
+func (c *Channel) Handlers() Handlers { return c.handlers }
+
+func (c *Channel) Request(op string, in, out interface{}) error {
+  return c.RequestContext(context.Background(), op, in, out)
+}
+
+func (c *Channel) RequestContext(ctx context.Context, op string, in, out interface{}) error {
+  codec := c.sock.Codec()
+  inbuf, err := codec.Marshal(in)
+  if err != nil {
+    return err
+  }
+  outbuf, err := c.BufferRequestContext(ctx, op, inbuf)
+  if err != nil {
+    return err
+  }
+  return codec.Unmarshal(outbuf, out)
+}
+
+func (c *Channel) BufferRequest(op string, in []byte) ([]byte, error) {
+  return c.BufferRequestContext(context.Background(), op, in)
+}
+
+func (c *Channel) BufferRequestContext(ctx context.Context, op string, in []byte) ([]byte, error) {
+  ctx = context.WithValue(ctx, channelKey{}, c.id)
+  return c.sock.bufferRequest(ctx, op, in, c.sock.RequestTimeout(), nil)
+}
+
+func (c *Channel) Notify(name string, in interface{}) error {
+  buf, err := encodeValue(c.sock.Codec(), in)
+  if err != nil {
+    return err
+  }
+  return c.BufferNotify(name, buf)
+}
+
+// Like Sock.BufferNotify but the notification is never queued (see Sock.SetNotifyQueueSize)
+func (c *Channel) BufferNotify(name string, buf []byte) error {
+  s := c.sock
+  err := s.write(func() error {
+    if err := s.writeMsgLocked(MsgTypeSingleRes, ChannelID, "", []byte(c.id)); err != nil {
+      return err
+    }
+    return s.writeMsgLocked(MsgTypeNotification, "", name, buf)
+  })
+  if err == nil {
+    atomic.AddUint64(&s.stats.notificationsSent, 1)
+  }
+  return err
+}
@@ -0,0 +1,51 @@
+package gotalk
+
+import (
+  "strings"
+  "testing"
+)
+
+
+func TestChannel(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("who", func() (string, error) { return "default", nil })
+  notes := make(chan string, 2)
+  h.HandleNotification("note", func(s string) { notes <- "default:" + s })
+  s1, s2, err := PipeHandlers(NewHandlers(), h)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s1.Close()
+  defer s2.Close()
+
+  c2 := s2.Channel("a")
+  if s2.Channel("a") != c2 || c2.ID() != "a" {
+    t.Fatalf("Channel() returned another channel for the same ID")
+  }
+  c2.Handlers().HandleRequest("who", func() (string, error) { return "a", nil })
+  c2.Handlers().HandleNotification("note", func(s string) { notes <- "a:" + s })
+
+  var out string
+  if err := s1.Channel("a").Request("who", nil, &out); err != nil || out != "a" {
+    t.Errorf("Channel(a).Request() => (%q, %v), expected %q", out, err, "a")
+  }
+  if err := s1.Request("who", nil, &out); err != nil || out != "default" {
+    t.Errorf("Request() => (%q, %v), expected %q", out, err, "default")
+  }
+  err = s1.Channel("b").Request("who", nil, &out)
+  if err == nil || !strings.Contains(err.Error(), "unknown channel") {
+    t.Errorf("Channel(b).Request() => %v, expected unknown channel", err)
+  }
+
+  // Channels work both ways
+  s1.Channel("a").Handlers().HandleRequest("who", func() (string, error) { return "a1", nil })
+  if err := c2.Request("who", nil, &out); err != nil || out != "a1" {
+    t.Errorf("Request() on the other end => (%q, %v), expected %q", out, err, "a1")
+  }
+
+  s1.Channel("a").Notify("note", "x")
+  s1.Notify("note", "y")
+  if n1, n2 := <-notes, <-notes; n1 != "a:x" || n2 != "default:y" {
+    t.Errorf("received notifications %q, %q, expected \"a:x\", \"default:y\"", n1, n2)
+  }
+}
@@ -0,0 +1,75 @@
+package gotalk
+
+import (
+  "hash/crc32"
+  "io"
+  "strconv"
+)
+
+// Checksum announced during the handshake, which is the only one supported
+const checksumName = "crc32"
+
+func (s *socket) SetFrameChecksum(enable bool) {
+  s.checksum = enable
+}
+
+// Wraps a connection once both ends have announced checksums, writing everything as the
+// payloads of "checksummed" messages, each followed by the CRC-32 of its payload, and reading
+// such messages, failing with a *ProtocolError when a payload doesn't match its checksum.
+type checksumConn struct {
+  io.ReadWriteCloser
+  rbuf  []byte  // verified payload not yet read
+  limit int     // max payload size of received messages, or 0 for no limit
+}
+
+func (c *checksumConn) Write(b []byte) (int, error) {
+  if len(b) == 0 {
+    return 0, nil
+  }
+  msg := make([]byte, 0, 12 + len(b) + 8)
+  msg = append(msg, MakeMsg(MsgTypeChecksummed, "000", "", len(b))...)
+  msg = append(msg, b...)
+  msg = append(msg, makeFixnumBuf(8, uint64(crc32.ChecksumIEEE(b)), 16)...)
+  if _, err := c.ReadWriteCloser.Write(msg); err != nil {
+    return 0, err
+  }
+  return len(b), nil
+}
+
+func (c *checksumConn) Read(b []byte) (int, error) {
+  if len(c.rbuf) == 0 {
+    if err := c.readChecksummed(); err != nil {
+      return 0, err
+    }
+  }
+  n := copy(b, c.rbuf)
+  c.rbuf = c.rbuf[n:]
+  return n, nil
+}
+
+// Reads the next "checksummed" message into rbuf
+func (c *checksumConn) readChecksummed() error {
+  t, _, _, size, err := ReadMsg(c.ReadWriteCloser)
+  if e, ok := err.(*strconv.NumError); ok {
+    return &ProtocolError{msg:"malformed message header: " + e.Error(), msgType:t}
+  } else if err != nil {
+    return err
+  }
+  if t != MsgTypeChecksummed {
+    return &ProtocolError{msg:"message without checksum", msgType:t}
+  }
+  if err := checkMsgSize(t, size, c.limit); err != nil {
+    err.(*ProtocolError).msgType = t
+    return err
+  }
+  buf := make([]byte, int(size) + 8)
+  if err := readn(c.ReadWriteCloser, buf); err != nil {
+    return err
+  }
+  sum, err := strconv.ParseUint(string(buf[size:]), 16, 32)
+  if err != nil || uint32(sum) != crc32.ChecksumIEEE(buf[:size]) {
+    return &ProtocolError{msg:"checksum mismatch, message corrupted", msgType:t}
+  }
+  c.rbuf = buf[:size]
+  return nil
+}
@@ -0,0 +1,175 @@
+package gotalk
+import (
+  "fmt"
+  "hash/crc32"
+  "net"
+  "strings"
+  "testing"
+  "time"
+)
+
+
+func TestFrameChecksum(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  checksum := func(s Sock) { s.SetFrameChecksum(true) }
+
+  s1, _, err1, err2 := handshakeTCPWith(t, h, checksum, checksum)
+  if err1 != nil || err2 != nil {
+    t.Fatalf("Handshake() failed: %v, %v", err1, err2)
+  }
+  in := strings.Repeat("hello ", 100)
+  var out string
+  if err := s1.Request("echo", in, &out); err != nil || out != in {
+    t.Fatalf("Request() => (%d bytes, %v), expected %d bytes", len(out), err, len(in))
+  }
+
+  // Both sides must enable checksums
+  _, _, err1, _ = handshakeTCPWith(t, h, checksum, func(Sock) {})
+  if err1 == nil {
+    t.Errorf("Handshake() with checksums on one side only succeeded")
+  }
+}
+
+
+func TestFrameChecksumCorruption(t *testing.T) {
+  c1, c2 := net.Pipe()
+  defer c2.Close()
+  h := NewHandlers()
+  notes := make(chan string, 1)
+  h.HandleBufferNotification("note", func(s Sock, name string, b []byte) { notes <- string(b) })
+  s := NewSock(h)
+  s.SetFrameChecksum(true)
+  s.Adopt(c1)
+
+  handshake := make(chan error, 1)
+  go func() { handshake <- s.Handshake() }()
+  if _, err := ReadVersion(c2); err != nil {
+    t.Fatalf("ReadVersion() failed: %v", err)
+  }
+  if ty, id, _, _ := readRawMsg(t, c2); ty != MsgTypeSingleRes || id != FeaturesID {
+    t.Fatalf("got message %c %q, expected features", byte(ty), id)
+  }
+  buf := make([]byte, 17)
+  if err := readn(c2, buf); err != nil {
+    t.Fatalf("readn() failed: %v", err)
+  } else if string(buf) != "K005crc3200000000" {
+    t.Fatalf("peer announced %q, expected checksum announcement", buf)
+  }
+  WriteVersion(c2)
+  WriteChecksum(c2, checksumName)
+  if err := <-handshake; err != nil {
+    t.Fatalf("Handshake() failed: %v", err)
+  }
+  readErr := make(chan error, 1)
+  go func() { readErr <- s.Read() }()
+
+  frame := func(msg string) []byte {
+    b := MakeMsg(MsgTypeChecksummed, "000", "", len(msg))
+    b = append(b, msg...)
+    return append(b, fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(msg)))...)
+  }
+  msg := string(MakeMsg(MsgTypeNotification, "", "note", 5)) + "hello"
+  go c2.Write(frame(msg))
+  if note := <-notes; note != "hello" {
+    t.Fatalf("got notification %q, expected %q", note, "hello")
+  }
+
+  // Flip a byte of the payload after its checksum has been computed
+  b := frame(msg)
+  b[len(b) - 9] ^= 0x20
+  go c2.Write(b)
+  err := <-readErr
+  if perr, ok := err.(*ProtocolError); !ok || !strings.Contains(perr.Message(), "checksum") {
+    t.Fatalf("Read() => %v, expected checksum protocol error", err)
+  }
+  select {
+  case note := <-notes:
+    t.Errorf("corrupted notification %q was delivered", note)
+  default:
+  }
+}
+
+
+func TestFrameChecksumNotifyBatching(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  h := NewHandlers()
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  srv := NewServer(h, l)
+  srv.SetFrameChecksum(true)
+  srv.SetNotifyBatching(time.Millisecond)
+  go srv.Accept(func(s Sock) { s.Notify("note", "hello") })
+  defer srv.Close()
+
+  c, err := net.Dial("tcp", srv.Addr())
+  if err != nil {
+    t.Fatal(err)
+  }
+  h2 := NewHandlers()
+  notes := make(chan string, 1)
+  h2.HandleNotification("note", func(s string) { notes <- s })
+  s := NewSock(h2)
+  s.SetFrameChecksum(true)
+  s.Adopt(c)
+  defer s.Close()
+  if err := s.Handshake(); err != nil {
+    t.Fatalf("Handshake() failed: %v", err)
+  }
+  readErr := make(chan error, 1)
+  go func() { readErr <- s.Read() }()
+
+  // Batched notifications are written with checksums, like any other message
+  select {
+  case note := <-notes:
+    if note != "hello" {
+      t.Errorf("got notification %q, expected %q", note, "hello")
+    }
+  case err := <-readErr:
+    t.Fatalf("Read() => %v, expected notification", err)
+  case <-time.After(time.Second):
+    t.Fatalf("notification was not received")
+  }
+  var out string
+  if err := s.Request("echo", "hi", &out); err != nil || out != "hi" {
+    t.Errorf("Request() => (%q, %v), expected %q", out, err, "hi")
+  }
+}
+
+
+func TestFrameChecksumSizeLimit(t *testing.T) {
+  c1, c2 := net.Pipe()
+  defer c2.Close()
+  s := NewSock(NewHandlers())
+  s.SetFrameChecksum(true)
+  s.SetMaxMessageSize(100)
+  s.Adopt(c1)
+
+  handshake := make(chan error, 1)
+  go func() { handshake <- s.Handshake() }()
+  ReadVersion(c2)
+  readRawMsg(t, c2)
+  if err := readn(c2, make([]byte, 17)); err != nil {
+    t.Fatalf("readn() failed: %v", err)
+  }
+  WriteVersion(c2)
+  WriteChecksum(c2, checksumName)
+  if err := <-handshake; err != nil {
+    t.Fatalf("Handshake() failed: %v", err)
+  }
+  readErr := make(chan error, 1)
+  go func() { readErr <- s.Read() }()
+
+  // The size of a checksummed message is checked before its payload is read
+  go c2.Write(MakeMsg(MsgTypeChecksummed, "000", "", 0x7fffffff))
+  select {
+  case err := <-readErr:
+    if perr, ok := err.(*ProtocolError); !ok || !strings.Contains(perr.Message(), "exceeds limit") {
+      t.Fatalf("Read() => %v, expected size limit protocol error", err)
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("Read() did not fail on an oversized checksummed message")
+  }
+}
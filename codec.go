@@ -0,0 +1,97 @@
+package gotalk
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "io"
+)
+
+// Encodes and decodes values of requests, results and notifications. Both sides of a
+// connection must use the same codec, which is verified during the handshake.
+type Codec interface {
+  // Name identifying the codec during the handshake, e.g. "json" or "msgpack"
+  Name() string
+  Marshal(v interface{}) ([]byte, error)
+  Unmarshal(data []byte, v interface{}) error
+}
+
+// The default codec, using encoding/json
+var JSONCodec Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// Options of a codec created with NewJSONCodec. The zero value behaves like JSONCodec.
+type JSONCodecOptions struct {
+  // Don't escape the characters <, > and & in strings, which encoding/json escapes by default
+  // so that the JSON can be embedded in HTML
+  NoEscapeHTML bool
+
+  // Decode numbers into interface{} values as json.Number rather than float64, which loses
+  // the precision of integers larger than 2^53, like many 64-bit IDs
+  UseNumber bool
+}
+
+// Creates a JSON codec with options. It is named "json" like JSONCodec, so a peer using one
+// can talk to a peer using the other.
+func NewJSONCodec(opts JSONCodecOptions) Codec {
+  return &jsonOptCodec{opts}
+}
+
+type jsonOptCodec struct {
+  opts JSONCodecOptions
+}
+
+func (*jsonOptCodec) Name() string { return "json" }
+
+func (c *jsonOptCodec) Marshal(v interface{}) ([]byte, error) {
+  var b bytes.Buffer
+  enc := json.NewEncoder(&b)
+  enc.SetEscapeHTML(!c.opts.NoEscapeHTML)
+  if err := enc.Encode(v); err != nil {
+    return nil, err
+  }
+  return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil  // Encode adds a newline
+}
+
+func (c *jsonOptCodec) Unmarshal(data []byte, v interface{}) error {
+  if !c.opts.UseNumber {
+    return json.Unmarshal(data, v)
+  }
+  dec := json.NewDecoder(bytes.NewReader(data))
+  dec.UseNumber()
+  if err := dec.Decode(v); err != nil {
+    return err
+  }
+  // Like json.Unmarshal, refuse anything but whitespace after the value
+  if _, err := dec.Token(); err != io.EOF {
+    return errors.New("json: invalid data after top-level value")
+  }
+  return nil
+}
+
+// Results of request handlers of this type are sent as-is rather than being encoded by the
+// codec, e.g. for results which are already encoded.
+type RawBytes []byte
+
+// Encodes `v` with `codec` unless it is RawBytes
+func encodeValue(codec Codec, v interface{}) ([]byte, error) {
+  if b, ok := v.(RawBytes); ok {
+    return []byte(b), nil
+  }
+  return codec.Marshal(v)
+}
+
+// Returns the codec used by `s`, or JSONCodec if `s` is nil
+func codecOf(s Sock) Codec {
+  if s != nil {
+    if c := s.Codec(); c != nil {
+      return c
+    }
+  }
+  return JSONCodec
+}
@@ -0,0 +1,151 @@
+package gotalk
+import (
+  "encoding/json"
+  "net"
+  "strings"
+  "testing"
+)
+
+
+// Like JSONCodec but with a different name and upper-cases strings in transit
+type upperCodec struct{}
+
+func (upperCodec) Name() string { return "upper" }
+func (upperCodec) Marshal(v interface{}) ([]byte, error) {
+  if s, ok := v.(string); ok {
+    v = strings.ToUpper(s)
+  }
+  return json.Marshal(v)
+}
+func (upperCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+
+// Returns two sockets connected over TCP which have performed a handshake with codecs c1 & c2,
+// reading messages unless the handshake failed. The connections are closed when the test ends.
+func handshakeTCP(t *testing.T, h Handlers, c1, c2 Codec) (Sock, Sock, error, error) {
+  return handshakeTCPWith(t, h, func(s Sock) { s.SetCodec(c1) }, func(s Sock) { s.SetCodec(c2) })
+}
+
+// Like handshakeTCP but sets up the sockets with setup1 & setup2 before the handshake
+func handshakeTCPWith(t *testing.T, h Handlers, setup1, setup2 func(Sock)) (Sock, Sock, error, error) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer l.Close()
+
+  s1, s2 := NewSock(h), NewSock(h)
+  setup1(s1)
+  setup2(s2)
+  errch := make(chan error, 1)
+  go func() {
+    c, err := l.Accept()
+    if err != nil {
+      errch <- err
+      return
+    }
+    t.Cleanup(func() { c.Close() })
+    s2.Adopt(c)
+    err = s2.Handshake()
+    if err == nil {
+      go s2.Read()
+    }
+    errch <- err
+  }()
+
+  c, err := net.Dial("tcp", l.Addr().String())
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { c.Close() })
+  s1.Adopt(c)
+  err1 := s1.Handshake()
+  if err1 == nil {
+    go s1.Read()
+  }
+  return s1, s2, err1, <-errch
+}
+
+
+func TestCodecHandshake(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+
+  s1, _, err1, err2 := handshakeTCP(t, h, upperCodec{}, upperCodec{})
+  if err1 != nil || err2 != nil {
+    t.Fatalf("Handshake() failed: %v, %v", err1, err2)
+  }
+  var out string
+  if err := s1.Request("echo", "hello", &out); err != nil {
+    t.Errorf("Request() failed: %v", err)
+  } else if out != "HELLO" {
+    t.Errorf("Request() => %q, expected %q", out, "HELLO")
+  }
+
+  // Mismatching codecs
+  _, _, err1, _ = handshakeTCP(t, h, upperCodec{}, JSONCodec)
+  if err1 == nil {
+    t.Errorf("Handshake() with mismatching codecs succeeded")
+  }
+}
+
+
+func TestJSONCodecNoEscapeHTML(t *testing.T) {
+  v := map[string]string{"html": "<b>&</b>"}
+  c := NewJSONCodec(JSONCodecOptions{})
+  if b, err := c.Marshal(v); err != nil || string(b) != `{"html":"\u003cb\u003e\u0026\u003c/b\u003e"}` {
+    t.Errorf("Marshal() => (%s, %v), expected HTML to be escaped like JSONCodec", b, err)
+  }
+  c = NewJSONCodec(JSONCodecOptions{NoEscapeHTML:true})
+  if b, err := c.Marshal(v); err != nil || string(b) != `{"html":"<b>&</b>"}` {
+    t.Errorf("Marshal() => (%s, %v), expected HTML not to be escaped", b, err)
+  }
+
+  // Talks to peers using JSONCodec, both ways
+  h := NewHandlers()
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  s1, s2, err1, err2 := handshakeTCP(t, h, c, JSONCodec)
+  if err1 != nil || err2 != nil {
+    t.Fatalf("handshake failed: %v, %v", err1, err2)
+  }
+  for _, s := range []Sock{s1, s2} {
+    var out string
+    if err := s.Request("echo", "a<b", &out); err != nil || out != "a<b" {
+      t.Errorf("Request() => (%q, %v), expected %q", out, err, "a<b")
+    }
+  }
+}
+
+
+func TestJSONCodecUseNumber(t *testing.T) {
+  const id = "9007199254740993"  // 2^53 + 1, which float64 can't represent
+  var v interface{}
+  if err := JSONCodec.Unmarshal([]byte(id), &v); err != nil || v != float64(9007199254740992) {
+    t.Errorf("JSONCodec.Unmarshal() => (%v, %v), expected a float64", v, err)
+  }
+  c := NewJSONCodec(JSONCodecOptions{UseNumber:true})
+  if err := c.Unmarshal([]byte(id), &v); err != nil || v != json.Number(id) {
+    t.Errorf("Unmarshal() => (%#v, %v), expected json.Number(%s)", v, err, id)
+  }
+  if err := c.Unmarshal([]byte(id + " x"), &v); err == nil {
+    t.Errorf("Unmarshal() succeeded with data after the value")
+  }
+
+  // Handlers with interface{} parameters get exact numbers
+  h := NewHandlers()
+  h.HandleRequest("id", func(s Sock, in map[string]interface{}) (string, error) {
+    n, ok := in["id"].(json.Number)
+    if !ok {
+      return "", Errorf(400, "id is a %T", in["id"])
+    }
+    return n.String(), nil
+  })
+  s1, _, err1, err2 := handshakeTCP(t, h, JSONCodec, c)
+  if err1 != nil || err2 != nil {
+    t.Fatalf("handshake failed: %v, %v", err1, err2)
+  }
+  out, err := s1.BufferRequest("id", []byte(`{"id":` + id + `}`))
+  if err != nil || string(out) != `"` + id + `"` {
+    t.Errorf("BufferRequest() => (%s, %v), expected %q", out, err, id)
+  }
+}
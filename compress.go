@@ -0,0 +1,78 @@
+package gotalk
+
+import (
+  "bytes"
+  "compress/flate"
+  "io"
+)
+
+// Compression announced during the handshake, which is the only one supported
+const compressionName = "deflate"
+
+// Size of the largest message header, i.e. of a message with the longest possible name
+const maxMsgHeaderSize = 1 + 3 + 3 + 0xfff + 8
+
+func (s *socket) SetCompression(min int) {
+  s.compress = min >= 0
+  s.compressMin = min
+}
+
+// Writes a message compressed, as the payload of a "compressed" message, if compression is
+// enabled, the payload is larger than the threshold and compressing makes the message smaller.
+// Returns false if the message wasn't written. The caller must hold wmu.
+func (s *socket) writeCompressedLocked(t MsgType, id, op string, buf []byte) (bool, error) {
+  if !s.compress || len(buf) == 0 || len(buf) <= s.compressMin {
+    return false, nil
+  }
+  hdr := MakeMsg(t, id, op, len(buf))
+  s.zbuf.Reset()
+  if s.zw == nil {
+    s.zw, _ = flate.NewWriter(&s.zbuf, flate.DefaultCompression)
+  } else {
+    s.zw.Reset(&s.zbuf)
+  }
+  // Writes to a bytes.Buffer don't fail
+  s.zw.Write(hdr)
+  s.zw.Write(buf)
+  s.zw.Close()
+  if s.zbuf.Len() >= len(hdr) + len(buf) {
+    return false, nil
+  }
+
+  if id == "" {
+    id = "000"  // notifications have no ID
+  }
+  w := s.writer()
+  if _, err := w.Write(MakeMsg(MsgTypeCompressed, id, "", s.zbuf.Len())); err != nil {
+    return true, err
+  }
+  if _, err := w.Write(s.zbuf.Bytes()); err != nil {
+    return true, err
+  }
+  return true, s.flushLocked(t)
+}
+
+// Reads the payload of a "compressed" message and returns a reader of the inflated message
+func (s *socket) readCompressed(size int) (io.Reader, error) {
+  zbuf := make([]byte, size)
+  if err := readn(s.conn, zbuf); err != nil {
+    return nil, err
+  }
+  zr := flate.NewReader(bytes.NewReader(zbuf))
+  defer zr.Close()
+
+  // Don't let a small message inflate beyond the size limit
+  r, limit := io.Reader(zr), int64(-1)
+  if s.maxMsgSize > 0 {
+    limit = int64(s.maxMsgSize) + maxMsgHeaderSize
+    r = io.LimitReader(zr, limit + 1)
+  }
+  buf, err := io.ReadAll(r)
+  if err != nil {
+    return nil, &ProtocolError{msg:"invalid compressed message: " + err.Error()}
+  }
+  if limit >= 0 && int64(len(buf)) > limit {
+    return nil, &ProtocolError{msg:"compressed message exceeds size limit"}
+  }
+  return bytes.NewReader(buf), nil
+}
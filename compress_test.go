@@ -0,0 +1,71 @@
+package gotalk
+import (
+  "bytes"
+  "compress/flate"
+  "io"
+  "strings"
+  "testing"
+)
+
+
+func TestCompression(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  compress := func(s Sock) { s.SetCompression(64) }
+
+  s1, _, err1, err2 := handshakeTCPWith(t, h, compress, compress)
+  if err1 != nil || err2 != nil {
+    t.Fatalf("Handshake() failed: %v, %v", err1, err2)
+  }
+  in := strings.Repeat("hello ", 1000)
+  var out string
+  if err := s1.Request("echo", in, &out); err != nil {
+    t.Fatalf("Request() failed: %v", err)
+  } else if out != in {
+    t.Fatalf("Request() => %d bytes, expected %d bytes", len(out), len(in))
+  }
+  if n := s1.Stats().BytesWritten; n > uint64(len(in)) / 10 {
+    t.Errorf("%d bytes written for a request of %d bytes, expected it to be compressed", n, len(in))
+  }
+  // Small messages are sent as-is
+  if err := s1.Request("echo", "hi", &out); err != nil || out != "hi" {
+    t.Errorf("Request() => (%q, %v), expected %q", out, err, "hi")
+  }
+
+  // Both sides must enable compression
+  _, _, err1, _ = handshakeTCPWith(t, h, compress, func(Sock) {})
+  if err1 == nil {
+    t.Errorf("Handshake() with compression on one side only succeeded")
+  }
+}
+
+
+func TestCompressionWire(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  s.SetCompression(10)
+  payload := strings.Repeat("a", 100)
+  go s.BufferNotify("note", []byte(payload))
+
+  ty, id, _, zbuf := readRawMsg(t, c)
+  if ty != MsgTypeCompressed || id != "000" || len(zbuf) >= len(payload) {
+    t.Fatalf("got message %c %q of %d bytes, expected compressed message", byte(ty), id, len(zbuf))
+  }
+  msg, err := io.ReadAll(flate.NewReader(bytes.NewReader(zbuf)))
+  if err != nil {
+    t.Fatalf("failed to inflate message: %v", err)
+  }
+  r := bytes.NewReader(msg)
+  ty, _, name, size, err := ReadMsg(r)
+  if err != nil || ty != MsgTypeNotification || name != "note" || int(size) != r.Len() {
+    t.Errorf("ReadMsg() => (%c, %q, %d, %v), expected notification", byte(ty), name, size, err)
+  } else if rest, _ := io.ReadAll(r); string(rest) != payload {
+    t.Errorf("notification payload %q, expected %q", rest, payload)
+  }
+
+  // Incompressible payloads are sent as-is
+  go s.BufferNotify("note", []byte("0123456789abcdef"))
+  if ty, _, name, _ := readRawMsg(t, c); ty != MsgTypeNotification || name != "note" {
+    t.Errorf("got message %c %q, expected uncompressed notification", byte(ty), name)
+  }
+}
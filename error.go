@@ -0,0 +1,137 @@
+package gotalk
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+)
+
+// Error codes. Applications are free to use any other codes for their own purposes.
+const (
+  ErrCodeUnspecified   = 0  // the peer did not send a code, e.g. a plain error string
+  ErrCodeOverloaded    = 1  // too many requests; the request might succeed if retried later
+  ErrCodeGoingAway     = 2  // the peer is going away and no longer accepts requests
+  ErrCodeInvalidParams = 3  // the parameters of the request failed validation (see Validator)
+  ErrCodeRateLimited   = 4  // the rate limit of the operation was exceeded (see RateLimitInfo)
+  ErrCodeTimeout       = 5  // the handler didn't complete in time (see Handlers.SetHandlerTimeout)
+)
+
+// An error result of a request. Handlers can return a RequestError (e.g. created with Errorf)
+// to send a machine-readable code and data along with the error message, and failed requests
+// return a RequestError describing the error result received.
+type RequestError struct {
+  code    int
+  message string
+  data    interface{}
+  status  int   // HTTP-style status, or 0
+  panic   bool  // result of a handler panic
+}
+
+// Create a new RequestError. `data` is optional and is JSON-encoded when sent.
+func NewRequestError(code int, message string, data interface{}) *RequestError {
+  return &RequestError{code:code, message:message, data:data}
+}
+
+// Create a new RequestError with a message formatted according to `format`
+func Errorf(code int, format string, args ...interface{}) *RequestError {
+  return &RequestError{code:code, message:fmt.Sprintf(format, args...)}
+}
+
+func (e *RequestError) Error() string { return e.message }
+
+// Machine-readable code of the error, or ErrCodeUnspecified
+func (e *RequestError) Code() int { return e.code }
+
+// Human-readable message of the error
+func (e *RequestError) Message() string { return e.message }
+
+// Data of the error. For errors received from a peer, this is a json.RawMessage (or nil.)
+func (e *RequestError) Data() interface{} { return e.data }
+
+// Returns the StatusError sent by the handler, so that errors.As can find it, or nil
+func (e *RequestError) Unwrap() error {
+  if e.status == 0 {
+    return nil
+  }
+  return &StatusError{Code:e.status, Msg:e.message}
+}
+
+// An error with an HTTP-style status code, e.g. for gateways bridging requests from HTTP.
+// Handlers can return a StatusError, and failed requests return a RequestError wrapping the
+// StatusError sent, which errors.As finds. See ErrorStatus
+type StatusError struct {
+  Code int
+  Msg  string
+}
+
+func (e *StatusError) Error() string { return e.Msg }
+
+// Status of errors which don't carry one. See ErrorStatus
+const DefaultErrorStatus = 500
+
+// Returns the code of the StatusError of `err`, DefaultErrorStatus if `err` doesn't carry one,
+// or 0 if `err` is nil
+func ErrorStatus(err error) int {
+  if err == nil {
+    return 0
+  }
+  var e *StatusError
+  if errors.As(err, &e) {
+    return e.Code
+  }
+  return DefaultErrorStatus
+}
+
+// -------------------------------------------------------------------------------------
+
+type errorEnvelope struct {
+  Code    int             `json:"code"`
+  Message string          `json:"message"`
+  Data    json.RawMessage `json:"data,omitempty"`
+  Status  int             `json:"status,omitempty"`
+}
+
+// Encode an error as the payload of an ErrorResult message. RequestErrors and StatusErrors are
+// encoded as a JSON envelope `{"code":...,"message":...,"data":...,"status":...}` while any
+// other error is sent as its message.
+func encodeError(err error) []byte {
+  var env *errorEnvelope
+  var se *StatusError
+  if e, ok := err.(*RequestError); ok {
+    env = &errorEnvelope{Code:e.code, Message:e.message, Status:e.status}
+    if e.data != nil {
+      if data, err := json.Marshal(e.data); err == nil {
+        env.Data = data
+      }
+    }
+  } else if errors.As(err, &se) {
+    env = &errorEnvelope{Code:ErrCodeUnspecified, Message:err.Error(), Status:se.Code}
+  }
+  if env != nil {
+    if b, err := json.Marshal(env); err == nil {
+      return b
+    }
+  }
+  return []byte(err.Error())
+}
+
+// Decode the payload of an ErrorResult message. Payloads which aren't a JSON envelope (e.g. sent
+// by older peers) are treated as a message string.
+func decodeError(b []byte) *RequestError {
+  if len(b) != 0 && b[0] == '{' {
+    var env struct {
+      Code    int             `json:"code"`
+      Message *string         `json:"message"`
+      Data    json.RawMessage `json:"data"`
+      Status  int             `json:"status"`
+    }
+    if err := json.Unmarshal(b, &env); err == nil && env.Message != nil {
+      e := &RequestError{code:env.Code, message:*env.Message, status:env.Status}
+      if len(env.Data) != 0 {
+        e.data = env.Data
+      }
+      return e
+    }
+  }
+  return &RequestError{code:ErrCodeUnspecified, message:string(b)}
+}
@@ -0,0 +1,114 @@
+package gotalk
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net"
+  "testing"
+)
+
+
+func TestRequestErrorEncoding(t *testing.T) {
+  b := encodeError(NewRequestError(404, "no such thing", map[string]int{"id": 3}))
+  e := decodeError(b)
+  if e.Code() != 404 || e.Message() != "no such thing" || e.Error() != "no such thing" {
+    t.Errorf("decodeError(%q) => (%v, %q)", b, e.Code(), e.Message())
+  }
+  var data map[string]int
+  if raw, ok := e.Data().(json.RawMessage); ok == false {
+    t.Errorf("Data() => %T, expected json.RawMessage", e.Data())
+  } else if err := json.Unmarshal(raw, &data); err != nil || data["id"] != 3 {
+    t.Errorf("Data() => %q", raw)
+  }
+
+  e = decodeError(encodeError(Errorf(7, "bad %s", "thing")))
+  if e.Code() != 7 || e.Message() != "bad thing" || e.Data() != nil {
+    t.Errorf("decodeError() => (%v, %q, %v)", e.Code(), e.Message(), e.Data())
+  }
+
+  // Plain errors, and anything older peers send, become the message
+  for _, msg := range []string{"plain error", "{not json", `{"error":"no message"}`, ""} {
+    b := encodeError(errors.New(msg))
+    if string(b) != msg {
+      t.Errorf("encodeError(%q) => %q", msg, b)
+    }
+    if e := decodeError(b); e.Code() != ErrCodeUnspecified || e.Message() != msg {
+      t.Errorf("decodeError(%q) => (%v, %q)", b, e.Code(), e.Message())
+    }
+  }
+}
+
+
+func TestRequestErrorResult(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("fail", func() error {
+    return Errorf(42, "failed")
+  })
+  s, c := pipeRaw(t, h)
+  defer c.Close()
+
+  // Handler errors are sent as an envelope
+  c.Write(MakeMsg(MsgTypeSingleReq, "abc", "fail", 0))
+  ty, _, _, payload := readRawMsg(t, c)
+  if e := decodeError(payload); ty != MsgTypeErrorRes || e.Code() != 42 {
+    t.Errorf("got message %c %q", byte(ty), payload)
+  }
+
+  // Requests return a RequestError
+  errch := make(chan error, 1)
+  go func() { errch <- s.Request("fail", nil, nil) }()
+  _, id, _, _ := readRawMsg(t, c)
+  c.Write(MakeMsg(MsgTypeErrorRes, id, "", len(payload)))
+  c.Write(payload)
+  if e, ok := (<-errch).(*RequestError); ok == false || e.Code() != 42 || e.Message() != "failed" {
+    t.Errorf("Request() => %v, expected RequestError with code 42", e)
+  }
+}
+
+
+func TestStatusError(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("missing", func() error {
+    return &StatusError{Code: 404, Msg: "not found"}
+  })
+  h.HandleRequest("wrapped", func() error {
+    return fmt.Errorf("lookup: %w", &StatusError{Code: 403, Msg: "forbidden"})
+  })
+  h.HandleRequest("plain", func() error {
+    return errors.New("oops")
+  })
+  c1, c2 := net.Pipe()
+  defer c1.Close()
+  defer c2.Close()
+  s1, s2 := NewSock(NewHandlers()), NewSock(h)
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  go s1.Read()
+  go s2.Read()
+
+  for _, test := range []struct {
+    op      string
+    status  int
+    message string
+  }{
+    {"missing", 404, "not found"},
+    {"wrapped", 403, "lookup: forbidden"},
+    {"plain", DefaultErrorStatus, "oops"},
+  } {
+    err := s1.Request(test.op, nil, nil)
+    if status := ErrorStatus(err); status != test.status || err.Error() != test.message {
+      t.Errorf("%s: Request() => %q with status %d, expected %q with status %d",
+        test.op, err, status, test.message, test.status)
+    }
+    var se *StatusError
+    if errors.As(err, &se) != (test.status != DefaultErrorStatus) {
+      t.Errorf("%s: errors.As(%v, *StatusError) => %v", test.op, err, se)
+    }
+    if _, ok := err.(*RequestError); !ok {
+      t.Errorf("%s: Request() => %T, expected *RequestError", test.op, err)
+    }
+  }
+  if status := ErrorStatus(nil); status != 0 {
+    t.Errorf("ErrorStatus(nil) => %d, expected 0", status)
+  }
+}
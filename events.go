@@ -0,0 +1,89 @@
+package gotalk
+
+import (
+  "fmt"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// Kind of a lifecycle event of a socket. See Sock.Events
+type EventType int
+
+const (
+  EventConnected    = EventType(iota)  // a connection was adopted
+  EventHandshake                       // the handshake completed
+  EventRequestStart                    // a request from the peer is about to be handled
+  EventStreamOpen                      // a streaming request from the peer is about to be handled
+  EventRequestEnd                      // a request or streaming request has been handled
+  EventClosed                          // the socket closed; always the last event
+)
+
+func (t EventType) String() string {
+  switch t {
+  case EventConnected:    return "connected"
+  case EventHandshake:    return "handshake"
+  case EventRequestStart: return "request-start"
+  case EventStreamOpen:   return "stream-open"
+  case EventRequestEnd:   return "request-end"
+  case EventClosed:       return "closed"
+  }
+  return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// A lifecycle event of a socket
+type Event struct {
+  Type      EventType
+  Op        string     // operation of request events
+  RequestID string     // ID of the request of request events
+  Time      time.Time
+}
+
+// Number of events which can be waiting for the subscriber before further events are dropped
+const eventBufferSize = 256
+
+type eventStream struct {
+  mu     sync.Mutex
+  on     int32  // 1 once Events has been called; accessed atomically
+  ch     chan Event
+  closed bool
+}
+
+func (s *socket) Events() <-chan Event {
+  e := &s.events
+  e.mu.Lock()
+  defer e.mu.Unlock()
+  if e.ch == nil {
+    e.ch = make(chan Event, eventBufferSize)
+    if e.closed {
+      close(e.ch)
+    }
+    atomic.StoreInt32(&e.on, 1)
+  }
+  return e.ch
+}
+
+// Delivers an event to the subscriber, if any, dropping it if the subscriber isn't keeping up
+func (s *socket) emitEvent(t EventType, op, id string) {
+  e := &s.events
+  if atomic.LoadInt32(&e.on) == 0 && t != EventClosed {
+    return
+  }
+  e.mu.Lock()
+  defer e.mu.Unlock()
+  if e.closed {
+    return
+  }
+  if e.ch != nil {
+    select {
+    case e.ch <- Event{Type:t, Op:op, RequestID:id, Time:time.Now()}:
+    default:
+    }
+  }
+  if t == EventClosed {
+    e.closed = true
+    if e.ch != nil {
+      close(e.ch)
+    }
+  }
+}
@@ -0,0 +1,101 @@
+package gotalk
+
+import (
+  "testing"
+  "time"
+)
+
+
+func TestEvents(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  h.HandleStreamRequest("stream", func(s Sock, op string, rch chan []byte, write StreamWriter) error {
+    for <-rch != nil {
+    }
+    return nil
+  })
+  c1, c2 := relayedPipe()
+  s1, s2 := NewSock(NewHandlers()), NewSock(h)
+  events := s2.Events()
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  s2.SetStreamReqLimit(1)
+  errc := make(chan error, 1)
+  go func() { errc <- s1.Handshake() }()
+  if err := s2.Handshake(); err != nil {
+    t.Fatal(err)
+  }
+  if err := <-errc; err != nil {
+    t.Fatal(err)
+  }
+  go s1.Read()
+  go s2.Read()
+  defer s1.Close()
+
+  expect := func(ty EventType, op string) Event {
+    select {
+    case e := <-events:
+      if e.Type != ty || e.Op != op || e.Time.IsZero() {
+        t.Fatalf("got event %v %q, expected %v %q", e.Type, e.Op, ty, op)
+      }
+      return e
+    case <-time.After(5*time.Second):
+      t.Fatalf("timed out waiting for event %v", ty)
+    }
+    return Event{}
+  }
+  expect(EventConnected, "")
+  expect(EventHandshake, "")
+
+  var out string
+  if err := s1.Request("echo", "hi", &out); err != nil {
+    t.Fatal(err)
+  }
+  start := expect(EventRequestStart, "echo")
+  if end := expect(EventRequestEnd, "echo"); start.RequestID == "" || end.RequestID != start.RequestID {
+    t.Errorf("request IDs %q and %q, expected the same ID", start.RequestID, end.RequestID)
+  }
+
+  r := s1.StreamRequest("stream")
+  r.Write([]byte("a"))
+  r.CloseSend()
+  if _, err := r.Read(); err != nil {
+    t.Fatal(err)
+  }
+  expect(EventStreamOpen, "stream")
+  expect(EventRequestEnd, "stream")
+
+  s2.Close()
+  expect(EventClosed, "")
+  if _, ok := <-events; ok {
+    t.Errorf("events channel not closed after EventClosed")
+  }
+}
+
+
+func TestEventsDropped(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  s1, s2, err := PipeHandlers(NewHandlers(), h)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s1.Close()
+
+  // Nobody reads the events, which must not hold up the socket
+  events := s2.Events()
+  for i := 0; i < eventBufferSize; i++ {
+    var out string
+    if err := s1.Request("echo", "hi", &out); err != nil {
+      t.Fatal(err)
+    }
+  }
+  s2.Close()
+  n := 0
+  for range events {
+    n++
+  }
+  if n != eventBufferSize {
+    t.Errorf("received %d events, expected the buffer of %d to be full", n, eventBufferSize)
+  }
+}
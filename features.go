@@ -0,0 +1,106 @@
+package gotalk
+
+import (
+  "bytes"
+  "io"
+  "strings"
+  "sync/atomic"
+)
+
+// Optional features, announced right after the protocol version. Older peers close the
+// connection on message types they don't know of, so messages of the types a feature adds are
+// only sent to peers announcing it.
+const (
+  featureCancel = uint32(1 << iota)  // "cancel request" messages
+  featureGoAway                      // "going away" messages
+  featureHeartbeat                   // "heartbeat" messages, announced while they're enabled
+)
+
+// Names of the features, in the order of their bits
+var featureNames = []string{"cancel", "goaway", "heartbeat"}
+
+// Returns the features we announce, including heartbeats while they're enabled, so that
+// heartbeats are only exchanged when both ends have enabled them
+func (s *socket) localFeatures() uint32 {
+  f := featureCancel | featureGoAway
+  s.hbMu.Lock()
+  if s.hbStop != nil {
+    f |= featureHeartbeat
+  }
+  s.hbMu.Unlock()
+  return f
+}
+
+func formatFeatures(f uint32) string {
+  var names []string
+  for i, name := range featureNames {
+    if f & (1 << uint(i)) != 0 {
+      names = append(names, name)
+    }
+  }
+  return strings.Join(names, " ")
+}
+
+// Returns the features named in `b`, ignoring any we don't know of
+func parseFeatures(b []byte) uint32 {
+  var f uint32
+  for _, name := range bytes.Fields(b) {
+    for i, name2 := range featureNames {
+      if string(name) == name2 {
+        f |= 1 << uint(i)
+      }
+    }
+  }
+  return f
+}
+
+// Writes our protocol version followed by our features, in a single write like the version
+// alone, so that both ends can write their version before reading the other's
+func (s *socket) writeVersion() error {
+  var buf bytes.Buffer
+  WriteVersion(&buf)
+  WriteFeatures(&buf, formatFeatures(s.localFeatures()))
+  _, err := s.conn.Write(buf.Bytes())
+  return err
+}
+
+// Reports whether the peer has announced feature `f`
+func (s *socket) peerHas(f uint32) bool {
+  return atomic.LoadUint32(&s.peerFeatures) & f != 0
+}
+
+// Reads the payload of the features announced by the peer, replacing any announced before
+func (s *socket) readFeatures(r io.Reader, size int) error {
+  buf := make([]byte, size)
+  if err := readn(r, buf); err != nil {
+    return err
+  }
+  atomic.StoreUint32(&s.peerFeatures, parseFeatures(buf))
+  return nil
+}
+
+// Reads the features a peer announces along with its version from `r`, or returns none if the
+// next message is something else. For telling a peer why it's refused before its handshake
+// has been read.
+func readPeerFeatures(r io.Reader) uint32 {
+  t, id, _, size, err := ReadMsg(r)
+  if err != nil || t != MsgTypeSingleRes || id != FeaturesID || size > 0xfff {
+    return 0
+  }
+  buf := make([]byte, size)
+  if err := readn(r, buf); err != nil {
+    return 0
+  }
+  return parseFeatures(buf)
+}
+
+// Reads the next message of the peer's handshake, after any features announced before it
+func (s *socket) readHandshakeMsg() (MsgType, string, uint32, error) {
+  t, id, name, size, err := ReadMsg(s.conn)
+  if err == nil && t == MsgTypeSingleRes && id == FeaturesID {
+    if err = s.readFeatures(s.conn, int(size)); err == nil {
+      t, _, name, size, err = ReadMsg(s.conn)
+    }
+  }
+  return t, name, size, err
+}
@@ -0,0 +1,201 @@
+package gotalk
+
+import (
+  "math"
+  "sync"
+)
+
+// Flow control of streaming requests. A socket with a stream window grants the sender of each
+// streaming request it receives room to send a window of payload bytes beyond those delivered
+// to the handler, and grants more as the handler reads parts. The sender waits for room before
+// writing each part. Senders which never receive a grant, e.g. from peers not supporting flow
+// control, send parts as soon as they are written.
+
+func (s *socket) SetStreamWindowSize(n int) {
+  s.streamWindow = n
+}
+
+// -------------------------------------------------------------------------------------
+// Receiving side
+
+// Parts of a flow-controlled streaming request which have been read but not yet delivered to
+// the handler, so that reading other messages doesn't wait for the handler
+type partQueue struct {
+  mu     sync.Mutex
+  cond   sync.Cond  // signalled when a part is added or the queue is closed
+  parts  [][]byte
+  closed bool
+}
+
+func newPartQueue() *partQueue {
+  q := &partQueue{}
+  q.cond.L = &q.mu
+  return q
+}
+
+func (q *partQueue) push(b []byte) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if !q.closed {
+    q.parts = append(q.parts, b)
+    q.cond.Signal()
+  }
+}
+
+// Waits for a part. Returns false once the queue is closed.
+func (q *partQueue) pop() ([]byte, bool) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  for len(q.parts) == 0 && !q.closed {
+    q.cond.Wait()
+  }
+  if q.closed {
+    return nil, false
+  }
+  b := q.parts[0]
+  q.parts[0] = nil
+  q.parts = q.parts[1:]
+  return b, true
+}
+
+func (q *partQueue) close() {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  q.closed = true
+  q.parts = nil
+  q.cond.Signal()
+}
+
+// Delivers queued parts of streaming request `id` to its handler, granting the sender room for
+// `window` bytes beyond those delivered. `delivered` is the size of the first part, which the
+// handler already has.
+func (s *socket) deliverParts(id string, rc *reqChan, window, delivered int64) {
+  granted := delivered + window
+  s.writeMsg(MsgTypeSingleRes, StreamWindowID, "", makeStreamWindow(id, granted))
+  for {
+    b, ok := rc.queue.pop()
+    if !ok {
+      return
+    }
+    select {
+    case rc.ch <- b:
+    case <-rc.done:
+      return
+    }
+    delivered += int64(len(b))
+    if granted - delivered <= window/2 {
+      // Grant more room once half the window has been used, rather than for every part
+      granted = delivered + window
+      if err := s.writeMsg(MsgTypeSingleRes, StreamWindowID, "", makeStreamWindow(id, granted)); err != nil {
+        return
+      }
+    }
+  }
+}
+
+// Grants the sender of streaming request `id` unlimited room once its handler has returned, as
+// any further parts are discarded. Written before the result, which the requestor might only
+// read once it has finished sending.
+func (s *socket) endStreamWindow(id string) {
+  s.writeMsg(MsgTypeSingleRes, StreamWindowID, "", makeStreamWindow(id, math.MaxInt64))
+}
+
+// -------------------------------------------------------------------------------------
+// Sending side
+
+// Room to send parts of a streaming request, granted by the peer
+type sendWindow struct {
+  mu       sync.Mutex
+  granted  int64          // total payload bytes which may be sent, or -1 for no limit
+  stopped  bool           // true once the peer told us to stop sending
+  changed  chan struct{}  // closed when granted or stopped changes
+}
+
+func (w *sendWindow) grant(granted int64) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  if w.granted < 0 || granted > w.granted {
+    w.granted = granted
+    if w.changed != nil {
+      close(w.changed)
+      w.changed = nil
+    }
+  }
+}
+
+func (w *sendWindow) stop() {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.stopped = true
+  if w.changed != nil {
+    close(w.changed)
+    w.changed = nil
+  }
+}
+
+func (w *sendWindow) isStopped() bool {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  return w.stopped
+}
+
+// Waits until the peer has granted room to send more than `sent` bytes, the requestor no longer
+// waits for the result, or the socket closes. Fails with ErrStreamEnded once the peer has told
+// us to stop sending.
+func (s *socket) waitSendWindow(rc *resChan, sent int64) error {
+  w := &rc.window
+  for {
+    w.mu.Lock()
+    if w.stopped {
+      w.mu.Unlock()
+      return ErrStreamEnded
+    }
+    if w.granted < 0 || sent < w.granted {
+      w.mu.Unlock()
+      return nil
+    }
+    if w.changed == nil {
+      w.changed = make(chan struct{})
+    }
+    changed := w.changed
+    w.mu.Unlock()
+    select {
+    case <-changed:
+    case <-rc.done:
+      return ErrStreamEnded
+    case <-s.ctx.Done():
+      return ErrSockClosed
+    }
+  }
+}
+
+func (s *socket) readStreamWindow(size int) error {
+  buf := make([]byte, size)
+  if err := readn(s.rd, buf); err != nil {
+    return err
+  }
+  id, granted, err := ParseStreamWindow(buf)
+  if err != nil {
+    return err
+  }
+  if rc := s.getResChan(id); rc != nil {
+    rc.window.grant(granted)
+  }
+  return nil
+}
+
+// Reads a message telling us to stop sending parts of a streaming request, as its handler has
+// returned
+func (s *socket) readStreamStop(size int) error {
+  buf := make([]byte, size)
+  if err := readn(s.rd, buf); err != nil {
+    return err
+  }
+  if len(buf) != 3 {
+    return &ProtocolError{msg:"invalid stream stop"}
+  }
+  if rc := s.getResChan(string(buf)); rc != nil {
+    rc.window.stop()
+  }
+  return nil
+}
@@ -0,0 +1,113 @@
+package gotalk
+
+import (
+  "net"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+func TestStreamWindow(t *testing.T) {
+  h := NewHandlers()
+  release := make(chan struct{})
+  h.HandleStreamRequest("upload", func(s Sock, op string, rch chan []byte, write StreamWriter) error {
+    <-release
+    n := 0
+    for b := <-rch; b != nil; b = <-rch {
+      n += len(b)
+    }
+    return write([]byte{byte(n / 50)})
+  })
+  h.HandleBufferRequest("ping", func(Sock, string, []byte) ([]byte, error) {
+    return []byte("pong"), nil
+  })
+  c1, c2 := net.Pipe()
+  defer c1.Close()
+  defer c2.Close()
+  s1, s2 := NewSock(NewHandlers()), NewSock(h)
+  s2.SetStreamReqLimit(1)
+  s2.SetStreamWindowSize(100)
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  go s1.Read()
+  go s2.Read()
+
+  r := s1.StreamRequest("upload")
+  var sent int64
+  r.OnProgress(func(n, total int64) { atomic.StoreInt64(&sent, n) })
+  done := make(chan error, 1)
+  go func() {
+    part := make([]byte, 50)
+    for i := 0; i < 20; i++ {
+      if err := r.Write(part); err != nil {
+        done <- err
+        return
+      }
+    }
+    done <- r.End()
+  }()
+
+  // The sender waits once it has sent the first part and a window beyond it
+  time.Sleep(100*time.Millisecond)
+  if n := atomic.LoadInt64(&sent); n != 150 {
+    t.Errorf("sent %d bytes while the handler wasn't reading, expected 150", n)
+  }
+
+  // Other messages are read in the meantime
+  if out, err := s1.BufferRequest("ping", nil); err != nil || string(out) != "pong" {
+    t.Errorf("BufferRequest() => (%q, %v), expected \"pong\"", out, err)
+  }
+
+  // Once the handler reads, the rest is sent
+  close(release)
+  select {
+  case err := <-done:
+    if err != nil {
+      t.Fatal(err)
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("stream request was not sent in full")
+  }
+  if b, err := r.Read(); err != nil || len(b) != 1 || b[0] != 20 {
+    t.Errorf("Read() => (%v, %v), expected 20 parts received", b, err)
+  }
+}
+
+
+func TestStreamWindowHandlerReturns(t *testing.T) {
+  // A handler returning early stops flow control of the parts it won't read
+  h := NewHandlers()
+  h.HandleStreamRequest("upload", func(s Sock, op string, rch chan []byte, write StreamWriter) error {
+    return write([]byte("done"))
+  })
+  c1, c2 := net.Pipe()
+  defer c1.Close()
+  defer c2.Close()
+  s1, s2 := NewSock(NewHandlers()), NewSock(h)
+  s2.SetStreamReqLimit(1)
+  s2.SetStreamWindowSize(10)
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  go s1.Read()
+  go s2.Read()
+
+  r := s1.StreamRequest("upload")
+  done := make(chan error, 1)
+  go func() {
+    for i := 0; i < 20; i++ {
+      if err := r.Write(make([]byte, 10)); err != nil {
+        done <- err
+        return
+      }
+    }
+    done <- r.End()
+  }()
+  select {
+  case err := <-done:
+    if err != nil {
+      t.Fatal(err)
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("sender kept waiting after the handler returned")
+  }
+}
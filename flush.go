@@ -0,0 +1,106 @@
+package gotalk
+
+import (
+  "bufio"
+  "crypto/tls"
+  "io"
+  "net"
+  "time"
+)
+
+func (s *socket) SetNoDelay(noDelay bool) error {
+  c := s.rawConn()
+  if tc, ok := c.(*tls.Conn); ok {
+    c = tc.NetConn()
+  }
+  if tc, ok := c.(*net.TCPConn); ok {
+    return tc.SetNoDelay(noDelay)
+  }
+  return nil
+}
+
+func (s *socket) SetNotifyBatching(interval time.Duration) {
+  s.wmu.Lock()
+  defer s.wmu.Unlock()
+  s.bwInterval = interval
+  if s.conn == nil {
+    return  // Adopt starts batching
+  }
+  if interval <= 0 {
+    if s.bw != nil {
+      s.bw.Flush()
+      s.bw = nil
+      close(s.bwStop)
+    }
+    return
+  }
+  if s.bw == nil {
+    s.bw = bufio.NewWriter(s.conn)
+  } else {
+    close(s.bwStop)  // restart flushLoop with the new interval
+  }
+  s.bwStop = make(chan struct{})
+  go s.flushLoop(interval, s.bwStop)
+}
+
+func (s *socket) Flush() error {
+  s.wmu.Lock()
+  defer s.wmu.Unlock()
+  if s.bw != nil {
+    if err := s.bw.Flush(); err != nil {
+      return err
+    }
+  }
+  return s.flushConn()
+}
+
+// Returns where messages are written. wmu must be held.
+func (s *socket) writer() io.Writer {
+  if s.bw != nil {
+    return s.bw
+  }
+  return s.conn
+}
+
+// Writes any batched notifications along with a message of type `t` which was just written,
+// unless it is a notification. wmu must be held.
+func (s *socket) flushLocked(t MsgType) error {
+  if s.bw != nil {
+    if t == MsgTypeNotification {
+      return nil
+    }
+    if err := s.bw.Flush(); err != nil {
+      return err
+    }
+  }
+  return s.flushConn()
+}
+
+// Writes anything buffered by the connection itself, like a web socket with a write buffer.
+// wmu must be held, unless the socket isn't yet reading.
+func (s *socket) flushConn() error {
+  if f, ok := s.adoptedConn().(interface{ Flush() error }); ok {
+    return f.Flush()
+  }
+  return nil
+}
+
+// Writes batched notifications every `interval` until `stop` is closed or the socket closes
+func (s *socket) flushLoop(interval time.Duration, stop chan struct{}) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-ticker.C:
+    case <-stop:
+      return
+    case <-s.ctx.Done():
+      return
+    }
+    if err := s.Flush(); err != nil {
+      s.log().Errorf("failed to write notifications: %v", err)
+      s.closeWithError(err)
+      return
+    }
+  }
+}
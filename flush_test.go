@@ -0,0 +1,123 @@
+package gotalk
+
+import (
+  "net"
+  "testing"
+  "time"
+)
+
+func TestNotifyBatching(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  s.SetNotifyBatching(time.Hour)
+
+  // Notifications are buffered until flushed
+  s.BufferNotify("a", []byte("1"))
+  s.BufferNotify("b", []byte("2"))
+  c.SetReadDeadline(time.Now().Add(20*time.Millisecond))
+  if _, _, _, _, err := ReadMsg(c); err == nil {
+    t.Fatalf("notification written before flushing")
+  }
+  c.SetReadDeadline(time.Time{})
+  go s.Flush()
+  for _, name := range []string{"a", "b"} {
+    if ty, _, name2, _ := readRawMsg(t, c); ty != MsgTypeNotification || name2 != name {
+      t.Errorf("got message %c %q, expected notification %q", byte(ty), name2, name)
+    }
+  }
+
+  // Other messages are written right away, along with the notifications before them
+  s.BufferNotify("c", []byte("3"))
+  go s.BufferRequest("echo", nil)
+  if ty, _, name, _ := readRawMsg(t, c); ty != MsgTypeNotification || name != "c" {
+    t.Errorf("got message %c %q, expected notification \"c\"", byte(ty), name)
+  }
+  if ty, _, name, _ := readRawMsg(t, c); ty != MsgTypeSingleReq || name != "echo" {
+    t.Errorf("got message %c %q, expected request \"echo\"", byte(ty), name)
+  }
+
+  // Notifications are flushed every interval
+  s.SetNotifyBatching(time.Millisecond)
+  s.BufferNotify("d", []byte("4"))
+  if ty, _, name, _ := readRawMsg(t, c); ty != MsgTypeNotification || name != "d" {
+    t.Errorf("got message %c %q, expected notification \"d\"", byte(ty), name)
+  }
+
+  // Closing the socket writes buffered notifications
+  s.SetNotifyBatching(time.Hour)
+  s.BufferNotify("e", []byte("5"))
+  go s.Close()
+  if ty, _, name, _ := readRawMsg(t, c); ty != MsgTypeNotification || name != "e" {
+    t.Errorf("got message %c %q, expected notification \"e\"", byte(ty), name)
+  }
+}
+
+
+func TestSetNoDelay(t *testing.T) {
+  s1, s2, err1, err2 := handshakeTCP(t, NewHandlers(), JSONCodec, JSONCodec)
+  if err1 != nil || err2 != nil {
+    t.Fatal(err1, err2)
+  }
+  if err := s1.SetNoDelay(false); err != nil {
+    t.Errorf("SetNoDelay() failed on a TCP connection: %v", err)
+  }
+  if err := s2.SetNoDelay(true); err != nil {
+    t.Errorf("SetNoDelay() failed on a TCP connection: %v", err)
+  }
+
+  // No effect on other connections
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  if err := s.SetNoDelay(false); err != nil {
+    t.Errorf("SetNoDelay() failed on a pipe: %v", err)
+  }
+}
+
+
+func benchmarkNotify(b *testing.B, batching time.Duration) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    b.Fatal(err)
+  }
+  defer l.Close()
+  received := make(chan struct{}, 1)
+  n := 0
+  h := NewHandlers()
+  h.HandleBufferNotification("n", func(Sock, string, []byte) {
+    if n++; n == b.N {
+      received <- struct{}{}
+    }
+  })
+  go func() {
+    c, err := l.Accept()
+    if err != nil {
+      return
+    }
+    s := NewSock(h)
+    s.Adopt(c)
+    s.Read()
+  }()
+
+  c, err := net.Dial("tcp", l.Addr().String())
+  if err != nil {
+    b.Fatal(err)
+  }
+  s := NewSock(NewHandlers())
+  s.Adopt(c)
+  defer s.Close()
+  s.SetNotifyBatching(batching)
+
+  payload := []byte(`{"x":1}`)
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    if err := s.BufferNotify("n", payload); err != nil {
+      b.Fatal(err)
+    }
+  }
+  s.Flush()
+  <-received
+}
+
+func BenchmarkNotify(b *testing.B)        { benchmarkNotify(b, 0) }
+func BenchmarkNotifyBatched(b *testing.B) { benchmarkNotify(b, time.Millisecond) }
@@ -0,0 +1,122 @@
+package gotalk
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "strconv"
+)
+
+// A message with its payload, as read by ProtocolReader and written by ProtocolWriter. See
+// "Protocol and wire format" in the README for the fields of each type of message.
+type Frame struct {
+  Type    MsgType
+  ID      string  // request ID, or the load of heartbeats. Empty for messages without one
+  Name    string  // operation, notification type, codec name etc. Empty for messages without one
+  Payload []byte
+  Time    uint32  // time of heartbeats in seconds since 1970, which have no payload
+}
+
+// Reads frames of the wire format from any transport, for carrying conversations over
+// transports which Sock doesn't support, like message queues
+type ProtocolReader struct {
+  r          io.Reader
+  maxMsgSize int
+}
+
+// Writes frames of the wire format to any transport. See ProtocolReader
+type ProtocolWriter struct {
+  w io.Writer
+}
+
+func NewProtocolReader(r io.Reader) *ProtocolReader {
+  return &ProtocolReader{r:r}
+}
+
+func NewProtocolWriter(w io.Writer) *ProtocolWriter {
+  return &ProtocolWriter{w:w}
+}
+
+// Reads the protocol version which begins a conversation, failing if it isn't supported
+func (r *ProtocolReader) ReadVersion() error {
+  _, err := ReadVersion(r.r)
+  return err
+}
+
+// Makes ReadFrame fail with a *ProtocolError for payloads larger than `n` bytes, before reading
+// them. 0 (the default) means no limit. See Sock.SetMaxMessageSize
+func (r *ProtocolReader) SetMaxMessageSize(n int) {
+  r.maxMsgSize = n
+}
+
+// Reads the next frame. Malformed messages fail with a *ProtocolError and io.EOF is returned
+// at the end of the conversation.
+func (r *ProtocolReader) ReadFrame() (*Frame, error) {
+  t, id, name, size, err := ReadMsg(r.r)
+  if err != nil {
+    if e, ok := err.(*strconv.NumError); ok {
+      return nil, &ProtocolError{msg:"malformed message header: " + e.Error(), msgType:t}
+    }
+    return nil, err
+  }
+  f := &Frame{Type:t, ID:id, Name:name}
+  if t == MsgTypeHeartbeat {
+    f.Time = size
+    return f, nil
+  }
+  if err := checkMsgSize(t, size, r.maxMsgSize); err != nil {
+    return nil, err
+  }
+  if size != 0 {
+    f.Payload = make([]byte, size)
+    if err := readn(r.r, f.Payload); err != nil {
+      return nil, err
+    }
+  }
+  return f, nil
+}
+
+// Writes the protocol version which begins a conversation
+func (w *ProtocolWriter) WriteVersion() error {
+  _, err := WriteVersion(w.w)
+  return err
+}
+
+// Writes `f` with a single call to Write, so that each frame is a message of transports which
+// preserve message boundaries
+func (w *ProtocolWriter) WriteFrame(f *Frame) error {
+  if err := f.validate(); err != nil {
+    return err
+  }
+  var b []byte
+  if f.Type == MsgTypeHeartbeat {
+    b = MakeMsg(f.Type, f.ID, "", int(f.Time))
+  } else {
+    b = append(MakeMsg(f.Type, f.ID, f.Name, len(f.Payload)), f.Payload...)
+  }
+  _, err := w.w.Write(b)
+  return err
+}
+
+// Checks that the frame has the fields required by its type, and no others
+func (f *Frame) validate() error {
+  if msgHasID(f.Type) {
+    if len(f.ID) != 3 {
+      return fmt.Errorf("%c frame with ID %q, expected 3 bytes", byte(f.Type), f.ID)
+    }
+  } else if f.ID != "" {
+    return fmt.Errorf("%c frame can't have an ID", byte(f.Type))
+  }
+  if msgHasName(f.Type) {
+    if len(f.Name) == 0 || len(f.Name) > 0xfff {
+      return fmt.Errorf("%c frame with name of %d bytes, expected 1-4095", byte(f.Type),
+        len(f.Name))
+    }
+  } else if f.Name != "" {
+    return fmt.Errorf("%c frame can't have a name", byte(f.Type))
+  }
+  if f.Type == MsgTypeHeartbeat && len(f.Payload) != 0 {
+    return errors.New("heartbeat frame can't have a payload")
+  }
+  return nil
+}
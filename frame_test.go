@@ -0,0 +1,88 @@
+package gotalk
+import (
+  "bytes"
+  "net"
+  "testing"
+)
+
+
+func TestProtocolReaderWriter(t *testing.T) {
+  frames := []*Frame{
+    {Type:MsgTypeSingleReq, ID:"001", Name:"echo", Payload:[]byte(`"hi"`)},
+    {Type:MsgTypeSingleRes, ID:"001", Payload:[]byte(`"hi"`)},
+    {Type:MsgTypeStreamReqPart, ID:"002"},
+    {Type:MsgTypeNotification, Name:"note", Payload:[]byte("x")},
+    {Type:MsgTypeHeartbeat, ID:"00f", Time:1234},
+  }
+  var buf bytes.Buffer
+  w := NewProtocolWriter(&buf)
+  for _, f := range frames {
+    if err := w.WriteFrame(f); err != nil {
+      t.Fatalf("WriteFrame(%c) failed: %v", byte(f.Type), err)
+    }
+  }
+  r := NewProtocolReader(&buf)
+  for _, expect := range frames {
+    f, err := r.ReadFrame()
+    if err != nil {
+      t.Fatalf("ReadFrame() failed: %v", err)
+    }
+    if f.Type != expect.Type || f.ID != expect.ID || f.Name != expect.Name ||
+       !bytes.Equal(f.Payload, expect.Payload) || f.Time != expect.Time {
+      t.Errorf("ReadFrame() => %+v, expected %+v", f, expect)
+    }
+  }
+
+  // Frames must have the fields of their type
+  for _, f := range []*Frame{
+    {Type:MsgTypeSingleRes, ID:"01"},
+    {Type:MsgTypeSingleReq, ID:"001"},
+    {Type:MsgTypeNotification, ID:"001", Name:"note"},
+    {Type:MsgTypeHeartbeat, ID:"000", Payload:[]byte("x")},
+  } {
+    if err := w.WriteFrame(f); err == nil {
+      t.Errorf("WriteFrame(%+v) succeeded, expected error", f)
+    }
+  }
+
+  w.WriteFrame(&Frame{Type:MsgTypeSingleRes, ID:"001", Payload:[]byte("0123456789")})
+  r.SetMaxMessageSize(5)
+  if _, err := r.ReadFrame(); err == nil {
+    t.Errorf("ReadFrame() of a frame exceeding the size limit succeeded")
+  } else if _, ok := err.(*ProtocolError); !ok {
+    t.Errorf("ReadFrame() => %v, expected *ProtocolError", err)
+  }
+}
+
+
+func TestProtocolReaderWriterSock(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  c1, c2 := net.Pipe()
+  defer c2.Close()
+  s := NewSock(h)
+  s.Adopt(c1)
+  handshake := make(chan error, 1)
+  go func() { handshake <- s.Handshake() }()
+
+  r, w := NewProtocolReader(c2), NewProtocolWriter(c2)
+  go w.WriteVersion()
+  if err := r.ReadVersion(); err != nil {
+    t.Fatalf("ReadVersion() failed: %v", err)
+  }
+  if f, err := r.ReadFrame(); err != nil || f.Type != MsgTypeSingleRes || f.ID != FeaturesID {
+    t.Fatalf("ReadFrame() => (%+v, %v), expected features", f, err)
+  }
+  if err := <-handshake; err != nil {
+    t.Fatalf("Handshake() failed: %v", err)
+  }
+  go s.Read()
+  go w.WriteFrame(&Frame{Type:MsgTypeSingleReq, ID:"001", Name:"echo", Payload:[]byte(`"hi"`)})
+  f, err := r.ReadFrame()
+  if err != nil {
+    t.Fatalf("ReadFrame() failed: %v", err)
+  }
+  if f.Type != MsgTypeSingleRes || f.ID != "001" || string(f.Payload) != `"hi"` {
+    t.Errorf("ReadFrame() => %+v, expected result \"hi\"", f)
+  }
+}
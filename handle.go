@@ -1,13 +1,19 @@
 package gotalk
 import (
+  "context"
+  "fmt"
   "reflect"
   "errors"
+  "runtime/debug"
+  "sort"
+  "strings"
   "sync"
-  "encoding/json"
+  "time"
 )
 
 type Handlers interface {
-  // Handle operation with automatic JSON encoding of values.
+  // Handle operation with automatic encoding of values using the codec of the socket (JSON by
+  // default.)
   //
   // `f` must conform to one of the following signatures:
   //   `func(Sock, string, interface{}) (interface{}, error)` -- takes socket, op and parameters
@@ -21,47 +27,237 @@ type Handlers interface {
   //   `func(interface{}) error`
   //   `func(Sock) error`
   //   `func() error`
+  // Any of the above can additionally take a `context.Context`, or any other type implementing
+  // it, as its first argument, e.g.
+  //   `func(context.Context, Sock, interface{}) (interface{}, error)`
+  // in which case the context is cancelled when the requestor cancels the request or when the
+  // socket closes.
+  //
+  // A result of type RawBytes, e.g. an already-encoded value, is sent as-is.
+  //
+  // Handlers taking parameters can also take the raw payload of the request, e.g. to verify a
+  // signature, as a trailing `[]byte` argument, owned like the payload of a BufferReqHandler:
+  //   `func(Sock, interface{}, []byte) (interface{}, error)`
+  // except for `func(Sock, string, []byte)`, which takes the op and parameters of type []byte.
+  //
+  // A handler can also stream its result by taking a writer func as its last argument:
+  //   `func(Sock, interface{}, func(interface{}) error) error`
+  //   `func(interface{}, func(interface{}) error) error`
+  // Each value passed to the writer is encoded and sent as a separate part of a streaming
+  // result. The writer can take any type of value, e.g. `func(string) error`. The parameters
+  // are decoded from the complete payload of the request, which must be a streaming request
+  // (see Sock.SetStreamReqLimit.) The result is ended when the handler returns, or replaced by
+  // an error result if the handler returns an error.
+  //
+  // If the parameters are a receive-only channel, e.g. `<-chan int`, each part of the request
+  // is instead decoded and delivered on the channel as it arrives, and the channel is closed at
+  // the end of the request. A part which can't be decoded closes the channel and causes an
+  // error result.
   //
   // If `op` is empty, handle all requests which doesn't have a specific handler registered.
   HandleRequest(op string, f interface{})
 
+  // Like HandleRequest but returns an error rather than panicking if `f` doesn't conform to any
+  // of the signatures, e.g. for handlers registered dynamically
+  HandleRequestErr(op string, f interface{}) error
+
+  // Like HandleRequest but handles all operations starting with `prefix`, e.g. "user/" for
+  // "user/create" and "user/delete", which don't have a specific handler registered. Handlers
+  // taking an op receive the full name of the operation. When several prefixes match, the
+  // longest one wins. An empty `prefix` registers the fallback handler.
+  HandleRequestPrefix(prefix string, f interface{})
+
   // Handle operation with raw input and output buffers. If `op` is empty, handle
   // all requests which doesn't have a specific handler registered.
   HandleBufferRequest(op string, f BufferReqHandler)
 
   // Handle operation by reading and writing directly from/to the underlying stream.
   // If `op` is empty, handle all requests which doesn't have a specific handler registered.
+  // The handler doesn't need to read its input channel to the end: once it returns, parts
+  // still to be received are discarded and the requestor is told to stop sending parts.
   HandleStreamRequest(op string, f StreamReqHandler)
 
-  // Handle notifications of a certain name with automatic JSON encoding of values.
+  // Handle notifications of a certain name with automatic encoding of values using the codec of
+  // the socket (JSON by default.)
   //
   // `f` must conform to one of the following signatures:
   //   `func(s Sock, name string, v interface{})` -- takes socket, name and parameters
   //   `func(name string, v interface{})`         -- takes name and parameters, but no socket
   //   `func(v interface{})`                      -- takes only parameters
+  // Parameters of type []byte, e.g. `func(s Sock, name string, b []byte)`, receive the payload
+  // as-is rather than decoded, e.g. for binary data.
   //
   // If `name` is empty, handle all notifications which doesn't have a specific handler
   // registered.
   HandleNotification(name string, f interface{})
 
+  // Like HandleNotification but returns an error rather than panicking if `f` doesn't conform
+  // to any of the signatures
+  HandleNotificationErr(name string, f interface{}) error
+
   // Handle notifications of a certain name with raw input buffers. If `name` is empty, handle
   // all notifications which doesn't have a specific handler registered.
   HandleBufferNotification(name string, f BufferNoteHandler)
 
-  // Look up a handler for operation `op`. Returns `nil` if not found.
+  // Handle streams of notifications named `name`, sent with Sock.NotifyStream. `f` is called
+  // in a new goroutine when a stream starts, and receives the payloads of the stream in order,
+  // followed by nil when the stream ends or the socket closes. Notifications of streams without
+  // a stream handler are handled as separate notifications. If `name` is empty, handle all
+  // streams which don't have a specific handler registered.
+  HandleNotificationStream(name string, f NoteStreamHandler)
+
+  // Look up a handler for operation `op`: the handler registered for `op`, or else the handler
+  // of the longest matching prefix, or else the fallback handler. Returns `nil` if not found. Use RequestHandlerKind to
+  // tell what kind of handler this is, or FindBufferRequestHandler and FindStreamRequestHandler
+  // to look up a handler of a certain kind.
   FindRequestHandler(op string) interface{}
+
+  // Returns the kind of handler registered for operation `op`, or HandlerKindNone
+  RequestHandlerKind(op string) HandlerKind
+
+  // Look up a handler of single requests for operation `op`, wrapped in any middleware.
+  // Returns `nil` if not found or if the handler is a stream handler. Handlers taking a
+  // context.Context receive a background context when called through the returned function.
+  FindBufferRequestHandler(op string) BufferReqHandler
+
+  // Look up a handler of streaming requests for operation `op`. Returns `nil` if not found or
+  // if the handler is not a stream handler.
+  FindStreamRequestHandler(op string) StreamReqHandler
+
   FindNotificationHandler(name string) BufferNoteHandler
+  FindNotificationStreamHandler(name string) NoteStreamHandler
+
+  // Remove the handler for operation `op`, or the fallback handler if `op` is empty. Returns
+  // false if there was no such handler. Requests already being handled are not affected.
+  RemoveRequestHandler(op string) bool
+
+  // Remove the handler for notifications named `name`, or the fallback handler if `name` is
+  // empty. Returns false if there was no such handler.
+  RemoveNotificationHandler(name string) bool
+
+  // Returns the sorted names of operations and notifications with a registered handler. Fallback
+  // handlers are not included; look them up with an empty name instead.
+  OperationNames() []string
+  NotificationNames() []string
+
+  // Limit the number of handler invocations for operation `op` running at the same time on any
+  // one socket to `max`. Requests beyond that are queued until a running handler completes.
+  // A `max` of 0 means no limit (the default.) Streaming requests are not affected by this limit
+  // but by Sock.SetStreamReqLimit.
+  SetOperationConcurrency(op string, max int)
+
+  // Limit the number of requests for operation `op` which are queued because of the limit set
+  // with SetOperationConcurrency. Requests beyond that fail with an error of code
+  // ErrCodeOverloaded. A negative `max` means no limit (the default.)
+  SetOperationQueueLimit(op string, max int)
+
+  // Returns the limits set for operation `op` with SetOperationConcurrency and
+  // SetOperationQueueLimit.
+  OperationConcurrency(op string) (max, maxQueued int)
+
+  // Limit the time a handler for buffered requests of operation `op` may run to `d`. Requests
+  // whose handler doesn't return in time fail with an error of code ErrCodeTimeout, the context
+  // of the handler is canceled and its result is discarded once it returns. Time spent queued
+  // because of SetOperationConcurrency doesn't count. A `d` of 0 means no limit (the default.)
+  SetHandlerTimeout(op string, d time.Duration)
+
+  // Returns the limit set for operation `op` with SetHandlerTimeout, or 0 if there is none
+  HandlerTimeout(op string) time.Duration
+
+  // Remember the results of requests made with Sock.RequestIdempotent for `ttl`, for up to
+  // `maxKeys` idempotency keys, so that a request retried with the same key, e.g. after a
+  // reconnect, returns the result of the first one rather than calling the handler again. A
+  // retry arriving while the first request is still being handled waits for its result.
+  // Transient errors, see Sock.RequestIdempotent, and results of handlers which timed out or
+  // were canceled are not remembered. Applies to single requests on any socket using these
+  // handlers. A `maxKeys` or `ttl` of 0 disables the cache (the default.)
+  SetIdempotencyCache(maxKeys int, ttl time.Duration)
+
+  // Limit requests for operation `op` on any one socket to `ratePerSec` requests per second with
+  // bursts of up to `burst` requests, using a token bucket. Requests beyond the limit fail with an
+  // error of code ErrCodeRateLimited and RateLimitInfo data, without the handler being called.
+  // A `ratePerSec` of 0 removes the limit.
+  SetRateLimit(op string, ratePerSec float64, burst int)
+
+  // Like SetRateLimit but with one limit shared by all sockets using these handlers, e.g. all
+  // connections of a server.
+  SetSharedRateLimit(op string, ratePerSec float64, burst int)
+
+  // Returns the rate limit set for operation `op`, or a `ratePerSec` of 0 if there is none.
+  RateLimit(op string) (ratePerSec float64, burst int, shared bool)
+
+  // Enable or disable timing of request handlers (disabled by default.) Stats collected so far
+  // are kept when disabled. Streaming requests are not timed.
+  EnableLatencyStats(enable bool)
+
+  // Returns the handler latency of each operation timed while latency stats were enabled
+  LatencyStats() map[string]OpLatency
+
+  // Wrap request handlers with middleware `mw`, which receives the next handler in the chain
+  // and returns a handler to be called in its place. The returned handler sees the op and raw
+  // payload of each request and can refuse the request by returning an error without calling
+  // `next`. Middleware runs in the order it was added. Streaming requests are not affected.
+  Use(mw func(next BufferReqHandler) BufferReqHandler)
+
+  // Wrap notification handlers with middleware `mw`. Like Use but for notifications.
+  UseNotification(mw func(next BufferNoteHandler) BufferNoteHandler)
 }
 
 func NewHandlers() Handlers {
-  return &handlers{reqHandlers:make(reqHandlerMap), noteHandlers:make(noteHandlerMap)}
+  return &handlers{
+    reqHandlers:make(reqHandlerMap),
+    noteHandlers:make(noteHandlerMap),
+    noteStreamHandlers:make(map[string]NoteStreamHandler),
+    opLimits:make(opLimitMap),
+  }
 }
 
+// Handlers of requests and notifications with raw payloads. A handler owns `payload` unless
+// the socket reuses buffers (see Sock.SetBufferReuse), in which case the payload is only valid
+// until the handler returns. A request handler can return (part of) the payload as its result.
 type BufferReqHandler   func(s Sock, op string, payload []byte) ([]byte, error)
 type BufferNoteHandler  func(s Sock, name string, payload []byte)
 type StreamReqHandler   func(s Sock, name string, rch chan []byte, write StreamWriter) error
                         // ^EOS when <-rch==nil
+// Writes a part of the result of a streaming request, an empty part ending the result. Fails
+// with ErrSockClosed once the socket is closing, e.g. because the peer disconnected, and with
+// context.Canceled once the requestor has canceled the request. Handlers should return then.
 type StreamWriter       func([]byte) error
+type NoteStreamHandler  func(s Sock, name string, parts chan []byte)
+                        // ^EOS when <-parts==nil
+
+// Like BufferReqHandler but also receives the context of the request. Request handler funcs
+// taking a context.Context are registered as this type.
+type ctxReqHandler      func(ctx context.Context, s Sock, op string, payload []byte) ([]byte, error)
+
+// Kind of a request handler. See Handlers.RequestHandlerKind
+type HandlerKind int
+
+const (
+  HandlerKindNone   = HandlerKind(iota)  // no handler
+  HandlerKindBuffer                      // handles single requests, like a BufferReqHandler
+  HandlerKindStream                      // handles streaming requests, like a StreamReqHandler
+)
+
+func (k HandlerKind) String() string {
+  switch k {
+  case HandlerKindNone:   return "none"
+  case HandlerKindBuffer: return "buffer"
+  case HandlerKindStream: return "stream"
+  }
+  return fmt.Sprintf("HandlerKind(%d)", int(k))
+}
+
+// Returns the kind of request handler `handler`
+func requestHandlerKind(handler interface{}) HandlerKind {
+  switch handler.(type) {
+  case BufferReqHandler, ctxReqHandler:
+    return HandlerKindBuffer
+  case StreamReqHandler:
+    return HandlerKindStream
+  }
+  return HandlerKindNone
+}
 
 var DefaultHandlers = NewHandlers()
 
@@ -80,19 +276,47 @@ func HandleNotification(name string, fn interface{}) {
 func HandleBufferNotification(name string, fn BufferNoteHandler) {
   DefaultHandlers.HandleBufferNotification(name, fn)
 }
+func HandleNotificationStream(name string, fn NoteStreamHandler) {
+  DefaultHandlers.HandleNotificationStream(name, fn)
+}
 
 // -------------------------------------------------------------------------------------
 
 type reqHandlerMap  map[string]interface{}
 type noteHandlerMap map[string]BufferNoteHandler
+type opLimitMap     map[string]opLimit
+
+type prefixHandler struct {
+  prefix  string
+  handler interface{}
+}
+
+type opLimit struct {
+  max       int            // max concurrent handler invocations per socket, or 0 for no limit
+  maxQueued int            // max queued requests per socket, or <0 for no limit
+  timeout   time.Duration  // max time a handler may run, or 0 for no limit
+}
 
 type handlers struct {
   reqHandlersMu       sync.RWMutex
   reqHandlers         reqHandlerMap
+  reqPrefixHandlers   []prefixHandler  // longest prefix first
   reqFallbackHandler  interface{}
   notesMu             sync.RWMutex
   noteHandlers        noteHandlerMap
   noteFallbackHandler BufferNoteHandler
+  noteStreamHandlers  map[string]NoteStreamHandler  // guarded by notesMu; "" is the fallback
+  opLimitsMu          sync.RWMutex
+  opLimits            opLimitMap
+  rateLimits          rateLimitMap  // guarded by opLimitsMu
+  latencyEnabled      int32         // accessed atomically
+  latencyMu           sync.RWMutex
+  latency             map[string]*opLatency
+  idemMu              sync.RWMutex
+  idem                *idempotencyCache  // see SetIdempotencyCache
+  mwMu                sync.RWMutex
+  reqMiddleware       []func(BufferReqHandler) BufferReqHandler
+  noteMiddleware      []func(BufferNoteHandler) BufferNoteHandler
 }
 
 func (h *handlers) setRequestHandler(op string, fn interface{}) {
@@ -105,6 +329,37 @@ func (h *handlers) setRequestHandler(op string, fn interface{}) {
   }
 }
 
+func (h *handlers) setPrefixHandler(prefix string, fn interface{}) {
+  h.reqHandlersMu.Lock()
+  defer h.reqHandlersMu.Unlock()
+  for i, ph := range h.reqPrefixHandlers {
+    if ph.prefix == prefix {
+      h.reqPrefixHandlers[i].handler = fn
+      return
+    }
+  }
+  i := sort.Search(len(h.reqPrefixHandlers), func(i int) bool {
+    return len(h.reqPrefixHandlers[i].prefix) < len(prefix)
+  })
+  h.reqPrefixHandlers = append(h.reqPrefixHandlers, prefixHandler{})
+  copy(h.reqPrefixHandlers[i+1:], h.reqPrefixHandlers[i:])
+  h.reqPrefixHandlers[i] = prefixHandler{prefix, fn}
+}
+
+// Returns the handler for `op`, the handler of its longest matching prefix or the fallback
+// handler. h.reqHandlersMu must be held.
+func (h *handlers) findRequestHandlerLocked(op string) interface{} {
+  if handler := h.reqHandlers[op]; handler != nil {
+    return handler
+  }
+  for _, ph := range h.reqPrefixHandlers {
+    if strings.HasPrefix(op, ph.prefix) {
+      return ph.handler
+    }
+  }
+  return h.reqFallbackHandler
+}
+
 func (h *handlers) HandleBufferRequest(op string, fn BufferReqHandler) {
   h.setRequestHandler(op, fn)
 }
@@ -123,36 +378,263 @@ func (h *handlers) HandleBufferNotification(name string, fn BufferNoteHandler) {
   }
 }
 
+func (h *handlers) HandleNotificationStream(name string, fn NoteStreamHandler) {
+  h.notesMu.Lock()
+  defer h.notesMu.Unlock()
+  h.noteStreamHandlers[name] = fn
+}
+
+func (h *handlers) RemoveRequestHandler(op string) bool {
+  h.reqHandlersMu.Lock()
+  defer h.reqHandlersMu.Unlock()
+  if len(op) == 0 {
+    removed := h.reqFallbackHandler != nil
+    h.reqFallbackHandler = nil
+    return removed
+  }
+  _, removed := h.reqHandlers[op]
+  delete(h.reqHandlers, op)
+  return removed
+}
+
+func (h *handlers) RemoveNotificationHandler(name string) bool {
+  h.notesMu.Lock()
+  defer h.notesMu.Unlock()
+  if len(name) == 0 {
+    removed := h.noteFallbackHandler != nil
+    h.noteFallbackHandler = nil
+    return removed
+  }
+  _, removed := h.noteHandlers[name]
+  delete(h.noteHandlers, name)
+  return removed
+}
+
 
 func (h *handlers) FindRequestHandler(op string) interface{} {
+  h.reqHandlersMu.RLock()
+  handler := h.findRequestHandlerLocked(op)
+  h.reqHandlersMu.RUnlock()
+  return h.wrapReqHandler(handler)
+}
+
+func (h *handlers) RequestHandlerKind(op string) HandlerKind {
   h.reqHandlersMu.RLock()
   defer h.reqHandlersMu.RUnlock()
-  if handler := h.reqHandlers[op]; handler != nil {
-    return handler
+  return requestHandlerKind(h.findRequestHandlerLocked(op))
+}
+
+func (h *handlers) FindBufferRequestHandler(op string) BufferReqHandler {
+  switch a := h.FindRequestHandler(op).(type) {
+  case BufferReqHandler:
+    return a
+  case ctxReqHandler:
+    return func(s Sock, op string, b []byte) ([]byte, error) {
+      return a(context.Background(), s, op, b)
+    }
   }
-  return h.reqFallbackHandler
+  return nil
+}
+
+func (h *handlers) FindStreamRequestHandler(op string) StreamReqHandler {
+  a, _ := h.FindRequestHandler(op).(StreamReqHandler)
+  return a
 }
 
 func (h *handlers) FindNotificationHandler(name string) BufferNoteHandler {
+  h.notesMu.RLock()
+  handler := h.noteHandlers[name]
+  if handler == nil {
+    handler = h.noteFallbackHandler
+  }
+  h.notesMu.RUnlock()
+  return h.wrapNoteHandler(handler)
+}
+
+func (h *handlers) FindNotificationStreamHandler(name string) NoteStreamHandler {
   h.notesMu.RLock()
   defer h.notesMu.RUnlock()
-  if handler := h.noteHandlers[name]; handler != nil {
+  if handler := h.noteStreamHandlers[name]; handler != nil {
     return handler
   }
-  return h.noteFallbackHandler
+  return h.noteStreamHandlers[""]
+}
+
+func (h *handlers) OperationNames() []string {
+  h.reqHandlersMu.RLock()
+  names := make([]string, 0, len(h.reqHandlers))
+  for op := range h.reqHandlers {
+    names = append(names, op)
+  }
+  h.reqHandlersMu.RUnlock()
+  sort.Strings(names)
+  return names
+}
+
+func (h *handlers) NotificationNames() []string {
+  h.notesMu.RLock()
+  names := make([]string, 0, len(h.noteHandlers))
+  for name := range h.noteHandlers {
+    names = append(names, name)
+  }
+  h.notesMu.RUnlock()
+  sort.Strings(names)
+  return names
+}
+
+func (h *handlers) Use(mw func(next BufferReqHandler) BufferReqHandler) {
+  h.mwMu.Lock()
+  defer h.mwMu.Unlock()
+  h.reqMiddleware = append(h.reqMiddleware, mw)
+}
+
+func (h *handlers) UseNotification(mw func(next BufferNoteHandler) BufferNoteHandler) {
+  h.mwMu.Lock()
+  defer h.mwMu.Unlock()
+  h.noteMiddleware = append(h.noteMiddleware, mw)
+}
+
+// Returns `handler` wrapped in any request middleware. Stream handlers are returned as-is.
+func (h *handlers) wrapReqHandler(handler interface{}) interface{} {
+  h.mwMu.RLock()
+  mws := h.reqMiddleware
+  h.mwMu.RUnlock()
+  if len(mws) == 0 {
+    return handler
+  }
+  chain := func(next BufferReqHandler) BufferReqHandler {
+    for i := len(mws) - 1; i >= 0; i-- {
+      next = mws[i](next)
+    }
+    return next
+  }
+  switch a := handler.(type) {
+  case BufferReqHandler:
+    return chain(a)
+  case ctxReqHandler:
+    // Keep the context of each request flowing to the handler
+    return ctxReqHandler(func(ctx context.Context, s Sock, op string, b []byte) ([]byte, error) {
+      return chain(func(s Sock, op string, b []byte) ([]byte, error) {
+        return a(ctx, s, op, b)
+      })(s, op, b)
+    })
+  }
+  return handler
+}
+
+// Returns `handler` wrapped in any notification middleware
+func (h *handlers) wrapNoteHandler(handler BufferNoteHandler) BufferNoteHandler {
+  if handler == nil {
+    return nil
+  }
+  h.mwMu.RLock()
+  mws := h.noteMiddleware
+  h.mwMu.RUnlock()
+  for i := len(mws) - 1; i >= 0; i-- {
+    handler = mws[i](handler)
+  }
+  return handler
+}
+
+func (h *handlers) SetOperationConcurrency(op string, max int) {
+  h.opLimitsMu.Lock()
+  defer h.opLimitsMu.Unlock()
+  l, ok := h.opLimits[op]
+  if !ok {
+    l.maxQueued = -1
+  }
+  l.max = max
+  h.opLimits[op] = l
+}
+
+func (h *handlers) SetOperationQueueLimit(op string, max int) {
+  h.opLimitsMu.Lock()
+  defer h.opLimitsMu.Unlock()
+  l := h.opLimits[op]
+  l.maxQueued = max
+  h.opLimits[op] = l
+}
+
+func (h *handlers) OperationConcurrency(op string) (max, maxQueued int) {
+  h.opLimitsMu.RLock()
+  defer h.opLimitsMu.RUnlock()
+  if l, ok := h.opLimits[op]; ok {
+    return l.max, l.maxQueued
+  }
+  return 0, -1
+}
+
+func (h *handlers) SetHandlerTimeout(op string, d time.Duration) {
+  h.opLimitsMu.Lock()
+  defer h.opLimitsMu.Unlock()
+  l, ok := h.opLimits[op]
+  if !ok {
+    l.maxQueued = -1
+  }
+  l.timeout = d
+  h.opLimits[op] = l
+}
+
+func (h *handlers) HandlerTimeout(op string) time.Duration {
+  h.opLimitsMu.RLock()
+  defer h.opLimitsMu.RUnlock()
+  return h.opLimits[op].timeout
 }
 
 // -------------------------------------------------------------------------------------
 
 var (
   errMsgBadHandler = "invalid handler func signature (see gotalk.Handlers)"
+  errBadHandler = errors.New(errMsgBadHandler)
+  errHandlerNotFunc = errors.New("handler must be a function")
   errUnexpectedParamType = errors.New("unexpected parameter type")
 
   kErrorType = reflect.TypeOf(new(error)).Elem()
   kSockType = reflect.TypeOf(new(Sock)).Elem()
+  kContextType = reflect.TypeOf(new(context.Context)).Elem()
+  kBytesType = reflect.TypeOf([]byte(nil))
 )
 
 
+// When true, errors resulting from handler panics carry a stack trace as their data
+var HandlerPanicTrace = false
+
+
+// When true, errors of parameters which can't be decoded include the error of the codec, e.g.
+// the offset of invalid JSON or the field of a mismatched type, which helps debugging clients
+// but reveals details of handlers
+var VerboseParamErrors = false
+
+
+// Returns the error of parameters which failed to decode with `err`
+func paramTypeError(err error) error {
+  if VerboseParamErrors {
+    return fmt.Errorf("%w: %v", errUnexpectedParamType, err)
+  }
+  return errUnexpectedParamType
+}
+
+
+// Returns the error a handler panic with value `r` results in
+func handlerPanicError(r interface{}) *RequestError {
+  var data interface{}
+  if HandlerPanicTrace {
+    data = string(debug.Stack())
+  }
+  e := NewRequestError(ErrCodeUnspecified, fmt.Sprintf("handler panic: %v", r), data)
+  e.panic = true
+  return e
+}
+
+
+// Recovers from a handler panic, setting `*errp` to the resulting error
+func recoverHandlerPanic(errp *error) {
+  if r := recover(); r != nil {
+    *errp = handlerPanicError(r)
+  }
+}
+
+
 func valToErr(r reflect.Value) error {
   v := r.Interface()
   if err, ok := v.(error); ok {
@@ -164,10 +646,10 @@ func valToErr(r reflect.Value) error {
 }
 
 
-func decodeResult(r []reflect.Value) ([]byte, error) {
+func decodeResult(codec Codec, r []reflect.Value) ([]byte, error) {
   if len(r) == 2 {
     if r[1].IsNil() {
-      return json.Marshal(r[0].Interface())
+      return encodeValue(codec, r[0].Interface())
     } else {
       return nil, valToErr(r[1])
     }
@@ -179,179 +661,457 @@ func decodeResult(r []reflect.Value) ([]byte, error) {
 }
 
 
-func decodeParams(paramsType reflect.Type, inbuf []byte) (*reflect.Value, error) {
+// Parameters of handler funcs can implement this interface to be validated once decoded.
+// Requests with parameters failing validation get an error result with ErrCodeInvalidParams,
+// without the handler being called, and such notifications are ignored.
+type Validator interface {
+  Validate() error
+}
+
+
+func decodeParams(codec Codec, paramsType reflect.Type, inbuf []byte) (*reflect.Value, error) {
   paramsVal := reflect.New(paramsType)
-  params := paramsVal.Interface()
-  if err := json.Unmarshal(inbuf, &params); err != nil {
-    return &paramsVal, errUnexpectedParamType
+  err := decodeParamsInto(codec, paramsVal, inbuf)
+  return &paramsVal, err
+}
+
+
+// Decodes `inbuf` into the value pointed to by `paramsVal`, which must be zero
+func decodeParamsInto(codec Codec, paramsVal reflect.Value, inbuf []byte) error {
+  if err := codec.Unmarshal(inbuf, paramsVal.Interface()); err != nil {
+    return paramTypeError(err)
+  }
+  if err := validateParams(paramsVal); err != nil {
+    return NewRequestError(ErrCodeInvalidParams, err.Error(), nil)
   }
-  return &paramsVal, nil
+  return nil
 }
 
 
-func wrapFuncReqHandler(fn interface{}) BufferReqHandler {
+// Calls Validate of the value pointed to by `paramsVal`, if it is a Validator
+func validateParams(paramsVal reflect.Value) error {
+  if v, ok := paramsVal.Interface().(Validator); ok {
+    return v.Validate()
+  }
+  // Parameters of a pointer type, which are nil when decoded from null
+  if elem := paramsVal.Elem(); elem.Kind() == reflect.Ptr && !elem.IsNil() {
+    if v, ok := elem.Interface().(Validator); ok {
+      return v.Validate()
+    }
+  }
+  return nil
+}
+
+
+// True if `err` was returned by decodeParams for parameters failing validation
+func isInvalidParams(err error) bool {
+  e, ok := err.(*RequestError)
+  return ok && e.code == ErrCodeInvalidParams
+}
+
+
+// Pools of pointers to zero parameters, keyed by parameter type
+var paramsPools sync.Map
+
+func paramsPool(paramsType reflect.Type) *sync.Pool {
+  if pool, ok := paramsPools.Load(paramsType); ok {
+    return pool.(*sync.Pool)
+  }
+  pool, _ := paramsPools.LoadOrStore(paramsType, &sync.Pool{})
+  return pool.(*sync.Pool)
+}
+
+// Returns a pointer to zero parameters of type `paramsType` from `pool`
+func getParams(pool *sync.Pool, paramsType reflect.Type) reflect.Value {
+  if p := pool.Get(); p != nil {
+    return reflect.ValueOf(p)
+  }
+  return reflect.New(paramsType)
+}
+
+// Returns parameters to `pool` once the handler has returned. Only the parameters themselves
+// are reused, so handlers can keep anything they point to.
+func putParams(pool *sync.Pool, paramsVal reflect.Value) {
+  paramsVal.Elem().SetZero()
+  pool.Put(paramsVal.Interface())
+}
+
+
+func callFuncReqHandler(codec Codec, fnv reflect.Value, args []reflect.Value) (outbuf []byte, err error) {
+  defer recoverHandlerPanic(&err)
+  return decodeResult(codec, fnv.Call(args))
+}
+
+
+// Returns a BufferReqHandler, or a ctxReqHandler if `fn` takes a context.Context
+func wrapFuncReqHandler(fn interface{}) (interface{}, error) {
   // `fn` must conform to one of the following signatures:
-  //   `func(Sock, interface{})(interface{}, error)` -- takes socket and parameters
-  //   `func(interface{})(interface{}, error)`       -- takes parameters, but no socket
-  //   `func(Sock)(interface{}, error)`              -- takes no parameters
-  //   `func()(interface{},error)`                   -- takes no socket or parameters
+  //   `func(Sock, string, interface{})(interface{}, error)` -- takes socket, op and parameters
+  //   `func(Sock, interface{})(interface{}, error)`         -- takes socket and parameters
+  //   `func(interface{})(interface{}, error)`               -- takes parameters, but no socket
+  //   `func(Sock)(interface{}, error)`                      -- takes no parameters
+  //   `func()(interface{},error)`                           -- takes no socket or parameters
+  // optionally with a leading argument of a type implementing `context.Context`, and those
+  // taking parameters optionally with a trailing `[]byte` argument receiving the raw parameters,
+  // except for `func(Sock, string, []byte)` which takes the op and parameters of type []byte.
   fnv := reflect.ValueOf(fn)
+  if fnv.Kind() != reflect.Func {
+    return nil, errHandlerNotFunc
+  }
   fnt := fnv.Type()
 
-  if fnt.Kind() != reflect.Func {
-    panic("handler must be a function")
+  hasCtx := fnt.NumIn() != 0 && fnt.In(0).Implements(kContextType)
+  argz := 0  // index of first argument after any context
+  if hasCtx {
+    argz = 1
   }
+  numIn := fnt.NumIn() - argz
 
-  if fnt.NumIn() > 3 || fnt.NumOut() < 1 || fnt.NumOut() > 2 ||
+  hasRaw := numIn >= 2 && fnt.In(fnt.NumIn()-1) == kBytesType
+  if hasRaw && numIn == 2 {
+    hasRaw = fnt.In(argz).Implements(kSockType) == false
+  } else if hasRaw && numIn == 3 {
+    hasRaw = fnt.In(argz+1).Kind() != reflect.String
+  }
+  if hasRaw {
+    numIn--
+  }
+
+  if numIn > 3 || fnt.NumOut() < 1 || fnt.NumOut() > 2 ||
      fnt.Out(fnt.NumOut() - 1).Implements(kErrorType) == false {
-    panic(errMsgBadHandler)
+    return nil, errBadHandler
   }
 
-  if fnt.NumIn() == 3 {
-    // `func(Sock, string, interface{}) (interface{}, error)`
-    if fnt.In(0).Implements(kSockType) == false {
-      panic(errMsgBadHandler)
+  // Which arguments the func takes after any context, checked and looked up once
+  takesSock, takesOp := false, false
+  var paramsType, ctxType reflect.Type
+  if numIn == 3 {
+    // Signature: `func(Sock, string, interface{})(interface{}, error)`
+    if fnt.In(argz).Implements(kSockType) == false {
+      return nil, errBadHandler
     }
-    if fnt.In(1).Kind() != reflect.String {
-      panic(errMsgBadHandler)
+    if fnt.In(argz+1).Kind() != reflect.String {
+      return nil, errBadHandler
     }
-    paramsType := fnt.In(2)
+    takesSock, takesOp, paramsType = true, true, fnt.In(argz+2)
+  } else if numIn == 2 {
+    // Signature: `func(Sock, interface{})(interface{}, error)`
+    if fnt.In(argz).Implements(kSockType) == false {
+      return nil, errBadHandler
+    }
+    takesSock, paramsType = true, fnt.In(argz+1)
+  } else if numIn == 1 {
+    if fnt.In(argz).Implements(kSockType) {
+      // Signature: `func(Sock)(interface{}, error)` or `func(Sock)error`
+      takesSock = true
+    } else {
+      // Signature: `func(interface{})(interface{}, error)`
+      paramsType = fnt.In(argz)
+    }
+  } // else signature: `func()(interface{},error)` or `func()error`
+  if hasCtx {
+    ctxType = fnt.In(0)
+  }
+  var pool *sync.Pool
+  if paramsType != nil {
+    pool = paramsPool(paramsType)
+  }
+  nargs := fnt.NumIn()
 
-    return BufferReqHandler(func (s Sock, op string, inbuf []byte) ([]byte, error) {
-      paramsVal, err := decodeParams(paramsType, inbuf)
-      if err != nil {
+  handler := func (ctx context.Context, s Sock, op string, inbuf []byte) ([]byte, error) {
+    args := make([]reflect.Value, 0, nargs)
+    if hasCtx {
+      ctxv := reflect.ValueOf(ctx)
+      if !ctxv.Type().AssignableTo(ctxType) {
+        return nil, fmt.Errorf("context of type %v can't be passed as %v", ctxv.Type(), ctxType)
+      }
+      args = append(args, ctxv)
+    }
+    if takesSock {
+      args = append(args, reflect.ValueOf(s))
+    }
+    if takesOp {
+      args = append(args, reflect.ValueOf(op))
+    }
+    codec := codecOf(s)
+    if paramsType != nil {
+      paramsVal := getParams(pool, paramsType)
+      defer putParams(pool, paramsVal)
+      if err := decodeParamsInto(codec, paramsVal, inbuf); err != nil {
         return nil, err
       }
-      r := fnv.Call([]reflect.Value{reflect.ValueOf(s), reflect.ValueOf(op), paramsVal.Elem()})
-      return decodeResult(r)
-    })
-
-  } else if fnt.NumIn() == 2 {
-    // Signature: `func(Sock, interface{})(interface{}, error)`
-    if fnt.In(0).Implements(kSockType) == false {
-      panic(errMsgBadHandler)
+      args = append(args, paramsVal.Elem())
     }
-    paramsType := fnt.In(1)
+    if hasRaw {
+      args = append(args, reflect.ValueOf(inbuf))
+    }
+    return callFuncReqHandler(codec, fnv, args)
+  }
+
+  if hasCtx {
+    return ctxReqHandler(handler), nil
+  }
+  return BufferReqHandler(func (s Sock, op string, inbuf []byte) ([]byte, error) {
+    return handler(context.Background(), s, op, inbuf)
+  }), nil
+}
 
-    return BufferReqHandler(func (s Sock, _ string, inbuf []byte) ([]byte, error) {
-      paramsVal, err := decodeParams(paramsType, inbuf)
+
+// Returns a StreamReqHandler for a func taking a value writer as its last argument
+func wrapFuncStreamHandler(fn interface{}) (StreamReqHandler, error) {
+  // `fn` must conform to one of the following signatures:
+  //   `func(Sock, interface{}, func(interface{}) error) error` -- takes socket and parameters
+  //   `func(interface{}, func(interface{}) error) error`       -- takes parameters, but no socket
+  // where the parameters can be a `<-chan interface{}` and the writer can take any type.
+  fnv := reflect.ValueOf(fn)
+  if fnv.Kind() != reflect.Func {
+    return nil, errHandlerNotFunc
+  }
+  fnt := fnv.Type()
+
+  numIn := fnt.NumIn()
+  if numIn < 2 || numIn > 3 || isValueWriterType(fnt.In(numIn-1)) == false ||
+     fnt.NumOut() != 1 || fnt.Out(0).Implements(kErrorType) == false {
+    return nil, errBadHandler
+  }
+  if numIn == 3 && fnt.In(0).Implements(kSockType) == false {
+    return nil, errBadHandler
+  }
+  paramsType := fnt.In(numIn-2)
+  writerType := fnt.In(numIn-1)
+  isChan := paramsType.Kind() == reflect.Chan && paramsType.ChanDir() == reflect.RecvDir
+
+  return func (s Sock, _ string, rch chan []byte, write StreamWriter) error {
+    codec := codecOf(s)
+
+    var paramsVal reflect.Value
+    var decodeErr error
+    done, decoded := make(chan struct{}), make(chan struct{})
+    if isChan {
+      ch := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, paramsType.Elem()), 0)
+      go decodeStreamParts(codec, rch, ch, done, decoded, &decodeErr)
+      paramsVal = ch.Convert(paramsType)
+    } else {
+      // Read the complete request payload
+      var inbuf []byte
+      for b := <-rch; b != nil; b = <-rch {
+        inbuf = append(inbuf, b...)
+      }
+      v, err := decodeParams(codec, paramsType, inbuf)
       if err != nil {
-        return nil, err
+        return err
       }
-      r := fnv.Call([]reflect.Value{reflect.ValueOf(s), paramsVal.Elem()})
-      return decodeResult(r)
-    })
+      paramsVal = v.Elem()
+    }
 
-  } else if fnt.NumIn() == 1 {
-    if fnt.In(0).Implements(kSockType) {
-      if fnt.NumOut() == 2 {
-        // Signature: `func(Sock)(interface{}, error)`
-        return BufferReqHandler(func (s Sock, _ string, _ []byte) ([]byte, error) {
-          r := fnv.Call([]reflect.Value{reflect.ValueOf(s)})
-          return decodeResult(r)
-        })
+    writev := reflect.MakeFunc(writerType, func(args []reflect.Value) []reflect.Value {
+      var err error
+      if b, err1 := encodeValue(codec, args[0].Interface()); err1 != nil {
+        err = err1
       } else {
-        // Signature: `func(Sock)error`
-        f, ok := fn.(func(Sock)error)
-        if ok == false {
-          panic(errMsgBadHandler)
-        }
-        return BufferReqHandler(func (s Sock, _ string, _ []byte) ([]byte, error) {
-          return nil, f(s)
-        })
+        err = write(b)
       }
+      errv := reflect.New(kErrorType).Elem()
+      if err != nil {
+        errv.Set(reflect.ValueOf(err))
+      }
+      return []reflect.Value{errv}
+    })
 
-    } else {
-      // Signature: `func(interface{})(interface{}, error)`
-      paramsType := fnt.In(0)
-      return BufferReqHandler(func (_ Sock, _ string, inbuf []byte) ([]byte, error) {
-        paramsVal, err := decodeParams(paramsType, inbuf)
-        if err != nil {
-          return nil, err
-        }
-        r := fnv.Call([]reflect.Value{paramsVal.Elem()})
-        return decodeResult(r)
-      })
+    args := []reflect.Value{paramsVal, writev}
+    if numIn == 3 {
+      args = append([]reflect.Value{reflect.ValueOf(s)}, args...)
     }
-
-  } else {
-    if fnt.NumOut() == 2 {
-      // Signature: `func()(interface{},error)`
-      return BufferReqHandler(func (_ Sock, _ string, _ []byte) ([]byte, error) {
-        r := fnv.Call(nil)
-        return decodeResult(r)
-      })
-    } else {
-      // Signature: `func()error`
-      f, ok := fn.(func()error)
-      if ok == false {
-        panic(errMsgBadHandler)
+    r, err := callStreamFunc(fnv, args)
+    close(done)
+    if isChan {
+      <-decoded
+      if decodeErr != nil {
+        return decodeErr
       }
-      return BufferReqHandler(func (_ Sock, _ string, _ []byte) ([]byte, error) {
-        return nil, f()
-      })
     }
-  }
+    if err != nil {
+      return err
+    }
+    if !r[0].IsNil() {
+      return valToErr(r[0])
+    }
+    return nil
+  }, nil
+}
+
 
+func callStreamFunc(fnv reflect.Value, args []reflect.Value) (r []reflect.Value, err error) {
+  defer recoverHandlerPanic(&err)
+  return fnv.Call(args), nil
+}
+
+
+// True if `t` is a func taking a single value and returning an error
+func isValueWriterType(t reflect.Type) bool {
+  return t.Kind() == reflect.Func && t.NumIn() == 1 && t.NumOut() == 1 && t.Out(0) == kErrorType
+}
+
+
+// Decodes parts read from `rch` into values sent on `ch`, closing `ch` at the end of the stream,
+// when a part can't be decoded, in which case `*errp` is set, or when `done` is closed. Closes
+// `decoded` when `ch` is closed. Any remaining parts are discarded by the socket once the
+// handler has returned.
+func decodeStreamParts(codec Codec, rch chan []byte, ch reflect.Value, done, decoded chan struct{}, errp *error) {
+  defer close(decoded)
+  defer ch.Close()
+  for {
+    var b []byte
+    select {
+    case b = <-rch:
+    case <-done:
+      return
+    }
+    if b == nil {
+      return  // end of stream
+    }
+    v, err := decodeParams(codec, ch.Type().Elem(), b)
+    if err != nil {
+      *errp = err
+      return
+    }
+    chosen, _, _ := reflect.Select([]reflect.SelectCase{
+      {Dir:reflect.SelectSend, Chan:ch, Send:v.Elem()},
+      {Dir:reflect.SelectRecv, Chan:reflect.ValueOf(done)},
+    })
+    if chosen == 1 {
+      return
+    }
+  }
 }
 
 
 func (h *handlers) HandleRequest(op string, fn interface{}) {
-  h.HandleBufferRequest(op, wrapFuncReqHandler(fn))
+  if err := h.HandleRequestErr(op, fn); err != nil {
+    panic(err.Error())
+  }
 }
 
 
-func wrapFuncNotHandler(fn interface{}) BufferNoteHandler {
+func (h *handlers) HandleRequestErr(op string, fn interface{}) error {
+  handler, err := wrapFuncHandler(fn)
+  if err != nil {
+    return err
+  }
+  h.setRequestHandler(op, handler)
+  return nil
+}
+
+
+func (h *handlers) HandleRequestPrefix(prefix string, fn interface{}) {
+  handler, err := wrapFuncHandler(fn)
+  if err != nil {
+    panic(err.Error())
+  }
+  if len(prefix) == 0 {
+    h.setRequestHandler(prefix, handler)
+  } else {
+    h.setPrefixHandler(prefix, handler)
+  }
+}
+
+
+// Wraps a func request handler as a buffer, context or stream handler
+func wrapFuncHandler(fn interface{}) (interface{}, error) {
+  if fnt := reflect.TypeOf(fn); fnt != nil && fnt.Kind() == reflect.Func &&
+     fnt.NumIn() > 1 && isValueWriterType(fnt.In(fnt.NumIn()-1)) {
+    return wrapFuncStreamHandler(fn)
+  }
+  return wrapFuncReqHandler(fn)
+}
+
+
+func wrapFuncNotHandler(fn interface{}) (BufferNoteHandler, error) {
   // `fn` must conform to one of the following signatures:
   //   `func(Sock, string, interface{})` -- takes socket, name and parameters
   //   `func(string, interface{})`       -- takes name and parameters, but no socket
   //   `func(interface{})`               -- takes only parameters
+  // where parameters of type []byte receive the payload as-is.
   fnv := reflect.ValueOf(fn)
-  fnt := fnv.Type()
-
-  if fnt.Kind() != reflect.Func {
-    panic("handler must be a function")
+  if fnv.Kind() != reflect.Func {
+    return nil, errHandlerNotFunc
   }
+  fnt := fnv.Type()
 
-  if fnt.NumIn() > 3 || fnt.NumOut() > 0 {
-    panic(errMsgBadHandler)
+  if fnt.NumIn() == 0 || fnt.NumIn() > 3 || fnt.NumOut() > 0 {
+    return nil, errBadHandler
   }
 
   if fnt.NumIn() == 3 {
     // Signature: `func(Sock, string, interface{})`
     if fnt.In(0).Implements(kSockType) == false || fnt.In(1).Kind() != reflect.String {
-      panic(errMsgBadHandler)
+      return nil, errBadHandler
     }
     paramsType := fnt.In(2)
     return BufferNoteHandler(
       func (s Sock, name string, inbuf []byte) {
-        paramsVal, _ := decodeParams(paramsType, inbuf)
-        fnv.Call([]reflect.Value{reflect.ValueOf(s), reflect.ValueOf(name), paramsVal.Elem()})
-      })
+        paramsVal, ok := decodeNoteParams(s, paramsType, inbuf)
+        if !ok {
+          return
+        }
+        fnv.Call([]reflect.Value{reflect.ValueOf(s), reflect.ValueOf(name), paramsVal})
+      }), nil
   } else if fnt.NumIn() == 2 {
     // Signature: `func(string, interface{})`
     if fnt.In(0).Kind() != reflect.String {
-      panic(errMsgBadHandler)
+      return nil, errBadHandler
     }
     paramsType := fnt.In(1)
     return BufferNoteHandler(
-      func (_ Sock, name string, inbuf []byte) {
-        paramsVal, _ := decodeParams(paramsType, inbuf)
-        fnv.Call([]reflect.Value{reflect.ValueOf(name), paramsVal.Elem()})
-      })
+      func (s Sock, name string, inbuf []byte) {
+        paramsVal, ok := decodeNoteParams(s, paramsType, inbuf)
+        if !ok {
+          return
+        }
+        fnv.Call([]reflect.Value{reflect.ValueOf(name), paramsVal})
+      }), nil
   } else {
     // Signature: `func(interface{})`
     paramsType := fnt.In(0)
     return BufferNoteHandler(
-      func (_ Sock, _ string, inbuf []byte) {
-        paramsVal, _ := decodeParams(paramsType, inbuf)
-        fnv.Call([]reflect.Value{paramsVal.Elem()})
-      })
+      func (s Sock, _ string, inbuf []byte) {
+        paramsVal, ok := decodeNoteParams(s, paramsType, inbuf)
+        if !ok {
+          return
+        }
+        fnv.Call([]reflect.Value{paramsVal})
+      }), nil
   }
 }
 
 
+// Decodes the parameters of a notification, or returns the payload as-is for parameters of type
+// []byte. Returns false if the parameters fail validation.
+func decodeNoteParams(s Sock, paramsType reflect.Type, inbuf []byte) (reflect.Value, bool) {
+  if paramsType == kBytesType {
+    return reflect.ValueOf(inbuf), true
+  }
+  paramsVal, err := decodeParams(codecOf(s), paramsType, inbuf)
+  if isInvalidParams(err) {
+    return reflect.Value{}, false
+  }
+  return paramsVal.Elem(), true
+}
+
+
 func (h *handlers) HandleNotification(name string, fn interface{}) {
-  h.HandleBufferNotification(name, wrapFuncNotHandler(fn))
+  if err := h.HandleNotificationErr(name, fn); err != nil {
+    panic(err.Error())
+  }
+}
+
+
+func (h *handlers) HandleNotificationErr(name string, fn interface{}) error {
+  handler, err := wrapFuncNotHandler(fn)
+  if err != nil {
+    return err
+  }
+  h.HandleBufferNotification(name, handler)
+  return nil
 }
 
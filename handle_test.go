@@ -1,7 +1,11 @@
 package gotalk
 import (
+  "context"
   "testing"
   "bytes"
+  "errors"
+  "fmt"
+  "strings"
   "runtime/debug"
 )
 
@@ -112,6 +116,86 @@ func TestRequestFuncHandlers(t *testing.T) {
 }
 
 
+func TestRequestFuncHandlersContext(t *testing.T) {
+  h := NewHandlers()
+  defer recoverAsFail(t)
+
+  type ctxKey struct{}
+  ctx := context.WithValue(context.Background(), ctxKey{}, "v")
+  invocationCount := 0
+  checkCtx := func(ctx context.Context) {
+    if v, _ := ctx.Value(ctxKey{}).(string); v != "v" {
+      t.Errorf("handler did not receive the request context")
+    }
+    invocationCount++
+  }
+
+  h.HandleRequest("a", func(ctx context.Context, s Sock, op string, p int) (int, error) {
+    checkCtx(ctx)
+    return p+1, nil
+  })
+  h.HandleRequest("b", func(ctx context.Context, s Sock, p int) (int, error) {
+    checkCtx(ctx)
+    return p+1, nil
+  })
+  h.HandleRequest("c", func(ctx context.Context, p int) (int, error) {
+    checkCtx(ctx)
+    return p+1, nil
+  })
+  h.HandleRequest("d", func(ctx context.Context, s Sock) error {
+    checkCtx(ctx)
+    return nil
+  })
+  h.HandleRequest("e", func(ctx context.Context) (int, error) {
+    checkCtx(ctx)
+    return 1, nil
+  })
+
+  s := NewSock(h)
+
+  for _, c := range []struct{ op, input, expectedOutput string }{
+    {"a", "1", "2"}, {"b", "1", "2"}, {"c", "1", "2"}, {"d", "", ""}, {"e", "", "1"},
+  } {
+    if a, ok := h.FindRequestHandler(c.op).(ctxReqHandler); ok == false {
+      t.Errorf("handler '%s' is not a ctxReqHandler", c.op)
+    } else if outbuf, err := a(ctx, s, c.op, []byte(c.input)); err != nil {
+      t.Errorf("handler '%s' returned an error: %s", c.op, err.Error())
+    } else if string(outbuf) != c.expectedOutput {
+      t.Errorf("handler '%s' returned '%s', expected '%s'", c.op, outbuf, c.expectedOutput)
+    }
+  }
+
+  if invocationCount != 5 {
+    t.Error("not all handlers were invoked")
+  }
+}
+
+
+// A context type of its own, like an application might use to document what a handler expects
+type handlerCtx interface {
+  context.Context
+}
+
+func TestRequestFuncHandlersContextType(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("a", func(ctx handlerCtx, n int) (int, error) {
+    return n + 1, ctx.Err()
+  })
+  a, ok := h.FindRequestHandler("a").(ctxReqHandler)
+  if !ok {
+    t.Fatalf("handler taking a handlerCtx is not a ctxReqHandler")
+  }
+  ctx, cancel := context.WithCancel(context.Background())
+  if out, err := a(ctx, NewSock(h), "a", []byte("1")); err != nil || string(out) != "2" {
+    t.Errorf("handler returned (%s, %v), expected (2, nil)", out, err)
+  }
+  cancel()
+  if _, err := a(ctx, NewSock(h), "a", []byte("1")); err != context.Canceled {
+    t.Errorf("handler returned %v, expected %v", err, context.Canceled)
+  }
+}
+
+
 func checkNotHandler(t *testing.T, s Sock, h Handlers, name, input string) {
   if a := h.FindNotificationHandler(name); h == nil {
     t.Errorf("handler '%s' not found", name)
@@ -162,3 +246,497 @@ func TestNotificationFuncHandlers(t *testing.T) {
   }
 }
 
+
+
+type validatedParams struct {
+  Name string `json:"name"`
+}
+
+func (p validatedParams) Validate() error {
+  if p.Name == "" {
+    return errors.New("missing name")
+  }
+  return nil
+}
+
+
+func TestValidateParams(t *testing.T) {
+  h := NewHandlers()
+  defer recoverAsFail(t)
+  invocationCount := 0
+  h.HandleRequest("value", func(p validatedParams) (string, error) {
+    invocationCount++
+    return p.Name, nil
+  })
+  h.HandleRequest("ptr", func(p *validatedParams) (string, error) {
+    invocationCount++
+    if p == nil {
+      return "nil", nil
+    }
+    return p.Name, nil
+  })
+  h.HandleNotification("note", func(p validatedParams) {
+    invocationCount++
+  })
+  s := NewSock(h)
+
+  checkReqHandler(t,s,h, "value", `{"name":"bob"}`, `"bob"`)
+  checkReqHandler(t,s,h, "ptr", `{"name":"bob"}`, `"bob"`)
+  checkReqHandler(t,s,h, "ptr", `null`, `"nil"`)
+  for _, op := range []string{"value", "ptr"} {
+    _, err := h.FindRequestHandler(op).(BufferReqHandler)(s, op, []byte(`{}`))
+    if e, ok := err.(*RequestError); !ok || e.Code() != ErrCodeInvalidParams ||
+       e.Message() != "missing name" {
+      t.Errorf("handler %q returned %v, expected invalid params error", op, err)
+    }
+  }
+  checkNotHandler(t,s,h, "note", `{"name":"bob"}`)
+  checkNotHandler(t,s,h, "note", `{}`)
+
+  if invocationCount != 4 {
+    t.Errorf("handlers invoked %d times, expected 4", invocationCount)
+  }
+}
+
+
+func TestRequestFuncHandlersRaw(t *testing.T) {
+  h := NewHandlers()
+  defer recoverAsFail(t)
+
+  h.HandleRequest("a", func(s Sock, op string, p int, raw []byte) (string, error) {
+    return fmt.Sprintf("%s %d %s", op, p, raw), nil
+  })
+  h.HandleRequest("b", func(s Sock, p int, raw []byte) (string, error) {
+    return fmt.Sprintf("%d %s", p, raw), nil
+  })
+  h.HandleRequest("c", func(p int, raw []byte) (string, error) {
+    return fmt.Sprintf("%d %s", p, raw), nil
+  })
+  h.HandleRequest("d", func(ctx context.Context, p int, raw []byte) (string, error) {
+    return fmt.Sprintf("%d %s", p, raw), nil
+  })
+  // Parameters of type []byte rather than raw parameters
+  h.HandleRequest("e", func(s Sock, op string, p []byte) (string, error) {
+    return string(p), nil
+  })
+  h.HandleRequest("f", func(s Sock, p []byte) (string, error) {
+    return string(p), nil
+  })
+
+  s := NewSock(h)
+  checkReqHandler(t,s,h, "a", " 1", `"a 1  1"`)
+  checkReqHandler(t,s,h, "b", "2", `"2 2"`)
+  checkReqHandler(t,s,h, "c", "3", `"3 3"`)
+  d := h.FindRequestHandler("d").(ctxReqHandler)
+  if outbuf, err := d(context.Background(), s, "d", []byte("4")); err != nil || string(outbuf) != `"4 4"` {
+    t.Errorf("handler 'd' returned (%s, %v), expected '\"4 4\"'", outbuf, err)
+  }
+  checkReqHandler(t,s,h, "e", `"aGk="`, `"hi"`)
+  checkReqHandler(t,s,h, "f", `"aGk="`, `"hi"`)
+}
+
+func TestNotificationFuncHandlersRaw(t *testing.T) {
+  h := NewHandlers()
+  defer recoverAsFail(t)
+  var received []string
+  h.HandleNotification("a", func(s Sock, name string, b []byte) {
+    received = append(received, name + ":" + string(b))
+  })
+  h.HandleNotification("b", func(name string, b []byte) {
+    received = append(received, name + ":" + string(b))
+  })
+  h.HandleNotification("c", func(b []byte) {
+    received = append(received, string(b))
+  })
+  s := NewSock(h)
+
+  // Payloads are passed as-is, not decoded from JSON
+  checkNotHandler(t,s,h, "a", "\x00\x01")
+  checkNotHandler(t,s,h, "b", `"aGk="`)
+  checkNotHandler(t,s,h, "c", "raw")
+  expected := []string{"a:\x00\x01", `b:"aGk="`, "raw"}
+  if strings.Join(received, ",") != strings.Join(expected, ",") {
+    t.Errorf("received %q, expected %q", received, expected)
+  }
+}
+
+
+
+func TestHandleErr(t *testing.T) {
+  h := NewHandlers()
+  for _, fn := range []interface{}{nil, 1, func(a, b, c, d int) error { return nil }, func() {}} {
+    if err := h.HandleRequestErr("op", fn); err == nil {
+      t.Errorf("HandleRequestErr() succeeded with %T", fn)
+    }
+  }
+  for _, fn := range []interface{}{nil, 1, func() {}, func(int) error { return nil }} {
+    if err := h.HandleNotificationErr("note", fn); err == nil {
+      t.Errorf("HandleNotificationErr() succeeded with %T", fn)
+    }
+  }
+  if h.FindRequestHandler("op") != nil || h.FindNotificationHandler("note") != nil {
+    t.Errorf("invalid handlers were registered")
+  }
+
+  if err := h.HandleRequestErr("op", func(int) (int, error) { return 1, nil }); err != nil {
+    t.Errorf("HandleRequestErr() failed: %v", err)
+  }
+  if err := h.HandleRequestErr("stream", func(int, func(int) error) error { return nil }); err != nil {
+    t.Errorf("HandleRequestErr() failed: %v", err)
+  }
+  if err := h.HandleNotificationErr("note", func(int) {}); err != nil {
+    t.Errorf("HandleNotificationErr() failed: %v", err)
+  }
+  if h.RequestHandlerKind("op") != HandlerKindBuffer || h.RequestHandlerKind("stream") != HandlerKindStream ||
+     h.FindNotificationHandler("note") == nil {
+    t.Errorf("valid handlers were not registered")
+  }
+
+  // The panicking variants still panic
+  defer func() {
+    if r := recover(); r != errMsgBadHandler {
+      t.Errorf("HandleRequest() panicked with %v, expected %q", r, errMsgBadHandler)
+    }
+  }()
+  h.HandleRequest("op", func(a, b, c, d int) error { return nil })
+}
+
+
+func TestMiddleware(t *testing.T) {
+  h := NewHandlers()
+  defer recoverAsFail(t)
+
+  var trace []string
+  tracer := func(name string) func(BufferReqHandler) BufferReqHandler {
+    return func(next BufferReqHandler) BufferReqHandler {
+      return func(s Sock, op string, b []byte) ([]byte, error) {
+        trace = append(trace, name+":"+op+":"+string(b))
+        return next(s, op, b)
+      }
+    }
+  }
+  h.Use(tracer("1"))
+  h.Use(tracer("2"))
+  h.Use(func(next BufferReqHandler) BufferReqHandler {
+    return func(s Sock, op string, b []byte) ([]byte, error) {
+      if op == "secret" {
+        return nil, Errorf(403, "forbidden")
+      }
+      return next(s, op, b)
+    }
+  })
+
+  type ctxKey struct{}
+  h.HandleRequest("inc", func(p int) (int, error) { return p+1, nil })
+  h.HandleRequest("ctx", func(ctx context.Context) (string, error) {
+    v, _ := ctx.Value(ctxKey{}).(string)
+    return v, nil
+  })
+  h.HandleRequest("secret", func() error {
+    t.Errorf("handler of refused request was called")
+    return nil
+  })
+
+  s := NewSock(h)
+
+  // Middleware runs in the order it was added
+  checkReqHandler(t, s, h, "inc", "1", "2")
+  if len(trace) != 2 || trace[0] != "1:inc:1" || trace[1] != "2:inc:1" {
+    t.Errorf("unexpected middleware trace %q", trace)
+  }
+
+  // The context of the request reaches handlers taking a context
+  ctx := context.WithValue(context.Background(), ctxKey{}, "v")
+  if a, ok := h.FindRequestHandler("ctx").(ctxReqHandler); ok == false {
+    t.Errorf("handler 'ctx' is not a ctxReqHandler")
+  } else if outbuf, err := a(ctx, s, "ctx", nil); err != nil || string(outbuf) != `"v"` {
+    t.Errorf("handler 'ctx' returned (%q, %v)", outbuf, err)
+  }
+
+  // Middleware can refuse requests
+  a := h.FindRequestHandler("secret").(BufferReqHandler)
+  if _, err := a(s, "secret", nil); err == nil || err.(*RequestError).Code() != 403 {
+    t.Errorf("handler 'secret' returned %v, expected error with code 403", err)
+  }
+
+  // Notifications
+  var notes []string
+  h.UseNotification(func(next BufferNoteHandler) BufferNoteHandler {
+    return func(s Sock, name string, b []byte) {
+      notes = append(notes, "mw:"+name)
+      next(s, name, b)
+    }
+  })
+  h.HandleNotification("n", func(p int) { notes = append(notes, "n") })
+  checkNotHandler(t, s, h, "n", "1")
+  if len(notes) != 2 || notes[0] != "mw:n" || notes[1] != "n" {
+    t.Errorf("unexpected notification trace %q", notes)
+  }
+  if h.FindNotificationHandler("missing") != nil {
+    t.Errorf("FindNotificationHandler() returned a handler for an unknown name")
+  }
+}
+
+
+func TestRequestFuncHandlerPanic(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("crash", func(p int) (int, error) {
+    var m map[string]int
+    m["x"] = p
+    return p, nil
+  })
+  s := NewSock(h)
+  a := h.FindRequestHandler("crash").(BufferReqHandler)
+
+  _, err := a(s, "crash", []byte("1"))
+  if e, ok := err.(*RequestError); ok == false {
+    t.Fatalf("handler returned %v, expected a RequestError", err)
+  } else if !strings.Contains(e.Message(), "assignment to entry in nil map") || e.Data() != nil {
+    t.Errorf("handler returned (%q, %v)", e.Message(), e.Data())
+  }
+
+  HandlerPanicTrace = true
+  defer func() { HandlerPanicTrace = false }()
+  _, err = a(s, "crash", []byte("1"))
+  if stack, _ := err.(*RequestError).Data().(string); !strings.Contains(stack, "TestRequestFuncHandlerPanic") {
+    t.Errorf("error data %q does not contain a stack trace", stack)
+  }
+}
+
+
+func TestVerboseParamErrors(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("a", func(p struct{ N int }) error { return nil })
+  HandleTyped(h, "b", func(s Sock, p struct{ N int }) (int, error) { return p.N, nil })
+  s := NewSock(h)
+  for _, op := range []string{"a", "b"} {
+    a := h.FindRequestHandler(op)
+    call := func() error {
+      if f, ok := a.(BufferReqHandler); ok {
+        _, err := f(s, op, []byte(`{"n":"x"}`))
+        return err
+      }
+      _, err := a.(ctxReqHandler)(context.Background(), s, op, []byte(`{"n":"x"}`))
+      return err
+    }
+
+    // Generic by default
+    if err := call(); err == nil || err.Error() != "unexpected parameter type" {
+      t.Errorf("%s: handler returned %v, expected \"unexpected parameter type\"", op, err)
+    }
+
+    VerboseParamErrors = true
+    err := call()
+    VerboseParamErrors = false
+    if err == nil || !strings.HasPrefix(err.Error(), "unexpected parameter type: ") ||
+       !strings.Contains(err.Error(), "field .n") || !errors.Is(err, errUnexpectedParamType) {
+      t.Errorf("%s: handler returned %v, expected the field of the JSON error", op, err)
+    }
+  }
+}
+
+
+func TestRequestFuncHandlersRawBytes(t *testing.T) {
+  h := NewHandlers()
+  defer recoverAsFail(t)
+  h.HandleRequest("a", func() (RawBytes, error) {
+    return RawBytes(`{"cached":true}`), nil
+  })
+  h.HandleRequest("b", func(p int) (interface{}, error) {
+    if p == 0 {
+      return RawBytes("raw"), nil
+    }
+    return []byte("raw"), nil
+  })
+  s := NewSock(h)
+  checkReqHandler(t, s, h, "a", "", `{"cached":true}`)
+  checkReqHandler(t, s, h, "b", "0", "raw")
+  checkReqHandler(t, s, h, "b", "1", `"cmF3"`)  // other byte slices are encoded
+}
+
+
+func TestRequestHandlerKind(t *testing.T) {
+  h := NewHandlers()
+  h.HandleBufferRequest("buf", func(_ Sock, _ string, b []byte) ([]byte, error) {
+    return b, nil
+  })
+  h.HandleRequest("ctx", func(ctx context.Context, s string) (string, error) {
+    return s, ctx.Err()
+  })
+  h.HandleStreamRequest("stream", func(Sock, string, chan []byte, StreamWriter) error {
+    return nil
+  })
+
+  for _, c := range []struct{ op string; kind HandlerKind }{
+    {"buf", HandlerKindBuffer},
+    {"ctx", HandlerKindBuffer},
+    {"stream", HandlerKindStream},
+    {"missing", HandlerKindNone},
+  } {
+    if k := h.RequestHandlerKind(c.op); k != c.kind {
+      t.Errorf("RequestHandlerKind(%q) => %v, expected %v", c.op, k, c.kind)
+    }
+    if a := h.FindBufferRequestHandler(c.op); (a != nil) != (c.kind == HandlerKindBuffer) {
+      t.Errorf("FindBufferRequestHandler(%q) => %v", c.op, a != nil)
+    }
+    if a := h.FindStreamRequestHandler(c.op); (a != nil) != (c.kind == HandlerKindStream) {
+      t.Errorf("FindStreamRequestHandler(%q) => %v", c.op, a != nil)
+    }
+  }
+
+  // Handlers taking a context can be called through FindBufferRequestHandler
+  if out, err := h.FindBufferRequestHandler("ctx")(nil, "ctx", []byte(`"hi"`)); err != nil ||
+     string(out) != `"hi"` {
+    t.Errorf("handler returned (%s, %v), expected (\"hi\", nil)", out, err)
+  }
+
+  // The fallback handler applies to any op
+  h.HandleStreamRequest("", func(Sock, string, chan []byte, StreamWriter) error { return nil })
+  if k := h.RequestHandlerKind("missing"); k != HandlerKindStream {
+    t.Errorf("RequestHandlerKind(\"missing\") => %v, expected %v", k, HandlerKindStream)
+  }
+}
+
+
+func TestHandleRequestPrefix(t *testing.T) {
+  h := NewHandlers()
+  handler := func(name string) func(Sock, string, interface{}) (string, error) {
+    return func(_ Sock, op string, _ interface{}) (string, error) {
+      return name + ":" + op, nil
+    }
+  }
+  h.HandleRequestPrefix("user/", handler("user"))
+  h.HandleRequestPrefix("user/admin/", handler("admin"))
+  h.HandleRequest("user/me", handler("me"))
+  h.HandleRequest("", handler("fallback"))
+  s := NewSock(h)
+
+  for _, c := range []struct{ op, expected string }{
+    {"user/create", `"user:user/create"`},
+    {"user/admin/delete", `"admin:user/admin/delete"`},
+    {"user/me", `"me:user/me"`},
+    {"users", `"fallback:users"`},
+  } {
+    out, err := h.FindBufferRequestHandler(c.op)(s, c.op, []byte("null"))
+    if err != nil || string(out) != c.expected {
+      t.Errorf("handler of %q returned (%s, %v), expected %s", c.op, out, err, c.expected)
+    }
+  }
+
+  // Registering a prefix again replaces its handler
+  h.HandleRequestPrefix("user/", handler("user2"))
+  if out, _ := h.FindBufferRequestHandler("user/x")(s, "user/x", []byte("null")); string(out) != `"user2:user/x"` {
+    t.Errorf("handler returned %s after replacing it", out)
+  }
+  if k := h.RequestHandlerKind("user/x"); k != HandlerKindBuffer {
+    t.Errorf("RequestHandlerKind(\"user/x\") => %v, expected %v", k, HandlerKindBuffer)
+  }
+}
+
+
+func TestHandlerNames(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("b", func() error { return nil })
+  h.HandleRequest("a", func() error { return nil })
+  h.HandleRequest("", func() error { return nil })
+  h.HandleNotification("z", func(interface{}) {})
+  h.HandleNotification("", func(interface{}) {})
+
+  if names := h.OperationNames(); strings.Join(names, ",") != "a,b" {
+    t.Errorf("OperationNames() => %v, expected [a b]", names)
+  }
+  if names := h.NotificationNames(); strings.Join(names, ",") != "z" {
+    t.Errorf("NotificationNames() => %v, expected [z]", names)
+  }
+}
+
+
+func TestRemoveHandlers(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("a", func() error { return nil })
+  h.HandleRequest("", func() error { return nil })
+  h.HandleNotification("n", func(interface{}) {})
+
+  if !h.RemoveRequestHandler("a") || h.RemoveRequestHandler("a") {
+    t.Errorf("RemoveRequestHandler(\"a\") should succeed once")
+  }
+  if h.FindRequestHandler("a") == nil {
+    t.Errorf("fallback handler not used after removing handler")
+  }
+  if !h.RemoveRequestHandler("") || h.FindRequestHandler("a") != nil {
+    t.Errorf("RemoveRequestHandler(\"\") did not remove the fallback handler")
+  }
+  if h.RemoveRequestHandler("") {
+    t.Errorf("RemoveRequestHandler(\"\") => true without a fallback handler")
+  }
+  if !h.RemoveNotificationHandler("n") || h.FindNotificationHandler("n") != nil {
+    t.Errorf("RemoveNotificationHandler(\"n\") did not remove the handler")
+  }
+  if h.RemoveNotificationHandler("") {
+    t.Errorf("RemoveNotificationHandler(\"\") => true without a fallback handler")
+  }
+}
+
+
+func TestRequestFuncHandlersParamsReuse(t *testing.T) {
+  h := NewHandlers()
+  var kept []int
+  h.HandleRequest("op", func(p reuseParams) (int, error) {
+    if kept == nil {
+      kept = p.L
+    }
+    return p.A + len(p.L), nil
+  })
+  s := NewSock(h)
+  checkReqHandler(t,s,h, "op", `{"a":1,"l":[1,2]}`, "3")
+  // Parameters decoded later start out zero and don't share memory with earlier ones
+  checkReqHandler(t,s,h, "op", `{}`, "0")
+  checkReqHandler(t,s,h, "op", `{"l":[9,9]}`, "2")
+  if len(kept) != 2 || kept[0] != 1 || kept[1] != 2 {
+    t.Errorf("parameters kept by handler changed to %v", kept)
+  }
+}
+
+type reuseParams struct {
+  A int   `json:"a"`
+  L []int `json:"l"`
+}
+
+
+type benchParams struct {
+  A int    `json:"a"`
+  B string `json:"b"`
+}
+
+func BenchmarkFuncReqHandler(b *testing.B) {
+  h := NewHandlers()
+  h.HandleRequest("op", func(s Sock, p benchParams) (int, error) { return p.A, nil })
+  s := NewSock(h)
+  handler := h.FindRequestHandler("op").(BufferReqHandler)
+  inbuf := []byte(`{"a":1,"b":"x"}`)
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    if _, err := handler(s, "op", inbuf); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
+
+func BenchmarkFuncReqHandlerContext(b *testing.B) {
+  h := NewHandlers()
+  h.HandleRequest("op", func(ctx context.Context, s Sock, op string, p *benchParams) (int, error) {
+    return p.A, nil
+  })
+  s := NewSock(h)
+  handler := h.FindRequestHandler("op").(ctxReqHandler)
+  inbuf := []byte(`{"a":1,"b":"x"}`)
+  ctx := context.Background()
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    if _, err := handler(ctx, s, "op", inbuf); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
@@ -0,0 +1,103 @@
+package gotalk
+
+import (
+  "context"
+  "errors"
+  "io"
+  "net/http"
+  "strings"
+)
+
+// Largest request body accepted by HTTPHandler
+const maxHTTPBodySize = 32 << 20
+
+// Handler that can be used with the http package, exposing the request handlers of `h` as
+// endpoints: `POST /op/{name}` calls the handler of operation `name` with the request body as
+// its payload, which func handlers decode as JSON, and responds with the result. If `h` is nil,
+// DefaultHandlers is used.
+//
+// Errors are sent like error results, with the status of any StatusError, 400 for parameters
+// which can't be decoded and ErrCodeInvalidParams, 429 for ErrCodeRateLimited, 503 for ErrCodeOverloaded and
+// ErrCodeGoingAway, 504 for ErrCodeTimeout, and otherwise 500. Unknown operations respond with 404, and streaming
+// operations with 501 as they aren't supported over HTTP. Handlers receive a socket which isn't
+// connected, so sending requests or notifications from it fails. Limits set with
+// Handlers, like SetOpLimit and SetRateLimit, don't apply.
+func HTTPHandler(h Handlers) http.Handler {
+  if h == nil {
+    h = DefaultHandlers
+  }
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    op := strings.TrimPrefix(r.URL.Path, "/op/")
+    if op == r.URL.Path || op == "" {
+      http.NotFound(w, r)
+      return
+    }
+    if r.Method != http.MethodPost {
+      w.Header().Set("Allow", http.MethodPost)
+      http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+      return
+    }
+
+    var handler ctxReqHandler
+    switch a := h.FindRequestHandler(op).(type) {
+    case ctxReqHandler:
+      handler = a
+    case BufferReqHandler:
+      handler = func(_ context.Context, s Sock, op string, b []byte) ([]byte, error) {
+        return a(s, op, b)
+      }
+    case StreamReqHandler:
+      http.Error(w, "streaming request not supported", http.StatusNotImplemented)
+      return
+    default:
+      http.Error(w, "unknown operation \""+op+"\"", http.StatusNotFound)
+      return
+    }
+
+    inbuf, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHTTPBodySize))
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+      return
+    }
+    outbuf, err := handler(r.Context(), NewSock(h), op, inbuf)
+    if err != nil {
+      writeHTTPError(w, err)
+      return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(outbuf)
+  })
+}
+
+func writeHTTPError(w http.ResponseWriter, err error) {
+  b := encodeError(err)
+  if len(b) != 0 && b[0] == '{' {
+    w.Header().Set("Content-Type", "application/json")
+  } else {
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+  }
+  w.WriteHeader(httpErrorStatus(err))
+  w.Write(b)
+}
+
+// Returns the HTTP status of a handler error
+func httpErrorStatus(err error) int {
+  if errors.Is(err, errUnexpectedParamType) {
+    return http.StatusBadRequest
+  }
+  if _, ok := err.(*StatusError); !ok {
+    if e, ok := err.(*RequestError); ok && e.status == 0 {
+      switch e.code {
+      case ErrCodeInvalidParams:
+        return http.StatusBadRequest
+      case ErrCodeRateLimited:
+        return http.StatusTooManyRequests
+      case ErrCodeOverloaded, ErrCodeGoingAway:
+        return http.StatusServiceUnavailable
+      case ErrCodeTimeout:
+        return http.StatusGatewayTimeout
+      }
+    }
+  }
+  return ErrorStatus(err)
+}
@@ -0,0 +1,62 @@
+package gotalk
+
+import (
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+func TestHTTPHandler(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("greet", func(p struct{ Name string }) (string, error) {
+    return "Hello " + p.Name, nil
+  })
+  h.HandleBufferRequest("echo", func(s Sock, op string, b []byte) ([]byte, error) {
+    return b, nil
+  })
+  h.HandleRequest("missing", func() error {
+    return &StatusError{Code: 404, Msg: "no such thing"}
+  })
+  h.HandleRequest("busy", func() error {
+    return Errorf(ErrCodeOverloaded, "busy")
+  })
+  h.HandleRequest("notify", func(s Sock) error {
+    return s.Notify("hello", nil)
+  })
+  h.HandleStreamRequest("upload", func(Sock, string, chan []byte, StreamWriter) error {
+    return nil
+  })
+  srv := httptest.NewServer(HTTPHandler(h))
+  defer srv.Close()
+
+  for _, test := range []struct {
+    method, path, body string
+    status             int
+    expected           string
+  }{
+    {"POST", "/op/greet", `{"name":"Bob"}`, 200, `"Hello Bob"`},
+    {"POST", "/op/echo", "raw", 200, "raw"},
+    {"POST", "/op/greet", `[1]`, 400, ""},
+    {"POST", "/op/missing", "", 404, `{"code":0,"message":"no such thing","status":404}`},
+    {"POST", "/op/busy", "", 503, `{"code":1,"message":"busy"}`},
+    {"POST", "/op/notify", "", 500, "socket is not connected"},
+    {"POST", "/op/upload", "", 501, ""},
+    {"POST", "/op/nonexistent", "", 404, ""},
+    {"POST", "/greet", "", 404, ""},
+    {"GET", "/op/greet", "", 405, ""},
+  } {
+    req, _ := http.NewRequest(test.method, srv.URL + test.path, strings.NewReader(test.body))
+    res, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatal(err)
+    }
+    body, _ := io.ReadAll(res.Body)
+    res.Body.Close()
+    if res.StatusCode != test.status || (test.expected != "" && string(body) != test.expected) {
+      t.Errorf("%s %s => %d %q, expected %d %q",
+        test.method, test.path, res.StatusCode, body, test.status, test.expected)
+    }
+  }
+}
@@ -0,0 +1,164 @@
+package gotalk
+
+import (
+  "context"
+  "sync"
+  "time"
+)
+
+// Request metadata key carrying the idempotency key of requests made with RequestIdempotent
+const IdempotencyKeyMeta = "idempotency-key"
+
+// Attempts made by RequestIdempotent, and the delay before the first retry, which doubles with
+// each retry
+const (
+  idempotentAttempts   = 4
+  idempotentRetryDelay = 50*time.Millisecond
+)
+
+// Results of requests by operation and idempotency key, kept for a limited time
+type idempotencyCache struct {
+  mu      sync.Mutex
+  maxKeys int
+  ttl     time.Duration
+  entries map[string]*idempotentResult
+  order   []idempotentEntry  // oldest first
+}
+
+type idempotentEntry struct {
+  key string
+  r   *idempotentResult
+}
+
+type idempotentResult struct {
+  done    chan struct{}  // closed once outbuf and err are set
+  outbuf  []byte
+  err     error
+  expires time.Time
+}
+
+func newIdempotencyCache(maxKeys int, ttl time.Duration) *idempotencyCache {
+  return &idempotencyCache{maxKeys:maxKeys, ttl:ttl, entries:make(map[string]*idempotentResult)}
+}
+
+// Returns the result of the request for `op` with idempotency key `key` if there was one,
+// waiting for it if it's still being handled, or else the result of `run`, which is kept unless
+// `run` says it's not to be reused, e.g. because the handler timed out
+func (c *idempotencyCache) do(op, key string, run func() ([]byte, error, bool)) ([]byte, error) {
+  k := op + "\x00" + key
+  c.mu.Lock()
+  now := time.Now()
+  c.pruneLocked(now, 0)
+  if r := c.entries[k]; r != nil {
+    c.mu.Unlock()
+    <-r.done
+    return r.outbuf, r.err
+  }
+  c.pruneLocked(now, 1)
+  r := &idempotentResult{done:make(chan struct{}), expires:now.Add(c.ttl)}
+  c.entries[k] = r
+  c.order = append(c.order, idempotentEntry{k, r})
+  c.mu.Unlock()
+
+  outbuf, err, keep := run()
+  // The result might be (part of) the payload of the request, which is reused
+  r.outbuf, r.err = append([]byte(nil), outbuf...), err
+  close(r.done)
+  if !keep {
+    c.mu.Lock()
+    if c.entries[k] == r {
+      delete(c.entries, k)
+    }
+    for i := len(c.order) - 1; i >= 0; i-- {
+      if c.order[i].r == r {
+        c.order = append(c.order[:i], c.order[i+1:]...)
+        break
+      }
+    }
+    c.mu.Unlock()
+  }
+  return outbuf, err
+}
+
+// Removes expired results, and the oldest ones to make room for `room` more
+func (c *idempotencyCache) pruneLocked(now time.Time, room int) {
+  n := 0
+  for ; n < len(c.order); n++ {
+    e := c.order[n]
+    if len(c.order) - n + room <= c.maxKeys && now.Before(e.r.expires) {
+      break
+    }
+    if c.entries[e.key] == e.r {
+      delete(c.entries, e.key)
+    }
+  }
+  c.order = c.order[n:]
+}
+
+
+func (h *handlers) SetIdempotencyCache(maxKeys int, ttl time.Duration) {
+  h.idemMu.Lock()
+  defer h.idemMu.Unlock()
+  if maxKeys <= 0 || ttl <= 0 {
+    h.idem = nil
+  } else {
+    h.idem = newIdempotencyCache(maxKeys, ttl)
+  }
+}
+
+func (h *handlers) idempotencyCache() *idempotencyCache {
+  h.idemMu.RLock()
+  defer h.idemMu.RUnlock()
+  return h.idem
+}
+
+
+func (s *socket) RequestIdempotent(op string, in, out interface{}, key string) error {
+  return retryIdempotent(context.Background(), func() error {
+    return s.RequestWithMeta(op, in, out, map[string]string{IdempotencyKeyMeta: key})
+  })
+}
+
+// Like Sock.RequestIdempotent but also retries requests which failed because the connection
+// was lost, once it has been reestablished
+func (r *ReconnectingSock) RequestIdempotent(op string, in, out interface{}, key string) error {
+  return retryIdempotent(context.Background(), func() error {
+    s, err := r.current()
+    if err != nil {
+      return err
+    }
+    return r.mapErr(s.RequestWithMeta(op, in, out, map[string]string{IdempotencyKeyMeta: key}))
+  })
+}
+
+// Calls `f` until it succeeds, fails with an error which isn't transient, or has been called
+// idempotentAttempts times
+func retryIdempotent(ctx context.Context, f func() error) error {
+  delay := idempotentRetryDelay
+  for attempt := 1; ; attempt++ {
+    err := f()
+    if err == nil || attempt == idempotentAttempts || !isTransientErr(err) {
+      return err
+    }
+    select {
+    case <-ctx.Done():
+      return err
+    case <-time.After(delay):
+    }
+    delay *= 2
+  }
+}
+
+// True for errors of requests which might succeed if retried later
+func isTransientErr(err error) bool {
+  if err == ErrTimeout || err == ErrReconnecting {
+    return true
+  }
+  if e, ok := err.(*RequestError); ok {
+    switch e.Code() {
+    case ErrCodeOverloaded, ErrCodeGoingAway, ErrCodeRateLimited, ErrCodeTimeout:
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,117 @@
+package gotalk
+
+import (
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+
+func TestRequestIdempotent(t *testing.T) {
+  h := NewHandlers()
+  var calls int32
+  h.HandleRequest("create", func(name string) (string, error) {
+    n := atomic.AddInt32(&calls, 1)
+    if n == 1 {
+      return "", Errorf(ErrCodeOverloaded, "busy")
+    }
+    return name + "-" + string(rune('0' + n)), nil
+  })
+  h.SetIdempotencyCache(10, time.Minute)
+  s1, s2, err := PipeHandlers(NewHandlers(), h)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s1.Close()
+  defer s2.Close()
+
+  // The first attempt is refused as overloaded and retried
+  var out1, out2 string
+  if err := s1.RequestIdempotent("create", "a", &out1, "key1"); err != nil {
+    t.Fatalf("RequestIdempotent() failed: %v", err)
+  }
+  if err := s1.RequestIdempotent("create", "a", &out2, "key1"); err != nil || out2 != out1 {
+    t.Errorf("RequestIdempotent() => (%q, %v), expected the first result %q", out2, err, out1)
+  }
+  if n := atomic.LoadInt32(&calls); n != 2 {
+    t.Errorf("handler called %d times, expected 2", n)
+  }
+
+  // Other keys and requests without a key are handled
+  if err := s1.RequestIdempotent("create", "a", &out2, "key2"); err != nil || out2 == out1 {
+    t.Errorf("RequestIdempotent() => (%q, %v), expected a new result", out2, err)
+  }
+  if err := s1.Request("create", "a", &out2); err != nil {
+    t.Errorf("Request() failed: %v", err)
+  }
+  if n := atomic.LoadInt32(&calls); n != 4 {
+    t.Errorf("handler called %d times, expected 4", n)
+  }
+}
+
+
+func TestRequestIdempotentInFlight(t *testing.T) {
+  h := NewHandlers()
+  var calls int32
+  release := make(chan struct{})
+  h.HandleRequest("slow", func() (int, error) {
+    <-release
+    return int(atomic.AddInt32(&calls, 1)), nil
+  })
+  h.SetIdempotencyCache(10, time.Minute)
+
+  // A retry on another connection, e.g. after a reconnect, waits for the first request
+  var wg sync.WaitGroup
+  results := make([]int, 2)
+  for i := range results {
+    s1, s2, err := PipeHandlers(NewHandlers(), h)
+    if err != nil {
+      t.Fatal(err)
+    }
+    defer s1.Close()
+    defer s2.Close()
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      if err := s1.RequestIdempotent("slow", nil, &results[i], "key"); err != nil {
+        t.Errorf("RequestIdempotent() failed: %v", err)
+      }
+    }(i)
+  }
+  time.Sleep(20*time.Millisecond)
+  close(release)
+  wg.Wait()
+  if results[0] != 1 || results[1] != 1 {
+    t.Errorf("results %v, expected [1 1]", results)
+  }
+}
+
+
+func TestIdempotencyCacheLimit(t *testing.T) {
+  c := newIdempotencyCache(2, time.Minute)
+  calls := 0
+  run := func() ([]byte, error, bool) {
+    calls++
+    return []byte("x"), nil, true
+  }
+  for _, key := range []string{"a", "b", "c", "a"} {
+    c.do("op", key, run)
+  }
+  // "a" was evicted to make room for "c"
+  if calls != 4 {
+    t.Errorf("%d calls, expected 4", calls)
+  }
+  c.do("op", "c", run)
+  if calls != 4 {
+    t.Errorf("%d calls, expected the result of \"c\" to be remembered", calls)
+  }
+
+  c = newIdempotencyCache(10, time.Millisecond)
+  c.do("op", "a", run)
+  time.Sleep(5*time.Millisecond)
+  c.do("op", "a", run)
+  if calls != 6 {
+    t.Errorf("%d calls, expected the result to expire", calls)
+  }
+}
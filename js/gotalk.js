@@ -162,7 +162,13 @@ var MsgTypeSingleReq     = exports.MsgTypeSingleReq =     'r'.charCodeAt(0),
     MsgTypeSingleRes     = exports.MsgTypeSingleRes =     'R'.charCodeAt(0),
     MsgTypeStreamRes     = exports.MsgTypeStreamRes =     'S'.charCodeAt(0),
     MsgTypeErrorRes      = exports.MsgTypeErrorRes =      'E'.charCodeAt(0),
-    MsgTypeNotification  = exports.MsgTypeNotification =  'n'.charCodeAt(0);
+    MsgTypeNotification  = exports.MsgTypeNotification =  'n'.charCodeAt(0),
+    MsgTypeCancelReq     = exports.MsgTypeCancelReq =     'c'.charCodeAt(0),
+    MsgTypeGoingAway     = exports.MsgTypeGoingAway =     'g'.charCodeAt(0),
+    MsgTypeHeartbeat     = exports.MsgTypeHeartbeat =     'h'.charCodeAt(0);
+
+// ID of the result announcing the optional features of a peer, right after its version
+exports.FeaturesID = '--f';
 
 // ==============================================================================================
 // Binary (byte) protocol
@@ -199,12 +205,13 @@ exports.binary = {
     t = b[0];
     z = 1;
 
-    if (t !== MsgTypeNotification) {
+    if (t !== MsgTypeNotification && t !== MsgTypeGoingAway) {
       id = b.slice(z, z + 3);
       z += 3;
     }
 
-    if (t == MsgTypeSingleReq || t == MsgTypeStreamReq || t == MsgTypeNotification) {
+    if (t == MsgTypeSingleReq || t == MsgTypeStreamReq || t == MsgTypeNotification ||
+        t == MsgTypeGoingAway) {
       namez = parseInt(b.slice(z, z + 3), 16);
       z += 3;
       name = b.slice(z, z+namez).toString();
@@ -213,6 +220,11 @@ exports.binary = {
 
     size = parseInt(b.slice(z, z + 8), 16);
 
+    if (t == MsgTypeHeartbeat) {
+      // Heartbeats have no payload; the id is the load and the size the time
+      return {t:t, load:parseInt(id, 16), time:new Date(size * 1000), size:0};
+    }
+
     return {t:t, id:id, name:name, size:size};
   },
 
@@ -288,17 +300,23 @@ exports.text = {
     t = s.charCodeAt(0);
     z = 1;
 
-    if (t !== MsgTypeNotification) {
+    if (t !== MsgTypeNotification && t !== MsgTypeGoingAway) {
       id = s.substr(z, 3);
       z += 3;
     }
 
-    if (t == MsgTypeSingleReq || t == MsgTypeStreamReq || t == MsgTypeNotification) {
+    if (t == MsgTypeSingleReq || t == MsgTypeStreamReq || t == MsgTypeNotification ||
+        t == MsgTypeGoingAway) {
       name = s.substring(z + 3, s.length - 8);
     }
 
     size = parseInt(s.substr(s.length - 8), 16);
 
+    if (t == MsgTypeHeartbeat) {
+      // Heartbeats have no payload; the id is the load and the size the time
+      return {t:t, load:parseInt(id, 16), time:new Date(size * 1000), size:0};
+    }
+
     return {t:t, id:id, name:name, size:size};
   },
 
@@ -500,6 +518,8 @@ Sock.prototype.adoptWebSocket = function(ws) {
 
 Sock.prototype.handshake = function () {
   this.ws.send(this.protocol.versionBuf);
+  // Announce the optional message types we read, which are only sent to peers announcing them
+  this.sendMsg(protocol.MsgTypeSingleRes, protocol.FeaturesID, null, 'cancel goaway');
 };
 
 
@@ -641,6 +661,20 @@ msgHandlers[protocol.MsgTypeNotification] = function (msg, payload) {
   }
 };
 
+msgHandlers[protocol.MsgTypeCancelReq] = function (msg, payload) {
+  // Handlers can't be interrupted, so just let the request complete. The requestor ignores
+  // any result of a cancelled request.
+};
+
+msgHandlers[protocol.MsgTypeGoingAway] = function (msg, payload) {
+  // The other side is about to close the connection, e.g. because the server is shutting down
+  this.emit('goingaway', msg.name);
+};
+
+msgHandlers[protocol.MsgTypeHeartbeat] = function (msg, payload) {
+  this.emit('heartbeat', {load:msg.load, time:msg.time});
+};
+
 // ===============================================================================================
 // Sending messages
 
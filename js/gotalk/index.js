@@ -71,6 +71,8 @@ Sock.prototype.adoptWebSocket = function(ws) {
 
 Sock.prototype.handshake = function () {
   this.ws.send(this.protocol.versionBuf);
+  // Announce the optional message types we read, which are only sent to peers announcing them
+  this.sendMsg(protocol.MsgTypeSingleRes, protocol.FeaturesID, null, 'cancel goaway');
 };
 
 
@@ -212,6 +214,20 @@ msgHandlers[protocol.MsgTypeNotification] = function (msg, payload) {
   }
 };
 
+msgHandlers[protocol.MsgTypeCancelReq] = function (msg, payload) {
+  // Handlers can't be interrupted, so just let the request complete. The requestor ignores
+  // any result of a cancelled request.
+};
+
+msgHandlers[protocol.MsgTypeGoingAway] = function (msg, payload) {
+  // The other side is about to close the connection, e.g. because the server is shutting down
+  this.emit('goingaway', msg.name);
+};
+
+msgHandlers[protocol.MsgTypeHeartbeat] = function (msg, payload) {
+  this.emit('heartbeat', {load:msg.load, time:msg.time});
+};
+
 // ===============================================================================================
 // Sending messages
 
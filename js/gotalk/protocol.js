@@ -12,7 +12,13 @@ var MsgTypeSingleReq     = exports.MsgTypeSingleReq =     'r'.charCodeAt(0),
     MsgTypeSingleRes     = exports.MsgTypeSingleRes =     'R'.charCodeAt(0),
     MsgTypeStreamRes     = exports.MsgTypeStreamRes =     'S'.charCodeAt(0),
     MsgTypeErrorRes      = exports.MsgTypeErrorRes =      'E'.charCodeAt(0),
-    MsgTypeNotification  = exports.MsgTypeNotification =  'n'.charCodeAt(0);
+    MsgTypeNotification  = exports.MsgTypeNotification =  'n'.charCodeAt(0),
+    MsgTypeCancelReq     = exports.MsgTypeCancelReq =     'c'.charCodeAt(0),
+    MsgTypeGoingAway     = exports.MsgTypeGoingAway =     'g'.charCodeAt(0),
+    MsgTypeHeartbeat     = exports.MsgTypeHeartbeat =     'h'.charCodeAt(0);
+
+// ID of the result announcing the optional features of a peer, right after its version
+exports.FeaturesID = '--f';
 
 // ==============================================================================================
 // Binary (byte) protocol
@@ -49,12 +55,13 @@ exports.binary = {
     t = b[0];
     z = 1;
 
-    if (t !== MsgTypeNotification) {
+    if (t !== MsgTypeNotification && t !== MsgTypeGoingAway) {
       id = b.slice(z, z + 3);
       z += 3;
     }
 
-    if (t == MsgTypeSingleReq || t == MsgTypeStreamReq || t == MsgTypeNotification) {
+    if (t == MsgTypeSingleReq || t == MsgTypeStreamReq || t == MsgTypeNotification ||
+        t == MsgTypeGoingAway) {
       namez = parseInt(b.slice(z, z + 3), 16);
       z += 3;
       name = b.slice(z, z+namez).toString();
@@ -63,6 +70,11 @@ exports.binary = {
 
     size = parseInt(b.slice(z, z + 8), 16);
 
+    if (t == MsgTypeHeartbeat) {
+      // Heartbeats have no payload; the id is the load and the size the time
+      return {t:t, load:parseInt(id, 16), time:new Date(size * 1000), size:0};
+    }
+
     return {t:t, id:id, name:name, size:size};
   },
 
@@ -138,17 +150,23 @@ exports.text = {
     t = s.charCodeAt(0);
     z = 1;
 
-    if (t !== MsgTypeNotification) {
+    if (t !== MsgTypeNotification && t !== MsgTypeGoingAway) {
       id = s.substr(z, 3);
       z += 3;
     }
 
-    if (t == MsgTypeSingleReq || t == MsgTypeStreamReq || t == MsgTypeNotification) {
+    if (t == MsgTypeSingleReq || t == MsgTypeStreamReq || t == MsgTypeNotification ||
+        t == MsgTypeGoingAway) {
       name = s.substring(z + 3, s.length - 8);
     }
 
     size = parseInt(s.substr(s.length - 8), 16);
 
+    if (t == MsgTypeHeartbeat) {
+      // Heartbeats have no payload; the id is the load and the size the time
+      return {t:t, load:parseInt(id, 16), time:new Date(size * 1000), size:0};
+    }
+
     return {t:t, id:id, name:name, size:size};
   },
 
@@ -0,0 +1,155 @@
+package gotalk
+
+import (
+  "math/bits"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// Latency of the request handlers of an operation, as returned by Handlers.LatencyStats.
+// Percentiles are approximate, within 1/8 of the actual value.
+type OpLatency struct {
+  Count uint64
+  Sum   time.Duration
+  Min   time.Duration
+  Max   time.Duration
+  P50   time.Duration
+  P90   time.Duration
+  P99   time.Duration
+}
+
+// Buckets of the latency histogram. Each power of two is split into 1<<latencySubBits buckets.
+const (
+  latencySubBits = 3
+  latencyBuckets = (64 - latencySubBits + 1) << latencySubBits
+)
+
+type opLatency struct {
+  mu     sync.Mutex
+  count  uint64
+  sum    time.Duration
+  min    time.Duration
+  max    time.Duration
+  counts [latencyBuckets]uint64
+}
+
+func latencyBucket(d time.Duration) int {
+  v := uint64(d)
+  if v < 1<<latencySubBits {
+    return int(v)
+  }
+  exp := bits.Len64(v) - latencySubBits  // >= 1
+  return exp<<latencySubBits | int(v>>uint(exp-1)) & (1<<latencySubBits - 1)
+}
+
+// Returns the largest duration falling into bucket `i`
+func latencyBucketMax(i int) time.Duration {
+  if i < 1<<latencySubBits {
+    return time.Duration(i)
+  }
+  exp := uint(i >> latencySubBits)
+  sub := uint64(i & (1<<latencySubBits - 1))
+  return time.Duration(((1<<latencySubBits | sub) + 1) << (exp - 1) - 1)
+}
+
+func (l *opLatency) record(d time.Duration) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  if l.count == 0 || d < l.min {
+    l.min = d
+  }
+  if d > l.max {
+    l.max = d
+  }
+  l.count++
+  l.sum += d
+  l.counts[latencyBucket(d)]++
+}
+
+func (l *opLatency) snapshot() OpLatency {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  return OpLatency{
+    Count: l.count,
+    Sum:   l.sum,
+    Min:   l.min,
+    Max:   l.max,
+    P50:   l.percentile(0.5),
+    P90:   l.percentile(0.9),
+    P99:   l.percentile(0.99),
+  }
+}
+
+func (l *opLatency) percentile(p float64) time.Duration {
+  rank := uint64(p * float64(l.count) + 0.5)
+  if rank == 0 {
+    rank = 1
+  }
+  var n uint64
+  for i, c := range l.counts {
+    n += c
+    if n >= rank {
+      d := latencyBucketMax(i)
+      if d > l.max {
+        d = l.max
+      }
+      if d < l.min {
+        d = l.min
+      }
+      return d
+    }
+  }
+  return l.max
+}
+
+// -------------------------------------------------------------------------------------
+
+func (h *handlers) EnableLatencyStats(enable bool) {
+  var v int32
+  if enable {
+    v = 1
+  }
+  atomic.StoreInt32(&h.latencyEnabled, v)
+}
+
+func (h *handlers) LatencyStats() map[string]OpLatency {
+  h.latencyMu.RLock()
+  defer h.latencyMu.RUnlock()
+  m := make(map[string]OpLatency, len(h.latency))
+  for op, l := range h.latency {
+    m[op] = l.snapshot()
+  }
+  return m
+}
+
+// Returns the latency stats of `op` to be updated, or nil if latency stats are disabled
+func (h *handlers) opLatency(op string) *opLatency {
+  if atomic.LoadInt32(&h.latencyEnabled) == 0 {
+    return nil
+  }
+  h.latencyMu.RLock()
+  l := h.latency[op]
+  h.latencyMu.RUnlock()
+  if l != nil {
+    return l
+  }
+  h.latencyMu.Lock()
+  defer h.latencyMu.Unlock()
+  if l = h.latency[op]; l == nil {
+    if h.latency == nil {
+      h.latency = make(map[string]*opLatency)
+    }
+    l = &opLatency{}
+    h.latency[op] = l
+  }
+  return l
+}
+
+// Returns the latency stats of `op` to be updated, or nil if not timing handlers
+func (s *socket) opLatency(op string) *opLatency {
+  if h, ok := s.handlers.(*handlers); ok {
+    return h.opLatency(op)
+  }
+  return nil
+}
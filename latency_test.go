@@ -0,0 +1,69 @@
+package gotalk
+
+import (
+  "testing"
+  "time"
+)
+
+func TestLatencyBuckets(t *testing.T) {
+  for _, d := range []time.Duration{0, 1, 7, 8, 9, 15, 16, 17, 1000, time.Millisecond, time.Hour} {
+    i := latencyBucket(d)
+    max := latencyBucketMax(i)
+    if max < d || latencyBucket(max) != i || latencyBucket(max+1) != i+1 {
+      t.Errorf("latencyBucket(%d) = %d with max %d", d, i, max)
+    }
+    if d >= 8 && max - d > d/8 {
+      t.Errorf("bucket max %d of %d is off by more than 1/8", max, d)
+    }
+  }
+}
+
+
+func TestLatencyStats(t *testing.T) {
+  var l opLatency
+  for i := 1; i <= 100; i++ {
+    l.record(time.Duration(i) * time.Millisecond)
+  }
+  st := l.snapshot()
+  if st.Count != 100 || st.Sum != 5050*time.Millisecond ||
+     st.Min != time.Millisecond || st.Max != 100*time.Millisecond {
+    t.Errorf("stats = %+v, expected count 100, sum 5.05s, min 1ms, max 100ms", st)
+  }
+  for _, p := range []struct{ got, expected time.Duration }{
+    {st.P50, 50*time.Millisecond},
+    {st.P90, 90*time.Millisecond},
+    {st.P99, 99*time.Millisecond},
+  } {
+    if p.got < p.expected || p.got > p.expected + p.expected/8 {
+      t.Errorf("percentile = %v, expected about %v", p.got, p.expected)
+    }
+  }
+}
+
+
+func TestEnableLatencyStats(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("work", func() error {
+    time.Sleep(time.Millisecond)
+    return nil
+  })
+  _, c := pipeRaw(t, h)
+  defer c.Close()
+
+  // Disabled by default
+  c.Write(MakeMsg(MsgTypeSingleReq, "001", "work", 0))
+  readRawMsg(t, c)
+  if st := h.LatencyStats(); len(st) != 0 {
+    t.Errorf("LatencyStats = %+v while disabled", st)
+  }
+
+  h.EnableLatencyStats(true)
+  c.Write(MakeMsg(MsgTypeSingleReq, "002", "work", 0))
+  readRawMsg(t, c)
+  c.Write(MakeMsg(MsgTypeSingleReq, "003", "work", 0))
+  readRawMsg(t, c)
+  st := h.LatencyStats()["work"]
+  if st.Count != 2 || st.Min < time.Millisecond || st.Max < st.Min || st.Sum < st.Min + st.Max {
+    t.Errorf("LatencyStats()[\"work\"] = %+v, expected two timed requests", st)
+  }
+}
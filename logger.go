@@ -0,0 +1,50 @@
+package gotalk
+
+import (
+  "fmt"
+  "log"
+)
+
+// Receives messages about errors and other events of sockets and servers, like failures to
+// parse messages from the peer, handler panics and notifications without handlers.
+type Logger interface {
+  Errorf(format string, args ...interface{})
+  Debugf(format string, args ...interface{})
+}
+
+// Logger which discards all messages. Used by sockets and servers unless another logger is set.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+
+// Returns a Logger writing to `l`, or to the standard logger of the "log" package if `l` is nil.
+// Debug messages are only written if `debug` is true.
+func NewStdLogger(l *log.Logger, debug bool) Logger {
+  return &stdLogger{l, debug}
+}
+
+type stdLogger struct {
+  l     *log.Logger
+  debug bool
+}
+
+func (l *stdLogger) Errorf(format string, args ...interface{}) {
+  l.output("gotalk: " + fmt.Sprintf(format, args...))
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) {
+  if l.debug {
+    l.output("gotalk [debug]: " + fmt.Sprintf(format, args...))
+  }
+}
+
+func (l *stdLogger) output(s string) {
+  if l.l != nil {
+    l.l.Output(3, s)
+  } else {
+    log.Output(3, s)
+  }
+}
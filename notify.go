@@ -0,0 +1,216 @@
+package gotalk
+
+import (
+  "sync"
+  "sync/atomic"
+)
+
+// What to do when a notification is sent while the notification queue of a socket is full.
+// See Sock.SetNotifyQueueSize
+type NotifyQueuePolicy int
+
+const (
+  // Wait for the queue to have room for the notification (the default.) No notifications are
+  // dropped, unless the socket closes.
+  BlockPolicy = NotifyQueuePolicy(iota)
+
+  // Drop the oldest notification in the queue to make room for the new one, making sure
+  // the most recent notifications are delivered.
+  DropOldestPolicy
+
+  // Drop the new notification, making sure notifications already queued are delivered
+  DropNewestPolicy
+)
+
+// Notifications waiting to be written to the connection of a socket
+type notifyQueue struct {
+  abytes   int64      // nbytes, accessed atomically so it can be read without locking; kept
+                      // first for alignment
+  mu       sync.Mutex
+  cond     sync.Cond  // signalled when notifications are added or removed, or when closed
+  notes    []queuedNote
+  nbytes   int        // payload bytes of notes
+  nnotes   int32      // len(notes), accessed atomically so it can be read without locking
+  size     int        // zero when notifications are written directly
+  policy   NotifyQueuePolicy
+  dropFunc func(name string, buf []byte)
+  writing  bool       // true once the goroutine writing notifications has been started
+  closed   bool
+  stats    *sockStats
+}
+
+func newNotifyQueue(stats *sockStats) *notifyQueue {
+  q := &notifyQueue{stats:stats}
+  q.cond.L = &q.mu
+  return q
+}
+
+// Add a notification to the queue according to the policy of the queue. Returns false if the
+// queue is disabled, in which case the caller should write the notification itself, or
+// ErrSockClosed if the queue is closed before the notification was added.
+func (q *notifyQueue) push(name string, buf []byte) (bool, error) {
+  q.mu.Lock()
+  if q.size == 0 {
+    q.mu.Unlock()
+    return false, nil
+  }
+  if q.policy == BlockPolicy {
+    for q.size != 0 && len(q.notes) >= q.size && !q.closed {
+      q.cond.Wait()
+    }
+  }
+  if q.closed {
+    q.mu.Unlock()
+    return true, ErrSockClosed
+  }
+  n := queuedNote{name, buf}
+  var dropped []queuedNote
+  if q.size != 0 && len(q.notes) >= q.size {
+    if q.policy == DropNewestPolicy {
+      dropped = append(dropped, n)
+    } else {
+      k := len(q.notes) - q.size + 1
+      dropped = append(dropped, q.notes[:k]...)
+      for _, d := range q.notes[:k] {
+        q.nbytes -= len(d.buf)
+      }
+      q.notes = append(q.notes[:0], q.notes[k:]...)
+    }
+  }
+  if len(dropped) == 0 || q.policy != DropNewestPolicy {
+    q.notes = append(q.notes, n)
+    q.nbytes += len(buf)
+    q.cond.Broadcast()
+  }
+  q.storeLenLocked()
+  dropFunc := q.dropFunc
+  q.mu.Unlock()
+  q.drop(dropFunc, dropped)
+  return true, nil
+}
+
+// Wait for a notification to be queued. Returns false if the queue has been closed.
+func (q *notifyQueue) wait() bool {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  for len(q.notes) == 0 && !q.closed {
+    q.cond.Wait()
+  }
+  return !q.closed
+}
+
+// Remove the oldest notification from the queue
+func (q *notifyQueue) pop() (queuedNote, bool) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if len(q.notes) == 0 || q.closed {
+    return queuedNote{}, false
+  }
+  n := q.notes[0]
+  q.notes[0] = queuedNote{}
+  q.notes = q.notes[1:]
+  q.nbytes -= len(n.buf)
+  q.storeLenLocked()
+  q.cond.Broadcast()
+  return n, true
+}
+
+// Publishes the number and size of notifications in the queue. mu must be held.
+func (q *notifyQueue) storeLenLocked() {
+  atomic.StoreInt32(&q.nnotes, int32(len(q.notes)))
+  atomic.StoreInt64(&q.abytes, int64(q.nbytes))
+}
+
+// Number of notifications in the queue. Doesn't lock.
+func (q *notifyQueue) len() int {
+  return int(atomic.LoadInt32(&q.nnotes))
+}
+
+// Payload bytes of the notifications in the queue. Doesn't lock.
+func (q *notifyQueue) bytes() int {
+  return int(atomic.LoadInt64(&q.abytes))
+}
+
+// Close the queue, dropping any notifications in it
+func (q *notifyQueue) close() {
+  q.mu.Lock()
+  if q.closed {
+    q.mu.Unlock()
+    return
+  }
+  q.closed = true
+  notes := q.notes
+  q.notes = nil
+  q.nbytes = 0
+  q.storeLenLocked()
+  dropFunc := q.dropFunc
+  q.cond.Broadcast()
+  q.mu.Unlock()
+  q.drop(dropFunc, notes)
+}
+
+func (q *notifyQueue) drop(dropFunc func(string, []byte), notes []queuedNote) {
+  for _, n := range notes {
+    atomic.AddUint64(&q.stats.notificationsDropped, 1)
+    if dropFunc != nil {
+      dropFunc(n.name, n.buf)
+    }
+  }
+}
+
+// ----------------------------------------------------------------------------------------------
+
+func (s *socket) SetNotifyQueueSize(n int) {
+  q := s.notes
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if n < 0 {
+    n = 0
+  }
+  q.size = n
+  q.cond.Broadcast()
+  if n != 0 && !q.writing && !q.closed {
+    q.writing = true
+    go s.notifyLoop()
+  }
+}
+
+func (s *socket) SetNotifyQueuePolicy(p NotifyQueuePolicy) {
+  s.notes.mu.Lock()
+  defer s.notes.mu.Unlock()
+  s.notes.policy = p
+  s.notes.cond.Broadcast()
+}
+
+func (s *socket) OnNotifyDropped(f func(name string, buf []byte)) {
+  s.notes.mu.Lock()
+  defer s.notes.mu.Unlock()
+  s.notes.dropFunc = f
+}
+
+// Writes queued notifications until the queue is closed
+func (s *socket) notifyLoop() {
+  q := s.notes
+  for q.wait() {
+    // Notifications stay in the queue, where they might be dropped, until we can write
+    s.wmu.Lock()
+    n, ok := q.pop()
+    var err error
+    if ok {
+      err = s.writeMsgLocked(MsgTypeNotification, "", n.name, n.buf)
+    }
+    s.wmu.Unlock()
+    if !ok {
+      continue
+    }
+    if err != nil {
+      s.log().Errorf("failed to write notification %q: %v", n.name, err)
+      q.mu.Lock()
+      dropFunc := q.dropFunc
+      q.mu.Unlock()
+      q.drop(dropFunc, []queuedNote{n})
+    } else {
+      atomic.AddUint64(&s.stats.notificationsSent, 1)
+    }
+  }
+}
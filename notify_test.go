@@ -0,0 +1,208 @@
+package gotalk
+import (
+  "net"
+  "sync"
+  "strings"
+  "testing"
+  "time"
+)
+
+
+// Returns a socket with a notification queue of size 2, holding its write lock until the
+// returned function is called, so that notifications stay in the queue.
+func pipeNotifyQueue(t *testing.T, policy NotifyQueuePolicy) (*socket, net.Conn, func()) {
+  s, c := pipeRaw(t, NewHandlers())
+  sock := s.(*socket)
+  sock.SetNotifyQueueSize(2)
+  sock.SetNotifyQueuePolicy(policy)
+  sock.wmu.Lock()
+  return sock, c, sock.wmu.Unlock
+}
+
+func readNotes(t *testing.T, c net.Conn, n int) []string {
+  var names []string
+  for i := 0; i < n; i++ {
+    ty, _, name, payload := readRawMsg(t, c)
+    if ty != MsgTypeNotification || name != "note" {
+      t.Fatalf("received %q %q, expected notification", ty, name)
+    }
+    names = append(names, string(payload))
+  }
+  return names
+}
+
+func checkNotes(t *testing.T, what string, actual []string, expected ...string) {
+  if len(actual) != len(expected) {
+    t.Errorf("%s %v, expected %v", what, actual, expected)
+    return
+  }
+  for i := range actual {
+    if actual[i] != expected[i] {
+      t.Errorf("%s %v, expected %v", what, actual, expected)
+      return
+    }
+  }
+}
+
+
+func TestNotifyQueueDropOldest(t *testing.T) {
+  s, c, unlock := pipeNotifyQueue(t, DropOldestPolicy)
+  defer c.Close()
+  var dropped []string
+  s.OnNotifyDropped(func(name string, buf []byte) { dropped = append(dropped, string(buf)) })
+
+  for _, v := range []string{"1", "2", "3", "4", "5"} {
+    if err := s.BufferNotify("note", []byte(v)); err != nil {
+      t.Fatalf("BufferNotify() failed: %v", err)
+    }
+  }
+  checkNotes(t, "dropped", dropped, "1", "2", "3")
+  unlock()
+  checkNotes(t, "received", readNotes(t, c, 2), "4", "5")
+  if n := s.Stats().NotificationsDropped; n != 3 {
+    t.Errorf("Stats().NotificationsDropped => %d, expected 3", n)
+  }
+}
+
+
+func TestNotifyQueueDropNewest(t *testing.T) {
+  s, c, unlock := pipeNotifyQueue(t, DropNewestPolicy)
+  defer c.Close()
+  var dropped []string
+  s.OnNotifyDropped(func(name string, buf []byte) { dropped = append(dropped, string(buf)) })
+
+  for _, v := range []string{"1", "2", "3", "4", "5"} {
+    if err := s.BufferNotify("note", []byte(v)); err != nil {
+      t.Fatalf("BufferNotify() failed: %v", err)
+    }
+  }
+  checkNotes(t, "dropped", dropped, "3", "4", "5")
+  unlock()
+  checkNotes(t, "received", readNotes(t, c, 2), "1", "2")
+}
+
+
+func TestNotifyQueueBlock(t *testing.T) {
+  s, c, unlock := pipeNotifyQueue(t, BlockPolicy)
+  defer c.Close()
+  s.OnNotifyDropped(func(name string, buf []byte) { t.Errorf("dropped %q", buf) })
+
+  s.BufferNotify("note", []byte("1"))
+  s.BufferNotify("note", []byte("2"))
+  errch := make(chan error, 1)
+  go func() { errch <- s.BufferNotify("note", []byte("3")) }()
+  select {
+  case err := <-errch:
+    t.Fatalf("BufferNotify() => %v while the queue was full", err)
+  case <-time.After(20*time.Millisecond):
+  }
+
+  unlock()
+  checkNotes(t, "received", readNotes(t, c, 3), "1", "2", "3")
+  if err := <-errch; err != nil {
+    t.Errorf("BufferNotify() failed: %v", err)
+  }
+}
+
+
+func TestNotifyQueueClose(t *testing.T) {
+  s, c, unlock := pipeNotifyQueue(t, BlockPolicy)
+  defer unlock()
+  defer c.Close()
+  var mu sync.Mutex
+  var dropped []string
+  s.OnNotifyDropped(func(name string, buf []byte) {
+    mu.Lock()
+    dropped = append(dropped, string(buf))
+    mu.Unlock()
+  })
+
+  s.BufferNotify("note", []byte("1"))
+  s.BufferNotify("note", []byte("2"))
+  errch := make(chan error, 1)
+  go func() { errch <- s.BufferNotify("note", []byte("3")) }()
+  time.Sleep(10*time.Millisecond)
+  s.Close()
+
+  if err := <-errch; err != ErrSockClosed {
+    t.Errorf("BufferNotify() => %v, expected %v", err, ErrSockClosed)
+  }
+  mu.Lock()
+  checkNotes(t, "dropped", dropped, "1", "2")
+  mu.Unlock()
+  if err := s.BufferNotify("note", []byte("4")); err != ErrSockClosed {
+    t.Errorf("BufferNotify() => %v after close, expected %v", err, ErrSockClosed)
+  }
+}
+
+
+func TestNotifyStream(t *testing.T) {
+  h := NewHandlers()
+  type stream struct {
+    name  string
+    parts []string
+  }
+  streams := make(chan stream, 2)
+  h.HandleNotificationStream("feed", func(s Sock, name string, parts chan []byte) {
+    st := stream{name:name}
+    for b := <-parts; b != nil; b = <-parts {
+      st.parts = append(st.parts, string(b))
+    }
+    streams <- st
+  })
+  notes := make(chan string, 4)
+  h.HandleBufferNotification("plain", func(s Sock, name string, b []byte) {
+    notes <- string(b)
+  })
+  s1, s2, err := PipeHandlers(NewHandlers(), h)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s1.Close()
+  defer s2.Close()
+
+  // Interleaved streams are reassembled in order
+  send1, close1 := s1.NotifyStream("feed")
+  send2, close2 := s1.NotifyStream("feed")
+  for i := 0; i < 3; i++ {
+    if err := send1(i); err != nil {
+      t.Fatal(err)
+    }
+    if err := send2(i * 10); err != nil {
+      t.Fatal(err)
+    }
+  }
+  close1()
+  close2()
+  if err := send1(3); err != ErrStreamEnded {
+    t.Errorf("send() => %v after close, expected ErrStreamEnded", err)
+  }
+  got := map[string]bool{}
+  for i := 0; i < 2; i++ {
+    select {
+    case st := <-streams:
+      got[strings.Join(st.parts, ",")] = st.name == "feed"
+    case <-time.After(time.Second):
+      t.Fatalf("stream did not end")
+    }
+  }
+  if !got["0,1,2"] || !got["0,10,20"] {
+    t.Errorf("received streams %v, expected [0,1,2] and [0,10,20]", got)
+  }
+
+  // Streams without a stream handler arrive as separate notifications
+  send, close := s1.NotifyStream("plain")
+  send("a")
+  send("b")
+  close()
+  for _, expected := range []string{`"a"`, `"b"`} {
+    select {
+    case b := <-notes:
+      if b != expected {
+        t.Errorf("received notification %s, expected %s", b, expected)
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("notification not received")
+    }
+  }
+}
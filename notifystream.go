@@ -0,0 +1,130 @@
+package gotalk
+
+import (
+  "sync"
+  "sync/atomic"
+)
+
+// Notification streams. Each part of a stream is a notification preceded by a message tagging
+// it with the ID of its stream, written together so that parts of different streams can be
+// interleaved. Stream IDs are chosen by the sender and are independent of request IDs.
+
+func (s *socket) NotifyStream(name string) (send func(interface{}) error, close func()) {
+  n := atomic.AddUint32(&s.noteStreamSeq, 1) - 1
+  id := string(makeFixnumBuf(3, uint64(n % 46656), 36))
+  var mu sync.Mutex
+  closed := false
+  send = func(v interface{}) error {
+    buf, err := encodeValue(s.Codec(), v)
+    if err != nil {
+      return err
+    }
+    mu.Lock()
+    defer mu.Unlock()
+    if closed {
+      return ErrStreamEnded
+    }
+    err = s.write(func() error {
+      if err := s.writeMsgLocked(MsgTypeSingleRes, NotifyStreamID, "", []byte(id + "p")); err != nil {
+        return err
+      }
+      return s.writeMsgLocked(MsgTypeNotification, "", name, buf)
+    })
+    if err == nil {
+      atomic.AddUint64(&s.stats.notificationsSent, 1)
+    }
+    return err
+  }
+  close = func() {
+    mu.Lock()
+    defer mu.Unlock()
+    if !closed {
+      closed = true
+      s.writeMsg(MsgTypeSingleRes, NotifyStreamID, "", []byte(id + "e"))  // best effort
+    }
+  }
+  return send, close
+}
+
+// A notification stream being received
+type noteStream struct {
+  ch   chan []byte
+  done chan struct{}  // closed when the handler has returned
+}
+
+func (s *socket) findNotificationStreamHandler(name string) NoteStreamHandler {
+  if local := s.getLocalHandlers(); local != nil {
+    if handler := local.FindNotificationStreamHandler(name); handler != nil {
+      return handler
+    }
+  }
+  return s.handlers.FindNotificationStreamHandler(name)
+}
+
+func (s *socket) readNotifyStream(size int) error {
+  buf := make([]byte, size)
+  if err := readn(s.rd, buf); err != nil {
+    return err
+  }
+  if len(buf) != 4 || (buf[3] != 'p' && buf[3] != 'e') {
+    return &ProtocolError{msg:"invalid notification stream tag"}
+  }
+  id := string(buf[:3])
+  if buf[3] == 'e' {
+    s.endNoteStream(id)
+  } else {
+    s.noteStreamTag = id
+  }
+  return nil
+}
+
+// Returns the stream of the notification being read, or "" if it isn't part of a stream
+func (s *socket) takeNoteStreamTag() string {
+  id := s.noteStreamTag
+  s.noteStreamTag = ""
+  return id
+}
+
+// Reads a part of stream `id` and delivers it to the handler of the stream, starting it for the
+// first part
+func (s *socket) readNoteStreamPart(handler NoteStreamHandler, id, name string, size int) error {
+  buf := make([]byte, size)
+  if err := readn(s.rd, buf); err != nil {
+    return err
+  }
+  ns := s.noteStreams[id]
+  if ns == nil {
+    ns = &noteStream{ch:make(chan []byte), done:make(chan struct{})}
+    if s.noteStreams == nil {
+      s.noteStreams = make(map[string]*noteStream)
+    }
+    s.noteStreams[id] = ns
+    go func() {
+      defer close(ns.done)
+      handler(s, name, ns.ch)
+    }()
+  }
+  // Parts of a stream whose handler has returned are discarded
+  select {
+  case ns.ch <- buf:
+  case <-ns.done:
+  }
+  return nil
+}
+
+func (s *socket) endNoteStream(id string) {
+  if ns := s.noteStreams[id]; ns != nil {
+    delete(s.noteStreams, id)
+    select {
+    case ns.ch <- nil:
+    case <-ns.done:
+    }
+  }
+}
+
+// Ends the streams being received once the socket stops reading
+func (s *socket) endNoteStreams() {
+  for id := range s.noteStreams {
+    s.endNoteStream(id)
+  }
+}
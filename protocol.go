@@ -1,16 +1,19 @@
 package gotalk
 
 import (
+  "fmt"
   "io"
   "strconv"
   "errors"
+  "time"
 )
 
 const (
   // Version of this protocol
   ProtocolVersion      = uint8(0)
 
-  // Message types
+  // Message types, which are part of the wire format and never change meaning. See
+  // MsgType.String for their names in the protocol description of the README.
   MsgTypeSingleReq     = MsgType(byte('r'))
   MsgTypeStreamReq     = MsgType(byte('s'))
   MsgTypeStreamReqPart = MsgType(byte('p'))
@@ -18,11 +21,120 @@ const (
   MsgTypeStreamRes     = MsgType(byte('S'))
   MsgTypeErrorRes      = MsgType(byte('E'))
   MsgTypeNotification  = MsgType(byte('n'))
+  MsgTypeCancelReq     = MsgType(byte('c'))
+  MsgTypeCodec         = MsgType(byte('C'))
+  MsgTypeGoingAway     = MsgType(byte('g'))
+  MsgTypeHeartbeat     = MsgType(byte('h'))
+  MsgTypeCompression   = MsgType(byte('Z'))
+  MsgTypeCompressed    = MsgType(byte('z'))
+  MsgTypeChecksum      = MsgType(byte('K'))
+  MsgTypeChecksummed   = MsgType(byte('k'))
+
+  // Maximum load reported in heartbeats
+  HeartbeatMaxLoad     = 0xfff
+
+  // ID of single-result messages carrying the metadata of the request which follows. It can't
+  // be the ID of an actual request, so peers not supporting metadata discard such messages.
+  RequestMetaID        = "---"
+
+  // ID of single-result messages carrying the metadata of the result of a request, as the
+  // request ID followed by a JSON object, written right before the result. Peers not
+  // supporting result metadata discard such messages.
+  ResultMetaID         = "--m"
+
+  // ID of single-result messages carrying the time budget of the request which follows, as the
+  // request ID followed by 8 hexadecimal digits of milliseconds from receipt. Like metadata,
+  // peers not supporting deadlines discard such messages.
+  RequestDeadlineID    = "--d"
+
+  // ID of single-result messages granting the sender of a streaming request more room to
+  // send parts, as the request ID followed by 16 hexadecimal digits of the number of payload
+  // bytes the sender may have sent in total. See Sock.SetStreamWindowSize
+  StreamWindowID       = "--w"
+
+  // ID of single-result messages telling the sender of a streaming request to stop sending
+  // parts, as the request ID, written when the handler returns before the request has ended.
+  // Further parts are discarded. Peers not supporting it discard such messages.
+  StreamStopID         = "--s"
+
+  // ID of a single-result message carrying application-defined data, sent right after the
+  // handshake. See Sock.SetHandshakeData. Peers not supporting it discard the message.
+  HandshakeDataID      = "--h"
+
+  // ID of single-result messages tagging the notification which follows as a part of a
+  // notification stream, as the stream ID followed by "p", or ending a stream, as the stream ID
+  // followed by "e". Peers not supporting notification streams discard such messages and
+  // handle the parts as separate notifications.
+  NotifyStreamID       = "--n"
+
+  // ID of single requests whose result isn't wanted. The handler is called as for any other
+  // request but no result is written, and any number of such requests may be handled at the
+  // same time. Peers not supporting it write the result with this ID, which is discarded.
+  NoReplyID            = "--r"
+
+  // ID of single-result messages carrying the ID of the channel of the request or notification
+  // which follows. See Sock.Channel. Peers not supporting channels discard such messages and
+  // handle the message which follows as any other.
+  ChannelID            = "--c"
+
+  // ID of a single-result message announcing the optional features of a peer, as a
+  // space-separated list like "cancel", written right after the protocol version. Messages of
+  // the types a feature adds are only sent to peers announcing it. Peers not supporting
+  // features discard the message.
+  FeaturesID           = "--f"
+
+  // Longest time budget which can be sent with a request
+  MaxRequestDeadline   = time.Duration(0xffffffff) * time.Millisecond
 )
 
 type MsgType byte
 var ProtocolVersionBuf [2]byte
 
+var msgTypeNames = map[MsgType]string{
+  MsgTypeSingleReq:     "SingleRequest",
+  MsgTypeStreamReq:     "StreamRequest",
+  MsgTypeStreamReqPart: "StreamReqPart",
+  MsgTypeSingleRes:     "SingleResult",
+  MsgTypeStreamRes:     "StreamResult",
+  MsgTypeErrorRes:      "ErrorResult",
+  MsgTypeNotification:  "Notification",
+  MsgTypeCancelReq:     "CancelRequest",
+  MsgTypeCodec:         "Codec",
+  MsgTypeGoingAway:     "GoingAway",
+  MsgTypeHeartbeat:     "Heartbeat",
+  MsgTypeCompression:   "Compression",
+  MsgTypeCompressed:    "Compressed",
+  MsgTypeChecksum:      "Checksum",
+  MsgTypeChecksummed:   "Checksummed",
+}
+
+// Returns the name of the message type, e.g. "SingleRequest", or e.g. "MsgType('x')" for types
+// which aren't part of the protocol
+func (t MsgType) String() string {
+  if name, ok := msgTypeNames[t]; ok {
+    return name
+  }
+  return fmt.Sprintf("MsgType(%q)", byte(t))
+}
+
+// Error caused by the peer violating the protocol, e.g. by sending a message which is too large
+type ProtocolError struct {
+  msg     string
+  msgType MsgType  // type of the offending message, or 0 if unknown
+  id      string   // request ID of the offending message, if any
+}
+
+func (e *ProtocolError) Error() string { return "protocol error: " + e.msg }
+
+// Describes what the peer did wrong, without the "protocol error" prefix of Error
+func (e *ProtocolError) Message() string { return e.msg }
+
+// Type of the offending message, or 0 if it isn't known, e.g. for a handshake which failed
+func (e *ProtocolError) MsgType() MsgType { return e.msgType }
+
+// Request ID of the offending message, or "" if it has none
+func (e *ProtocolError) MsgID() string { return e.id }
+
 func init() {
   copyFixnum(ProtocolVersionBuf[:0], 2, uint64(ProtocolVersion), 16)
 }
@@ -53,6 +165,140 @@ func WriteErrorRes(s io.Writer, id string, size int) (int, error) {
   return s.Write(MakeMsg(MsgTypeErrorRes, id, "", size))
 }
 
+func WriteCancelReq(s io.Writer, id string) (int, error) {
+  return s.Write(MakeMsg(MsgTypeCancelReq, id, "", 0))
+}
+
+// Writes the header of the metadata of request `id`, to be followed by `size` bytes of JSON
+func WriteRequestMeta(s io.Writer, id string, size int) (int, error) {
+  return s.Write(append(MakeMsg(MsgTypeSingleRes, RequestMetaID, "", len(id)+size), id...))
+}
+
+// Writes the header of the metadata of the result of request `id`, to be followed by `size`
+// bytes of JSON
+func WriteResultMeta(s io.Writer, id string, size int) (int, error) {
+  return s.Write(append(MakeMsg(MsgTypeSingleRes, ResultMetaID, "", len(id)+size), id...))
+}
+
+// Writes the header of handshake data, to be followed by `size` bytes of data
+func WriteHandshakeData(s io.Writer, size int) (int, error) {
+  return s.Write(MakeMsg(MsgTypeSingleRes, HandshakeDataID, "", size))
+}
+
+// Writes the optional features we support, as a space-separated list
+func WriteFeatures(s io.Writer, features string) (int, error) {
+  return s.Write(append(MakeMsg(MsgTypeSingleRes, FeaturesID, "", len(features)), features...))
+}
+
+// Writes the time budget of request `id`, which is rounded up to milliseconds and clamped to
+// [1ms-MaxRequestDeadline]
+func WriteRequestDeadline(s io.Writer, id string, timeout time.Duration) (int, error) {
+  return s.Write(MakeRequestDeadlineMsg(id, timeout))
+}
+
+func MakeRequestDeadlineMsg(id string, timeout time.Duration) []byte {
+  return append(MakeMsg(MsgTypeSingleRes, RequestDeadlineID, "", 3+8), makeRequestDeadline(id, timeout)...)
+}
+
+// Returns the payload of a request deadline message
+func makeRequestDeadline(id string, timeout time.Duration) []byte {
+  ms := (timeout + time.Millisecond - 1) / time.Millisecond
+  if ms < 1 {
+    ms = 1
+  } else if ms > 0xffffffff {
+    ms = 0xffffffff
+  }
+  return append([]byte(id), makeFixnumBuf(8, uint64(ms), 16)...)
+}
+
+// Parses the payload of a request deadline message
+func ParseRequestDeadline(payload []byte) (id string, timeout time.Duration, err error) {
+  if len(payload) != 3+8 {
+    return "", 0, &ProtocolError{msg:"invalid request deadline"}
+  }
+  ms, err := strconv.ParseUint(string(payload[3:]), 16, 32)
+  if err != nil {
+    return "", 0, &ProtocolError{msg:"invalid request deadline"}
+  }
+  return string(payload[:3]), time.Duration(ms) * time.Millisecond, nil
+}
+
+func WriteStreamWindow(s io.Writer, id string, granted int64) (int, error) {
+  return s.Write(MakeStreamWindowMsg(id, granted))
+}
+
+func MakeStreamWindowMsg(id string, granted int64) []byte {
+  return append(MakeMsg(MsgTypeSingleRes, StreamWindowID, "", 3+16), makeStreamWindow(id, granted)...)
+}
+
+// Returns the payload of a stream window message
+func makeStreamWindow(id string, granted int64) []byte {
+  if granted < 0 {
+    granted = 0
+  }
+  return append([]byte(id), makeFixnumBuf(16, uint64(granted), 16)...)
+}
+
+// Parses the payload of a stream window message
+func ParseStreamWindow(payload []byte) (id string, granted int64, err error) {
+  if len(payload) != 3+16 {
+    return "", 0, &ProtocolError{msg:"invalid stream window"}
+  }
+  n, err := strconv.ParseInt(string(payload[3:]), 16, 64)
+  if err != nil || n < 0 {
+    return "", 0, &ProtocolError{msg:"invalid stream window"}
+  }
+  return string(payload[:3]), n, nil
+}
+
+func WriteStreamStop(s io.Writer, id string) (int, error) {
+  return s.Write(append(MakeMsg(MsgTypeSingleRes, StreamStopID, "", len(id)), id...))
+}
+
+func WriteCodec(s io.Writer, name string) (int, error) {
+  return s.Write(MakeMsg(MsgTypeCodec, "", name, 0))
+}
+
+func WriteCompression(s io.Writer, name string) (int, error) {
+  return s.Write(MakeMsg(MsgTypeCompression, "", name, 0))
+}
+
+func WriteChecksum(s io.Writer, name string) (int, error) {
+  return s.Write(MakeMsg(MsgTypeChecksum, "", name, 0))
+}
+
+func WriteGoingAway(s io.Writer, reason string) (int, error) {
+  return s.Write(MakeMsg(MsgTypeGoingAway, "", reason, 0))
+}
+
+// Write a heartbeat reporting `load`, which is clamped to [0-HeartbeatMaxLoad], at time `t`
+func WriteHeartbeat(s io.Writer, load int, t time.Time) (int, error) {
+  return s.Write(MakeHeartbeatMsg(load, t))
+}
+
+// Create a heartbeat message. Heartbeats have the same layout as messages with an id and no
+// name, with the load in place of the id and the time in seconds since 1970 in place of the
+// payload size, i.e. ReadMsg returns them as (MsgTypeHeartbeat, load, "", time, nil).
+func MakeHeartbeatMsg(load int, t time.Time) []byte {
+  if load < 0 {
+    load = 0
+  } else if load > HeartbeatMaxLoad {
+    load = HeartbeatMaxLoad
+  }
+  var id [3]byte
+  copyFixnum(id[:], 3, uint64(load), 16)
+  return MakeMsg(MsgTypeHeartbeat, string(id[:]), "", int(uint32(t.Unix())))
+}
+
+// Parses the load and time of a heartbeat read with ReadMsg
+func ParseHeartbeat(id string, size uint32) (load int, t time.Time, err error) {
+  n, err := strconv.ParseUint(id, 16, 16)
+  if err != nil {
+    return 0, t, err
+  }
+  return int(n), time.Unix(int64(size), 0), nil
+}
+
 
 // Create a slice of bytes representing a message (w/o any payload.)
 func MakeMsg(t MsgType, id, name3 string, size int) []byte {
@@ -125,12 +371,12 @@ func ReadMsg(s io.Reader) (t MsgType, id, name3 string, size uint32, err error)
     t = MsgType(b[0])
     z := 1
 
-    if t != MsgTypeNotification {
+    if msgHasID(t) {
       id = string(b[z:z+3])
       z += 3
     }
 
-    if t == MsgTypeSingleReq || t == MsgTypeStreamReq || t == MsgTypeNotification {
+    if msgHasName(t) {
       name3z, e := strconv.ParseUint(string(b[z:z+3]), 16, 16)
       z += 3
       if e != nil {
@@ -174,6 +420,33 @@ func ReadMsg(s io.Reader) (t MsgType, id, name3 string, size uint32, err error)
 }
 
 
+// True for messages of type `t` having a request ID (or the load of heartbeats)
+func msgHasID(t MsgType) bool {
+  return t != MsgTypeNotification && t != MsgTypeCodec && t != MsgTypeGoingAway &&
+         t != MsgTypeCompression && t != MsgTypeChecksum
+}
+
+
+// True for messages of type `t` having a name, like an operation or a notification type
+func msgHasName(t MsgType) bool {
+  return t == MsgTypeSingleReq || t == MsgTypeStreamReq || t == MsgTypeNotification ||
+         t == MsgTypeCodec || t == MsgTypeGoingAway || t == MsgTypeCompression ||
+         t == MsgTypeChecksum
+}
+
+
+// Returns a *ProtocolError if a message of type `t` with a payload of `size` bytes exceeds
+// `limit` bytes. 0 means no limit.
+func checkMsgSize(t MsgType, size uint32, limit int) error {
+  // The size of heartbeats is a timestamp rather than the size of a payload
+  if limit > 0 && t != MsgTypeHeartbeat && uint64(size) > uint64(limit) {
+    return &ProtocolError{msg:fmt.Sprintf("%c message of %d bytes exceeds limit of %d bytes",
+      byte(t), size, limit)}
+  }
+  return nil
+}
+
+
 // =============================================================================
 
 
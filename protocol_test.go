@@ -2,6 +2,7 @@ package gotalk
 import (
   "testing"
   "bytes"
+  "time"
 )
 
 func assertMsgEqual(t *testing.T, msg []byte, expect []byte) {
@@ -118,3 +119,69 @@ func TestWriteReadMsg(t *testing.T) {
     assertReadMsg(t, s, msg)
   }
 }
+
+
+func TestHeartbeatMsg(t *testing.T) {
+  tm := time.Unix(0x5f5e1000, 0)
+  msg := MakeHeartbeatMsg(10, tm)
+  assertMsgEqual(t, msg, []byte("h00a5f5e1000"))
+  assertMsgEqual(t, MakeHeartbeatMsg(-1, tm), []byte("h0005f5e1000"))
+  assertMsgEqual(t, MakeHeartbeatMsg(HeartbeatMaxLoad+1, tm), []byte("hfff5f5e1000"))
+
+  ty, id, name, size, err := ReadMsg(bytes.NewBuffer(msg))
+  if err != nil || ty != MsgTypeHeartbeat || name != "" {
+    t.Fatalf("ReadMsg() => (%c, %q, %q, %v, %v)", byte(ty), id, name, size, err)
+  }
+  if load, t2, err := ParseHeartbeat(id, size); err != nil || load != 10 || !t2.Equal(tm) {
+    t.Errorf("ParseHeartbeat() => (%v, %v, %v), expected (10, %v, nil)", load, t2, err, tm)
+  }
+}
+
+
+func TestRequestDeadlineMsg(t *testing.T) {
+  msg := MakeRequestDeadlineMsg("001", 1500*time.Millisecond)
+  assertMsgEqual(t, msg, []byte("R--d0000000b001000005dc"))
+  assertMsgEqual(t, MakeRequestDeadlineMsg("001", 0), []byte("R--d0000000b00100000001"))
+  assertMsgEqual(t, MakeRequestDeadlineMsg("001", 1001*time.Microsecond), []byte("R--d0000000b00100000002"))
+  assertMsgEqual(t, MakeRequestDeadlineMsg("001", 2*MaxRequestDeadline), []byte("R--d0000000b001ffffffff"))
+
+  if id, timeout, err := ParseRequestDeadline(msg[12:]); err != nil || id != "001" || timeout != 1500*time.Millisecond {
+    t.Errorf("ParseRequestDeadline() => (%q, %v, %v), expected (\"001\", 1.5s, nil)", id, timeout, err)
+  }
+  for _, payload := range []string{"001", "001000005dc0", "001-00005dc"} {
+    if _, _, err := ParseRequestDeadline([]byte(payload)); err == nil {
+      t.Errorf("ParseRequestDeadline(%q) succeeded", payload)
+    }
+  }
+}
+
+
+func TestStreamWindowMsg(t *testing.T) {
+  msg := MakeStreamWindowMsg("001", 4096)
+  assertMsgEqual(t, msg, []byte("R--w000000130010000000000001000"))
+  assertMsgEqual(t, MakeStreamWindowMsg("001", -1), []byte("R--w000000130010000000000000000"))
+
+  if id, granted, err := ParseStreamWindow(msg[12:]); err != nil || id != "001" || granted != 4096 {
+    t.Errorf("ParseStreamWindow() => (%q, %d, %v), expected (\"001\", 4096, nil)", id, granted, err)
+  }
+  for _, payload := range []string{"001", "00100000000000001000", "001-000000000001000"} {
+    if _, _, err := ParseStreamWindow([]byte(payload)); err == nil {
+      t.Errorf("ParseStreamWindow(%q) succeeded", payload)
+    }
+  }
+}
+
+
+func TestMsgTypeString(t *testing.T) {
+  for ty, name := range map[MsgType]string{
+    MsgTypeSingleReq:    "SingleRequest",
+    MsgTypeErrorRes:     "ErrorResult",
+    MsgTypeNotification: "Notification",
+    MsgTypeChecksummed:  "Checksummed",
+    MsgType('x'):        "MsgType('x')",
+  } {
+    if s := ty.String(); s != name {
+      t.Errorf("MsgType(%q).String() => %q, expected %q", byte(ty), s, name)
+    }
+  }
+}
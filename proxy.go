@@ -0,0 +1,129 @@
+package gotalk
+
+import (
+  "context"
+)
+
+// Called by Proxy with each request and notification it relays from `from` to `to`, with its
+// operation or notification name and its payload, which for streaming requests is the first
+// part. Returns the name and payload to relay instead, e.g. to rename operations, or an error
+// to refuse a request, which the requestor receives, or to drop a notification.
+type ProxyHook func(from, to Sock, name string, payload []byte) (string, []byte, error)
+
+// Handles both single and streaming requests, which other handlers can't
+type proxyHandler struct {
+  single ctxReqHandler
+  stream StreamReqHandler
+}
+
+// Relays requests, single and streaming, and notifications received by `client` to `upstream`
+// and those received by `upstream` to `client`, and their results back. Requests are sent anew
+// by the other socket, so request IDs of one connection never collide with those of the other.
+// Metadata, time budgets and cancellation of single requests are relayed too. Streaming
+// requests are only relayed by a socket accepting them; see SetStreamReqLimit. `hook` is
+// called with each request and notification unless nil.
+//
+// Proxy installs fallback handlers in LocalHandlers of both sockets, so operations and
+// notifications with a handler of their own there are handled rather than relayed. Closing one
+// socket doesn't close the other; do that with OnClose if needed.
+func Proxy(client, upstream Sock, hook ProxyHook) {
+  relay(client, upstream, hook)
+  relay(upstream, client, hook)
+}
+
+
+// Relays requests and notifications received by `from` to `to`
+func relay(from, to Sock, hook ProxyHook) {
+  if hook == nil {
+    hook = func(_, _ Sock, name string, payload []byte) (string, []byte, error) {
+      return name, payload, nil
+    }
+  }
+  single := func(ctx context.Context, _ Sock, op string, payload []byte) ([]byte, error) {
+    op, payload, err := hook(from, to, op, payload)
+    if err != nil {
+      return nil, err
+    }
+    s, ok := to.(*socket)
+    if !ok {
+      return to.BufferRequest(op, payload)
+    }
+    outbuf, meta, err := s.bufferRequestMeta(ctx, op, payload, s.RequestTimeout(),
+      RequestMetaFromContext(ctx))
+    for k, v := range meta {
+      SetResultMeta(ctx, k, v)
+    }
+    return outbuf, err
+  }
+  stream := func(_ Sock, op string, rch chan []byte, write StreamWriter) error {
+    op, payload, err := hook(from, to, op, <-rch)
+    if err != nil {
+      return err
+    }
+    r := to.StreamRequest(op)
+    if err := r.Write(payload); err != nil {
+      return err
+    }
+    done := make(chan struct{})
+    defer close(done)
+    go relayStreamParts(r, rch, done)
+    for {
+      b, err := r.Read()
+      if err != nil {
+        return err
+      }
+      if err := write(b); err != nil {
+        // The requestor is gone, but the result must still be read to its end
+        go drainStreamResult(r)
+        return err
+      }
+      if len(b) == 0 {
+        return nil
+      }
+    }
+  }
+
+  h := from.LocalHandlers()
+  if lh, ok := h.(*handlers); ok {
+    lh.setRequestHandler("", proxyHandler{ctxReqHandler(single), StreamReqHandler(stream)})
+  } else {
+    h.HandleBufferRequest("", func(s Sock, op string, payload []byte) ([]byte, error) {
+      return single(context.Background(), s, op, payload)
+    })
+  }
+  h.HandleBufferNotification("", func(_ Sock, name string, payload []byte) {
+    name, payload, err := hook(from, to, name, payload)
+    if err == nil {
+      to.BufferNotify(name, payload)
+    }
+  })
+}
+
+
+// Writes the parts of a request received on `rch` to `r` until the end of the request, a
+// failed write or `done` being closed
+func relayStreamParts(r StreamRequest, rch chan []byte, done chan struct{}) {
+  for {
+    select {
+    case b := <-rch:
+      if b == nil {
+        r.CloseSend()
+        return
+      }
+      if err := r.Write(b); err != nil {
+        return
+      }
+    case <-done:
+      return
+    }
+  }
+}
+
+
+func drainStreamResult(r StreamRequest) {
+  for {
+    if b, err := r.Read(); err != nil || len(b) == 0 {
+      return
+    }
+  }
+}
@@ -0,0 +1,132 @@
+package gotalk
+
+import (
+  "errors"
+  "strings"
+  "sync"
+  "testing"
+)
+
+
+// Connects a client to a backend handling requests with `h` through a proxy, returning the
+// socket of the proxy connected to the client as `gateway`
+func proxyPipe(t *testing.T, h Handlers, hook ProxyHook) (client, gateway, backend Sock) {
+  client, gwClient, err := PipeHandlers(NewHandlers(), NewHandlers())
+  if err != nil {
+    t.Fatal(err)
+  }
+  gwUpstream, backend, err := PipeHandlers(NewHandlers(), h)
+  if err != nil {
+    t.Fatal(err)
+  }
+  Proxy(gwClient, gwUpstream, hook)
+  t.Cleanup(func() {
+    client.Close()
+    gwClient.Close()
+    gwUpstream.Close()
+    backend.Close()
+  })
+  return client, gwClient, backend
+}
+
+
+func TestProxy(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  h.HandleRequest("fail", func() error { return Errorf(ErrCodeOverloaded, "busy") })
+  notes := make(chan string, 1)
+  h.HandleBufferNotification("note", func(s Sock, name string, b []byte) { notes <- string(b) })
+  client, _, backend := proxyPipe(t, h, nil)
+
+  // Requests from several goroutines don't collide, although each connection has its own IDs
+  var wg sync.WaitGroup
+  for i := 0; i < 20; i++ {
+    wg.Add(1)
+    go func(in string) {
+      defer wg.Done()
+      var out string
+      if err := client.Request("echo", in, &out); err != nil || out != in {
+        t.Errorf("Request() => (%q, %v), expected %q", out, err, in)
+      }
+    }(strings.Repeat("x", i))
+  }
+  wg.Wait()
+
+  err := client.Request("fail", nil, nil)
+  if e, ok := err.(*RequestError); !ok || e.Code() != ErrCodeOverloaded {
+    t.Errorf("Request() => %v, expected the error of the backend", err)
+  }
+  if err := client.Request("missing", nil, nil); err == nil ||
+     !strings.Contains(err.Error(), "unknown operation") {
+    t.Errorf("Request() => %v, expected unknown operation", err)
+  }
+
+  // Notifications are relayed both ways
+  client.BufferNotify("note", []byte("up"))
+  if note := <-notes; note != "up" {
+    t.Errorf("backend received %q, expected %q", note, "up")
+  }
+  client.LocalHandlers().HandleBufferNotification("note", func(s Sock, name string, b []byte) { notes <- string(b) })
+  backend.BufferNotify("note", []byte("down"))
+  if note := <-notes; note != "down" {
+    t.Errorf("client received %q, expected %q", note, "down")
+  }
+}
+
+
+func TestProxyStreamRequest(t *testing.T) {
+  h := NewHandlers()
+  h.HandleStreamRequest("upper", func(s Sock, op string, rch chan []byte, write StreamWriter) error {
+    for b := <-rch; b != nil; b = <-rch {
+      if err := write([]byte(strings.ToUpper(string(b)))); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  client, gateway, backend := proxyPipe(t, h, nil)
+  gateway.SetStreamReqLimit(1)
+  backend.SetStreamReqLimit(1)
+
+  r := client.StreamRequest("upper")
+  for _, part := range []string{"a", "b", "c"} {
+    if err := r.Write([]byte(part)); err != nil {
+      t.Fatalf("Write() failed: %v", err)
+    }
+  }
+  r.CloseSend()
+  var got []string
+  for {
+    b, err := r.Read()
+    if err != nil {
+      t.Fatalf("Read() failed: %v", err)
+    }
+    if len(b) == 0 {
+      break
+    }
+    got = append(got, string(b))
+  }
+  if strings.Join(got, "") != "ABC" {
+    t.Errorf("received %q, expected [A B C]", got)
+  }
+}
+
+
+func TestProxyHook(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("v2/echo", func(s string) (string, error) { return s, nil })
+  client, _, _ := proxyPipe(t, h, func(from, to Sock, op string, b []byte) (string, []byte, error) {
+    if op == "secret" {
+      return "", nil, errors.New("forbidden")
+    }
+    return "v2/" + op, b, nil
+  })
+
+  var out string
+  if err := client.Request("echo", "hi", &out); err != nil || out != "hi" {
+    t.Errorf("Request() => (%q, %v), expected %q", out, err, "hi")
+  }
+  if err := client.Request("secret", nil, nil); err == nil || err.Error() != "forbidden" {
+    t.Errorf("Request() => %v, expected error from the hook", err)
+  }
+}
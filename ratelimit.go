@@ -0,0 +1,128 @@
+package gotalk
+
+import (
+  "math"
+  "sync"
+  "time"
+)
+
+// Data of errors with code ErrCodeRateLimited
+type RateLimitInfo struct {
+  Remaining  float64 `json:"remaining"`   // tokens left in the bucket, always less than one
+  RetryAfter float64 `json:"retryAfter"`  // seconds until the next request would be admitted
+}
+
+type rateLimitMap map[string]rateLimit
+
+type rateLimit struct {
+  rate   float64       // tokens added per second
+  burst  int           // capacity of the bucket
+  shared *tokenBucket  // non-nil if the bucket is shared by all sockets
+}
+
+// A token bucket holding up to `burst` tokens, refilled at `rate` tokens per second
+type tokenBucket struct {
+  mu     sync.Mutex
+  rate   float64
+  burst  int
+  tokens float64
+  last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+  return &tokenBucket{rate:rate, burst:burst, tokens:float64(burst)}
+}
+
+// Takes one token from the bucket. If the bucket is empty, returns false together with the
+// remaining tokens and the time until a token is available.
+func (b *tokenBucket) take(now time.Time) (ok bool, remaining float64, retryAfter time.Duration) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  if !b.last.IsZero() {
+    b.tokens = math.Min(float64(b.burst), b.tokens + now.Sub(b.last).Seconds() * b.rate)
+  }
+  b.last = now
+  if b.tokens >= 1 {
+    b.tokens--
+    return true, b.tokens, 0
+  }
+  retryAfter = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+  return false, b.tokens, retryAfter
+}
+
+// -------------------------------------------------------------------------------------
+
+func (h *handlers) SetRateLimit(op string, ratePerSec float64, burst int) {
+  h.setRateLimit(op, rateLimit{rate:ratePerSec, burst:burst})
+}
+
+func (h *handlers) SetSharedRateLimit(op string, ratePerSec float64, burst int) {
+  h.setRateLimit(op, rateLimit{
+    rate:   ratePerSec,
+    burst:  burst,
+    shared: newTokenBucket(ratePerSec, burst),
+  })
+}
+
+func (h *handlers) setRateLimit(op string, l rateLimit) {
+  h.opLimitsMu.Lock()
+  defer h.opLimitsMu.Unlock()
+  if l.rate <= 0 {
+    delete(h.rateLimits, op)
+    return
+  }
+  if h.rateLimits == nil {
+    h.rateLimits = make(rateLimitMap)
+  }
+  h.rateLimits[op] = l
+}
+
+func (h *handlers) RateLimit(op string) (ratePerSec float64, burst int, shared bool) {
+  l := h.rateLimit(op)
+  return l.rate, l.burst, l.shared != nil
+}
+
+func (h *handlers) rateLimit(op string) rateLimit {
+  h.opLimitsMu.RLock()
+  defer h.opLimitsMu.RUnlock()
+  return h.rateLimits[op]
+}
+
+// -------------------------------------------------------------------------------------
+
+// Takes a token for a request for `op` as limited by Handlers.SetRateLimit, failing with an
+// error of code ErrCodeRateLimited if there is none.
+func (s *socket) takeRateToken(op string) error {
+  h, ok := s.handlers.(*handlers)
+  if !ok {
+    return nil
+  }
+  l := h.rateLimit(op)
+  if l.rate <= 0 {
+    return nil
+  }
+
+  b := l.shared
+  if b == nil {
+    s.opSemMu.Lock()
+    if s.rateBuckets == nil {
+      s.rateBuckets = make(map[string]*tokenBucket)
+    }
+    b = s.rateBuckets[op]
+    if b == nil || b.rate != l.rate || b.burst != l.burst {
+      b = newTokenBucket(l.rate, l.burst)
+      s.rateBuckets[op] = b
+    }
+    s.opSemMu.Unlock()
+  }
+
+  ok, remaining, retryAfter := b.take(time.Now())
+  if ok {
+    return nil
+  }
+  return NewRequestError(
+    ErrCodeRateLimited,
+    "rate limit exceeded for operation \"" + op + "\"",
+    &RateLimitInfo{Remaining:remaining, RetryAfter:retryAfter.Seconds()},
+  )
+}
@@ -0,0 +1,117 @@
+package gotalk
+
+import (
+  "encoding/json"
+  "testing"
+  "time"
+)
+
+func TestTokenBucket(t *testing.T) {
+  b := newTokenBucket(2, 2)
+  now := time.Now()
+  for i := 0; i < 2; i++ {
+    if ok, _, _ := b.take(now); !ok {
+      t.Fatalf("take #%d failed with a full bucket", i)
+    }
+  }
+  ok, remaining, retryAfter := b.take(now)
+  if ok || remaining != 0 || retryAfter != 500*time.Millisecond {
+    t.Errorf("take = %v, %v, %v, expected false, 0, 500ms", ok, remaining, retryAfter)
+  }
+
+  // Tokens are refilled over time but never beyond the burst size
+  if ok, _, _ := b.take(now.Add(500*time.Millisecond)); !ok {
+    t.Errorf("take failed after refill")
+  }
+  now = now.Add(time.Hour)
+  for i := 0; i < 2; i++ {
+    if ok, _, _ := b.take(now); !ok {
+      t.Fatalf("take #%d failed after refill", i)
+    }
+  }
+  if ok, _, _ := b.take(now); ok {
+    t.Errorf("take succeeded beyond the burst size")
+  }
+}
+
+
+func TestRateLimit(t *testing.T) {
+  h := NewHandlers()
+  h.SetRateLimit("work", 0.001, 2)
+  calls := 0
+  h.HandleRequest("work", func() error {
+    calls++
+    return nil
+  })
+  _, c := pipeRaw(t, h)
+  defer c.Close()
+
+  for _, id := range []string{"001", "002"} {
+    c.Write(MakeMsg(MsgTypeSingleReq, id, "work", 0))
+    if ty, rid, _, _ := readRawMsg(t, c); ty != MsgTypeSingleRes || rid != id {
+      t.Errorf("got message %c %q, expected result for %q", byte(ty), rid, id)
+    }
+  }
+
+  // The bucket is empty, so the handler is not called
+  c.Write(MakeMsg(MsgTypeSingleReq, "003", "work", 0))
+  ty, id, _, payload := readRawMsg(t, c)
+  e := decodeError(payload)
+  if ty != MsgTypeErrorRes || id != "003" || e.Code() != ErrCodeRateLimited {
+    t.Fatalf("got message %c %q %q, expected rate limit error for \"003\"", byte(ty), id, payload)
+  }
+  var info RateLimitInfo
+  if err := json.Unmarshal(e.Data().(json.RawMessage), &info); err != nil {
+    t.Fatal(err)
+  }
+  if info.Remaining >= 1 || info.RetryAfter <= 0 {
+    t.Errorf("error data = %+v, expected less than one token and a positive retry time", info)
+  }
+  if calls != 2 {
+    t.Errorf("handler called %d times, expected 2", calls)
+  }
+
+  // Other sockets have their own limit
+  _, c2 := pipeRaw(t, h)
+  defer c2.Close()
+  c2.Write(MakeMsg(MsgTypeSingleReq, "001", "work", 0))
+  if ty, id, _, _ := readRawMsg(t, c2); ty != MsgTypeSingleRes || id != "001" {
+    t.Errorf("got message %c %q, expected result for \"001\"", byte(ty), id)
+  }
+
+  // Removing the limit
+  h.SetRateLimit("work", 0, 0)
+  if rate, _, _ := h.RateLimit("work"); rate != 0 {
+    t.Errorf("RateLimit = %v, expected 0", rate)
+  }
+  c.Write(MakeMsg(MsgTypeSingleReq, "004", "work", 0))
+  if ty, id, _, _ := readRawMsg(t, c); ty != MsgTypeSingleRes || id != "004" {
+    t.Errorf("got message %c %q, expected result for \"004\"", byte(ty), id)
+  }
+}
+
+
+func TestSharedRateLimit(t *testing.T) {
+  h := NewHandlers()
+  h.SetSharedRateLimit("work", 0.001, 1)
+  h.HandleRequest("work", func() error { return nil })
+  if rate, burst, shared := h.RateLimit("work"); rate != 0.001 || burst != 1 || !shared {
+    t.Errorf("RateLimit = %v, %v, %v, expected 0.001, 1, true", rate, burst, shared)
+  }
+  _, c1 := pipeRaw(t, h)
+  defer c1.Close()
+  _, c2 := pipeRaw(t, h)
+  defer c2.Close()
+
+  c1.Write(MakeMsg(MsgTypeSingleReq, "001", "work", 0))
+  if ty, id, _, _ := readRawMsg(t, c1); ty != MsgTypeSingleRes || id != "001" {
+    t.Errorf("got message %c %q, expected result for \"001\"", byte(ty), id)
+  }
+
+  // The token taken by the first socket is gone for the second one too
+  c2.Write(MakeMsg(MsgTypeSingleReq, "001", "work", 0))
+  ty, id, _, payload := readRawMsg(t, c2)
+  if e := decodeError(payload); ty != MsgTypeErrorRes || id != "001" || e.Code() != ErrCodeRateLimited {
+    t.Errorf("got message %c %q %q, expected rate limit error for \"001\"", byte(ty), id, payload)
+  }
+}
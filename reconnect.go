@@ -0,0 +1,321 @@
+package gotalk
+
+import (
+  "context"
+  "errors"
+  "sync"
+  "time"
+)
+
+// Returned by ReconnectingSock requests which can't be performed because the connection was
+// lost, or had not been reestablished yet.
+var ErrReconnecting = errors.New("reconnecting")
+
+// Connection state of a ReconnectingSock
+type ConnState int
+
+const (
+  StateConnecting ConnState = iota  // trying to connect
+  StateConnected                    // connected and ready to perform requests
+  StateDisconnected                 // the connection was lost or could not be established
+  StateClosed                       // closed with Close; no more connection attempts are made
+)
+
+func (s ConnState) String() string {
+  switch s {
+  case StateConnecting:   return "connecting"
+  case StateConnected:    return "connected"
+  case StateDisconnected: return "disconnected"
+  case StateClosed:       return "closed"
+  }
+  return "invalid"
+}
+
+// A client connection which is automatically reestablished with exponential backoff when lost.
+// Requests waiting for a result when the connection is lost, and requests made while not
+// connected, fail with ErrReconnecting. After Close, requests fail with ErrSockClosed.
+type ReconnectingSock struct {
+  how, addr      string
+  handlers       Handlers
+
+  mu             sync.Mutex
+  sock           Sock           // current connection, or nil when not connected
+  state          ConnState
+  minDelay       time.Duration
+  maxDelay       time.Duration
+  factor         float64
+  onConnect      func(Sock)
+  stateFunc      func(ConnState)
+  maxQueuedNotes int
+  queuedNotes    []queuedNote   // notifications waiting to be sent once connected
+  closed         chan struct{}  // closed by Close
+}
+
+type queuedNote struct {
+  name string
+  buf  []byte
+}
+
+// Create a socket connecting to `addr` using `how`, e.g. "tcp", handling requests from the
+// peer with `h`. If `h` is nil, DefaultHandlers is used. Call Connect to start connecting.
+func NewReconnectingSock(how, addr string, h Handlers) *ReconnectingSock {
+  if h == nil {
+    h = DefaultHandlers
+  }
+  return &ReconnectingSock{
+    how:      how,
+    addr:     addr,
+    handlers: h,
+    state:    StateDisconnected,
+    minDelay: 100*time.Millisecond,
+    maxDelay: 30*time.Second,
+    factor:   2,
+    closed:   make(chan struct{}),
+  }
+}
+
+// Wait `min` after the first failed connection attempt, increasing the delay by `factor` after
+// each failed attempt, up to `max`. Defaults to 100ms, 30s and 2.
+func (r *ReconnectingSock) SetReconnectPolicy(min, max time.Duration, factor float64) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  r.minDelay, r.maxDelay, r.factor = min, max, factor
+}
+
+// Set a function to be called each time a connection has been established, before the state
+// changes to StateConnected, e.g. to subscribe to notifications. Requests can be made on `s`.
+func (r *ReconnectingSock) OnConnect(f func(s Sock)) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  r.onConnect = f
+}
+
+// Set a function to be called with the new state whenever the state changes
+func (r *ReconnectingSock) OnStateChange(f func(ConnState)) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  r.stateFunc = f
+}
+
+// Queue up to `max` notifications sent while not connected, sending them once connected.
+// Zero disables queuing (the default), in which case such notifications fail with
+// ErrReconnecting.
+func (r *ReconnectingSock) SetNotificationQueueLimit(max int) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  r.maxQueuedNotes = max
+}
+
+// Start connecting. Returns once the first connection attempt has either succeeded or failed,
+// with the error of the attempt. Connection attempts continue in the background until Close is
+// called. Must only be called once.
+func (r *ReconnectingSock) Connect() error {
+  first := make(chan error, 1)
+  go r.connectLoop(first)
+  return <-first
+}
+
+// Current state of the connection
+func (r *ReconnectingSock) State() ConnState {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  return r.state
+}
+
+// Current connection, or nil when not connected
+func (r *ReconnectingSock) Sock() Sock {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  return r.sock
+}
+
+func (r *ReconnectingSock) Request(op string, in interface{}, out interface{}) error {
+  return r.RequestContext(context.Background(), op, in, out)
+}
+
+func (r *ReconnectingSock) RequestContext(ctx context.Context, op string, in, out interface{}) error {
+  s, err := r.current()
+  if err != nil {
+    return err
+  }
+  return r.mapErr(s.RequestContext(ctx, op, in, out))
+}
+
+func (r *ReconnectingSock) BufferRequest(op string, in []byte) ([]byte, error) {
+  s, err := r.current()
+  if err != nil {
+    return nil, err
+  }
+  out, err := s.BufferRequest(op, in)
+  return out, r.mapErr(err)
+}
+
+func (r *ReconnectingSock) Notify(name string, v interface{}) error {
+  r.mu.Lock()
+  s := r.sock
+  r.mu.Unlock()
+  var codec Codec = JSONCodec
+  if s != nil {
+    codec = s.Codec()
+  }
+  buf, err := codec.Marshal(v)
+  if err != nil {
+    return err
+  }
+  return r.BufferNotify(name, buf)
+}
+
+func (r *ReconnectingSock) BufferNotify(name string, buf []byte) error {
+  r.mu.Lock()
+  s := r.sock
+  if s == nil {
+    defer r.mu.Unlock()
+    if r.state == StateClosed {
+      return ErrSockClosed
+    }
+    if len(r.queuedNotes) < r.maxQueuedNotes {
+      r.queuedNotes = append(r.queuedNotes, queuedNote{name, buf})
+      return nil
+    }
+    return ErrReconnecting
+  }
+  r.mu.Unlock()
+  return r.mapErr(s.BufferNotify(name, buf))
+}
+
+// Close the current connection and stop reconnecting
+func (r *ReconnectingSock) Close() error {
+  r.mu.Lock()
+  if r.state == StateClosed {
+    r.mu.Unlock()
+    return nil
+  }
+  close(r.closed)
+  r.state = StateClosed
+  f := r.stateFunc
+  s := r.sock
+  r.sock = nil
+  r.queuedNotes = nil
+  r.mu.Unlock()
+  if f != nil {
+    f(StateClosed)
+  }
+  if s != nil {
+    return s.Close()
+  }
+  return nil
+}
+
+// Returns the current connection, or an error if there's none
+func (r *ReconnectingSock) current() (Sock, error) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  if r.sock != nil {
+    return r.sock, nil
+  } else if r.state == StateClosed {
+    return nil, ErrSockClosed
+  }
+  return nil, ErrReconnecting
+}
+
+// Errors caused by the connection closing become ErrReconnecting unless we are closed
+func (r *ReconnectingSock) mapErr(err error) error {
+  if err == ErrSockClosed {
+    select {
+    case <-r.closed:
+    default:
+      return ErrReconnecting
+    }
+  }
+  return err
+}
+
+func (r *ReconnectingSock) setState(state ConnState) {
+  r.mu.Lock()
+  if r.state == state || r.state == StateClosed {
+    r.mu.Unlock()
+    return
+  }
+  r.state = state
+  f := r.stateFunc
+  r.mu.Unlock()
+  if f != nil {
+    f(state)
+  }
+}
+
+func (r *ReconnectingSock) connectLoop(first chan error) {
+  var delay time.Duration
+  for {
+    r.setState(StateConnecting)
+    s, err := dial(r.how, r.addr, r.handlers)
+    if first != nil {
+      first <- err
+      first = nil
+    }
+
+    if err == nil {
+      delay = 0
+      readDone := make(chan struct{})
+      go func() {
+        s.Read()
+        close(readDone)
+      }()
+      if r.connected(s) {
+        <-readDone
+      } else {
+        s.Close()
+      }
+      r.mu.Lock()
+      if r.sock == s {
+        r.sock = nil
+      }
+      r.mu.Unlock()
+    }
+    r.setState(StateDisconnected)
+
+    // Back off before the next attempt
+    r.mu.Lock()
+    if delay == 0 {
+      delay = r.minDelay
+    } else if delay = time.Duration(float64(delay) * r.factor); delay > r.maxDelay {
+      delay = r.maxDelay
+    }
+    r.mu.Unlock()
+    select {
+    case <-r.closed:
+      return
+    case <-time.After(delay):
+    }
+  }
+}
+
+// Makes `s` the current connection. Returns false if we have been closed.
+func (r *ReconnectingSock) connected(s Sock) bool {
+  r.mu.Lock()
+  f := r.onConnect
+  r.mu.Unlock()
+  if f != nil {
+    f(s)
+  }
+
+  r.mu.Lock()
+  select {
+  case <-r.closed:
+    r.mu.Unlock()
+    return false
+  default:
+  }
+  r.sock = s
+  notes := r.queuedNotes
+  r.queuedNotes = nil
+  r.mu.Unlock()
+
+  for _, n := range notes {
+    if err := s.BufferNotify(n.name, n.buf); err != nil {
+      break
+    }
+  }
+  r.setState(StateConnected)
+  return true
+}
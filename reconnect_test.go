@@ -0,0 +1,88 @@
+package gotalk
+import (
+  "context"
+  "net"
+  "testing"
+  "time"
+)
+
+
+func TestReconnectingSock(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  addr := l.Addr().String()
+
+  h := NewHandlers()
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  notes := make(chan string, 10)
+  h.HandleNotification("note", func(s string) { notes <- s })
+  srv := NewServer(h, l)
+  go srv.Accept(nil)
+
+  r := NewReconnectingSock("tcp", addr, NewHandlers())
+  r.SetReconnectPolicy(time.Millisecond, 10*time.Millisecond, 2)
+  r.SetNotificationQueueLimit(1)
+  states := make(chan ConnState, 20)
+  r.OnStateChange(func(s ConnState) { states <- s })
+  connects := make(chan Sock, 10)
+  r.OnConnect(func(s Sock) { connects <- s })
+  expectState := func(expected ConnState) {
+    for {
+      select {
+      case s := <-states:
+        if s == expected {
+          return
+        }
+      case <-time.After(5*time.Second):
+        t.Fatalf("timed out waiting for state %v", expected)
+      }
+    }
+  }
+
+  if err := r.Connect(); err != nil {
+    t.Fatal(err)
+  }
+  <-connects
+  expectState(StateConnected)
+  var out string
+  if err := r.Request("echo", "hello", &out); err != nil || out != "hello" {
+    t.Errorf("Request() => (%q, %v)", out, err)
+  }
+
+  // Lose the connection while the server is down
+  srv.Shutdown(context.Background())
+  expectState(StateDisconnected)
+  if err := r.Request("echo", "hello", &out); err != ErrReconnecting {
+    t.Errorf("Request() => %v, expected %v", err, ErrReconnecting)
+  }
+  if err := r.Notify("note", "queued"); err != nil {
+    t.Errorf("Notify() => %v, expected queued notification", err)
+  }
+  if err := r.Notify("note", "dropped"); err != ErrReconnecting {
+    t.Errorf("Notify() => %v, expected %v", err, ErrReconnecting)
+  }
+
+  // Bring the server back up on the same address
+  if l, err = net.Listen("tcp", addr); err != nil {
+    t.Fatal(err)
+  }
+  srv = NewServer(h, l)
+  go srv.Accept(nil)
+  defer srv.Close()
+  <-connects
+  expectState(StateConnected)
+  if n := <-notes; n != "queued" {
+    t.Errorf("received notification %q, expected %q", n, "queued")
+  }
+  if err := r.Request("echo", "again", &out); err != nil || out != "again" {
+    t.Errorf("Request() => (%q, %v)", out, err)
+  }
+
+  r.Close()
+  expectState(StateClosed)
+  if err := r.Request("echo", "hello", &out); err != ErrSockClosed {
+    t.Errorf("Request() after Close => %v, expected %v", err, ErrSockClosed)
+  }
+}
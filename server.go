@@ -0,0 +1,613 @@
+package gotalk
+
+import (
+  "context"
+  "crypto/tls"
+  "net"
+  "os"
+  "os/signal"
+  "path/filepath"
+  "sync"
+  "syscall"
+  "time"
+)
+
+// What a Server does with connections beyond the limit set with SetMaxConnections
+type ConnLimitPolicy int
+
+const (
+  // Accept the connection, tell the peer the server is going away with the reason
+  // "server busy" if it supports that, and close it (the default.)
+  RejectConnPolicy = ConnLimitPolicy(iota)
+
+  // Stop accepting connections until a connection has closed, leaving new connections
+  // waiting in the listener's backlog
+  QueueConnPolicy
+)
+
+// Accepts connections from a listener, creating a Sock for each connection
+type Server struct {
+  handlers         Handlers
+  listener         net.Listener
+  streamReqLimit   int
+  streamWindow     int
+  maxRequests      int
+  maxMsgSize       int
+  bufReuse         bool
+  compress         bool
+  compressMin      int
+  checksum         bool
+  minVersion       int
+  codec            Codec
+  logger           Logger
+  heartbeat        time.Duration
+  notifyBatching   time.Duration
+  idleTimeout      time.Duration
+  handshakeTimeout time.Duration
+  maxConns         int
+  connPolicy       ConnLimitPolicy
+  onAccept         func(Sock) error
+  onProtocolErr    func(Sock, *ProtocolError)
+  handshakeData    []byte
+
+  mu               sync.Mutex
+  socks            map[*socket]struct{}  // connected sockets
+  shutdown         bool                  // true after Shutdown has been called
+  closed           bool                  // true after the listener has been closed
+  nconns           int                   // accepted connections, including those handshaking
+  connFreed        sync.Cond             // signalled when nconns decreases or when closed
+}
+
+// Create a server accepting connections from `l`, serving requests with `h`. If `h` is nil,
+// DefaultHandlers is used.
+func NewServer(h Handlers, l net.Listener) *Server {
+  if h == nil {
+    h = DefaultHandlers
+  }
+  s := &Server{handlers:h, listener:l, socks:make(map[*socket]struct{})}
+  s.connFreed.L = &s.mu
+  return s
+}
+
+// Start a `how` server listening for connections at `addr`. You need to call Accept() on the
+// returned server to start accepting connections.
+//
+// For unix sockets, `addr` is the path of the socket file. A socket file left behind by a
+// process which didn't shut down cleanly is removed, and the file is removed again when the
+// server is closed.
+func ListenServer(how, addr string) (*Server, error) {
+  if how == "unix" || how == "unixpacket" {
+    if err := removeStaleUnixSocket(how, addr); err != nil {
+      return nil, err
+    }
+  }
+  l, err := net.Listen(how, addr)
+  if err != nil {
+    return nil, err
+  }
+
+  s := NewServer(DefaultHandlers, l)
+  if how == "unix" || how == "unixpacket" {
+    closeOnSignal(s)
+  }
+  return s, nil
+}
+
+// Unix sockets must be unlink()ed before being reused again.
+// Handle common process-killing signals so we can gracefully shut down.
+func closeOnSignal(s *Server) {
+  sigc := make(chan os.Signal, 1)
+  signal.Notify(sigc, os.Interrupt, os.Kill, syscall.SIGTERM)
+  go func(c chan os.Signal) {
+    <-c  // Wait for a signal
+    //sig := <-c  // Wait for a signal
+    //log.Printf("Caught signal %s: shutting down.", sig)
+    s.Close()  // Stop listening and unlink the socket
+    os.Exit(0)
+  }(sigc)
+}
+
+// Start a `how` server listening for connections at `addr`, returning a listening socket. You
+// need to call Accept() on the returned socket to start accepting connections. Unlike
+// ListenServer, the returned socket doesn't support graceful shutdown.
+func Listen(how, addr string) (Sock, error) {
+  srv, err := ListenServer(how, addr)
+  if err != nil {
+    return nil, err
+  }
+  s := NewSock(DefaultHandlers).(*socket)
+  s.listenServer = srv
+  return s, nil
+}
+
+// Like ListenServer("unix", path) but also sets the permissions of the socket file to `perm`, e.g.
+// 0600 to only allow connections from processes of the same user.
+func ListenUnix(path string, perm os.FileMode) (*Server, error) {
+  if err := removeStaleUnixSocket("unix", path); err != nil {
+    return nil, err
+  }
+  l, err := listenUnixPerm(path, perm)
+  if err != nil {
+    return nil, err
+  }
+  s := NewServer(DefaultHandlers, l)
+  closeOnSignal(s)
+  return s, nil
+}
+
+// Creates the socket in a directory only we can access, where its permissions are set before
+// it's linked into place, so that nobody can connect while the permissions are wider.
+func listenUnixPerm(path string, perm os.FileMode) (net.Listener, error) {
+  dir, err := os.MkdirTemp(filepath.Dir(path), ".gotalk")
+  if err != nil {
+    return nil, err
+  }
+  defer os.RemoveAll(dir)
+  tmppath := filepath.Join(dir, "sock")
+  l, err := net.Listen("unix", tmppath)
+  if err != nil {
+    return nil, err
+  }
+  ul := l.(*net.UnixListener)
+  ul.SetUnlinkOnClose(false)
+  if err := os.Chmod(tmppath, perm); err != nil {
+    ul.Close()
+    return nil, err
+  }
+  // Unlike rename, link fails instead of replacing a socket in use at `path`
+  if err := os.Link(tmppath, path); err != nil {
+    ul.Close()
+    return nil, err
+  }
+  return &unixListener{ul, path}, nil
+}
+
+// Removes the socket file when closed
+type unixListener struct {
+  *net.UnixListener
+  path string
+}
+
+func (l *unixListener) Close() error {
+  err := l.UnixListener.Close()
+  os.Remove(l.path)
+  return err
+}
+
+// Removes the unix socket file at `path` unless it's in use or isn't a socket
+func removeStaleUnixSocket(how, path string) error {
+  fi, err := os.Lstat(path)
+  if err != nil || fi.Mode() & os.ModeSocket == 0 {
+    return nil  // let net.Listen deal with it
+  }
+  if c, err := net.Dial(how, path); err == nil {
+    c.Close()
+    return nil  // in use
+  }
+  return os.Remove(path)
+}
+
+// Start a `how` server accepting connections at `addr`.
+func Serve(how, addr string, handler SockHandler) error {
+  s, err := ListenServer(how, addr)
+  if err != nil {
+    return err
+  }
+  return s.Accept(handler)
+}
+
+// Accept connections. Blocks until closed or an error occurs. SockHandler is called for
+// each newly accepted and connected socket, unless nil.
+func (s *Server) Accept(sockHandler SockHandler) error {
+  for {
+    queue := s.connPolicy == QueueConnPolicy
+    if queue {
+      s.takeConn(true)
+    }
+    c, err := s.listener.Accept()
+    if err != nil {
+      if queue {
+        s.releaseConn()
+      }
+      return err
+    }
+    if !queue && !s.takeConn(false) {
+      go rejectConn(c)
+      continue
+    }
+    go s.accept(c, sockHandler)
+  }
+}
+
+// Counts a connection against the limit set with SetMaxConnections. Returns false if the limit
+// has been reached, unless `wait` is true, in which case it waits for a connection to close.
+func (s *Server) takeConn(wait bool) bool {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  for s.maxConns > 0 && s.nconns >= s.maxConns && !s.closed {
+    if !wait {
+      return false
+    }
+    s.connFreed.Wait()
+  }
+  s.nconns++
+  return true
+}
+
+func (s *Server) releaseConn() {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.nconns--
+  s.connFreed.Signal()
+}
+
+// Tells the peer of a connection beyond the limit that the server is busy, if it supports that
+// as announced along with its version, without completing the handshake, and closes the
+// connection
+func rejectConn(c net.Conn) {
+  c.SetDeadline(time.Now().Add(time.Second))  // don't wait long for a peer not reading
+  if _, err := WriteVersion(c); err == nil {
+    if _, err := ReadVersion(c); err == nil && readPeerFeatures(c) & featureGoAway != 0 {
+      c.Write(MakeMsg(MsgTypeGoingAway, "", "server busy", 0))
+    }
+  }
+  c.Close()
+}
+
+func (s *Server) accept(c net.Conn, sockHandler SockHandler) {
+  defer s.releaseConn()
+  s2 := NewSock(s.handlers).(*socket)
+  s2.SetStreamReqLimit(s.streamReqLimit)
+  s2.SetStreamWindowSize(s.streamWindow)
+  s2.SetMaxConcurrentRequests(s.maxRequests)
+  s2.SetMaxMessageSize(s.maxMsgSize)
+  s2.SetBufferReuse(s.bufReuse)
+  if s.compress {
+    s2.SetCompression(s.compressMin)
+  }
+  s2.SetFrameChecksum(s.checksum)
+  s2.SetCodec(s.codec)
+  s2.SetLogger(s.logger)
+  s2.minVersion = s.minVersion
+  s2.bwInterval = s.notifyBatching
+  s2.SetIdleTimeout(s.idleTimeout)
+  s2.SetHandshakeData(s.handshakeData)
+  if f := s.onProtocolErr; f != nil {
+    s2.OnProtocolError(func(err *ProtocolError) { f(s2, err) })
+  }
+  if s.handshakeTimeout > 0 {
+    c.SetDeadline(time.Now().Add(s.handshakeTimeout))
+  }
+  if tc, ok := c.(*tls.Conn); ok {
+    // Complete the TLS handshake before our own, so that ConnectionState is available
+    if err := tc.Handshake(); err != nil {
+      s2.log().Errorf("TLS handshake with %s failed: %v", c.RemoteAddr(), err)
+      c.Close()
+      return
+    }
+  }
+  s2.Adopt(c)
+  if err := s2.Handshake(); err != nil {
+    s2.log().Errorf("handshake with %s failed: %v", c.RemoteAddr(), err)
+    s2.reportProtocolError(err)
+    c.Close()
+    return
+  }
+  if s.handshakeTimeout > 0 {
+    c.SetDeadline(time.Time{})
+  }
+  if s.onAccept != nil {
+    if err := s.onAccept(s2); err != nil {
+      s2.closeWithError(err)
+      return
+    }
+  }
+  if !s.addSock(s2) {
+    s2.Close()
+    return
+  }
+  if s.heartbeat > 0 {
+    s2.SetHeartbeat(s.heartbeat)
+  }
+  if sockHandler != nil {
+    sockHandler(s2)
+  }
+  s2.Read()
+}
+
+func (s *Server) addSock(s2 *socket) bool {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.shutdown {
+    return false
+  }
+  s.socks[s2] = struct{}{}
+  s2.server = s
+  return true
+}
+
+func (s *Server) removeSock(s2 *socket) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  delete(s.socks, s2)
+}
+
+// Handlers used for accepted connections
+func (s *Server) Handlers() Handlers {
+  return s.handlers
+}
+
+// Set the streaming request limit of accepted connections. See Sock.SetStreamReqLimit
+func (s *Server) SetStreamReqLimit(limit int) {
+  s.streamReqLimit = limit
+}
+
+// Set the stream window size of accepted connections. See Sock.SetStreamWindowSize
+func (s *Server) SetStreamWindowSize(n int) {
+  s.streamWindow = n
+}
+
+// Set the limit of concurrent requests of accepted connections.
+// See Sock.SetMaxConcurrentRequests
+func (s *Server) SetMaxConcurrentRequests(n int) {
+  s.maxRequests = n
+}
+
+// Set the message size limit of accepted connections. See Sock.SetMaxMessageSize
+func (s *Server) SetMaxMessageSize(n int) {
+  s.maxMsgSize = n
+}
+
+// Set whether accepted connections reuse payload buffers. See Sock.SetBufferReuse
+func (s *Server) SetBufferReuse(reuse bool) {
+  s.bufReuse = reuse
+}
+
+// Set the compression threshold of accepted connections. See Sock.SetCompression
+func (s *Server) SetCompression(min int) {
+  s.compress = min >= 0
+  s.compressMin = min
+}
+
+// Enable checksums for accepted connections. See Sock.SetFrameChecksum
+func (s *Server) SetFrameChecksum(enable bool) {
+  s.checksum = enable
+}
+
+// Refuse peers using a protocol version older than `v`. They are told that the server is going
+// away, with the reason "protocol version", and disconnected during the handshake.
+func (s *Server) SetMinProtocolVersion(v int) {
+  s.minVersion = v
+}
+
+// Set the notification batching interval of accepted connections. See Sock.SetNotifyBatching
+func (s *Server) SetNotifyBatching(interval time.Duration) {
+  s.notifyBatching = interval
+}
+
+// Set the idle timeout of accepted connections. See Sock.SetIdleTimeout
+func (s *Server) SetIdleTimeout(d time.Duration) {
+  s.idleTimeout = d
+}
+
+// Close accepted connections which don't complete the handshake within `d`, including any TLS
+// handshake. Zero means no timeout (the default.)
+func (s *Server) SetHandshakeTimeout(d time.Duration) {
+  s.handshakeTimeout = d
+}
+
+// Limit the number of open connections to `n`, including connections still handshaking, with
+// `policy` deciding what happens to connections beyond the limit. Zero means no limit (the
+// default.) Set before calling Accept.
+func (s *Server) SetMaxConnections(n int, policy ConnLimitPolicy) {
+  s.maxConns = n
+  s.connPolicy = policy
+}
+
+// Set a function called for each accepted connection once the handshake has completed, before
+// the connection is handled, e.g. to refuse peers based on their address. If it returns an
+// error, the connection is closed with that error instead.
+func (s *Server) OnAccept(f func(Sock) error) {
+  s.onAccept = f
+}
+
+// Set a function called when the peer of any accepted connection violates the protocol, right
+// before the connection is closed. See Sock.OnProtocolError
+func (s *Server) OnProtocolError(f func(s Sock, err *ProtocolError)) {
+  s.onProtocolErr = f
+}
+
+// Returns the number of open connections, including connections still handshaking
+func (s *Server) ConnectionCount() int {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return s.nconns
+}
+
+// Set the data sent to peers right after the handshake. See Sock.SetHandshakeData
+func (s *Server) SetHandshakeData(b []byte) {
+  s.handshakeData = b
+}
+
+// Set the codec of accepted connections. See Sock.SetCodec
+func (s *Server) SetCodec(c Codec) {
+  s.codec = c
+}
+
+// Set the heartbeat interval of accepted connections. See Sock.SetHeartbeat
+func (s *Server) SetHeartbeat(interval time.Duration) {
+  s.heartbeat = interval
+}
+
+// Set the logger of the server and accepted connections. See Sock.SetLogger
+func (s *Server) SetLogger(l Logger) {
+  s.logger = l
+}
+
+// Returns a snapshot of the connected sockets
+func (s *Server) connectedSocks() []*socket {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  socks := make([]*socket, 0, len(s.socks))
+  for s2 := range s.socks {
+    socks = append(socks, s2)
+  }
+  return socks
+}
+
+// Returns the connected sockets. Sockets connecting or disconnecting while the caller uses the
+// returned slice are not reflected in it.
+func (s *Server) Socks() []Sock {
+  socks := s.connectedSocks()
+  a := make([]Sock, len(socks))
+  for i, s2 := range socks {
+    a[i] = s2
+  }
+  return a
+}
+
+// Calls `f` for each connected socket until it returns false. Like Socks, `f` is called for a
+// snapshot of the connected sockets, so it can e.g. close sockets.
+func (s *Server) Range(f func(Sock) bool) {
+  for _, s2 := range s.connectedSocks() {
+    if !f(s2) {
+      break
+    }
+  }
+}
+
+// Send a notification to all connected sockets. `v` is encoded once per codec and the same
+// payload is sent to each socket, so functions set with Sock.OnNotifyDropped must not modify
+// it. Sockets with a notification queue apply their queue policy, e.g. sockets using
+// DropNewestPolicy skip the notification when their queue is full, while those using
+// BlockPolicy make Broadcast wait for room in their queue.
+//
+// Returns the number of sockets notified, which excludes sockets failing to send the
+// notification, e.g. because they are closing.
+func (s *Server) Broadcast(name string, v interface{}) (int, error) {
+  return s.BroadcastFunc(name, v, nil)
+}
+
+// Like Broadcast but only notifies sockets for which `f` returns true, e.g. subscribers of a
+// topic. If `f` is nil, all sockets are notified.
+func (s *Server) BroadcastFunc(name string, v interface{}, f func(Sock) bool) (int, error) {
+  socks := s.Socks()
+  if f != nil {
+    n := 0
+    for _, s2 := range socks {
+      if f(s2) {
+        socks[n] = s2
+        n++
+      }
+    }
+    socks = socks[:n]
+  }
+  return broadcast(socks, name, v)
+}
+
+// Sends a notification to `socks`, encoding `v` once per codec. Returns the number of sockets
+// notified.
+func broadcast(socks []Sock, name string, v interface{}) (int, error) {
+  var bufs map[string][]byte  // keyed by codec name
+  n := 0
+  for _, s := range socks {
+    codec := codecOf(s)
+    buf, ok := bufs[codec.Name()]
+    if !ok {
+      var err error
+      if buf, err = codec.Marshal(v); err != nil {
+        return n, err
+      }
+      if bufs == nil {
+        bufs = make(map[string][]byte, 1)
+      }
+      bufs[codec.Name()] = buf
+    }
+    if s.BufferNotify(name, buf) == nil {
+      n++
+    }
+  }
+  return n, nil
+}
+
+// Like Broadcast but ignores errors encoding `v`
+func (s *Server) BroadcastNotify(name string, v interface{}) int {
+  n, _ := s.Broadcast(name, v)
+  return n
+}
+
+// Returns the sum of the counters of all connected sockets. See Sock.Stats
+func (s *Server) Stats() Stats {
+  var st Stats
+  for _, s2 := range s.connectedSocks() {
+    st = st.Add(s2.Stats())
+  }
+  return st
+}
+
+// Address of the listener
+func (s *Server) Addr() string {
+  return s.listener.Addr().String()
+}
+
+// Stop listening for connections. Already accepted connections are left open.
+func (s *Server) Close() error {
+  s.closeListener()
+  return s.listener.Close()
+}
+
+// Wakes up Accept waiting for a connection to close, so that it fails with the listener
+func (s *Server) closeListener() {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.closed = true
+  s.connFreed.Broadcast()
+}
+
+// Gracefully shut down the server: Stop accepting connections and tell connected peers that we
+// are going away, if they support that, refusing any new requests from them. Then wait for requests being handled to
+// complete, or for `ctx` to be done, before closing all connections.
+//
+// Returns the number of requests which were still being handled when the connections were
+// closed, together with ctx.Err() if `ctx` was done before all requests completed.
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+  s.mu.Lock()
+  s.shutdown = true
+  socks := make([]*socket, 0, len(s.socks))
+  for s2 := range s.socks {
+    socks = append(socks, s2)
+  }
+  s.mu.Unlock()
+
+  s.closeListener()
+  s.listener.Close()
+
+  idle := make([]<-chan struct{}, len(socks))
+  for i, s2 := range socks {
+    idle[i] = s2.goAway("shutdown")
+  }
+
+  var err error
+  for _, ch := range idle {
+    select {
+    case <-ch:
+    case <-ctx.Done():
+      err = ctx.Err()
+    }
+    if err != nil {
+      break
+    }
+  }
+
+  n := 0
+  for _, s2 := range socks {
+    n += s2.inflightCount()
+    if err == nil {
+      // Wait for the results of requests which just ended to be written
+      s2.wmu.Lock()
+      s2.wmu.Unlock()
+    }
+    s2.Close()
+  }
+  return n, err
+}
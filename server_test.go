@@ -0,0 +1,750 @@
+package gotalk
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "net"
+  "os"
+  "path/filepath"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+
+// Returns a server accepting connections on a random local TCP port
+func listenTCP(t *testing.T, h Handlers) *Server {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  s := NewServer(h, l)
+  go s.Accept(nil)
+  return s
+}
+
+
+func TestServerShutdown(t *testing.T) {
+  h := NewHandlers()
+  started := make(chan struct{}, 1)
+  release := make(chan struct{})
+  h.HandleRequest("work", func() (string, error) {
+    started <- struct{}{}
+    <-release
+    return "done", nil
+  })
+  srv := listenTCP(t, h)
+
+  s, err := Connect("tcp", srv.Addr())
+  if err != nil {
+    t.Fatal(err)
+  }
+  goingAway := make(chan string, 1)
+  s.SetGoingAwayFunc(func(_ Sock, reason string) { goingAway <- reason })
+  closed := make(chan struct{})
+  s.SetCloseFunc(func(Sock) { close(closed) })
+
+  reqerr := make(chan error, 1)
+  go func() {
+    var out string
+    reqerr <- s.Request("work", nil, &out)
+  }()
+  <-started
+
+  type shutdownResult struct {
+    n   int
+    err error
+  }
+  shutdown := make(chan shutdownResult, 1)
+  go func() {
+    n, err := srv.Shutdown(context.Background())
+    shutdown <- shutdownResult{n, err}
+  }()
+
+  if reason := <-goingAway; reason != "shutdown" {
+    t.Errorf("going away with reason %q, expected %q", reason, "shutdown")
+  }
+
+  // New requests are refused while the running one is allowed to complete
+  if e, ok := s.Request("work", nil, nil).(*RequestError); !ok || e.Code() != ErrCodeGoingAway {
+    t.Errorf("Request() => %v, expected error with code ErrCodeGoingAway", e)
+  }
+  select {
+  case r := <-shutdown:
+    t.Fatalf("Shutdown() => (%v, %v) while a request was being handled", r.n, r.err)
+  default:
+  }
+  close(release)
+  if err := <-reqerr; err != nil {
+    t.Errorf("Request() failed: %v", err)
+  }
+  if r := <-shutdown; r.n != 0 || r.err != nil {
+    t.Errorf("Shutdown() => (%v, %v), expected (0, nil)", r.n, r.err)
+  }
+
+  // The server closes the connection
+  select {
+  case <-closed:
+  case <-time.After(time.Second):
+    t.Errorf("connection not closed after shutdown")
+  }
+}
+
+
+func TestServerShutdownTimeout(t *testing.T) {
+  h := NewHandlers()
+  started := make(chan struct{}, 1)
+  release := make(chan struct{})
+  defer close(release)
+  h.HandleRequest("work", func() error {
+    started <- struct{}{}
+    <-release
+    return nil
+  })
+  srv := listenTCP(t, h)
+
+  s, err := Connect("tcp", srv.Addr())
+  if err != nil {
+    t.Fatal(err)
+  }
+  go s.Request("work", nil, nil)
+  <-started
+
+  ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+  defer cancel()
+  if n, err := srv.Shutdown(ctx); n != 1 || err != context.DeadlineExceeded {
+    t.Errorf("Shutdown() => (%v, %v), expected (1, %v)", n, err, context.DeadlineExceeded)
+  }
+}
+
+
+func TestServerUnix(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "gotalk.sock")
+
+  // Leave a stale socket file behind
+  l, err := net.Listen("unix", path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  l.(*net.UnixListener).SetUnlinkOnClose(false)
+  l.Close()
+
+  h := NewHandlers()
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  srv, err := ListenUnix(path, 0600)
+  if err != nil {
+    t.Fatal(err)
+  }
+  srv.handlers = h
+  go srv.Accept(nil)
+  if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+    t.Errorf("socket file mode %v (%v), expected %v", fi.Mode().Perm(), err, os.FileMode(0600))
+  }
+
+  // No temporary files are left behind
+  if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+    t.Errorf("%d files next to the socket file, expected none", len(entries) - 1)
+  }
+
+  // Refuse to replace a socket in use
+  if _, err := Listen("unix", path); err == nil {
+    t.Errorf("Listen() succeeded on a socket in use")
+  }
+  if _, err := ListenUnix(path, 0600); err == nil {
+    t.Errorf("ListenUnix() succeeded on a socket in use")
+  }
+
+  s, err := Connect("unix", path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  var out string
+  if err := s.Request("echo", "hello", &out); err != nil || out != "hello" {
+    t.Errorf("Request() => (%q, %v)", out, err)
+  }
+  s.Close()
+
+  srv.Close()
+  if _, err := os.Stat(path); !os.IsNotExist(err) {
+    t.Errorf("socket file not removed on close: %v", err)
+  }
+}
+
+
+func TestListenSock(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  h := NewHandlers()
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  ls := NewSock(h)
+  ls.AdoptListener(l)
+  if ls.Addr() != l.Addr().String() {
+    t.Errorf("Addr() => %q, expected %q", ls.Addr(), l.Addr().String())
+  }
+  acceptErr := make(chan error, 1)
+  go func() { acceptErr <- ls.Accept(nil) }()
+
+  s, err := Connect("tcp", ls.Addr())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s.Close()
+  var out string
+  if err := s.Request("echo", "hello", &out); err != nil || out != "hello" {
+    t.Errorf("Request() => (%q, %v)", out, err)
+  }
+
+  // Closing the listening socket stops Accept
+  ls.Close()
+  select {
+  case err := <-acceptErr:
+    if err == nil {
+      t.Errorf("Accept() => nil after Close")
+    }
+  case <-time.After(time.Second):
+    t.Errorf("Accept() still running after Close")
+  }
+
+  // Listen returns a listening socket too
+  ls2, err := Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if ls2.Addr() == "" {
+    t.Errorf("Addr() => \"\" for listening socket")
+  }
+  ls2.Close()
+}
+
+
+func TestServerMinProtocolVersion(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  srv := NewServer(NewHandlers(), l)
+  srv.SetMinProtocolVersion(int(ProtocolVersion) + 1)
+  go srv.Accept(nil)
+  defer srv.Close()
+
+  // Our side completes the handshake, but is then told why the server goes away
+  s, err := dial("tcp", srv.Addr(), NewHandlers())
+  if err != nil {
+    t.Fatalf("handshake failed: %v", err)
+  }
+  if v := s.ProtocolVersion(); v != int(ProtocolVersion) {
+    t.Errorf("ProtocolVersion() => %d, expected %d", v, ProtocolVersion)
+  }
+  goingAway := make(chan string, 1)
+  s.SetGoingAwayFunc(func(_ Sock, reason string) { goingAway <- reason })
+  readerr := make(chan error, 1)
+  go func() { readerr <- s.Read() }()
+
+  select {
+  case reason := <-goingAway:
+    if reason != "protocol version" {
+      t.Errorf("going away with reason %q, expected %q", reason, "protocol version")
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("server did not refuse the old client")
+  }
+  select {
+  case <-readerr:
+  case <-time.After(time.Second):
+    t.Fatalf("connection to the server did not close")
+  }
+  if err := s.Request("echo", nil, nil); err == nil {
+    t.Errorf("Request() succeeded after the server refused the client")
+  }
+
+  if v := NewSock(nil).ProtocolVersion(); v != -1 {
+    t.Errorf("ProtocolVersion() => %d before handshake, expected -1", v)
+  }
+}
+
+
+func TestServerSocks(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("ping", func() error { return nil })
+  srv := listenTCP(t, h)
+  defer srv.Close()
+
+  received := make(chan string, 2)
+  ch := NewHandlers()
+  ch.HandleNotification("hello", func(s string) { received <- s })
+  var clients []Sock
+  for i := 0; i < 2; i++ {
+    s, err := dial("tcp", srv.Addr(), ch)
+    if err != nil {
+      t.Fatal(err)
+    }
+    defer s.Close()
+    go s.Read()
+    // The server registers a connection before reading from it
+    if _, err := s.BufferRequest("ping", nil); err != nil {
+      t.Fatal(err)
+    }
+    clients = append(clients, s)
+  }
+
+  if n := len(srv.Socks()); n != 2 {
+    t.Errorf("len(Socks()) = %d, expected 2", n)
+  }
+  n := 0
+  srv.Range(func(Sock) bool {
+    n++
+    return false
+  })
+  if n != 1 {
+    t.Errorf("Range called f %d times after it returned false, expected 1", n)
+  }
+
+  if n := srv.BroadcastNotify("hello", "hi"); n != 2 {
+    t.Errorf("BroadcastNotify() = %d, expected 2", n)
+  }
+  for i := 0; i < 2; i++ {
+    select {
+    case s := <-received:
+      if s != "hi" {
+        t.Errorf("received %q, expected \"hi\"", s)
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("notification was not received by all clients")
+    }
+  }
+
+  // Disconnected sockets are no longer included
+  clients[0].Close()
+  for deadline := time.Now().Add(time.Second); len(srv.Socks()) != 1; {
+    if time.Now().After(deadline) {
+      t.Fatalf("len(Socks()) = %d after disconnect, expected 1", len(srv.Socks()))
+    }
+    time.Sleep(time.Millisecond)
+  }
+}
+
+
+// JSONCodec counting calls to Marshal
+type countingCodec struct {
+  marshals int32
+}
+
+func (c *countingCodec) Name() string { return "json" }
+func (c *countingCodec) Marshal(v interface{}) ([]byte, error) {
+  atomic.AddInt32(&c.marshals, 1)
+  return json.Marshal(v)
+}
+func (c *countingCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+
+func TestServerBroadcast(t *testing.T) {
+  h := NewHandlers()
+  h.HandleBufferRequest("ping", func(Sock, string, []byte) ([]byte, error) { return nil, nil })
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  srv := NewServer(h, l)
+  defer srv.Close()
+  codec := &countingCodec{}
+  srv.SetCodec(codec)
+  go srv.Accept(nil)
+
+  received := make(chan string, 3)
+  ch := NewHandlers()
+  ch.HandleNotification("hello", func(s string) { received <- s })
+  for i := 0; i < 3; i++ {
+    c, err := net.Dial("tcp", srv.Addr())
+    if err != nil {
+      t.Fatal(err)
+    }
+    s := NewSock(ch)
+    s.SetCodec(&countingCodec{})
+    s.Adopt(c)
+    defer s.Close()
+    if err := s.Handshake(); err != nil {
+      t.Fatal(err)
+    }
+    go s.Read()
+    if _, err := s.BufferRequest("ping", nil); err != nil {
+      t.Fatal(err)
+    }
+  }
+  expectReceived := func(n int, expected string) {
+    t.Helper()
+    for i := 0; i < n; i++ {
+      select {
+      case s := <-received:
+        if s != expected {
+          t.Errorf("received %q, expected %q", s, expected)
+        }
+      case <-time.After(time.Second):
+        t.Fatalf("notification was not received by all clients")
+      }
+    }
+  }
+
+  // The notification is encoded once for all sockets
+  if n, err := srv.Broadcast("hello", "hi"); n != 3 || err != nil {
+    t.Errorf("Broadcast() = (%d, %v), expected (3, nil)", n, err)
+  }
+  if n := atomic.LoadInt32(&codec.marshals); n != 1 {
+    t.Errorf("value encoded %d times, expected once", n)
+  }
+  expectReceived(3, "hi")
+
+  skipped := srv.Socks()[0]
+  n, err := srv.BroadcastFunc("hello", "some", func(s Sock) bool { return s != skipped })
+  if n != 2 || err != nil {
+    t.Errorf("BroadcastFunc() = (%d, %v), expected (2, nil)", n, err)
+  }
+  expectReceived(2, "some")
+
+  if n, err := srv.Broadcast("hello", make(chan int)); n != 0 || err == nil {
+    t.Errorf("Broadcast() = (%d, %v), expected an encoding error", n, err)
+  }
+}
+
+
+func TestServerHandshakeTimeout(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  h := NewHandlers()
+  h.HandleBufferRequest("ping", func(Sock, string, []byte) ([]byte, error) {
+    return []byte("pong"), nil
+  })
+  srv := NewServer(h, l)
+  srv.SetHandshakeTimeout(50*time.Millisecond)
+  go srv.Accept(nil)
+  defer srv.Close()
+
+  // A peer which never sends its protocol version is disconnected
+  c, err := net.Dial("tcp", srv.Addr())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer c.Close()
+  c.SetReadDeadline(time.Now().Add(time.Second))
+  if _, err := ReadVersion(c); err != nil {
+    t.Fatalf("ReadVersion() failed: %v", err)
+  }
+  readRawMsg(t, c)  // features
+  if _, err := c.Read(make([]byte, 1)); err == nil {
+    t.Fatalf("read data from the server, expected the connection to be closed")
+  } else if e, ok := err.(net.Error); ok && e.Timeout() {
+    t.Fatalf("connection was not closed by the handshake timeout")
+  }
+
+  // Sockets which completed the handshake are not affected
+  s, err := dial("tcp", srv.Addr(), NewHandlers())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s.Close()
+  go s.Read()
+  time.Sleep(100*time.Millisecond)
+  if out, err := s.BufferRequest("ping", nil); err != nil || string(out) != "pong" {
+    t.Errorf("BufferRequest() => (%q, %v), expected \"pong\"", out, err)
+  }
+}
+
+
+func TestServerMaxConnections(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("ping", func() (struct{}, error) { return struct{}{}, nil })
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  srv := NewServer(h, l)
+  srv.SetMaxConnections(1, RejectConnPolicy)
+  go srv.Accept(nil)
+  defer srv.Close()
+
+  s1, err := Connect("tcp", srv.Addr())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := s1.Request("ping", nil, &struct{}{}); err != nil {
+    t.Fatal(err)
+  }
+  if n := srv.ConnectionCount(); n != 1 {
+    t.Errorf("ConnectionCount() => %d, expected 1", n)
+  }
+
+  // The next connection is told why it's closed right away, before it's handled
+  start := time.Now()
+  s2, err := dial("tcp", srv.Addr(), NewHandlers())
+  if err != nil {
+    t.Fatalf("handshake failed: %v", err)
+  }
+  goingAway := make(chan string, 1)
+  s2.SetGoingAwayFunc(func(_ Sock, reason string) { goingAway <- reason })
+  readerr := make(chan error, 1)
+  go func() { readerr <- s2.Read() }()
+  select {
+  case reason := <-goingAway:
+    if reason != "server busy" {
+      t.Errorf("going away with reason %q, expected %q", reason, "server busy")
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("server did not reject the connection")
+  }
+  select {
+  case <-readerr:
+  case <-time.After(time.Second):
+    t.Fatalf("rejected connection did not close")
+  }
+  if d := time.Since(start); d > 500*time.Millisecond {
+    t.Errorf("rejecting the connection took %v", d)
+  }
+  if n := srv.ConnectionCount(); n != 1 {
+    t.Errorf("ConnectionCount() => %d after rejecting, expected 1", n)
+  }
+
+  // Closing a connection makes room for another
+  s1.Close()
+  for i := 0; srv.ConnectionCount() != 0; i++ {
+    if i == 100 {
+      t.Fatalf("ConnectionCount() => %d after closing, expected 0", srv.ConnectionCount())
+    }
+    time.Sleep(10*time.Millisecond)
+  }
+  s3, err := Connect("tcp", srv.Addr())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s3.Close()
+  if err := s3.Request("ping", nil, &struct{}{}); err != nil {
+    t.Errorf("Request() => %v after a connection closed", err)
+  }
+}
+
+
+func TestServerGoingAwayBaselinePeer(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  srv := NewServer(NewHandlers(), l)
+  srv.SetMaxConnections(1, RejectConnPolicy)
+  accepted := make(chan struct{}, 1)
+  go srv.Accept(func(Sock) { accepted <- struct{}{} })
+  defer srv.Close()
+
+  dialBaseline := func() <-chan MsgType {
+    c, err := net.Dial("tcp", srv.Addr())
+    if err != nil {
+      t.Fatal(err)
+    }
+    return baselinePeer(c)
+  }
+  expectClosed := func(unknown <-chan MsgType) {
+    select {
+    case ty, ok := <-unknown:
+      if ok {
+        t.Errorf("peer was sent a message of unknown type %c", byte(ty))
+      }
+    case <-time.After(2*time.Second):
+      t.Fatalf("connection was not closed")
+    }
+  }
+
+  // Peers which don't announce going away are neither told that the server is busy nor that it
+  // shuts down, but simply disconnected
+  unknown1 := dialBaseline()
+  <-accepted
+  expectClosed(dialBaseline())
+  ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+  defer cancel()
+  if _, err := srv.Shutdown(ctx); err != nil {
+    t.Errorf("Shutdown() failed: %v", err)
+  }
+  expectClosed(unknown1)
+}
+
+
+func TestServerMaxConnectionsQueue(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  srv := NewServer(NewHandlers(), l)
+  srv.SetMaxConnections(1, QueueConnPolicy)
+  go srv.Accept(nil)
+  defer srv.Close()
+
+  s1, err := Connect("tcp", srv.Addr())
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // The next connection waits to be accepted until the first closes
+  connected := make(chan Sock, 1)
+  go func() {
+    s2, err := Connect("tcp", srv.Addr())
+    if err != nil {
+      t.Error(err)
+    }
+    connected <- s2
+  }()
+  select {
+  case <-connected:
+    t.Fatalf("connection beyond the limit was accepted")
+  case <-time.After(100*time.Millisecond):
+  }
+  s1.Close()
+  select {
+  case s2 := <-connected:
+    if s2 != nil {
+      s2.Close()
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("queued connection was not accepted after a connection closed")
+  }
+}
+
+
+func TestServerOnAccept(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("ping", func() (struct{}, error) { return struct{}{}, nil })
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  srv := NewServer(h, l)
+  errRejected := errors.New("rejected")
+  closed := make(chan error, 1)
+  var n int32
+  srv.OnAccept(func(s Sock) error {
+    if s.RemoteAddr() == nil || s.ProtocolVersion() != int(ProtocolVersion) {
+      t.Errorf("OnAccept called before the handshake")
+    }
+    if atomic.AddInt32(&n, 1) == 1 {
+      s.OnClose(func(err error) { closed <- err })
+      return errRejected
+    }
+    return nil
+  })
+  go srv.Accept(nil)
+  defer srv.Close()
+
+  // The first connection is closed before it's handled
+  s1, err := dial("tcp", srv.Addr(), NewHandlers())
+  if err != nil {
+    t.Fatal(err)
+  }
+  readerr := make(chan error, 1)
+  go func() { readerr <- s1.Read() }()
+  select {
+  case <-readerr:
+  case <-time.After(time.Second):
+    t.Fatalf("rejected connection was not closed")
+  }
+  if err := <-closed; err != errRejected {
+    t.Errorf("connection closed with %v, expected %v", err, errRejected)
+  }
+  if socks := srv.Socks(); len(socks) != 0 {
+    t.Errorf("Socks() => %v, expected the rejected connection to be left out", socks)
+  }
+
+  s2, err := Connect("tcp", srv.Addr())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s2.Close()
+  if err := s2.Request("ping", nil, &struct{}{}); err != nil {
+    t.Errorf("Request() => %v on an accepted connection", err)
+  }
+}
+
+
+func TestServerOnProtocolError(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  srv := NewServer(NewHandlers(), l)
+  errc := make(chan *ProtocolError, 1)
+  srv.OnProtocolError(func(s Sock, err *ProtocolError) {
+    if s == nil {
+      t.Errorf("OnProtocolError func called without a socket")
+    }
+    errc <- err
+  })
+  go srv.Accept(nil)
+  defer srv.Close()
+
+  c, err := net.Dial("tcp", srv.Addr())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer c.Close()
+  if _, err := WriteVersion(c); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := ReadVersion(c); err != nil {
+    t.Fatal(err)
+  }
+  c.Write([]byte("x00100000000"))
+  select {
+  case err := <-errc:
+    if err.MsgType() != MsgType('x') {
+      t.Errorf("got error %v for %c message, expected 'x'", err, byte(err.MsgType()))
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("OnProtocolError func not called")
+  }
+}
+
+
+func TestHandshakeData(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("peerdata", func(s Sock) (string, error) {
+    return string(s.PeerHandshakeData()), nil
+  })
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  srv := NewServer(h, l)
+  srv.SetHandshakeData([]byte("server-v2"))
+  go srv.Accept(nil)
+  defer srv.Close()
+
+  c, err := net.Dial("tcp", srv.Addr())
+  if err != nil {
+    t.Fatal(err)
+  }
+  s := NewSock(NewHandlers())
+  s.SetHandshakeData([]byte("client-v1"))
+  s.Adopt(c)
+  if err := s.Handshake(); err != nil {
+    t.Fatal(err)
+  }
+  go s.Read()
+  defer s.Close()
+
+  // The data is read before the request, and the server's data before the result
+  var out string
+  if err := s.Request("peerdata", nil, &out); err != nil || out != "client-v1" {
+    t.Errorf("Request() => (%q, %v), expected %q", out, err, "client-v1")
+  }
+  if d := s.PeerHandshakeData(); string(d) != "server-v2" {
+    t.Errorf("PeerHandshakeData() => %q, expected %q", d, "server-v2")
+  }
+
+  // Peers not sending data
+  s2, err := Connect("tcp", srv.Addr())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s2.Close()
+  if err := s2.Request("peerdata", nil, &out); err != nil || out != "" {
+    t.Errorf("Request() => (%q, %v), expected no data", out, err)
+  }
+}
@@ -0,0 +1,57 @@
+package gotalk
+
+import (
+  "errors"
+  "time"
+)
+
+// Returned by Read, and given to the OnClose func, when the socket closed because the peer
+// didn't read what we wrote fast enough. See Sock.SetSlowConsumerLimit
+var ErrSlowConsumer = errors.New("slow consumer")
+
+func (s *socket) SetSlowConsumerLimit(maxQueuedBytes int, maxDuration time.Duration) {
+  s.slowMu.Lock()
+  defer s.slowMu.Unlock()
+  if s.slowStop != nil {
+    close(s.slowStop)
+    s.slowStop = nil
+  }
+  if maxQueuedBytes > 0 {
+    s.slowStop = make(chan struct{})
+    go s.slowConsumerLoop(maxQueuedBytes, maxDuration, s.slowStop)
+  }
+}
+
+// Closes the socket with ErrSlowConsumer once more than `maxBytes` have been waiting to be
+// written for longer than `maxDuration`, checking a few times per `maxDuration`
+func (s *socket) slowConsumerLoop(maxBytes int, maxDuration time.Duration, stop chan struct{}) {
+  interval := maxDuration / 4
+  if interval < time.Millisecond {
+    interval = time.Millisecond
+  }
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  var overSince time.Time  // when the queue last grew beyond maxBytes, or zero
+  for {
+    select {
+    case <-stop:
+      return
+    case <-s.ctx.Done():
+      return
+    case <-ticker.C:
+    }
+    if s.PendingSendBytes() <= maxBytes {
+      overSince = time.Time{}
+      continue
+    }
+    if overSince.IsZero() {
+      overSince = time.Now()
+    }
+    if time.Since(overSince) >= maxDuration {
+      s.log().Errorf("more than %d bytes waiting to be written for %v; closing connection",
+        maxBytes, maxDuration)
+      s.closeWithError(ErrSlowConsumer)
+      return
+    }
+  }
+}
@@ -0,0 +1,63 @@
+package gotalk
+
+import (
+  "testing"
+  "time"
+)
+
+
+func TestSlowConsumerLimit(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  closed := make(chan error, 1)
+  s.OnClose(func(err error) { closed <- err })
+  s.SetSlowConsumerLimit(10, 20*time.Millisecond)
+
+  // Nothing is read from `c`, so the notification waits to be written
+  errc := make(chan error, 1)
+  go func() { errc <- s.BufferNotify("note", make([]byte, 20)) }()
+  for deadline := time.Now().Add(time.Second); s.PendingSendBytes() != 20; {
+    if time.Now().After(deadline) {
+      t.Fatalf("PendingSendBytes() => %d, expected 20", s.PendingSendBytes())
+    }
+    time.Sleep(time.Millisecond)
+  }
+
+  select {
+  case err := <-closed:
+    if err != ErrSlowConsumer {
+      t.Errorf("socket closed with %v, expected ErrSlowConsumer", err)
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("socket not closed")
+  }
+  if err := <-errc; err == nil {
+    t.Errorf("BufferNotify() succeeded after the socket closed")
+  }
+}
+
+
+func TestSlowConsumerLimitNotExceeded(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  s.SetSlowConsumerLimit(100, 20*time.Millisecond)
+
+  // Small messages which are read, if slowly, don't close the socket
+  errc := make(chan error, 1)
+  go func() {
+    for i := 0; i < 5; i++ {
+      if err := s.BufferNotify("note", make([]byte, 20)); err != nil {
+        errc <- err
+        return
+      }
+    }
+    errc <- nil
+  }()
+  for i := 0; i < 5; i++ {
+    time.Sleep(10*time.Millisecond)
+    readRawMsg(t, c)
+  }
+  if err := <-errc; err != nil {
+    t.Fatal(err)
+  }
+}
@@ -1,185 +1,678 @@
 package gotalk
 
 import (
+  "bufio"
+  "bytes"
+  "compress/flate"
+  "context"
+  "crypto/tls"
   "encoding/json"
   "errors"
+  "fmt"
   "io"
-  "log"
+  "math"
   "net"
-  "os"
-  "os/signal"
+  "net/http"
+  "strconv"
   "sync"
-  "syscall"
+  "sync/atomic"
+  "time"
+  "golang.org/x/net/websocket"
 )
 
+// A connection over which requests and notifications are sent and received. Requests and
+// notifications can be sent from any number of goroutines at once: each message is written to
+// the connection in one piece, never interleaved with another message.
 type Sock interface {
   // Adopt an I/O stream, which should already be in a "connected" state. After calling this,
   // you need to call Handshake and Read to perform the protocol handshake and read messages.
   Adopt(io.ReadWriteCloser)
 
+  // Adopt a listener, which should already be in a "listening" state. Use a Server instead for
+  // graceful shutdown and other server features.
+  AdoptListener(net.Listener)
+
+  // Accept connections. Blocks until closed or an error occurs. SockHandler is called for
+  // each newly accepted and connected socket, unless nil. Accepted sockets inherit the
+  // handlers, codec, logger and limits of this socket.
+  Accept(SockHandler) error
+
   // Before reading any messages over a socket, handshake must happen. This function will block
   // until the handshake either succeeds or fails.
   Handshake() error
 
+  // Like Handshake but gives up when `ctx` is done, closing the socket and returning ctx.Err().
+  // The handshake is the first thing written to and read from the connection once adopted, so
+  // call it after Adopt and before Read, requests or notifications. Anything else exchanged on
+  // the connection, e.g. an authentication exchange of your own, must happen before Adopt.
+  HandshakeContext(ctx context.Context) error
+
   // After completing a succesful handshake, call this function to read messages received to this
   // socket. Does not return until the socket is closed.
   Read() error
 
-  // Adopt a listener, which should already be in a "listening" state.
-  AdoptListener(net.Listener)
-
-  // Accept connections. Blocks until closed or an error occurs. SockHandler is called for
-  // each newly accepted and connected socket, unless nil.
-  Accept(SockHandler) error
-
-  // Perform requests
+  // Perform requests. Any number of requests can be in flight at once, e.g. sent from different
+  // goroutines. Results are matched to their requests by request ID, whatever order the peer
+  // sends them in. Results are read one at a time, each waiting for its requestor to take it,
+  // so a streaming request whose results aren't read holds up the results of other requests.
   Request(op string, in interface{}, out interface{}) error
+  // Like Request but gives up waiting for the result when `ctx` is done, in which case the
+  // peer is asked to cancel the request, if it supports that, and `ctx.Err()` is returned.
+  // If `ctx` has a deadline, the remaining time is sent along so that the context of the
+  // handler expires with it.
+  RequestContext(ctx context.Context, op string, in interface{}, out interface{}) error
+  // Like Request but sends `in` as is and returns the result as is, without encoding either
+  // with the codec, e.g. for binary protocols handled with HandleBufferRequest
   BufferRequest(op string, in []byte) ([]byte, error)
+  // Send a request for operation `op` without waiting for its result, like a notification
+  // handled by the request handler of `op`. The peer doesn't write the result, so the request
+  // costs no round-trip, but neither does the requestor learn whether it succeeded. Returns
+  // once the request has been written.
+  RequestNoReply(op string, in interface{}) error
+  // Like Request but sends `key` along, so that handlers with an idempotency cache (see
+  // Handlers.SetIdempotencyCache) return the result of an earlier request with the same key
+  // rather than handling it again. Requests failing with a transient error, like ErrTimeout or
+  // an error of code ErrCodeOverloaded, are retried a few times with backoff. Use a key unique
+  // to the operation being performed, e.g. a random ID generated before the first attempt.
+  RequestIdempotent(op string, in, out interface{}, key string) error
+  // Like Request but also sends metadata, like a trace ID or an auth token, which handlers
+  // taking a context can access with RequestMetaFromContext. Peers not supporting metadata
+  // ignore it.
+  RequestWithMeta(op string, in, out interface{}, meta map[string]string) error
+  // Like RequestWithMeta but also returns the metadata the handler set on the result with
+  // SetResultMeta, or nil if it set none.
+  RequestWithResultMeta(op string, in, out interface{}, meta map[string]string) (map[string]string, error)
+  // Send the requests of `reqs` with a single write and wait for all their results, each
+  // carrying its own error. Fails without results if the requests couldn't be sent. The
+  // request timeout applies to the batch as a whole.
+  RequestBatch(reqs []BatchReq) ([]BatchResult, error)
   StreamRequest(op string) StreamRequest
+  // Start a stream of notifications named `name`, which the peer can handle as a whole with
+  // Handlers.HandleNotificationStream. `send` encodes a value with the codec and sends it as
+  // the next part; parts are delivered in the order they were sent. `close` ends the stream,
+  // after which `send` fails with ErrStreamEnded. Peers without a stream handler for `name`
+  // receive the parts as separate notifications.
+  NotifyStream(name string) (send func(interface{}) error, close func())
+  // Number of requests sent which are waiting for their result, including streaming requests
+  // whose result hasn't ended
+  InFlightRequests() int
+  // Number of messages waiting to be written to the connection, including queued notifications
+  // and writes in progress. A number which keeps growing means the peer doesn't read as fast as
+  // we write, e.g. a slow consumer. Cheap to call and doesn't lock.
+  PendingSendCount() int
+  // Number of payload bytes waiting to be written to the connection, like PendingSendCount
+  PendingSendBytes() int
+
+  // Close the socket when more than `maxQueuedBytes` have been waiting to be written (see
+  // PendingSendBytes) for longer than `maxDuration`, e.g. because the peer stopped reading, in
+  // which case OnClose receives ErrSlowConsumer. This keeps a stuck peer from holding on to an
+  // ever-growing amount of memory, e.g. when broadcasting notifications. A `maxQueuedBytes` of
+  // 0 removes the limit (the default.)
+  SetSlowConsumerLimit(maxQueuedBytes int, maxDuration time.Duration)
   Notify(name string, in interface{}) error
+  // Like Notify but returns once the notification has been written to the connection, or with
+  // `ctx.Err()` when `ctx` is done before that, e.g. while waiting for other writes to finish.
+  // In the latter case the notification might still be written.
+  NotifyContext(ctx context.Context, name string, in interface{}) error
   BufferNotify(name string, in []byte) error
 
+  // Queue up to `n` notifications instead of writing them before Notify and BufferNotify
+  // return, so that sending notifications doesn't wait for a slow peer. Zero disables the
+  // queue (the default.) Queued notifications are written in the order they were sent, though
+  // requests and results sent after a notification might be written before it. What happens
+  // when the queue is full is decided by SetNotifyQueuePolicy. Notifications still queued when
+  // the socket closes are dropped. Should be called before sending any notifications.
+  SetNotifyQueueSize(n int)
+
+  // Set what happens when a notification is sent while the notification queue is full:
+  //
+  //   BlockPolicy       Notify waits for room in the queue; nothing is dropped (the default)
+  //   DropOldestPolicy  The oldest queued notification is dropped in favor of the new one
+  //   DropNewestPolicy  The new notification is dropped
+  //
+  // With any policy, the notifications which are delivered keep the order they were sent in.
+  SetNotifyQueuePolicy(NotifyQueuePolicy)
+
+  // Set a function to be called with notifications dropped from the notification queue
+  OnNotifyDropped(func(name string, buf []byte))
+
+  // Generate the IDs of requests sent with `f`, e.g. to embed trace context, instead of using a
+  // counter (the default, restored by a nil `f`.) IDs must be exactly 3 bytes, as the ID of a
+  // message has a fixed width, and must not start with "-", which is reserved. Requests fail
+  // without being sent if `f` returns an invalid ID or the ID of a request still waiting for
+  // its result.
+  SetRequestIDFunc(f func() string)
+
+  // Make Request and BufferRequest fail with ErrTimeout when no result has been received `d`
+  // after the request was sent, in which case the peer is asked to cancel the request. Zero
+  // means no timeout (the default.) Requests made with a context are not affected.
+  SetRequestTimeout(d time.Duration)
+  RequestTimeout() time.Duration
+
   // Access Handlers associated with this socket
   Handlers() Handlers
 
+  // Handlers of this socket only, e.g. for operations which are only available after
+  // authenticating, consulted before those returned by Handlers. Middleware added to Handlers
+  // also wraps these handlers, and operation limits set with Handlers apply to them. Note that
+  // a fallback handler registered here takes precedence over any handler of Handlers.
+  LocalHandlers() Handlers
+
+  // Returns the channel `id` of this socket, opening it if needed. Requests and notifications
+  // sent on a channel are handled by the handlers of the channel with the same ID at the other
+  // end; requests for a channel which the other end hasn't opened fail. Handlers of the socket
+  // are never called for channels, nor vice versa, and middleware added to Handlers doesn't
+  // wrap the handlers of channels. `id` must not be empty.
+  Channel(id string) *Channel
+
+  // Set the codec used to encode and decode values of requests, results and notifications.
+  // Both sides must use the same codec; unless it is a JSON codec like the default JSONCodec,
+  // the codec is announced during Handshake, which fails if the other side uses a different codec. Must be
+  // set before calling Handshake. When accepting connections, connected sockets inherit this.
+  SetCodec(Codec)
+  Codec() Codec
+
+  // Compress messages with payloads larger than `min` bytes, or don't compress messages if
+  // `min` is negative (the default.) Messages are only sent compressed when that makes them
+  // smaller. Like the codec, compression is announced during Handshake, which fails unless both
+  // sides enable it. Must be set before calling Handshake. When accepting connections,
+  // connected sockets inherit this.
+  SetCompression(min int)
+
+  // Follow everything written after the handshake with a CRC-32 checksum, so that corruption,
+  // e.g. by an unreliable tunnel, is detected and closes the socket with a *ProtocolError
+  // rather than going unnoticed. Disabled by default as it costs a copy of every message. Like
+  // compression, checksums are announced during Handshake, which fails unless both sides
+  // enable them. Must be set before calling Handshake. When accepting connections, connected
+  // sockets inherit this.
+  SetFrameChecksum(enable bool)
+
+  // Protocol version of the other side, known after Handshake, or -1 before
+  ProtocolVersion() int
+
+  // Set application-defined data, like a client version or an auth token, to send to the peer
+  // right after the handshake. Call before Handshake. When accepting connections, connected
+  // sockets inherit this.
+  SetHandshakeData(b []byte)
+
+  // Data the peer sent right after the handshake, or nil if it sent none, e.g. because it
+  // doesn't support handshake data. It is read before any request or notification from the
+  // peer, so handlers can rely on it, but isn't available before the socket starts reading.
+  PeerHandshakeData() []byte
+
   // Associate some application-specific data with this socket
   SetUserData(interface{})
   GetUserData() interface{}
 
+  // Associate `value` with `key`, e.g. an authenticated user or a session, for handlers to
+  // retrieve with Value. Unlike SetUserData, this is safe to call from any goroutine. A nil
+  // `value` removes `key`. All values are removed after the socket has closed and the function
+  // set with SetCloseFunc has returned.
+  SetValue(key, value interface{})
+  // Returns the value associated with `key`, or nil
+  Value(key interface{}) interface{}
+
   // Enable streaming requests and set the limit for how many streaming requests this socket
   // can handle at the same time. Setting this to `0` disables streaming requests alltogether
   // (the default) while setting this to a large number might be cause for security concerns
   // as a malicious peer could send many "start stream" messages, but never sending
-  // any "end stream" messages, slowly exhausting memory.
+  // any "end stream" messages, slowly exhausting memory. Streaming requests beyond the limit
+  // fail with an error of code ErrCodeOverloaded, and a streaming request stops counting towards
+  // the limit once its handler returns. See Stats.StreamsActive for the current number.
   // When accepting connections, connected sockets inherit this value.
   SetStreamReqLimit(int)
 
+  // Let the senders of streaming requests send at most `n` payload bytes which the handler
+  // hasn't yet read, holding up StreamRequest.Write until the handler catches up. Parts are
+  // queued without holding up reading other messages. Zero disables flow control (the default,)
+  // in which case reading waits for the handler to read each part. Peers not supporting flow
+  // control send parts without waiting, as do requestors which aren't reading the result when
+  // part of it arrives. Should be called before reading.
+  // When accepting connections, connected sockets inherit this value.
+  SetStreamWindowSize(n int)
+
+  // Limit the number of requests, single or streaming, this socket handles at the same time to
+  // `n`. Requests beyond that fail with an error of code ErrCodeOverloaded, without a handler
+  // being called. Zero means no limit (the default.) When accepting connections, connected
+  // sockets inherit this value.
+  SetMaxConcurrentRequests(n int)
+
+  // Limit the size of the payload of messages received to `n` bytes. When the peer sends a
+  // larger message, the socket closes without reading the payload and Read returns a
+  // *ProtocolError. Zero means no limit (the default.) When accepting connections, connected
+  // sockets inherit this value.
+  SetMaxMessageSize(n int)
+
+  // Read the payloads of buffered requests and notifications into buffers which are reused once
+  // the handler has returned and any result has been written, instead of into a new buffer for
+  // each message (the default.) Handlers must then copy any part of the payload they keep.
+  // When accepting connections, connected sockets inherit this.
+  SetBufferReuse(bool)
+
   // Address of this socket
   Addr() string
 
+  // Network addresses of the other side and of our side of the connection, or nil if there is
+  // no connection or it isn't a network connection. For web sockets accepted by a server, these
+  // are the addresses of the HTTP connection, not taking any proxies into account.
+  RemoteAddr() net.Addr
+  LocalAddr() net.Addr
+
+  // State of the TLS connection, or nil if the connection doesn't use TLS
+  ConnectionState() *tls.ConnectionState
+
+  // The HTTP request which opened a web socket accepted by a server, e.g. for reading cookies
+  // in a SockHandler passed to WebSocketHandler. nil for other connections.
+  HTTPRequest() *http.Request
+
+  // The subprotocol chosen for a web socket accepted by a server, or "" if none was chosen.
+  // See WebSocketOptions.Subprotocols
+  Subprotocol() string
+
   // Close this socket
   Close() error
 
+  // True after the socket has closed, whether by Close, the peer or an error
+  Closed() bool
+
+  // Returns a channel which is closed when the socket closes, e.g. for stopping a goroutine
+  // writing to the socket when the peer disconnects
+  Done() <-chan struct{}
+
+  // Returns a channel receiving lifecycle events of the socket, e.g. for tracing, starting with
+  // the first call. Events are dropped when the channel's buffer is full, so that a slow
+  // subscriber never holds up the socket. The channel is closed after the EventClosed event.
+  // Call before Adopt and Handshake to also receive EventConnected and EventHandshake.
+  Events() <-chan Event
+
+  // Gracefully close the socket, e.g. to shed connections one at a time during a rolling
+  // restart: Tell the peer that we are going away, if it supports that, refusing any new
+  // requests from it with an error of code ErrCodeGoingAway, and wait for requests being
+  // handled to complete, or for `ctx` to be done, before closing. Returns ctx.Err() if `ctx` was done first. Either way the
+  // socket is closed as with Close, so OnClose functions receive a nil error.
+  Drain(ctx context.Context) error
+
   // Set a function to be closed when the socket closes
   SetCloseFunc(func(Sock))
+
+  // Set a function to be called once when the socket closes, after the function set with
+  // SetCloseFunc. `err` is nil when the socket was closed with Close or by the peer closing the
+  // connection, or otherwise the error which caused the socket to close, e.g. a *ProtocolError,
+  // ErrHeartbeatTimeout, ErrSlowConsumer or a failure to read from or write to the connection.
+  OnClose(func(err error))
+
+  // Set a function to be called when the peer violates the protocol, e.g. by sending a malformed
+  // message, right before the socket closes with `err`. Useful for diagnosing buggy peers.
+  OnProtocolError(func(err *ProtocolError))
+
+  // Set a function to be called when the peer tells us it's going away, e.g. because a server
+  // is shutting down. The peer refuses any further requests and closes the connection once
+  // it has finished handling requests already sent.
+  SetGoingAwayFunc(func(s Sock, reason string))
+
+  // Send a heartbeat every `interval`, reporting the number of requests being handled as our
+  // load. Zero disables heartbeats (the default.) Heartbeats are only exchanged while both ends
+  // have enabled them, which peers announce during the handshake or whenever this is called
+  // after it. When they are and nothing has been received from the peer for
+  // SetHeartbeatMaxMissed intervals, the socket closes and Read returns ErrHeartbeatTimeout.
+  // Must be called after Adopt. See also SetTCPKeepAlive.
+  SetHeartbeat(interval time.Duration)
+
+  // Set the deadline for reading from or writing to the connection, like net.Conn does. Fails if
+  // the connection doesn't support deadlines.
+  SetReadDeadline(t time.Time) error
+  SetWriteDeadline(t time.Time) error
+
+  // Enable TCP keep-alive probes every `d` on the connection, or disable them if `d` is zero,
+  // so that the OS detects a dead peer even when the connection is idle. Unlike heartbeats,
+  // which also detect a peer that is connected but stuck, probes are answered by the OS of the
+  // peer and cost nothing but a few bytes. Go enables them by default for dialed and accepted
+  // TCP connections with a period of 15 seconds. Fails for connections other than TCP, or TLS
+  // over TCP, e.g. web sockets.
+  SetTCPKeepAlive(d time.Duration) error
+
+  // Close the socket when a message hasn't been received in full within `d` of the previous
+  // one, e.g. a peer trickling a message byte by byte, in which case Read returns
+  // ErrIdleTimeout. Zero means no timeout (the default.) Overrides any read deadline. When
+  // accepting connections, connected sockets inherit this.
+  SetIdleTimeout(d time.Duration)
+
+  // Set the number of heartbeat intervals to wait for any message from the peer before timing
+  // out. Defaults to 3.
+  SetHeartbeatMaxMissed(n int)
+
+  // Set a function to be called with the load and time reported in heartbeats from the peer
+  OnHeartbeat(func(load int, t time.Time))
+
+  // Returns a snapshot of the counters of the socket. Safe to call at any time.
+  Stats() Stats
+
+  // Set the logger receiving messages about errors like malformed messages from the peer,
+  // handler panics and notifications without handlers. Messages are discarded by default.
+  SetLogger(Logger)
+
+  // Set whether the TCP connection sends data as soon as possible (the default) or lets the
+  // operating system delay small writes to combine them (Nagle's algorithm), trading latency
+  // for fewer packets. Has no effect on connections other than TCP and TLS over TCP.
+  SetNoDelay(noDelay bool) error
+
+  // Buffer notifications and write them together every `interval` instead of one at a time,
+  // or write each notification as it is sent if `interval` is zero (the default.) Batching
+  // saves writes and packets when sending many small notifications, at the cost of delivering
+  // them up to `interval` later. Writing any other message, e.g. a request or a result, also
+  // writes the notifications buffered before it. Notifications still buffered are written when
+  // the socket is closed with Close. When accepting connections, connected sockets inherit this.
+  SetNotifyBatching(interval time.Duration)
+
+  // Write any notifications buffered because of SetNotifyBatching
+  Flush() error
 }
 
 type SockHandler func(Sock)
 
 type StreamRequest interface {
+  // Write a part of the request. Fails with ErrStreamEnded after CloseSend, and once the
+  // handler has returned without reading the request to its end, e.g. because of an error, in
+  // which case Read still returns the result.
   Write([]byte) error
+
+  // Same as CloseSend
   End() error
+
+  // Signal the end of the request while still receiving the result, like half-closing a
+  // connection. The handler receives a nil part on its input channel and can keep writing
+  // results. Write fails with ErrStreamEnded after this.
+  CloseSend() error
+
   Read() ([]byte, error)
+
+  // Set a function to be called after each part of the request has been written, with the
+  // number of payload bytes written so far and the total set with SetTotal, or -1 if unknown
+  OnProgress(f func(bytesSent, total int64))
+
+  // Set the total number of payload bytes to be written, as reported to OnProgress
+  SetTotal(total int64)
 }
 
 func NewSock(h Handlers) Sock {
-  return &socket{handlers:h}
+  ctx, cancel := context.WithCancel(context.Background())
+  s := &socket{handlers:h, ctx:ctx, cancelCtx:cancel, version:-1}
+  s.notes = newNotifyQueue(&s.stats)
+  return s
 }
 
-// Creates two sockets which are connected to eachother
+// Creates two sockets which are connected to eachother in memory, handling requests with
+// DefaultHandlers. The handshake has been performed and both sockets are reading.
 func Pipe() (Sock, Sock, error) {
-  c1, c2 := net.Pipe()
-  s1 := NewSock(DefaultHandlers)
-  s2 := NewSock(DefaultHandlers)
+  return PipeHandlers(DefaultHandlers, DefaultHandlers)
+}
+
+// Like Pipe but with the first socket handling requests with `h1` and the second with `h2`,
+// e.g. to test handlers end-to-end without a network connection
+func PipeHandlers(h1, h2 Handlers) (Sock, Sock, error) {
+  c1, c2 := relayedPipe()
+  s1 := NewSock(h1)
+  s2 := NewSock(h2)
   s1.Adopt(c1)
   s2.Adopt(c2)
-  // Note: We deliberately ignore performing a handshake
+  errc := make(chan error, 1)
+  go func() { errc <- s1.Handshake() }()
+  err2 := s2.Handshake()
+  if err1 := <-errc; err1 != nil || err2 != nil {
+    s1.Close()
+    s2.Close()
+    if err1 != nil {
+      return nil, nil, err1
+    }
+    return nil, nil, err2
+  }
   go s1.Read()
   go s2.Read()
   return s1, s2, nil
 }
 
+// Like net.Pipe but with the ends connected by goroutines copying between them, so that a write
+// doesn't wait for the other end to read it. Both ends can then write their handshake first.
+func relayedPipe() (net.Conn, net.Conn) {
+  c1, r1 := net.Pipe()
+  c2, r2 := net.Pipe()
+  relay := func(dst, src net.Conn) {
+    io.Copy(dst, src)
+    dst.Close()
+    src.Close()
+  }
+  go relay(r2, r1)
+  go relay(r1, r2)
+  return c1, c2
+}
+
 // Connect to a server via `how` at `addr`. Unless there's an error, the returned socket is
 // already reading in a different goroutine and is ready to be used.
 func Connect(how, addr string) (Sock, error) {
-  c, err := net.Dial(how, addr)
+  s, err := dial(how, addr, DefaultHandlers)
   if err != nil {
     return nil, err
   }
-  s := NewSock(DefaultHandlers)
-  s.Adopt(c)
-  if err := s.Handshake(); err != nil {
-    return nil, err
-  }
   go s.Read()
   return s, nil
 }
 
-// Start a `how` server listening for connections at `addr`. You need to call Accept() on the
-// returned socket to start accepting connections.
-func Listen(how, addr string) (Sock, error) {
-  l, err := net.Listen(how, addr)
+// Like Connect but fails with ErrConnectTimeout if connecting and performing the protocol
+// handshake doesn't complete within `timeout`. Zero means no timeout, like Connect.
+func ConnectTimeout(how, addr string, timeout time.Duration) (Sock, error) {
+  s, err := dialTimeout(how, addr, DefaultHandlers, timeout)
   if err != nil {
     return nil, err
   }
+  go s.Read()
+  return s, nil
+}
 
-  s := NewSock(DefaultHandlers)
-  s.AdoptListener(l)
+// Connect to `addr` and perform the handshake, returning a socket which isn't yet reading
+func dial(how, addr string, h Handlers) (Sock, error) {
+  return dialTimeout(how, addr, h, 0)
+}
 
-  if how == "unix" || how == "unixpacket" {
-    // Unix sockets must be unlink()ed before being reused again.
-    // Handle common process-killing signals so we can gracefully shut down.
-    sigc := make(chan os.Signal, 1)
-    signal.Notify(sigc, os.Interrupt, os.Kill, syscall.SIGTERM)
-    go func(c chan os.Signal) {
-      <-c  // Wait for a signal
-      //sig := <-c  // Wait for a signal
-      //log.Printf("Caught signal %s: shutting down.", sig)
-      s.Close()  // Stop listening and unlink the socket
-      os.Exit(0)
-    }(sigc)
+func dialTimeout(how, addr string, h Handlers, timeout time.Duration) (Sock, error) {
+  var deadline time.Time
+  if timeout > 0 {
+    deadline = time.Now().Add(timeout)
+  }
+  c, err := net.DialTimeout(how, addr, timeout)
+  if err != nil {
+    return nil, connectErr(err)
+  }
+  if !deadline.IsZero() {
+    c.SetDeadline(deadline)
+  }
+  s, err := adoptConn(c, h)
+  if err != nil {
+    return nil, connectErr(err)
+  }
+  if !deadline.IsZero() {
+    c.SetDeadline(time.Time{})
   }
-
   return s, nil
 }
 
-// Start a `how` server accepting connections at `addr`.
-func Serve(how, addr string, handler SockHandler) error {
-  s, err := Listen(how, addr)
-  if err != nil {
-    return err
+// Returns ErrConnectTimeout in place of `err` if connecting timed out
+func connectErr(err error) error {
+  var e net.Error
+  if errors.As(err, &e) && e.Timeout() {
+    return ErrConnectTimeout
+  }
+  return err
+}
+
+// Perform the handshake on connection `c`, closing it if the handshake fails
+func adoptConn(c net.Conn, h Handlers) (Sock, error) {
+  s := NewSock(h)
+  s.Adopt(c)
+  if err := s.Handshake(); err != nil {
+    c.Close()
+    return nil, err
   }
-  return s.Accept(handler)
+  return s, nil
 }
 
 // -------------------------------------------------------------------------------------
 
-type pendingResMap  map[string]chan interface{}
-type pendingReqMap  map[string]chan []byte
+type pendingResMap  map[string]*resChan
+type pendingReqMap  map[string]*reqChan
+type handlerCtxMap  map[string]context.CancelFunc
+type opSemMap       map[string]*opSem
 
 type socket struct {
+  // Accessed atomically, so kept first for alignment:
+  requestTimeout int64               // time.Duration
+  idleTimeout    int64               // time.Duration
+  lastRecv       int64               // time in UnixNano when a message was last received
+  pendingBytes   int64               // payload bytes of messages being written by writeMsg
+  pendingSends   int32               // write jobs sent to the writer which haven't completed
+  peerFeatures   uint32              // features announced by the peer
+  stats          sockStats
   handlers       Handlers
+  local          *handlers           // created by LocalHandlers
+  localMu        sync.Mutex
   wmu            sync.Mutex          // guards writes on conn
-  listener       net.Listener        // non-nil after successful call to Listen
+  sendq          chan writeJob       // write jobs waiting for the writer
+  writerDone     chan struct{}       // closed when the writer has stopped
   conn           io.ReadWriteCloser  // non-nil after successful call to Connect or accept
+  listenServer   *Server             // non-nil after successful call to Listen or AdoptListener
+  closed         int32               // non-zero after Close
+  maxMsgSize     int                 // max payload size of received messages, or 0 for no limit
+  bufReuse       bool                // read payloads into pooled buffers
   closeFunc      func(Sock)
+  onClose        func(error)
+  onProtocolErr  func(*ProtocolError)
+  server         *Server             // non-nil for sockets accepted by a Server
+  topics         map[*Topics]struct{}  // registries the socket is subscribed to topics in
+  topicsMu       sync.Mutex
   userData       interface{}
+  values         map[interface{}]interface{}
+  valuesMu       sync.RWMutex
+  codec          Codec
+  version        int                 // protocol version of the peer, or -1 before Handshake
+  minVersion     int                 // Handshake fails for peers using an older version
+  handshakeData  []byte              // sent right after the handshake
+  peerData       []byte              // received right after the handshake, guarded by peerDataMu
+  peerDataMu     sync.Mutex
+  rd             io.Reader           // conn, or the inflated message being read; only used by Read
+
+  // Used for batching notifications, guarded by wmu:
+  bw             *bufio.Writer       // buffers notifications; nil unless batching
+  bwStop         chan struct{}       // stops flushLoop
+  bwInterval     time.Duration       // set with SetNotifyBatching
+
+  // Used for compression, guarded by wmu when writing:
+  compress       bool
+  compressMin    int                 // compress payloads larger than this
+  checksum       bool                // see SetFrameChecksum
+  zw             *flate.Writer
+  zbuf           bytes.Buffer
 
   // Used for performing requests:
   nextOpID       uint
+  idFunc         func() string       // generates request IDs, guarded by pendingResMu
   pendingRes     pendingResMap
   pendingResMu   sync.RWMutex
 
+  // Used for notification streams:
+  noteStreamSeq  uint32              // ID of the next stream sent; accessed atomically
+  noteStreamTag  string              // stream of the next notification; only used by Read
+  channelTag     string              // channel of the next request or notification; only used by Read
+  channelsMu     sync.Mutex
+  events         eventStream         // see Events
+  channels       map[string]*Channel  // opened with Channel
+  noteStreams    map[string]*noteStream  // streams being received; only used by Read
+
+  // Used for handling requests:
+  reqMetaID      string              // request ID of reqMeta
+  reqMeta        map[string]string   // metadata of the request which follows; only used by Read
+  reqMetaErr     error               // set instead of reqMeta when the metadata is invalid
+  reqDeadlineID  string              // request ID of reqDeadline
+  reqDeadline    time.Duration       // time budget of the request which follows; only used by Read
+  ctx            context.Context     // cancelled when the socket closes
+  cancelCtx      context.CancelFunc
+  handlerCtx     handlerCtxMap       // cancels the context of running handlers, keyed by request ID
+  handlerCtxMu   sync.Mutex
+  opSem          opSemMap            // limits concurrent handlers, keyed by operation
+  opSemMu        sync.Mutex
+  rateBuckets    map[string]*tokenBucket  // per-socket rate limits, keyed by operation
+
+  // Used for going away:
+  inflightMu     sync.Mutex
+  ninflight      int                 // number of requests being handled
+  maxInflight    int                 // limit of ninflight, or 0 for no limit
+  goingAway      bool                // true after goAway, when new requests are refused
+  idle           chan struct{}       // closed when ninflight reaches 0 after goAway
+  goingAwayFunc  func(Sock, string)
+  logger         Logger
+  notes          *notifyQueue        // notifications waiting to be written
+
+  // Used for detecting slow consumers:
+  slowMu         sync.Mutex
+  slowStop       chan struct{}       // closed to stop slowConsumerLoop
+
+  // Used for heartbeats:
+  hbMu           sync.Mutex
+  hbStop         chan struct{}       // closed to stop the heartbeat goroutine
+  hbMaxMissed    int
+  heartbeatFunc  func(load int, t time.Time)
+  closeErr       error               // returned by Read when the socket closed itself
+
   // Used for streaming requests:
   streamReqLimit int
+  streamWindow   int                 // see SetStreamWindowSize
   pendingReq     pendingReqMap
   pendingReqMu   sync.RWMutex
 }
 
 
 func (s *socket) Adopt(c io.ReadWriteCloser) {
-  if s.listener != nil || s.conn != nil {
+  if s.conn != nil || s.listenServer != nil {
     panic("already adopted")
   }
-  s.conn = c
+  s.conn = &countingConn{c, &s.stats}
+  s.startWriter()
+  if s.bwInterval > 0 {
+    s.SetNotifyBatching(s.bwInterval)
+  }
+  s.emitEvent(EventConnected, "", "")
 }
 
 
-func (s *socket) AdoptListener(listener net.Listener) {
-  if s.listener != nil || s.conn != nil {
+func (s *socket) AdoptListener(l net.Listener) {
+  if s.conn != nil || s.listenServer != nil {
     panic("already adopted")
   }
-  s.listener = listener
+  s.listenServer = NewServer(s.handlers, l)
+}
+
+
+func (s *socket) Accept(sockHandler SockHandler) error {
+  srv := s.listenServer
+  if srv == nil {
+    return errors.New("socket is not listening")
+  }
+  srv.handlers = s.handlers
+  srv.SetStreamReqLimit(s.streamReqLimit)
+  srv.SetStreamWindowSize(s.streamWindow)
+  srv.SetCodec(s.codec)
+  srv.SetLogger(s.logger)
+  srv.SetMaxMessageSize(s.maxMsgSize)
+  srv.SetBufferReuse(s.bufReuse)
+  if s.compress {
+    srv.SetCompression(s.compressMin)
+  }
+  srv.SetFrameChecksum(s.checksum)
+  srv.SetNotifyBatching(s.bwInterval)
+  srv.SetHandshakeData(s.handshakeData)
+  srv.SetIdleTimeout(time.Duration(atomic.LoadInt64(&s.idleTimeout)))
+  s.inflightMu.Lock()
+  srv.SetMaxConcurrentRequests(s.maxInflight)
+  s.inflightMu.Unlock()
+  return srv.Accept(sockHandler)
 }
 
 
@@ -192,7 +685,15 @@ type reqHandlerType int
 
 // ----------------------------------------------------------------------------------------------
 
-func (s *socket) getResChan(id string) chan interface{} {
+type resChan struct {
+  id     string
+  ch     chan interface{}
+  done   chan struct{}  // closed when the requestor is no longer waiting for a response
+  window sendWindow     // room to send parts of a streaming request
+  meta   map[string]string  // metadata of the result, set before the result is handed over
+}
+
+func (s *socket) getResChan(id string) *resChan {
   s.pendingResMu.RLock()
   defer s.pendingResMu.RUnlock()
   if s.pendingRes == nil {
@@ -202,37 +703,85 @@ func (s *socket) getResChan(id string) chan interface{} {
 }
 
 
-func (s *socket) allocResChan() (string, chan interface{}) {
-  ch := make(chan interface{})
+func (s *socket) allocResChan() (string, *resChan, error) {
+  rc := &resChan{ch:make(chan interface{}), done:make(chan struct{})}
+  rc.window.granted = -1
 
   s.pendingResMu.Lock()
   defer s.pendingResMu.Unlock()
 
-  id := string(makeFixnumBuf(3, uint64(s.nextOpID), 36))
-  s.nextOpID++
-  if s.nextOpID == 46656 {
-    // limit for base36 within 3 digits (36^2=46656)
-    s.nextOpID = 0
+  var id string
+  if s.idFunc != nil {
+    id = s.idFunc()
+    if len(id) != 3 || id[0] == '-' {
+      return "", nil, fmt.Errorf("invalid request ID %q", id)
+    }
+    if s.pendingRes[id] != nil {
+      return "", nil, fmt.Errorf("request ID %q is already in use", id)
+    }
+  } else {
+    id = string(makeFixnumBuf(3, uint64(s.nextOpID), 36))
+    s.nextOpID++
+    if s.nextOpID == 46656 {
+      // limit for base36 within 3 digits (36^2=46656)
+      s.nextOpID = 0
+    }
   }
 
   if s.pendingRes == nil {
     s.pendingRes = make(pendingResMap)
   }
-  s.pendingRes[id] = ch
+  rc.id = id
+  s.pendingRes[id] = rc
 
-  return id, ch
+  return id, rc, nil
+}
+
+
+func (s *socket) SetRequestIDFunc(f func() string) {
+  s.pendingResMu.Lock()
+  defer s.pendingResMu.Unlock()
+  s.idFunc = f
 }
 
 
 func (s *socket) deallocResChan(id string) {
   s.pendingResMu.Lock()
   defer s.pendingResMu.Unlock()
-  delete(s.pendingRes, id)
+  if rc := s.pendingRes[id]; rc != nil {
+    close(rc.done)
+    delete(s.pendingRes, id)
+  }
+}
+
+// Like deallocResChan but does nothing if `rc` has already been deallocated, even if its ID has
+// been reused since
+func (s *socket) releaseResChan(rc *resChan) {
+  s.pendingResMu.Lock()
+  defer s.pendingResMu.Unlock()
+  if s.pendingRes[rc.id] == rc {
+    close(rc.done)
+    delete(s.pendingRes, rc.id)
+  }
+}
+
+
+func (s *socket) InFlightRequests() int {
+  s.pendingResMu.RLock()
+  defer s.pendingResMu.RUnlock()
+  return len(s.pendingRes)
 }
 
 // ----------------------------------------------------------------------------------------------
 
-func (s *socket) getReqChan(id string) chan []byte {
+type reqChan struct {
+  ch    chan []byte
+  done  chan struct{}  // closed when the handler has returned and no longer reads from ch
+  queue *partQueue     // parts waiting for the handler, when flow controlled
+  ended int32          // non-zero once the requestor has ended the request; accessed atomically
+}
+
+func (s *socket) getReqChan(id string) *reqChan {
   s.pendingReqMu.RLock()
   defer s.pendingReqMu.RUnlock()
   if s.pendingReq == nil {
@@ -243,7 +792,7 @@ func (s *socket) getReqChan(id string) chan []byte {
 
 
 func (s *socket) allocReqChan(id string) chan []byte {
-  ch := make(chan []byte, 1)
+  rc := &reqChan{ch:make(chan []byte, 1), done:make(chan struct{})}
 
   s.pendingReqMu.Lock()
   defer s.pendingReqMu.Unlock()
@@ -254,297 +803,1015 @@ func (s *socket) allocReqChan(id string) chan []byte {
   if s.pendingReq[id] != nil {
     panic("identical request ID in two different requests")
   }
-  s.pendingReq[id] = ch
-  return ch
+  s.pendingReq[id] = rc
+  return rc.ch
 }
 
 
+// Must be called when the handler of streaming request `id` has returned. Parts of the request
+// arriving after that are discarded.
 func (s *socket) deallocReqChan(id string) {
   s.pendingReqMu.Lock()
   defer s.pendingReqMu.Unlock()
-  delete(s.pendingReq, id)
-}
-
-// ----------------------------------------------------------------------------------------------
-
-func (s *socket) writeMsg(t MsgType, id, op string, buf []byte) error {
-  s.wmu.Lock()
-  defer s.wmu.Unlock()
-  if _, err := s.conn.Write(MakeMsg(t, id, op, len(buf))); err != nil {
-    return err
+  if rc := s.pendingReq[id]; rc != nil {
+    close(rc.done)
+    if rc.queue != nil {
+      rc.queue.close()
+    }
+    delete(s.pendingReq, id)
   }
-  _, err := s.conn.Write(buf)
-  return err
 }
 
+// ----------------------------------------------------------------------------------------------
 
-func (s *socket) BufferRequest(op string, buf []byte) ([]byte, error) {
-  id, ch := s.allocResChan()
-  defer s.deallocResChan(id)
+func (s *socket) allocHandlerCtx(id string, timeout time.Duration) context.Context {
+  ctx, cancel := s.newHandlerCtx(timeout)
 
-  //fmt.Printf("BufferRequest: writeMsg(%v, %v, %v)\n", id, op, buf)
+  s.handlerCtxMu.Lock()
+  defer s.handlerCtxMu.Unlock()
 
-  if err := s.writeMsg(MsgTypeSingleReq, id, op, buf); err != nil {
-    return nil, err
+  if s.handlerCtx == nil {
+    s.handlerCtx = make(handlerCtxMap)
   }
+  s.handlerCtx[id] = cancel
+  return ctx
+}
 
-  // Wait for response to be read in readLoop
-  ch <- reqHandlerTypeBuf
-  // Note: Don't call any code in between here that can panic, as that could cause readLoop to
-  // deadlock.
-  resval := <-ch  // response buffer
 
-  if resbuf, ok := resval.(resbuffer); ok {
-    if resbuf.t == MsgTypeSingleRes {
-      return resbuf.b, nil
-    } else if resbuf.t == MsgTypeErrorRes {
-      return nil, errors.New(string(resbuf.b))
-      // TODO: return an error type which contains the buffer, because the buffer might not be
-      // a string.
-    }
-    // Note: This particular function requires the response to be buffered and not streaming
-    return resbuf.b, errors.New("unexpected message "+string(byte(resbuf.t)))
+// Returns a context for a handler, cancelled when the socket closes or after `timeout` unless 0
+func (s *socket) newHandlerCtx(timeout time.Duration) (context.Context, context.CancelFunc) {
+  if timeout > 0 {
+    return context.WithTimeout(s.ctx, timeout)
   }
-  return nil, nil
+  return context.WithCancel(s.ctx)
 }
 
 
-func (s *socket) Request(op string, in interface{}, out interface{}) error {
-  inbuf, err := json.Marshal(in)
-  if err != nil {
-    return err
+// Fails with a ProtocolError if the peer sent request `id` while a request with the same ID is
+// still being handled, as the results of both would be indistinguishable
+func (s *socket) checkRequestID(id string) error {
+  s.handlerCtxMu.Lock()
+  _, inUse := s.handlerCtx[id]
+  s.handlerCtxMu.Unlock()
+  if !inUse {
+    inUse = s.getReqChan(id) != nil
   }
-  outbuf, err := s.BufferRequest(op, inbuf)
-  if err != nil {
-    return err
+  if inUse {
+    return &ProtocolError{msg:fmt.Sprintf("request ID %q is already in use", id)}
   }
-  return json.Unmarshal(outbuf, out)
+  return nil
 }
 
 
-func (s *socket) StreamRequest(op string) StreamRequest {
-  return &streamRequest{sock:s, op:op}
+// Cancels the context of the handler for request `id`, if any
+func (s *socket) deallocHandlerCtx(id string) {
+  s.handlerCtxMu.Lock()
+  defer s.handlerCtxMu.Unlock()
+  if cancel := s.handlerCtx[id]; cancel != nil {
+    cancel()
+    delete(s.handlerCtx, id)
+  }
 }
 
+// ----------------------------------------------------------------------------------------------
 
-func (s *socket) BufferNotify(t string, buf []byte) error {
-  return s.writeMsg(MsgTypeNotification, "", t, buf)
+type opSem struct {
+  running chan struct{}  // buffered to the concurrency limit of the operation
+  queued  int            // number of requests waiting for `running`
 }
 
-func (s *socket) Notify(t string, v interface{}) error {
-  if buf, err := json.Marshal(v); err != nil {
-    return err
-  } else {
-    return s.BufferNotify(t, buf)
-  }
+// A request admitted by admitOp
+type opTicket struct {
+  s       *socket
+  sem     *opSem
+  running bool
 }
 
-// ===========================================================================================
-
-type streamRequest struct {
-  sock    *socket
-  op      string
-  id      string
-  started bool // request started?
-  ended   bool // response ended?
-  ch      chan interface{}
-}
 
-func (r *streamRequest) finalize() {
-  if r.id != "" {
-    r.sock.deallocResChan(r.id)
-    r.id = ""
+// Admits a request for `op` as limited by Handlers.SetOperationConcurrency, failing if too many
+// requests are queued. Called from the read loop so requests are admitted in the order received.
+// Returns nil if `op` is not limited.
+func (s *socket) admitOp(op string) (*opTicket, error) {
+  max, maxQueued := s.handlers.OperationConcurrency(op)
+  if max <= 0 {
+    return nil, nil
   }
-}
 
-func (r *streamRequest) Write(b []byte) error {
-  if r.started == false {
-    r.started = true
-    r.id, r.ch = r.sock.allocResChan()
-    if err := r.sock.writeMsg(MsgTypeStreamReq, r.id, r.op, b); err != nil {
-      r.finalize()
-      return err
-    }
-  } else {
-    if err := r.sock.writeMsg(MsgTypeStreamReqPart, r.id, "", b); err != nil {
-      r.finalize()
-      return err
-    }
+  s.opSemMu.Lock()
+  defer s.opSemMu.Unlock()
+  if s.opSem == nil {
+    s.opSem = make(opSemMap)
   }
-  return nil
-}
-
-func (r *streamRequest) End() error {
-  err := r.sock.writeMsg(MsgTypeStreamReqPart, r.id, "", nil)
-  if err != nil {
-    r.finalize()
+  sem := s.opSem[op]
+  if sem == nil || cap(sem.running) != max {
+    sem = &opSem{running:make(chan struct{}, max)}
+    s.opSem[op] = sem
   }
-  return err
-}
 
-func (r *streamRequest) Read() ([]byte, error) {
-  if r.ended == true {
-    return nil, nil
+  select {
+  case sem.running <- struct{}{}:
+    return &opTicket{s, sem, true}, nil
+  default:
   }
 
-  // Wait for result chunk to be read in readLoop
-  r.ch <- reqHandlerTypeBuf
-  resval := <- r.ch
-
-  // Interpret resbuf
-  if resbuf, ok := resval.(resbuffer); ok {
-    if resbuf.t == MsgTypeErrorRes {
-      r.ended = true
-      return nil, errors.New(string(resbuf.b))
-    } else if resbuf.t == MsgTypeSingleRes {
-      r.ended = true
-    }
-    return resbuf.b, nil
+  if maxQueued >= 0 && sem.queued >= maxQueued {
+    return nil, Errorf(ErrCodeOverloaded, "too many requests for operation \"%s\"", op)
   }
-  return nil, nil
+  sem.queued++
+  return &opTicket{s, sem, false}, nil
 }
 
-// ===========================================================================================
 
-func (s *socket) readDiscard(readz int) error {
-  if readz != 0 {
-    // todo: is there a better way to read data w/o copying it into a buffer?
-    err := readn(s.conn, make([]byte, readz))
-    return err
+// Waits until the handler may run
+func (t *opTicket) wait(ctx context.Context) error {
+  if t == nil || t.running {
+    return nil
+  }
+  defer func() {
+    t.s.opSemMu.Lock()
+    t.sem.queued--
+    t.s.opSemMu.Unlock()
+  }()
+  select {
+  case t.sem.running <- struct{}{}:
+    t.running = true
+    return nil
+  case <-ctx.Done():
+    return ctx.Err()
   }
-  return nil
 }
 
 
-func (s *socket) respondErr(readz int, id, errmsg string) error {
-  if err := s.readDiscard(readz); err != nil {
-    return err
-  }
-  s.wmu.Lock()
-  defer s.wmu.Unlock()
-  if _, err := WriteErrorRes(s.conn, id, len(errmsg)); err != nil {
-    return err
+// Must be called when the handler has completed, or will never run
+func (t *opTicket) release() {
+  if t != nil && t.running {
+    <-t.sem.running
   }
-  _, err := s.conn.Write([]byte(errmsg))
-  return err
 }
 
+// ----------------------------------------------------------------------------------------------
 
-func (s *socket) respondOK(id string, outbuf []byte) error {
-  s.wmu.Lock()
-  defer s.wmu.Unlock()
-  if _, err := WriteSingleRes(s.conn, id, len(outbuf)); err != nil {
-    return err
+// Registers a request about to be handled. Returns an error if we are going away or are
+// handling too many requests, in which case the request must be refused with that error.
+func (s *socket) beginRequest() error {
+  s.inflightMu.Lock()
+  defer s.inflightMu.Unlock()
+  if s.goingAway {
+    return Errorf(ErrCodeGoingAway, "going away")
   }
-  if len(outbuf) != 0 {
-    _, err := s.conn.Write(outbuf)
-    return err
+  if s.maxInflight > 0 && s.ninflight >= s.maxInflight {
+    return Errorf(ErrCodeOverloaded, "too many requests")
   }
+  s.ninflight++
   return nil
 }
 
 
-func (s *socket) findHandlerOrResErr(id, op string, size int) interface{} {
-  handler := s.handlers.FindRequestHandler(op)
-  if handler == nil {
-    if err := s.respondErr(size, id, "unknown operation \""+op+"\""); err != nil {
-      panic("failed to send error")
-    }
+// Must be called when a request registered with beginRequest has been handled
+func (s *socket) endRequest() {
+  s.inflightMu.Lock()
+  defer s.inflightMu.Unlock()
+  s.ninflight--
+  if s.ninflight == 0 && s.idle != nil {
+    close(s.idle)
+    s.idle = nil
   }
-  return handler
 }
 
 
-func (s *socket) readSingleReq(id, op string, size int) error {
-  handlerval := s.findHandlerOrResErr(id, op, size)
-  if handlerval == nil {
-    return nil
-  }
-
-  handler, ok := handlerval.(BufferReqHandler)
-  if ok == false {
-    return s.respondErr(size, id, "buffered request not supported")
-  }
+// Ends a request and writes its last message. The request ends before the message is written,
+// so that the requestor can make another request as soon as it has the result, but with the
+// write lock held, so that closing once requests have ended doesn't cut the message short.
+func (s *socket) endRequestWrite(t MsgType, id string, buf []byte) error {
+  return s.endRequestWriteMeta(t, id, buf, nil)
+}
 
-  // Buffered handler
-  inbuf := make([]byte, size)
-  if err := readn(s.conn, inbuf); err != nil {
-    return err
-  }
-  // Dispatch handler
-  go func() {
-    outbuf, err := handler(s, op, inbuf)
-    if err != nil {
-      if err := s.respondErr(0, id, err.Error()); err != nil {
-        log.Println(err)
-        s.Close()
-      }
-    } else {
-      if err := s.respondOK(id, outbuf); err != nil {
-        log.Println(err)
-        s.Close()
+// Like endRequestWrite but precedes the message with result metadata unless `meta` is nil
+func (s *socket) endRequestWriteMeta(t MsgType, id string, buf, meta []byte) error {
+  return s.write(func() error {
+    s.endRequest()
+    if meta != nil {
+      if err := s.writeMsgLocked(MsgTypeSingleRes, ResultMetaID, "", append([]byte(id), meta...)); err != nil {
+        return err
       }
     }
-  }()
+    return s.writeMsgLocked(t, id, "", buf)
+  })
+}
 
-  return nil
+
+func (s *socket) inflightCount() int {
+  s.inflightMu.Lock()
+  defer s.inflightMu.Unlock()
+  return s.ninflight
 }
 
 
-func (s *socket) readStreamReq(id, op string, size int) error {
-  if len(s.pendingReq) >= s.streamReqLimit {
-    if s.streamReqLimit == 0 {
-      return s.respondErr(size, id, "stream request not supported")
-    } else {
-      return s.respondErr(size, id, "stream request limit")
-    }
+// Tell the peer we are going away, if it supports that, and refuse any further requests. Returns a channel which is
+// closed when all requests being handled have completed.
+func (s *socket) goAway(reason string) <-chan struct{} {
+  s.inflightMu.Lock()
+  wasGoingAway := s.goingAway
+  s.goingAway = true
+  idle := make(chan struct{})
+  if s.ninflight == 0 {
+    close(idle)
+  } else if s.idle != nil {
+    idle = s.idle
+  } else {
+    s.idle = idle
   }
+  s.inflightMu.Unlock()
 
-  handlerval := s.findHandlerOrResErr(id, op, size)
-  if handlerval == nil {
-    return nil
+  if !wasGoingAway && s.peerHas(featureGoAway) {
+    s.writeMsg(MsgTypeGoingAway, "", reason, nil)  // best effort
   }
+  return idle
+}
 
-  handler, ok := handlerval.(StreamReqHandler)
-  if ok == false {
-    return s.respondErr(size, id, "streaming request not supported")
+
+func (s *socket) Drain(ctx context.Context) error {
+  var err error
+  select {
+  case <-s.goAway("drain"):
+    // Wait for the results of requests which just ended to be written
+    s.wmu.Lock()
+    s.wmu.Unlock()
+  case <-ctx.Done():
+    err = ctx.Err()
   }
+  s.Close()
+  return err
+}
 
-  // Read first buff
-  inbuf := make([]byte, size)
-  if err := readn(s.conn, inbuf); err != nil {
+
+func (s *socket) refuseReq(readz int, id string, reason error) error {
+  if err := s.readDiscard(readz); err != nil {
     return err
   }
+  return s.respondHandlerErr(id, reason)
+}
 
-  // Create read chan
-  rch := s.allocReqChan(id)
-  rch <- inbuf
+// ----------------------------------------------------------------------------------------------
 
-  // Create result writer
-  wroteEOS := false
-  writer := func (b []byte) error {
-    if len(b) == 0 {
-      wroteEOS = true
-    }
-    return s.writeMsg(MsgTypeStreamRes, id, "", b)
-  }
+func (s *socket) writeMsg(t MsgType, id, op string, buf []byte) error {
+  atomic.AddInt64(&s.pendingBytes, int64(len(buf)))
+  defer atomic.AddInt64(&s.pendingBytes, -int64(len(buf)))
+  return s.write(func() error {
+    return s.writeMsgLocked(t, id, op, buf)
+  })
+}
 
-  // Dispatch handler
-  go func () {
-    if err := handler(s, op, rch, writer); err != nil {
-      s.deallocReqChan(id)
-      if err := s.respondErr(0, id, err.Error()); err != nil {
-        log.Println(err)
-        s.Close()
+// Like writeMsg but the caller must hold wmu
+func (s *socket) writeMsgLocked(t MsgType, id, op string, buf []byte) error {
+  if ok, err := s.writeCompressedLocked(t, id, op, buf); ok {
+    return err
+  }
+  w := s.writer()
+  if _, err := w.Write(MakeMsg(t, id, op, len(buf))); err != nil {
+    return err
+  }
+  if len(buf) != 0 {
+    if _, err := w.Write(buf); err != nil {
+      return err
+    }
+  }
+  return s.flushLocked(t)
+}
+
+
+// Returned by requests which timed out. See Sock.SetRequestTimeout
+var ErrTimeout = errors.New("request timed out")
+
+// Returned by ConnectTimeout when connecting to the server took too long
+var ErrConnectTimeout = errors.New("connect timed out")
+
+// Returned by Read when the peer has been silent for too long. See Sock.SetHeartbeat
+var ErrHeartbeatTimeout = errors.New("heartbeat timeout")
+
+// Returned when writing to a streaming request which has ended. See StreamRequest.CloseSend
+var ErrStreamEnded = errors.New("stream request ended")
+
+// Returned by Read when no message has been received in full within the idle timeout.
+// See Sock.SetIdleTimeout
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// Returned by requests which were waiting for a result when the socket closed, and when
+// sending anything after the socket has closed
+var ErrSockClosed = errors.New("socket closed")
+
+
+func (s *socket) BufferRequest(op string, buf []byte) ([]byte, error) {
+  return s.bufferRequest(context.Background(), op, buf, s.RequestTimeout(), nil)
+}
+
+
+// Performs a request, giving up when `ctx` is done or, unless zero, `timeout` has passed since
+// the request was written. `meta` is sent along with the request unless empty.
+func (s *socket) bufferRequest(ctx context.Context, op string, buf []byte, timeout time.Duration, meta map[string]string) ([]byte, error) {
+  outbuf, _, err := s.bufferRequestMeta(ctx, op, buf, timeout, meta)
+  return outbuf, err
+}
+
+
+// Like bufferRequest but also returns the metadata of the result
+func (s *socket) bufferRequestMeta(ctx context.Context, op string, buf []byte, timeout time.Duration, meta map[string]string) ([]byte, map[string]string, error) {
+  if err := ctx.Err(); err != nil {
+    return nil, nil, err
+  }
+
+  id, rc, err := s.allocResChan()
+  if err != nil {
+    return nil, nil, err
+  }
+  defer s.deallocResChan(id)
+
+  //fmt.Printf("BufferRequest: writeMsg(%v, %v, %v)\n", id, op, buf)
+
+  // Send the time budget of the request so the handler can give up when we do
+  var budget time.Duration
+  if deadline, ok := ctx.Deadline(); ok {
+    budget = time.Until(deadline)
+  }
+
+  channel, _ := ctx.Value(channelKey{}).(string)
+  if err := s.writeReq(id, op, buf, meta, budget, channel); err != nil {
+    return nil, nil, err
+  }
+  atomic.AddUint64(&s.stats.requestsSent, 1)
+
+  var timeoutc <-chan time.Time
+  if timeout > 0 {
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    timeoutc = timer.C
+  }
+  return s.waitResult(ctx, id, rc, timeoutc)
+}
+
+
+// Waits for the result of buffered request `id`, giving up when `ctx` is done or `timeoutc`
+// receives. Returns the result and its metadata.
+func (s *socket) waitResult(ctx context.Context, id string, rc *resChan, timeoutc <-chan time.Time) ([]byte, map[string]string, error) {
+  // Wait for response to be read in readLoop. If we stop waiting, deallocResChan signals
+  // readLoop (via rc.done) to discard the response instead of blocking on us.
+  var resval interface{}
+  select {
+  case rc.ch <- reqHandlerTypeBuf:
+    select {
+    case resval = <-rc.ch:  // response buffer
+    case <-ctx.Done():
+      return nil, nil, s.cancelRequest(id, ctx.Err())
+    case <-timeoutc:
+      return nil, nil, s.cancelRequest(id, ErrTimeout)
+    case <-s.ctx.Done():
+      return nil, nil, ErrSockClosed
+    }
+  case <-ctx.Done():
+    return nil, nil, s.cancelRequest(id, ctx.Err())
+  case <-timeoutc:
+    return nil, nil, s.cancelRequest(id, ErrTimeout)
+  case <-s.ctx.Done():
+    return nil, nil, ErrSockClosed
+  }
+
+  if resbuf, ok := resval.(resbuffer); ok {
+    if resbuf.t == MsgTypeSingleRes {
+      return resbuf.b, rc.meta, nil
+    } else if resbuf.t == MsgTypeErrorRes {
+      return nil, rc.meta, decodeError(resbuf.b)
+    }
+    // Note: This particular function requires the response to be buffered and not streaming
+    return resbuf.b, nil, errors.New("unexpected message "+string(byte(resbuf.t)))
+  }
+  return nil, nil, nil
+}
+
+
+// Write a single request, preceded by its time budget unless zero and its metadata unless empty
+func (s *socket) writeReq(id, op string, buf []byte, meta map[string]string, timeout time.Duration, channel string) error {
+  var metabuf []byte
+  if len(meta) != 0 {
+    var err error
+    if metabuf, err = json.Marshal(meta); err != nil {
+      return err
+    }
+  }
+  return s.write(func() error {
+    if timeout > 0 {
+      b := makeRequestDeadline(id, timeout)
+      if err := s.writeMsgLocked(MsgTypeSingleRes, RequestDeadlineID, "", b); err != nil {
+        return err
+      }
+    }
+    if metabuf != nil {
+      metabuf = append([]byte(id), metabuf...)
+      if err := s.writeMsgLocked(MsgTypeSingleRes, RequestMetaID, "", metabuf); err != nil {
+        return err
+      }
+    }
+    if channel != "" {
+      if err := s.writeMsgLocked(MsgTypeSingleRes, ChannelID, "", []byte(channel)); err != nil {
+        return err
+      }
+    }
+    return s.writeMsgLocked(MsgTypeSingleReq, id, op, buf)
+  })
+}
+
+
+// Tell the peer we are no longer interested in the result of request `id`, unless it doesn't
+// support canceling requests. Returns `err`.
+func (s *socket) cancelRequest(id string, err error) error {
+  if s.peerHas(featureCancel) {
+    s.writeMsg(MsgTypeCancelReq, id, "", nil)  // best effort; the caller gets err anyway
+  }
+  return err
+}
+
+
+func (s *socket) Request(op string, in interface{}, out interface{}) error {
+  return s.request(context.Background(), op, in, out, s.RequestTimeout(), nil)
+}
+
+
+func (s *socket) RequestContext(ctx context.Context, op string, in interface{}, out interface{}) error {
+  return s.request(ctx, op, in, out, 0, nil)
+}
+
+
+func (s *socket) RequestWithMeta(op string, in, out interface{}, meta map[string]string) error {
+  return s.request(context.Background(), op, in, out, s.RequestTimeout(), meta)
+}
+
+
+func (s *socket) RequestWithResultMeta(op string, in, out interface{}, meta map[string]string) (map[string]string, error) {
+  codec := s.Codec()
+  inbuf, err := codec.Marshal(in)
+  if err != nil {
+    return nil, err
+  }
+  outbuf, resmeta, err := s.bufferRequestMeta(context.Background(), op, inbuf, s.RequestTimeout(), meta)
+  if err != nil {
+    return resmeta, err
+  }
+  return resmeta, codec.Unmarshal(outbuf, out)
+}
+
+
+func (s *socket) request(ctx context.Context, op string, in, out interface{}, timeout time.Duration, meta map[string]string) error {
+  codec := s.Codec()
+  inbuf, err := codec.Marshal(in)
+  if err != nil {
+    return err
+  }
+  outbuf, err := s.bufferRequest(ctx, op, inbuf, timeout, meta)
+  if err != nil {
+    return err
+  }
+  return codec.Unmarshal(outbuf, out)
+}
+
+
+func (s *socket) RequestNoReply(op string, in interface{}) error {
+  buf, err := encodeValue(s.Codec(), in)
+  if err != nil {
+    return err
+  }
+  if err := s.writeMsg(MsgTypeSingleReq, NoReplyID, op, buf); err != nil {
+    return err
+  }
+  atomic.AddUint64(&s.stats.requestsSent, 1)
+  return nil
+}
+
+
+func (s *socket) StreamRequest(op string) StreamRequest {
+  return &streamRequest{sock:s, op:op, total:-1}
+}
+
+
+func (s *socket) BufferNotify(t string, buf []byte) error {
+  if queued, err := s.notes.push(t, buf); queued {
+    return err
+  }
+  if err := s.writeMsg(MsgTypeNotification, "", t, buf); err != nil {
+    return err
+  }
+  atomic.AddUint64(&s.stats.notificationsSent, 1)
+  return nil
+}
+
+func (s *socket) Notify(t string, v interface{}) error {
+  if buf, err := s.Codec().Marshal(v); err != nil {
+    return err
+  } else {
+    return s.BufferNotify(t, buf)
+  }
+}
+
+func (s *socket) NotifyContext(ctx context.Context, t string, v interface{}) error {
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+  buf, err := s.Codec().Marshal(v)
+  if err != nil {
+    return err
+  }
+  // Write in the background as an interrupted write would leave a partial message on the wire
+  errch := make(chan error, 1)
+  go func() {
+    errch <- s.BufferNotify(t, buf)
+  }()
+  select {
+  case err := <-errch:
+    return err
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
+
+// ===========================================================================================
+
+type streamRequest struct {
+  sock     *socket
+  op       string
+  id       string
+  started  bool  // request started?
+  sendDone bool  // request ended by CloseSend?
+  ended    bool  // response ended?
+  rc       *resChan
+  sent     int64  // payload bytes written
+  total    int64  // set with SetTotal, or -1
+  progress func(bytesSent, total int64)
+}
+
+func (r *streamRequest) OnProgress(f func(bytesSent, total int64)) {
+  r.progress = f
+}
+
+func (r *streamRequest) SetTotal(total int64) {
+  r.total = total
+}
+
+func (r *streamRequest) finalize() {
+  if r.id != "" {
+    r.sock.deallocResChan(r.id)
+    r.id = ""
+  }
+}
+
+func (r *streamRequest) Write(b []byte) error {
+  if r.sendDone {
+    return ErrStreamEnded
+  }
+  if r.started == false {
+    r.started = true
+    var err error
+    if r.id, r.rc, err = r.sock.allocResChan(); err != nil {
+      return err
+    }
+    if err := r.sock.writeMsg(MsgTypeStreamReq, r.id, r.op, b); err != nil {
+      r.finalize()
+      return err
+    }
+    atomic.AddUint64(&r.sock.stats.requestsSent, 1)
+    atomic.AddUint64(&r.sock.stats.streamRequestsSent, 1)
+  } else {
+    if err := r.sock.waitSendWindow(r.rc, r.sent); err != nil {
+      if r.rc.window.isStopped() {
+        // The handler has returned, but the result can still be read
+        r.sendDone = true
+      } else {
+        r.finalize()
+      }
+      return err
+    }
+    if err := r.sock.writeMsg(MsgTypeStreamReqPart, r.id, "", b); err != nil {
+      r.finalize()
+      return err
+    }
+  }
+  r.sent += int64(len(b))
+  if r.progress != nil {
+    r.progress(r.sent, r.total)
+  }
+  return nil
+}
+
+func (r *streamRequest) End() error {
+  return r.CloseSend()
+}
+
+func (r *streamRequest) CloseSend() error {
+  if r.sendDone {
+    return ErrStreamEnded
+  }
+  if r.started == false {
+    // Start the request without any payload
+    if err := r.Write(nil); err != nil {
+      return err
+    }
+  }
+  r.sendDone = true
+  err := r.sock.writeMsg(MsgTypeStreamReqPart, r.id, "", nil)
+  if err != nil {
+    r.finalize()
+  }
+  return err
+}
+
+// Ends the result, after which the request no longer counts as in flight
+func (r *streamRequest) endRead() {
+  r.ended = true
+  r.sock.releaseResChan(r.rc)
+}
+
+func (r *streamRequest) Read() ([]byte, error) {
+  if r.ended == true {
+    return nil, nil
+  }
+
+  // Wait for result chunk to be read in readLoop
+  var resval interface{}
+  select {
+  case r.rc.ch <- reqHandlerTypeBuf:
+    select {
+    case resval = <-r.rc.ch:
+    case <-r.sock.ctx.Done():
+      r.endRead()
+      return nil, ErrSockClosed
+    }
+  case <-r.sock.ctx.Done():
+    r.endRead()
+    return nil, ErrSockClosed
+  }
+
+  // Interpret resbuf
+  if resbuf, ok := resval.(resbuffer); ok {
+    if resbuf.t == MsgTypeErrorRes {
+      r.endRead()
+      return nil, decodeError(resbuf.b)
+    } else if resbuf.t == MsgTypeSingleRes || len(resbuf.b) == 0 {
+      r.endRead()
+    }
+    return resbuf.b, nil
+  }
+  return nil, nil
+}
+
+// ===========================================================================================
+
+func (s *socket) readDiscard(readz int) error {
+  if readz != 0 {
+    // todo: is there a better way to read data w/o copying it into a buffer?
+    err := readn(s.rd, make([]byte, readz))
+    return err
+  }
+  return nil
+}
+
+
+func (s *socket) respondErr(readz int, id, errmsg string) error {
+  if err := s.readDiscard(readz); err != nil {
+    return err
+  }
+  if id == NoReplyID {
+    return nil
+  }
+  return s.writeMsg(MsgTypeErrorRes, id, "", []byte(errmsg))
+}
+
+
+// Respond with an error returned by a handler
+func (s *socket) respondHandlerErr(id string, err error) error {
+  if id == NoReplyID {
+    return nil
+  }
+  return s.writeMsg(MsgTypeErrorRes, id, "", encodeError(err))
+}
+
+
+// Returns the local handler of the socket for request `op`, or the shared handler
+func (s *socket) findRequestHandler(op string) interface{} {
+  if local := s.getLocalHandlers(); local != nil {
+    if handler := local.FindRequestHandler(op); handler != nil {
+      if shared, ok := s.handlers.(*handlers); ok {
+        return shared.wrapReqHandler(handler)
       }
+      return handler
+    }
+  }
+  return s.handlers.FindRequestHandler(op)
+}
+
+// Returns the local handler of the socket for notification `name`, or the shared handler
+func (s *socket) findNotificationHandler(name string) BufferNoteHandler {
+  if local := s.getLocalHandlers(); local != nil {
+    if handler := local.FindNotificationHandler(name); handler != nil {
+      if shared, ok := s.handlers.(*handlers); ok {
+        return shared.wrapNoteHandler(handler)
+      }
+      return handler
+    }
+  }
+  return s.handlers.FindNotificationHandler(name)
+}
+
+func (s *socket) findHandlerOrResErr(id, op string, size int) interface{} {
+  var handler interface{}
+  if s.channelTag == "" {
+    handler = s.findRequestHandler(op)
+  } else if c := s.findChannel(s.channelTag); c != nil {
+    handler = c.handlers.FindRequestHandler(op)
+  } else {
+    if err := s.respondErr(size, id, "unknown channel \""+s.channelTag+"\""); err != nil {
+      panic("failed to send error")
+    }
+    return nil
+  }
+  if handler == nil {
+    if err := s.respondErr(size, id, "unknown operation \""+op+"\""); err != nil {
+      panic("failed to send error")
+    }
+  }
+  return handler
+}
+
+
+func (s *socket) readSingleReq(id, op string, size int) error {
+  noReply := id == NoReplyID
+  if !noReply {
+    if err := s.checkRequestID(id); err != nil {
+      return err
     }
-    if wroteEOS == false {
+  }
+  atomic.AddUint64(&s.stats.requestsReceived, 1)
+  timeout := s.takeRequestDeadline(id)
+  meta, err := s.takeRequestMeta(id)
+  if err != nil {
+    return s.respondErr(size, id, err.Error())
+  }
+  handlerval := s.findHandlerOrResErr(id, op, size)
+  if handlerval == nil {
+    return nil
+  }
+
+  var handler ctxReqHandler
+  switch h := handlerval.(type) {
+  case ctxReqHandler:
+    handler = h
+  case BufferReqHandler:
+    handler = func (_ context.Context, s Sock, op string, inbuf []byte) ([]byte, error) {
+      return h(s, op, inbuf)
+    }
+  case proxyHandler:
+    handler = h.single
+  default:
+    return s.respondErr(size, id, "buffered request not supported")
+  }
+
+  if err := s.takeRateToken(op); err != nil {
+    return s.refuseReq(size, id, err)
+  }
+  if err := s.beginRequest(); err != nil {
+    return s.refuseReq(size, id, err)
+  }
+
+  // Buffered handler
+  reuse := s.bufReuse
+  inbuf := allocPayload(reuse, size)
+  if err := readn(s.rd, inbuf); err != nil {
+    s.endRequest()
+    return err
+  }
+  ticket, err := s.admitOp(op)
+  if err != nil {
+    s.endRequest()
+    freePayload(reuse, inbuf)
+    return s.respondHandlerErr(id, err)
+  }
+  s.emitEvent(EventRequestStart, op, id)
+
+  // Dispatch handler
+  var ctx context.Context
+  endCtx := func() { s.deallocHandlerCtx(id) }
+  if noReply {
+    // Not registered by ID, as any number of these may be running and none can be cancelled
+    ctx, endCtx = s.newHandlerCtx(timeout)
+  } else {
+    ctx = s.allocHandlerCtx(id, timeout)
+  }
+  handlerCtx := ctx
+  if meta != nil {
+    handlerCtx = context.WithValue(ctx, requestMetaKey{}, meta)
+  }
+  resmeta := &resultMeta{}
+  handlerCtx = context.WithValue(handlerCtx, resultMetaKey{}, resmeta)
+  htimeout := s.handlers.HandlerTimeout(op)
+  var idem *idempotencyCache
+  if shared, ok := s.handlers.(*handlers); ok && meta[IdempotencyKeyMeta] != "" {
+    idem = shared.idempotencyCache()
+  }
+  go func() {
+    var outbuf []byte
+    returned := true
+    err := ticket.wait(ctx)
+    if err == nil && idem != nil {
+      ran := false
+      outbuf, err = idem.do(op, meta[IdempotencyKeyMeta], func() ([]byte, error, bool) {
+        var err error
+        ran = true
+        outbuf, returned, err = s.runReqHandler(handlerCtx, handler, op, inbuf, htimeout, ticket)
+        return outbuf, err, returned && ctx.Err() == nil && !isTransientErr(err)
+      })
+      if !ran {
+        ticket.release()
+      }
+    } else if err == nil {
+      outbuf, returned, err = s.runReqHandler(handlerCtx, handler, op, inbuf, htimeout, ticket)
+    }
+    endCtx()
+    if noReply {
+      if err != nil {
+        s.log().Debugf("request %q without reply failed: %v", op, err)
+      }
+      s.endRequest()
+    } else if err != nil {
+      if err := s.endRequestWriteMeta(MsgTypeErrorRes, id, encodeError(err), resmeta.encode()); err != nil {
+        s.log().Errorf("failed to write error result: %v", err)
+        s.closeWithError(err)
+      }
+    } else {
+      if err := s.endRequestWriteMeta(MsgTypeSingleRes, id, outbuf, resmeta.encode()); err != nil {
+        s.log().Errorf("failed to write result: %v", err)
+        s.closeWithError(err)
+      }
+    }
+    // The result might be (part of) the payload, which a handler which timed out still uses
+    if returned {
+      freePayload(reuse, inbuf)
+    }
+    s.emitEvent(EventRequestEnd, op, id)
+  }()
+
+  return nil
+}
+
+
+// Calls the handler of a buffered request, releasing `ticket` once the handler returns. If
+// `timeout` is not 0 and the handler doesn't return in time, fails with ErrCodeTimeout without
+// waiting for it, returning false for `returned`.
+func (s *socket) runReqHandler(ctx context.Context, h ctxReqHandler, op string, inbuf []byte, timeout time.Duration, ticket *opTicket) (outbuf []byte, returned bool, err error) {
+  call := func() ([]byte, error) {
+    defer ticket.release()
+    if lat := s.opLatency(op); lat != nil {
+      start := time.Now()
+      defer func() { lat.record(time.Since(start)) }()
+    }
+    return s.callReqHandler(ctx, h, op, inbuf)
+  }
+  if timeout <= 0 {
+    outbuf, err = call()
+    return outbuf, true, err
+  }
+
+  type result struct {
+    buf []byte
+    err error
+  }
+  resc := make(chan result, 1)
+  go func() {
+    buf, err := call()
+    resc <- result{buf, err}
+  }()
+  timer := time.NewTimer(timeout)
+  defer timer.Stop()
+  select {
+  case r := <-resc:
+    return r.buf, true, r.err
+  case <-timer.C:
+    return nil, false, Errorf(ErrCodeTimeout, "handler for operation \"%s\" timed out", op)
+  }
+}
+
+
+func (s *socket) readStreamReq(id, op string, size int) error {
+  if err := s.checkRequestID(id); err != nil {
+    return err
+  }
+  atomic.AddUint64(&s.stats.requestsReceived, 1)
+  atomic.AddUint64(&s.stats.streamRequestsReceived, 1)
+  // Stream handlers don't take a context, so metadata is only checked and deadlines ignored
+  s.takeRequestDeadline(id)
+  if _, err := s.takeRequestMeta(id); err != nil {
+    return s.respondErr(size, id, err.Error())
+  }
+  s.pendingReqMu.Lock()
+  npending := len(s.pendingReq)
+  s.pendingReqMu.Unlock()
+  if npending >= s.streamReqLimit {
+    if s.streamReqLimit == 0 {
+      return s.respondErr(size, id, "stream request not supported")
+    } else {
+      return s.refuseReq(size, id, Errorf(ErrCodeOverloaded, "stream request limit"))
+    }
+  }
+
+  handlerval := s.findHandlerOrResErr(id, op, size)
+  if handlerval == nil {
+    return nil
+  }
+
+  if p, ok := handlerval.(proxyHandler); ok {
+    handlerval = p.stream
+  }
+  handler, ok := handlerval.(StreamReqHandler)
+  if ok == false {
+    return s.respondErr(size, id, "streaming request not supported")
+  }
+
+  if err := s.takeRateToken(op); err != nil {
+    return s.refuseReq(size, id, err)
+  }
+  if err := s.beginRequest(); err != nil {
+    return s.refuseReq(size, id, err)
+  }
+
+  // Read first buff
+  inbuf := make([]byte, size)
+  if err := readn(s.rd, inbuf); err != nil {
+    s.endRequest()
+    return err
+  }
+
+  // Create read chan
+  rch := s.allocReqChan(id)
+  rch <- inbuf
+  reqc := s.getReqChan(id)
+  flowControlled := s.streamWindow > 0
+  if flowControlled {
+    rc := reqc
+    rc.queue = newPartQueue()
+    go s.deliverParts(id, rc, int64(s.streamWindow), int64(len(inbuf)))
+  }
+
+  // Create result writer, which stops writing once the request is cancelled or the socket is
+  // closing. A failed write closes the socket, as the peer might have received part of it.
+  ctx := s.allocHandlerCtx(id, 0)
+  wroteEOS := false
+  writer := func (b []byte) error {
+    if atomic.LoadInt32(&s.closed) != 0 {
+      return ErrSockClosed
+    }
+    if err := ctx.Err(); err != nil {
+      return err
+    }
+    if len(b) == 0 {
+      wroteEOS = true
+    }
+    if err := s.writeMsg(MsgTypeStreamRes, id, "", b); err != nil {
+      if atomic.LoadInt32(&s.closed) == 0 {
+        s.log().Errorf("failed to write result: %v", err)
+        s.closeWithError(err)
+      }
+      return ErrSockClosed
+    }
+    return nil
+  }
+
+  // Dispatch handler
+  s.emitEvent(EventStreamOpen, op, id)
+  go func () {
+    err := s.callStreamReqHandler(handler, op, rch, writer)
+    s.deallocReqChan(id)
+    cancelled := ctx.Err() != nil
+    if !cancelled && atomic.LoadInt32(&reqc.ended) == 0 {
+      // Parts still to be sent would be discarded
+      s.writeMsg(MsgTypeSingleRes, StreamStopID, "", []byte(id))
+    }
+    if flowControlled {
+      s.endStreamWindow(id)
+    }
+    s.deallocHandlerCtx(id)
+    if cancelled {
+      // The requestor is no longer interested in the result
+      s.endRequest()
+    } else if err != nil {
+      if err := s.endRequestWrite(MsgTypeErrorRes, id, encodeError(err)); err != nil {
+        s.log().Errorf("failed to write error result: %v", err)
+        s.closeWithError(err)
+      }
+    } else if wroteEOS == false {
       // automatically writing EOS unless it was written by handler
-      if err := s.writeMsg(MsgTypeStreamRes, id, "", nil); err != nil {
-        log.Println(err)
-        s.Close()
+      if err := s.endRequestWrite(MsgTypeStreamRes, id, nil); err != nil {
+        s.log().Errorf("failed to write result: %v", err)
+        s.closeWithError(err)
       }
+    } else {
+      s.endRequest()
     }
+    s.emitEvent(EventRequestEnd, op, id)
   }()
 
   return nil
@@ -556,15 +1823,25 @@ func (s *socket) readStreamReqPart(id string, size int) error {
 
   if size != 0 {
     b = make([]byte, size)
-    if err := readn(s.conn, b); err != nil {
+    if err := readn(s.rd, b); err != nil {
       return err
     }
   }
 
-  if rch := s.getReqChan(id); rch != nil {
-    rch <- b
+  rc := s.getReqChan(id)
+  if rc != nil && b == nil {
+    atomic.StoreInt32(&rc.ended, 1)
+  }
+  if rc != nil && rc.queue != nil {
+    rc.queue.push(b)
+  } else if rc != nil {
+    select {
+    case rc.ch <- b:
+    case <-rc.done:  // the handler returned while we were waiting for it to read
+    }
   } else if s.streamReqLimit == 0 {
-    return errors.New("illegal message")  // There was no "start stream" message
+    // There was no "start stream" message
+    return &ProtocolError{msg:"stream request part without a stream request"}
   } // else: ignore msg
 
   return nil
@@ -579,14 +1856,27 @@ type resbuffer struct {
 }
 
 func (s *socket) readRes(t MsgType, id string, size int) error {
-  ch := s.getResChan(id)
+  rc := s.getResChan(id)
 
-  if ch == nil {
+  if rc == nil {
     // Unexpected response: discard and ignore
     return s.readDiscard(size)
   }
 
-  handlerTv := <-ch
+  var handlerTv interface{}
+  select {
+  case handlerTv = <-rc.ch:
+  default:
+    // The requestor isn't reading yet. If it is sending a streaming request, it might be waiting
+    // for room to send parts, which can't be granted until this result has been read.
+    rc.window.grant(math.MaxInt64)
+    select {
+    case handlerTv = <-rc.ch:
+    case <-rc.done:
+      // Requestor gave up waiting: discard and ignore
+      return s.readDiscard(size)
+    }
+  }
 
   if handlerType, ok := handlerTv.(reqHandlerType); ok {
     switch (handlerType) {
@@ -595,11 +1885,14 @@ func (s *socket) readRes(t MsgType, id string, size int) error {
       var buf []byte
       if size != 0 {
         buf = make([]byte, size)
-        if err := readn(s.conn, buf); err != nil {
+        if err := readn(s.rd, buf); err != nil {
           return err
         }
       }
-      ch <- resbuffer{t, buf}
+      select {
+      case rc.ch <- resbuffer{t, buf}:
+      case <-rc.done:
+      }
 
     default:
       panic("unexpected req handler type")
@@ -613,47 +1906,382 @@ func (s *socket) readRes(t MsgType, id string, size int) error {
 
 
 func (s *socket) readNotification(name string, size int) error {
-  handler := s.handlers.FindNotificationHandler(name)
+  atomic.AddUint64(&s.stats.notificationsReceived, 1)
+  if id := s.takeNoteStreamTag(); id != "" && s.channelTag == "" {
+    if handler := s.findNotificationStreamHandler(name); handler != nil {
+      return s.readNoteStreamPart(handler, id, name, size)
+    }
+  }
+  var handler BufferNoteHandler
+  if s.channelTag == "" {
+    handler = s.findNotificationHandler(name)
+  } else if c := s.findChannel(s.channelTag); c != nil {
+    handler = c.handlers.FindNotificationHandler(name)
+  }
 
   if handler == nil {
     // read any payload and ignore notification
+    s.log().Debugf("dropped notification %q without handler", name)
     return s.readDiscard(size)
   }
 
   // Read any payload
   var buf []byte
+  reuse := s.bufReuse
   if size != 0 {
-    buf = make([]byte, size)
-    if err := readn(s.conn, buf); err != nil {
+    buf = allocPayload(reuse, size)
+    if err := readn(s.rd, buf); err != nil {
       return err
     }
   }
-
-  handler(s, name, buf)
+
+  s.callNoteHandler(handler, name, buf)
+  freePayload(reuse, buf)
+  return nil
+}
+
+
+// Payload buffers of sockets reusing buffers. Larger buffers are not kept.
+var payloadPool sync.Pool
+const maxPooledPayload = 64 * 1024
+
+// Returns a buffer for a payload of `size` bytes, from payloadPool if `reuse` is true
+func allocPayload(reuse bool, size int) []byte {
+  if reuse && size <= maxPooledPayload {
+    if p, ok := payloadPool.Get().(*[]byte); ok && cap(*p) >= size {
+      return (*p)[:size]
+    }
+  }
+  return make([]byte, size)
+}
+
+// Returns a buffer allocated with allocPayload to payloadPool if `reuse` is true
+func freePayload(reuse bool, b []byte) {
+  if reuse && cap(b) != 0 && cap(b) <= maxPooledPayload {
+    b = b[:0]
+    payloadPool.Put(&b)
+  }
+}
+
+
+func (s *socket) recoverHandler(what, name string, errp *error) {
+  if r := recover(); r != nil {
+    s.log().Errorf("panic in %s handler %q: %v", what, name, r)
+    if errp != nil {
+      *errp = handlerPanicError(r)
+    }
+  }
+}
+
+type requestMetaKey struct{}
+
+// Returns the metadata sent with the request being handled, given the context passed to its
+// handler, or nil if the request has no metadata.
+func RequestMetaFromContext(ctx context.Context) map[string]string {
+  meta, _ := ctx.Value(requestMetaKey{}).(map[string]string)
+  return meta
+}
+
+type resultMetaKey struct{}
+
+// Metadata set by a request handler, sent right before its result
+type resultMeta struct {
+  mu sync.Mutex
+  m  map[string]string
+}
+
+// Returns the metadata as JSON, or nil if there is none
+func (m *resultMeta) encode() []byte {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  if len(m.m) == 0 {
+    return nil
+  }
+  buf, _ := json.Marshal(m.m)
+  return buf
+}
+
+// Sets metadata of the result of the request being handled, given the context passed to its
+// handler, e.g. a cursor for fetching the next page or a caching hint, without adding fields
+// to every result type, or for a fallback handler to tell the requestor which op handled it.
+// The requestor receives it with RequestWithResultMeta; peers not supporting result metadata
+// ignore it. Has no effect for streaming requests or contexts of other than request handlers.
+func SetResultMeta(ctx context.Context, key, value string) {
+  m, ok := ctx.Value(resultMetaKey{}).(*resultMeta)
+  if !ok {
+    return
+  }
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  if m.m == nil {
+    m.m = make(map[string]string)
+  }
+  m.m[key] = value
+}
+
+// Read the metadata of the result of a request we sent, which precedes that result. Invalid
+// metadata is ignored.
+func (s *socket) readResultMeta(size int) error {
+  buf := make([]byte, size)
+  if err := readn(s.rd, buf); err != nil {
+    return err
+  }
+  if len(buf) < 3 {
+    return &ProtocolError{msg:"result metadata without a request ID"}
+  }
+  if rc := s.getResChan(string(buf[:3])); rc != nil {
+    var meta map[string]string
+    if json.Unmarshal(buf[3:], &meta) == nil {
+      rc.meta = meta
+    }
+  }
+  return nil
+}
+
+// Read the metadata of the request which follows. Invalid metadata fails that request rather
+// than the connection.
+func (s *socket) readRequestMeta(size int) error {
+  buf := make([]byte, size)
+  if err := readn(s.rd, buf); err != nil {
+    return err
+  }
+  if len(buf) < 3 {
+    return &ProtocolError{msg:"request metadata without a request ID"}
+  }
+  var meta map[string]string
+  err := json.Unmarshal(buf[3:], &meta)
+  if err != nil {
+    meta, err = nil, errors.New("invalid request metadata: " + err.Error())
+  }
+  s.reqMetaID, s.reqMeta, s.reqMetaErr = string(buf[:3]), meta, err
+  return nil
+}
+
+// Returns the metadata read for request `id`, if any
+func (s *socket) takeRequestMeta(id string) (map[string]string, error) {
+  meta, err := s.reqMeta, s.reqMetaErr
+  s.reqMeta, s.reqMetaErr = nil, nil
+  if s.reqMetaID != id {
+    return nil, nil
+  }
+  return meta, err
+}
+
+func (s *socket) readRequestDeadline(size int) error {
+  buf := make([]byte, size)
+  if err := readn(s.rd, buf); err != nil {
+    return err
+  }
+  id, timeout, err := ParseRequestDeadline(buf)
+  if err != nil {
+    return err
+  }
+  s.reqDeadlineID, s.reqDeadline = id, timeout
+  return nil
+}
+
+// Returns the time budget read for request `id`, or 0 if none
+func (s *socket) takeRequestDeadline(id string) time.Duration {
+  timeout := s.reqDeadline
+  s.reqDeadline = 0
+  if s.reqDeadlineID != id {
+    return 0
+  }
+  return timeout
+}
+
+// Logs panics recovered by func handlers, which are already turned into errors
+func (s *socket) logHandlerPanic(op string, err error) {
+  if e, ok := err.(*RequestError); ok && e.panic {
+    s.log().Errorf("panic in request handler %q: %v", op, e.message)
+  }
+}
+
+func (s *socket) callReqHandler(ctx context.Context, h ctxReqHandler, op string, inbuf []byte) (outbuf []byte, err error) {
+  defer s.recoverHandler("request", op, &err)
+  outbuf, err = h(ctx, s, op, inbuf)
+  s.logHandlerPanic(op, err)
+  return
+}
+
+func (s *socket) callStreamReqHandler(h StreamReqHandler, op string, rch chan []byte, write StreamWriter) (err error) {
+  defer s.recoverHandler("request", op, &err)
+  err = h(s, op, rch, write)
+  s.logHandlerPanic(op, err)
+  return
+}
+
+func (s *socket) callNoteHandler(h BufferNoteHandler, name string, buf []byte) {
+  defer s.recoverHandler("notification", name, nil)
+  h(s, name, buf)
+}
+
+
+func (s *socket) readCancelReq(id string, size int) error {
+  if err := s.readDiscard(size); err != nil {
+    return err
+  }
+  // Handlers which don't observe their context are left to complete, and their result is
+  // ignored by the peer. Streaming results end with the part being written, if any.
+  s.deallocHandlerCtx(id)
+  return nil
+}
+
+
+func (s *socket) readGoingAway(reason string, size int) error {
+  if err := s.readDiscard(size); err != nil {
+    return err
+  }
+  if s.goingAwayFunc != nil {
+    s.goingAwayFunc(s, reason)
+  }
   return nil
 }
 
 
+func (s *socket) HandshakeContext(ctx context.Context) error {
+  if ctx.Done() == nil {
+    return s.Handshake()
+  }
+  errc := make(chan error, 1)
+  go func() { errc <- s.Handshake() }()
+  select {
+  case err := <-errc:
+    return err
+  case <-ctx.Done():
+    // Unblock the handshake, which can't be resumed
+    s.closeWithError(ctx.Err())
+    <-errc
+    return ctx.Err()
+  }
+}
+
+
 func (s *socket) Handshake() error {
   // Write, read and compare version
-  if _, err := WriteVersion(s.conn); err != nil {
-    s.Close()
+  if err := s.writeVersion(); err != nil {
+    s.closeWithError(err)
+    return err
+  }
+  // Announce any codec other than the default
+  codec := s.Codec()
+  if codec.Name() != JSONCodec.Name() {
+    if _, err := WriteCodec(s.conn, codec.Name()); err != nil {
+      s.closeWithError(err)
+      return err
+    }
+  }
+  if s.compress {
+    if _, err := WriteCompression(s.conn, compressionName); err != nil {
+      s.closeWithError(err)
+      return err
+    }
+  }
+  // Everything written after announcing checksums has them, while reading switches to
+  // checksums once the peer has announced them
+  var w io.Writer = s.conn
+  var cconn *checksumConn
+  if s.checksum {
+    if _, err := WriteChecksum(s.conn, checksumName); err != nil {
+      s.closeWithError(err)
+      return err
+    }
+    cconn = &checksumConn{ReadWriteCloser:s.conn}
+    if s.maxMsgSize > 0 {
+      // A checksummed message holds a message or a few batched ones
+      cconn.limit = s.maxMsgSize + maxMsgHeaderSize
+    }
+    w = cconn
+  }
+  if len(s.handshakeData) != 0 {
+    _, err := WriteHandshakeData(w, len(s.handshakeData))
+    if err == nil {
+      _, err = w.Write(s.handshakeData)
+    }
+    if err != nil {
+      s.closeWithError(err)
+      return err
+    }
+  }
+  if err := s.flushConn(); err != nil {
+    s.closeWithError(err)
     return err
   }
-  if _, err := ReadVersion(s.conn); err != nil {
-    s.Close()
+  v, err := ReadVersion(s.conn)
+  if err == nil && int(v) < s.minVersion {
+    // Tell the peer why if it supports that, as announced along with its version
+    if c, ok := s.adoptedConn().(interface{ SetReadDeadline(time.Time) error }); ok {
+      c.SetReadDeadline(time.Now().Add(time.Second))
+      atomic.StoreUint32(&s.peerFeatures, readPeerFeatures(s.conn))
+    }
+    if s.peerHas(featureGoAway) {
+      s.writeMsg(MsgTypeGoingAway, "", "protocol version", nil)  // best effort
+    }
+    err = &ProtocolError{msg:fmt.Sprintf("peer uses protocol version %d, older than version %d",
+      v, s.minVersion)}
+  }
+  if err != nil {
+    s.closeWithError(err)
     return err
   }
+  s.version = int(v)
+  if codec.Name() != JSONCodec.Name() {
+    // The peer must announce the same codec
+    t, name, size, err := s.readHandshakeMsg()
+    if err == nil && (t != MsgTypeCodec || name != codec.Name() || size != 0) {
+      err = errors.New("peer does not use codec \"" + codec.Name() + "\"")
+    }
+    if err != nil {
+      s.closeWithError(err)
+      return err
+    }
+  }
+  if s.compress {
+    // The peer must enable compression too
+    t, name, size, err := s.readHandshakeMsg()
+    if err == nil && (t != MsgTypeCompression || name != compressionName || size != 0) {
+      err = errors.New("peer does not use compression \"" + compressionName + "\"")
+    }
+    if err != nil {
+      s.closeWithError(err)
+      return err
+    }
+  }
+  if s.checksum {
+    // The peer must enable checksums too
+    t, name, size, err := s.readHandshakeMsg()
+    if err == nil && (t != MsgTypeChecksum || name != checksumName || size != 0) {
+      err = errors.New("peer does not use checksum \"" + checksumName + "\"")
+    }
+    if err != nil {
+      s.closeWithError(err)
+      return err
+    }
+    // Batched notifications must be written with checksums too
+    s.wmu.Lock()
+    if s.bw != nil {
+      err = s.bw.Flush()
+      s.bw = bufio.NewWriter(cconn)
+    }
+    s.conn = cconn
+    s.wmu.Unlock()
+    if err != nil {
+      s.closeWithError(err)
+      return err
+    }
+  }
+  s.emitEvent(EventHandshake, "", "")
   return nil
 }
 
 
 func (s *socket) Read() error {
+  defer s.endNoteStreams()
   defer func() {
     // recover from a faulty readLoop by closing the connection
     if r := recover(); r != nil {
-      log.Println("gotalk.Sock panic:", r)
-      s.Close()
+      s.log().Errorf("panic in read loop: %v", r)
+      s.closeWithError(fmt.Errorf("panic in read loop: %v", r))
     }
   }()
 
@@ -668,10 +2296,50 @@ func (s *socket) Read() error {
     // fmt.Printf("Read: %v\n", string(b))
     // continue
 
-    // Read next message
+    // Read next message, which must arrive in full within the idle timeout
+    if d := time.Duration(atomic.LoadInt64(&s.idleTimeout)); d > 0 {
+      s.SetReadDeadline(time.Now().Add(d))
+    }
     t, id, name, size, err := ReadMsg(s.conn)
+    if e, ok := err.(*strconv.NumError); ok {
+      err = &ProtocolError{msg:"malformed message header: " + e.Error(), msgType:t, id:id}
+    }
+    err = s.idleErr(err)
+    if err != nil {
+      if err == io.EOF || atomic.LoadInt32(&s.closed) != 0 {
+        s.log().Debugf("connection closed: %v", err)
+        s.Close()
+      } else {
+        s.log().Errorf("failed to read message: %v", err)
+        s.closeWithError(err)
+      }
+      s.hbMu.Lock()
+      if s.closeErr != nil {
+        err = s.closeErr
+      }
+      s.hbMu.Unlock()
+      return err
+    }
+    atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+
+    s.rd = s.conn
+    err = s.checkMsgSize(t, size)
+    if err == nil && t == MsgTypeCompressed && s.compress {
+      // Read the message from the inflated payload instead
+      if s.rd, err = s.readCompressed(int(size)); err == nil {
+        t, id, name, size, err = ReadMsg(s.rd)
+        if e, ok := err.(*strconv.NumError); ok {
+          err = &ProtocolError{msg:"malformed message header: " + e.Error(), msgType:t, id:id}
+        } else if err == nil && t == MsgTypeCompressed {
+          err = &ProtocolError{msg:"compressed message inside compressed message"}
+        } else if err == nil {
+          err = s.checkMsgSize(t, size)
+        }
+      }
+    }
     if err != nil {
-      s.Close()
+      s.log().Errorf("%v", err)
+      s.closeWithError(err)
       return err
     }
 
@@ -688,19 +2356,70 @@ func (s *socket) Read() error {
         err = s.readStreamReqPart(id, int(size))
 
       case MsgTypeSingleRes, MsgTypeStreamRes, MsgTypeErrorRes:
-        err = s.readRes(t, id, int(size))
+        if t == MsgTypeSingleRes && id == NotifyStreamID {
+          err = s.readNotifyStream(int(size))
+        } else if t == MsgTypeSingleRes && id == RequestMetaID {
+          err = s.readRequestMeta(int(size))
+        } else if t == MsgTypeSingleRes && id == HandshakeDataID {
+          err = s.readHandshakeData(int(size))
+        } else if t == MsgTypeSingleRes && id == ResultMetaID {
+          err = s.readResultMeta(int(size))
+        } else if t == MsgTypeSingleRes && id == RequestDeadlineID {
+          err = s.readRequestDeadline(int(size))
+        } else if t == MsgTypeSingleRes && id == StreamWindowID {
+          err = s.readStreamWindow(int(size))
+        } else if t == MsgTypeSingleRes && id == StreamStopID {
+          err = s.readStreamStop(int(size))
+        } else if t == MsgTypeSingleRes && id == ChannelID {
+          err = s.readChannelTag(int(size))
+        } else if t == MsgTypeSingleRes && id == FeaturesID {
+          err = s.readFeatures(s.rd, int(size))
+        } else {
+          err = s.readRes(t, id, int(size))
+        }
 
       case MsgTypeNotification:
         err = s.readNotification(name, int(size))
 
+      case MsgTypeCancelReq:
+        err = s.readCancelReq(id, int(size))
+
+      case MsgTypeGoingAway:
+        err = s.readGoingAway(name, int(size))
+
+      case MsgTypeHeartbeat:
+        err = s.readHeartbeat(id, size)
+
+      case MsgTypeCodec:
+        // Only sent by peers using a codec other than the default, which we don't use or we
+        // would have read it during handshake.
+        err = errors.New("peer uses unsupported codec \"" + name + "\"")
+
+      case MsgTypeCompression:
+        // Likewise only sent by peers using compression
+        err = errors.New("peer uses unsupported compression \"" + name + "\"")
+
+      case MsgTypeChecksum:
+        // Likewise only sent by peers using checksums
+        err = errors.New("peer uses unsupported checksum \"" + name + "\"")
+
       default:
-        return errors.New("unexpected protocol message type")
+        err = &ProtocolError{msg:fmt.Sprintf("unexpected message type %q", byte(t))}
     }
 
-    if err != nil {
-      s.Close()
+    if e, ok := err.(*ProtocolError); ok && e.msgType == 0 {
+      e.msgType = t
+      e.id = id
+    }
+    if err = s.idleErr(err); err != nil {
+      s.log().Errorf("failed to read %c message: %v", byte(t), err)
+      s.closeWithError(err)
       return err
     }
+    // A channel tag only applies to the message right after it
+    if t != MsgTypeSingleRes || id != ChannelID {
+      s.channelTag = ""
+    }
   }
 
   // never reached
@@ -708,34 +2427,275 @@ func (s *socket) Read() error {
 }
 
 
-func (s *socket) accept(c net.Conn, sockHandler SockHandler) {
-  s2 := NewSock(s.handlers)
-  s2.SetStreamReqLimit(s.streamReqLimit)
-  s2.Adopt(c)
-  if err := s2.Handshake(); err == nil {
-    if sockHandler != nil {
-      sockHandler(s2)
-    }
-    s2.Read()
+func (s *socket) Handlers() Handlers {
+  return s.handlers
+}
+
+
+func (s *socket) LocalHandlers() Handlers {
+  s.localMu.Lock()
+  defer s.localMu.Unlock()
+  if s.local == nil {
+    s.local = NewHandlers().(*handlers)
   }
+  return s.local
 }
 
 
-func (s *socket) Accept(sockHandler SockHandler) error {
+// Returns the local handlers of the socket, or nil if LocalHandlers hasn't been called
+func (s *socket) getLocalHandlers() *handlers {
+  s.localMu.Lock()
+  defer s.localMu.Unlock()
+  return s.local
+}
+
+
+// Returns a *ProtocolError if a message of type `t` with a payload of `size` bytes exceeds the
+// size limit
+func (s *socket) checkMsgSize(t MsgType, size uint32) error {
+  return checkMsgSize(t, size, s.maxMsgSize)
+}
+
+
+func (s *socket) SetCodec(c Codec) {
+  s.codec = c
+}
+
+func (s *socket) SetRequestTimeout(d time.Duration) {
+  atomic.StoreInt64(&s.requestTimeout, int64(d))
+}
+
+func (s *socket) RequestTimeout() time.Duration {
+  return time.Duration(atomic.LoadInt64(&s.requestTimeout))
+}
+
+type deadlineConn interface {
+  SetReadDeadline(t time.Time) error
+  SetWriteDeadline(t time.Time) error
+}
+
+var errNoDeadline = errors.New("connection does not support deadlines")
+
+func (s *socket) SetReadDeadline(t time.Time) error {
+  if c, ok := s.rawConn().(deadlineConn); ok {
+    return c.SetReadDeadline(t)
+  }
+  return errNoDeadline
+}
+
+func (s *socket) SetWriteDeadline(t time.Time) error {
+  if c, ok := s.rawConn().(deadlineConn); ok {
+    return c.SetWriteDeadline(t)
+  }
+  return errNoDeadline
+}
+
+var errNotTCP = errors.New("not a TCP connection")
+
+func (s *socket) SetTCPKeepAlive(d time.Duration) error {
+  c := s.rawConn()
+  if tc, ok := c.(*tls.Conn); ok {
+    c = tc.NetConn()
+  }
+  tc, ok := c.(*net.TCPConn)
+  if !ok {
+    return errNotTCP
+  }
+  if d <= 0 {
+    return tc.SetKeepAlive(false)
+  }
+  if err := tc.SetKeepAlive(true); err != nil {
+    return err
+  }
+  return tc.SetKeepAlivePeriod(d)
+}
+
+func (s *socket) SetIdleTimeout(d time.Duration) {
+  atomic.StoreInt64(&s.idleTimeout, int64(d))
+}
+
+// Returns ErrIdleTimeout in place of `err` if reading timed out because of the idle timeout
+func (s *socket) idleErr(err error) error {
+  if e, ok := err.(net.Error); ok && e.Timeout() && atomic.LoadInt64(&s.idleTimeout) > 0 {
+    return ErrIdleTimeout
+  }
+  return err
+}
+
+func (s *socket) SetHeartbeat(interval time.Duration) {
+  s.hbMu.Lock()
+  wasEnabled := s.hbStop != nil
+  if s.hbStop != nil {
+    close(s.hbStop)
+    s.hbStop = nil
+  }
+  if interval > 0 {
+    s.hbStop = make(chan struct{})
+    atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+    go s.heartbeatLoop(interval, s.hbStop)
+  }
+  s.hbMu.Unlock()
+
+  if (interval > 0) != wasEnabled && s.version >= 0 {
+    // Tell the peer whether we want heartbeats, the handshake having announced our features
+    features := formatFeatures(s.localFeatures())
+    s.writeMsg(MsgTypeSingleRes, FeaturesID, "", []byte(features))  // best effort
+  }
+}
+
+func (s *socket) SetHeartbeatMaxMissed(n int) {
+  s.hbMu.Lock()
+  defer s.hbMu.Unlock()
+  s.hbMaxMissed = n
+}
+
+func (s *socket) OnHeartbeat(f func(load int, t time.Time)) {
+  s.hbMu.Lock()
+  defer s.hbMu.Unlock()
+  s.heartbeatFunc = f
+}
+
+func (s *socket) heartbeatLoop(interval time.Duration, stop chan struct{}) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
   for {
-    c, err := s.listener.Accept()
+    select {
+    case <-stop:
+      return
+    case <-s.ctx.Done():
+      return
+    case <-ticker.C:
+    }
+    if !s.peerHas(featureHeartbeat) {
+      continue  // the peer doesn't want heartbeats, nor sends any
+    }
+
+    s.hbMu.Lock()
+    maxMissed := s.hbMaxMissed
+    s.hbMu.Unlock()
+    if maxMissed <= 0 {
+      maxMissed = 3
+    }
+    if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRecv))) > time.Duration(maxMissed)*interval {
+      s.log().Errorf("no message received from peer for %v; closing connection",
+        time.Duration(maxMissed)*interval)
+      s.closeWithError(ErrHeartbeatTimeout)
+      return
+    }
+
+    // Heartbeats are written like any other message, in between other messages and never in
+    // the middle of one, e.g. a long streaming result part.
+    err := s.write(func() error {
+      if _, err := WriteHeartbeat(s.writer(), s.inflightCount(), time.Now()); err != nil {
+        return err
+      }
+      return s.flushLocked(MsgTypeHeartbeat)
+    })
+    if err == ErrSockClosed {
+      return
+    }
     if err != nil {
-      return err
+      s.log().Errorf("failed to write heartbeat: %v", err)
+      s.closeWithError(err)
+      return
     }
-    go s.accept(c, sockHandler)
   }
-  s.listener.Close()
+}
+
+func (s *socket) readHeartbeat(id string, size uint32) error {
+  load, t, err := ParseHeartbeat(id, size)
+  if err != nil {
+    return err
+  }
+  s.hbMu.Lock()
+  f := s.heartbeatFunc
+  s.hbMu.Unlock()
+  if f != nil {
+    f(load, t)
+  }
   return nil
 }
 
+// Close the socket because of `err`, which Read returns and the OnClose func receives, unless
+// the socket is already closed. A nil `err` means a clean close.
+func (s *socket) closeWithError(err error) error {
+  if s.conn == nil || !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+    return nil
+  }
+  s.reportProtocolError(err)
+  if err != nil {
+    s.hbMu.Lock()
+    s.closeErr = err
+    s.hbMu.Unlock()
+  }
+  if s.cancelCtx != nil {
+    s.cancelCtx()
+  }
+  if err == nil && s.wmu.TryLock() {
+    // Write batched notifications unless another write is stuck
+    if s.bw != nil {
+      s.bw.Flush()
+    }
+    s.flushConn()
+    s.wmu.Unlock()
+  }
+  cerr := s.conn.Close()
+  s.notes.close()
+  if s.server != nil {
+    s.server.removeSock(s)
+  }
+  s.leaveTopics()
+  if s.closeFunc != nil {
+    s.closeFunc(s)
+  }
+  if s.onClose != nil {
+    s.onClose(err)
+  }
+  s.emitEvent(EventClosed, "", "")
+  s.valuesMu.Lock()
+  s.values = nil
+  s.valuesMu.Unlock()
+  return cerr
+}
+
+func (s *socket) Stats() Stats {
+  st := s.stats.snapshot()
+  st.RequestsInFlight = s.inflightCount()
+  s.pendingResMu.RLock()
+  st.ResultsPending = len(s.pendingRes)
+  s.pendingResMu.RUnlock()
+  s.pendingReqMu.RLock()
+  st.StreamsActive = len(s.pendingReq)
+  s.pendingReqMu.RUnlock()
+  st.SendsPending = s.PendingSendCount()
+  return st
+}
 
-func (s *socket) Handlers() Handlers {
-  return s.handlers
+func (s *socket) PendingSendCount() int {
+  return int(atomic.LoadInt32(&s.pendingSends)) + s.notes.len()
+}
+
+func (s *socket) PendingSendBytes() int {
+  return int(atomic.LoadInt64(&s.pendingBytes)) + s.notes.bytes()
+}
+
+func (s *socket) SetLogger(l Logger) {
+  s.logger = l
+}
+
+// Returns the logger of the socket, or NopLogger if none is set
+func (s *socket) log() Logger {
+  if s.logger == nil {
+    return NopLogger
+  }
+  return s.logger
+}
+
+func (s *socket) Codec() Codec {
+  if s.codec == nil {
+    return JSONCodec
+  }
+  return s.codec
 }
 
 
@@ -748,44 +2708,212 @@ func (s *socket) GetUserData() interface{} {
 }
 
 
+func (s *socket) SetValue(key, value interface{}) {
+  s.valuesMu.Lock()
+  defer s.valuesMu.Unlock()
+  if value == nil {
+    delete(s.values, key)
+    return
+  }
+  if s.values == nil {
+    s.values = make(map[interface{}]interface{})
+  }
+  s.values[key] = value
+}
+
+
+func (s *socket) Value(key interface{}) interface{} {
+  s.valuesMu.RLock()
+  defer s.valuesMu.RUnlock()
+  return s.values[key]
+}
+
+
 func (s *socket) SetStreamReqLimit(limit int) {
   s.streamReqLimit = limit
 }
 
 
-func (s *socket) Addr() string {
-  if s.conn != nil {
-    if netconn, ok := s.conn.(net.Conn); ok {
-      return netconn.RemoteAddr().String()
+func (s *socket) SetMaxMessageSize(n int) {
+  s.maxMsgSize = n
+}
+
+
+func (s *socket) SetBufferReuse(reuse bool) {
+  s.bufReuse = reuse
+}
+
+
+func (s *socket) SetMaxConcurrentRequests(n int) {
+  s.inflightMu.Lock()
+  defer s.inflightMu.Unlock()
+  s.maxInflight = n
+}
+
+
+// Returns the connection adopted by the socket, unwrapped from checksums and counting
+func (s *socket) adoptedConn() io.ReadWriteCloser {
+  c := s.conn
+  if cc, ok := c.(*checksumConn); ok {
+    c = cc.ReadWriteCloser
+  }
+  if cc, ok := c.(*countingConn); ok {
+    c = cc.ReadWriteCloser
+  }
+  return c
+}
+
+
+// Returns the connection adopted by the socket, or the web socket of a buffered web socket
+func (s *socket) rawConn() io.ReadWriteCloser {
+  c := s.adoptedConn()
+  if wc, ok := c.(*webSocketConn); ok {
+    return wc.Conn
+  }
+  return c
+}
+
+
+func (s *socket) ConnectionState() *tls.ConnectionState {
+  if c, ok := s.rawConn().(*tls.Conn); ok {
+    cs := c.ConnectionState()
+    return &cs
+  }
+  return nil
+}
+
+
+func (s *socket) HTTPRequest() *http.Request {
+  if c, ok := s.rawConn().(*websocket.Conn); ok {
+    return c.Request()
+  }
+  return nil
+}
+
+
+func (s *socket) Subprotocol() string {
+  if c, ok := s.rawConn().(*websocket.Conn); ok && c.Request() != nil {
+    if protocols := c.Config().Protocol; len(protocols) == 1 {
+      return protocols[0]
     }
-  } else if s.listener != nil {
-    return s.listener.Addr().String()
   }
   return ""
 }
 
 
+func (s *socket) Addr() string {
+  if s.listenServer != nil {
+    return s.listenServer.Addr()
+  }
+  if a := s.RemoteAddr(); a != nil {
+    return a.String()
+  }
+  return ""
+}
+
+
+func (s *socket) RemoteAddr() net.Addr {
+  switch c := s.rawConn().(type) {
+  case *websocket.Conn:
+    remote, _ := webSocketAddrs(c)
+    return remote
+  case net.Conn:
+    return c.RemoteAddr()
+  }
+  return nil
+}
+
+
+func (s *socket) LocalAddr() net.Addr {
+  switch c := s.rawConn().(type) {
+  case *websocket.Conn:
+    _, local := webSocketAddrs(c)
+    return local
+  case net.Conn:
+    return c.LocalAddr()
+  }
+  return nil
+}
+
+
+func (s *socket) Closed() bool {
+  return atomic.LoadInt32(&s.closed) != 0
+}
+
+
+func (s *socket) Done() <-chan struct{} {
+  return s.ctx.Done()
+}
+
+
+// Safe to call concurrently with reads and writes, and more than once.
 func (s *socket) Close() error {
-  if s.conn != nil {
-    err := s.conn.Close()
-    s.conn = nil
-    if s.closeFunc != nil {
-      s.closeFunc(s)
+  if srv := s.listenServer; srv != nil {
+    if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+      return nil
     }
-    return err
-  } else if s.listener != nil {
-    err := s.listener.Close()
-    s.listener = nil
+    err := srv.Close()
     if s.closeFunc != nil {
       s.closeFunc(s)
     }
     return err
-  } else {
-    return nil
   }
+  return s.closeWithError(nil)
 }
 
 
 func (s *socket) SetCloseFunc(f func(Sock)) {
   s.closeFunc = f
 }
+
+
+func (s *socket) OnClose(f func(err error)) {
+  s.onClose = f
+}
+
+
+func (s *socket) OnProtocolError(f func(err *ProtocolError)) {
+  s.onProtocolErr = f
+}
+
+
+// Calls the OnProtocolError func if `err` is a *ProtocolError
+func (s *socket) reportProtocolError(err error) {
+  if e, ok := err.(*ProtocolError); ok && s.onProtocolErr != nil {
+    s.onProtocolErr(e)
+  }
+}
+
+
+func (s *socket) ProtocolVersion() int {
+  return s.version
+}
+
+
+func (s *socket) SetHandshakeData(b []byte) {
+  s.handshakeData = b
+}
+
+
+func (s *socket) PeerHandshakeData() []byte {
+  s.peerDataMu.Lock()
+  defer s.peerDataMu.Unlock()
+  return s.peerData
+}
+
+
+func (s *socket) readHandshakeData(size int) error {
+  buf := make([]byte, size)
+  if err := readn(s.rd, buf); err != nil {
+    return err
+  }
+  s.peerDataMu.Lock()
+  defer s.peerDataMu.Unlock()
+  s.peerData = buf
+  return nil
+}
+
+
+func (s *socket) SetGoingAwayFunc(f func(Sock, string)) {
+  s.goingAwayFunc = f
+}
@@ -0,0 +1,2002 @@
+package gotalk
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "io"
+  "net"
+  "runtime"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+
+// Returns a reading socket connected to a raw connection which the test can use to act as the
+// other side.
+func pipeRaw(t *testing.T, h Handlers) (Sock, net.Conn) {
+  c1, c2 := net.Pipe()
+  s := NewSock(h)
+  s.Adopt(c1)
+  go s.Read()
+  return s, c2
+}
+
+
+func readRawMsg(t *testing.T, c net.Conn) (MsgType, string, string, []byte) {
+  ty, id, name, size, err := ReadMsg(c)
+  if err != nil {
+    t.Fatalf("ReadMsg() failed: %v", err)
+  }
+  payload := make([]byte, size)
+  if err := readn(c, payload); err != nil {
+    t.Fatalf("readn() failed: %v", err)
+  }
+  return ty, id, name, payload
+}
+
+
+// Handshakes and reads messages on `c` like a peer from before features were announced, which
+// closes the connection on message types it doesn't know of. Returns a channel which receives
+// the type of such a message, and is closed when the connection closes.
+func baselinePeer(c net.Conn) <-chan MsgType {
+  unknown := make(chan MsgType, 1)
+  go func() {
+    defer close(unknown)
+    defer c.Close()
+    go WriteVersion(c)
+    if _, err := ReadVersion(c); err != nil {
+      return
+    }
+    for {
+      t, _, _, size, err := ReadMsg(c)
+      if err != nil {
+        return
+      }
+      switch t {
+      case MsgTypeSingleReq, MsgTypeStreamReq, MsgTypeStreamReqPart, MsgTypeSingleRes,
+           MsgTypeStreamRes, MsgTypeErrorRes, MsgTypeNotification:
+        if err := readn(c, make([]byte, size)); err != nil {
+          return
+        }
+      default:
+        unknown <- t
+        return
+      }
+    }
+  }()
+  return unknown
+}
+
+
+func TestRequestContextCancel(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  WriteFeatures(c, "cancel")
+
+  errch := make(chan error, 1)
+  ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+  defer cancel()
+  go func() {
+    var out string
+    errch <- s.RequestContext(ctx, "echo", "hello", &out)
+  }()
+
+  // The deadline of the context is sent before the request
+  if ty, id, _, _ := readRawMsg(t, c); ty != MsgTypeSingleRes || id != RequestDeadlineID {
+    t.Fatalf("got message %c %q, expected request deadline", byte(ty), id)
+  }
+  ty, id, name, _ := readRawMsg(t, c)
+  if ty != MsgTypeSingleReq || name != "echo" {
+    t.Fatalf("got message %c %q, expected %c %q", byte(ty), name, byte(MsgTypeSingleReq), "echo")
+  }
+
+  // The requestor should give up and tell us about it
+  ty2, id2, _, _ := readRawMsg(t, c)
+  if ty2 != MsgTypeCancelReq || id2 != id {
+    t.Errorf("got message %c %q, expected %c %q", byte(ty2), id2, byte(MsgTypeCancelReq), id)
+  }
+  if err := <-errch; err != context.DeadlineExceeded {
+    t.Errorf("RequestContext() => %v, expected %v", err, context.DeadlineExceeded)
+  }
+
+  // The pending-response slot should have been freed
+  if rc := s.(*socket).getResChan(id); rc != nil {
+    t.Errorf("pending response %q was not freed", id)
+  }
+
+  // A late response should be ignored and the socket still be usable
+  c.Write(MakeMsg(MsgTypeSingleRes, id, "", 0))
+  go func() {
+    var out string
+    if err := s.Request("echo", "hello", &out); err != nil {
+      errch <- err
+    } else if out != "hello" {
+      t.Errorf("Request() => %q, expected %q", out, "hello")
+    }
+    errch <- nil
+  }()
+  _, id, _, payload := readRawMsg(t, c)
+  c.Write(MakeMsg(MsgTypeSingleRes, id, "", len(payload)))
+  c.Write(payload)
+  if err := <-errch; err != nil {
+    t.Errorf("Request() failed: %v", err)
+  }
+}
+
+
+func TestHandlerContextCancel(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("wait", func(ctx context.Context) error {
+    <-ctx.Done()
+    return ctx.Err()
+  })
+  s, c := pipeRaw(t, h)
+  defer c.Close()
+
+  c.Write(MakeMsg(MsgTypeSingleReq, "abc", "wait", 0))
+  c.Write(MakeMsg(MsgTypeCancelReq, "abc", "", 0))
+
+  ty, id, _, payload := readRawMsg(t, c)
+  if ty != MsgTypeErrorRes || id != "abc" || string(payload) != context.Canceled.Error() {
+    t.Errorf("got message %c %q %q, expected %c %q %q", byte(ty), id, payload,
+      byte(MsgTypeErrorRes), "abc", context.Canceled.Error())
+  }
+  if n := len(s.(*socket).handlerCtx); n != 0 {
+    t.Errorf("len(handlerCtx) = %v, expected 0", n)
+  }
+}
+
+
+func TestOperationConcurrency(t *testing.T) {
+  h := NewHandlers()
+  h.SetOperationConcurrency("work", 1)
+  h.SetOperationQueueLimit("work", 1)
+  started := make(chan string, 3)
+  release := make(chan struct{})
+  h.HandleRequest("work", func(s string) (string, error) {
+    started <- s
+    <-release
+    return s, nil
+  })
+  _, c := pipeRaw(t, h)
+  defer c.Close()
+
+  c.Write(MakeMsg(MsgTypeSingleReq, "001", "work", 3))
+  c.Write([]byte(`"a"`))
+  if s := <-started; s != "a" {
+    t.Fatalf("handler started with %q, expected %q", s, "a")
+  }
+
+  // The second request is queued while the third is rejected
+  c.Write(MakeMsg(MsgTypeSingleReq, "002", "work", 3))
+  c.Write([]byte(`"b"`))
+  c.Write(MakeMsg(MsgTypeSingleReq, "003", "work", 3))
+  c.Write([]byte(`"c"`))
+  ty, id, _, payload := readRawMsg(t, c)
+  if e := decodeError(payload); ty != MsgTypeErrorRes || id != "003" || e.Code() != ErrCodeOverloaded {
+    t.Errorf("got message %c %q %q, expected error for \"003\"", byte(ty), id, payload)
+  }
+  select {
+  case s := <-started:
+    t.Errorf("handler started with %q while another one was running", s)
+  default:
+  }
+
+  // Completing the first request lets the second one run
+  release <- struct{}{}
+  if ty, id, _, _ := readRawMsg(t, c); ty != MsgTypeSingleRes || id != "001" {
+    t.Errorf("got message %c %q, expected result for \"001\"", byte(ty), id)
+  }
+  if s := <-started; s != "b" {
+    t.Errorf("handler started with %q, expected %q", s, "b")
+  }
+  release <- struct{}{}
+  if ty, id, _, _ := readRawMsg(t, c); ty != MsgTypeSingleRes || id != "002" {
+    t.Errorf("got message %c %q, expected result for \"002\"", byte(ty), id)
+  }
+}
+
+
+func TestHandlerTimeout(t *testing.T) {
+  h := NewHandlers()
+  h.SetHandlerTimeout("slow", 20*time.Millisecond)
+  canceled := make(chan error, 1)
+  h.HandleRequest("slow", func(ctx context.Context, s string) (string, error) {
+    <-ctx.Done()
+    canceled <- ctx.Err()
+    return s, nil
+  })
+  h.HandleRequest("fast", func(s string) (string, error) {
+    return s, nil
+  })
+  if d := h.HandlerTimeout("slow"); d != 20*time.Millisecond {
+    t.Errorf("HandlerTimeout() => %v, expected 20ms", d)
+  }
+  _, c := pipeRaw(t, h)
+  defer c.Close()
+
+  c.Write(MakeMsg(MsgTypeSingleReq, "001", "slow", 3))
+  c.Write([]byte(`"a"`))
+  ty, id, _, payload := readRawMsg(t, c)
+  if e := decodeError(payload); ty != MsgTypeErrorRes || id != "001" || e.Code() != ErrCodeTimeout {
+    t.Errorf("got message %c %q %q, expected timeout error for \"001\"", byte(ty), id, payload)
+  }
+  if err := <-canceled; err != context.Canceled {
+    t.Errorf("handler context ended with %v, expected context.Canceled", err)
+  }
+
+  // Other operations aren't limited, and the result of the late handler isn't sent
+  c.Write(MakeMsg(MsgTypeSingleReq, "002", "fast", 3))
+  c.Write([]byte(`"b"`))
+  if ty, id, _, _ := readRawMsg(t, c); ty != MsgTypeSingleRes || id != "002" {
+    t.Errorf("got message %c %q, expected result for \"002\"", byte(ty), id)
+  }
+}
+
+
+func TestRequestNoReply(t *testing.T) {
+  h := NewHandlers()
+  calls := make(chan int, 2)
+  h.HandleRequest("add", func(n int) (int, error) {
+    calls <- n
+    if n < 0 {
+      return 0, Errorf(400, "negative")
+    }
+    return n + 1, nil
+  })
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  s, c := pipeRaw(t, h)
+  defer c.Close()
+
+  // The request is written with the reserved ID
+  go s.RequestNoReply("add", 1)
+  ty, id, op, payload := readRawMsg(t, c)
+  if ty != MsgTypeSingleReq || id != NoReplyID || op != "add" || string(payload) != "1" {
+    t.Errorf("got message %c %q %q %q, expected request without reply", byte(ty), id, op, payload)
+  }
+
+  // Handlers are called but neither results nor errors are written, also for concurrent requests
+  for _, n := range []string{"2", "-1"} {
+    c.Write(MakeMsg(MsgTypeSingleReq, NoReplyID, "add", len(n)))
+    c.Write([]byte(n))
+  }
+  c.Write(MakeMsg(MsgTypeSingleReq, NoReplyID, "unknown", 0))
+  if got := map[int]bool{<-calls: true, <-calls: true}; !got[2] || !got[-1] {
+    t.Errorf("handler called with %v, expected 2 and -1", got)
+  }
+  c.Write(MakeMsg(MsgTypeSingleReq, "001", "echo", 4))
+  c.Write([]byte(`"hi"`))
+  if ty, id, _, _ := readRawMsg(t, c); ty != MsgTypeSingleRes || id != "001" {
+    t.Errorf("got message %c %q, expected result for \"001\"", byte(ty), id)
+  }
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+  h := NewHandlers()
+  started := make(chan struct{}, 2)
+  release := make(chan struct{})
+  h.HandleRequest("work", func() error {
+    started <- struct{}{}
+    <-release
+    return nil
+  })
+  s, c := pipeRaw(t, h)
+  defer c.Close()
+  s.SetMaxConcurrentRequests(1)
+
+  c.Write(MakeMsg(MsgTypeSingleReq, "001", "work", 0))
+  <-started
+
+  // Requests beyond the limit are refused without calling the handler
+  c.Write(MakeMsg(MsgTypeSingleReq, "002", "work", 0))
+  ty, id, _, payload := readRawMsg(t, c)
+  if e := decodeError(payload); ty != MsgTypeErrorRes || id != "002" || e.Code() != ErrCodeOverloaded {
+    t.Errorf("got message %c %q %q, expected error for \"002\"", byte(ty), id, payload)
+  }
+
+  // Completed requests no longer count towards the limit
+  release <- struct{}{}
+  if ty, id, _, _ := readRawMsg(t, c); ty != MsgTypeSingleRes || id != "001" {
+    t.Errorf("got message %c %q, expected result for \"001\"", byte(ty), id)
+  }
+  c.Write(MakeMsg(MsgTypeSingleReq, "003", "work", 0))
+  <-started
+  release <- struct{}{}
+  if ty, id, _, _ := readRawMsg(t, c); ty != MsgTypeSingleRes || id != "003" {
+    t.Errorf("got message %c %q, expected result for \"003\"", byte(ty), id)
+  }
+}
+
+
+func TestMaxMessageSize(t *testing.T) {
+  c1, c2 := net.Pipe()
+  defer c2.Close()
+  s := NewSock(NewHandlers())
+  s.Adopt(c1)
+  s.SetMaxMessageSize(1024)
+
+  // A message within the limit is fine, while one declaring 1 GB of payload is refused before
+  // its payload is allocated.
+  go func() {
+    c2.Write(MakeMsg(MsgTypeNotification, "", "note", 1024))
+    c2.Write(make([]byte, 1024))
+    c2.Write(MakeMsg(MsgTypeSingleReq, "001", "op", 1<<30))
+  }()
+  var m0, m1 runtime.MemStats
+  runtime.ReadMemStats(&m0)
+  err := s.Read()
+  runtime.ReadMemStats(&m1)
+  if _, ok := err.(*ProtocolError); !ok {
+    t.Errorf("Read() => %v, expected a *ProtocolError", err)
+  }
+  if n := m1.TotalAlloc - m0.TotalAlloc; n > 1<<20 {
+    t.Errorf("Read() allocated %d bytes", n)
+  }
+}
+
+
+func TestOnProtocolError(t *testing.T) {
+  c1, c2 := net.Pipe()
+  defer c2.Close()
+  s := NewSock(NewHandlers())
+  s.Adopt(c1)
+  var got *ProtocolError
+  s.OnProtocolError(func(err *ProtocolError) {
+    if atomic.LoadInt32(&s.(*socket).closed) == 0 || got != nil {
+      t.Errorf("OnProtocolError func called twice or before closing")
+    }
+    got = err
+  })
+  closed := make(chan struct{})
+  s.OnClose(func(error) {
+    if got == nil {
+      t.Errorf("OnClose func called before the OnProtocolError func")
+    }
+    close(closed)
+  })
+
+  // A request whose operation name has a length which isn't a number
+  go c2.Write([]byte("r001zzzecho00000000"))
+  err := s.Read()
+  <-closed
+  if err != got || got == nil {
+    t.Fatalf("Read() => %v, expected the error given to the OnProtocolError func (%v)", err, got)
+  }
+  if got.MsgType() != MsgTypeSingleReq || got.MsgID() != "001" ||
+     !strings.Contains(got.Message(), "malformed message header") {
+    t.Errorf("got error %q for %c message %q", got.Message(), byte(got.MsgType()), got.MsgID())
+  }
+}
+
+
+func TestStreamRequestProgress(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  r := s.StreamRequest("upload")
+  r.SetTotal(5)
+  var progress [][2]int64
+  r.OnProgress(func(sent, total int64) {
+    progress = append(progress, [2]int64{sent, total})
+  })
+
+  done := make(chan error, 1)
+  go func() {
+    for _, part := range []string{"ab", "cde"} {
+      if err := r.Write([]byte(part)); err != nil {
+        done <- err
+        return
+      }
+    }
+    done <- r.End()
+  }()
+  for i := 0; i < 3; i++ {
+    readRawMsg(t, c)
+  }
+  if err := <-done; err != nil {
+    t.Fatal(err)
+  }
+  if fmt.Sprint(progress) != "[[2 5] [5 5]]" {
+    t.Errorf("progress = %v, expected [[2 5] [5 5]]", progress)
+  }
+}
+
+
+func TestStreamRequestCloseSend(t *testing.T) {
+  h := NewHandlers()
+  h.HandleStreamRequest("echo", func(s Sock, op string, rch chan []byte, write StreamWriter) error {
+    for b := <-rch; b != nil; b = <-rch {
+      if len(b) != 0 {
+        if err := write(b); err != nil {
+          return err
+        }
+      }
+    }
+    // The input has ended but results can still be written
+    return write([]byte("bye"))
+  })
+  c1, c2 := net.Pipe()
+  defer c1.Close()
+  defer c2.Close()
+  s1, s2 := NewSock(NewHandlers()), NewSock(h)
+  s2.SetStreamReqLimit(1)
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  go s1.Read()
+  go s2.Read()
+
+  r := s1.StreamRequest("echo")
+  if err := r.Write([]byte("hi")); err != nil {
+    t.Fatal(err)
+  }
+  if b, err := r.Read(); err != nil || string(b) != "hi" {
+    t.Errorf("Read() => (%q, %v), expected (\"hi\", nil)", b, err)
+  }
+  if err := r.CloseSend(); err != nil {
+    t.Fatal(err)
+  }
+  if b, err := r.Read(); err != nil || string(b) != "bye" {
+    t.Errorf("Read() => (%q, %v), expected (\"bye\", nil)", b, err)
+  }
+  if b, err := r.Read(); err != nil || len(b) != 0 {
+    t.Errorf("Read() => (%q, %v), expected end of stream", b, err)
+  }
+  if err := r.Write([]byte("more")); err != ErrStreamEnded {
+    t.Errorf("Write() after CloseSend => %v, expected %v", err, ErrStreamEnded)
+  }
+}
+
+
+func TestStreamWriterSockClosed(t *testing.T) {
+  h := NewHandlers()
+  errc := make(chan error, 1)
+  h.HandleStreamRequest("feed", func(s Sock, op string, rch chan []byte, write StreamWriter) error {
+    for {
+      if err := write([]byte("x")); err != nil {
+        errc <- err
+        return err
+      }
+    }
+  })
+  s1, s2, err := PipeHandlers(NewHandlers(), h)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s2.Close()
+  s2.SetStreamReqLimit(1)
+
+  r := s1.StreamRequest("feed")
+  if err := r.Write([]byte("go")); err != nil {
+    t.Fatal(err)
+  }
+  if b, err := r.Read(); err != nil || string(b) != "x" {
+    t.Fatalf("Read() => (%q, %v), expected (\"x\", nil)", b, err)
+  }
+
+  // The peer disconnecting mid-stream makes the next write fail
+  s1.Close()
+  select {
+  case err := <-errc:
+    if err != ErrSockClosed {
+      t.Errorf("write() => %v after the peer disconnected, expected ErrSockClosed", err)
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("write() did not fail after the peer disconnected")
+  }
+}
+
+func TestDuplicateRequestID(t *testing.T) {
+  release := make(chan struct{})
+  defer close(release)
+  h := NewHandlers()
+  h.HandleRequest("wait", func() error {
+    <-release
+    return nil
+  })
+  h.HandleStreamRequest("stream", func(Sock, string, chan []byte, StreamWriter) error {
+    <-release
+    return nil
+  })
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+
+  for _, op := range []string{"wait", "stream"} {
+    c1, c2 := net.Pipe()
+    s := NewSock(h)
+    s.SetStreamReqLimit(1)
+    s.Adopt(c1)
+    errch := make(chan error, 1)
+    go func() { errch <- s.Read() }()
+
+    t1 := MsgTypeSingleReq
+    if op == "stream" {
+      t1 = MsgTypeStreamReq
+    }
+    c2.Write(MakeMsg(t1, "001", op, 0))
+    // Results of requests are sent with their own ID, so IDs can be reused once completed
+    c2.Write(append(MakeMsg(MsgTypeSingleReq, "002", "echo", 4), `"hi"`...))
+    if ty, id, _, _ := readRawMsg(t, c2); ty != MsgTypeSingleRes || id != "002" {
+      t.Errorf("got message %c %q, expected result for \"002\"", byte(ty), id)
+    }
+    c2.Write(append(MakeMsg(MsgTypeSingleReq, "002", "echo", 4), `"hi"`...))
+    if ty, id, _, _ := readRawMsg(t, c2); ty != MsgTypeSingleRes || id != "002" {
+      t.Errorf("got message %c %q, expected result for \"002\"", byte(ty), id)
+    }
+
+    // Reusing the ID of a request still being handled closes the connection
+    go c2.Write(append(MakeMsg(MsgTypeSingleReq, "001", "echo", 4), `"hi"`...))
+    select {
+    case err := <-errch:
+      if e, ok := err.(*ProtocolError); !ok || !strings.Contains(e.Error(), `"001"`) {
+        t.Errorf("%s: Read() => %v, expected a *ProtocolError about \"001\"", op, err)
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("%s: duplicate request ID did not close the connection", op)
+    }
+    c2.Close()
+  }
+}
+
+
+func TestConnectTimeout(t *testing.T) {
+  // A server which accepts connections but never completes the handshake
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer l.Close()
+  go func() {
+    for {
+      c, err := l.Accept()
+      if err != nil {
+        return
+      }
+      defer c.Close()
+    }
+  }()
+  start := time.Now()
+  if _, err := ConnectTimeout("tcp", l.Addr().String(), 50*time.Millisecond); err != ErrConnectTimeout {
+    t.Errorf("ConnectTimeout() => %v, expected %v", err, ErrConnectTimeout)
+  }
+  if d := time.Since(start); d > time.Second {
+    t.Errorf("ConnectTimeout() returned after %v", d)
+  }
+
+  // Sockets which connected in time have no deadline
+  h := NewHandlers()
+  h.HandleBufferRequest("ping", func(Sock, string, []byte) ([]byte, error) {
+    return []byte("pong"), nil
+  })
+  srv := listenTCP(t, h)
+  defer srv.Close()
+  s, err := ConnectTimeout("tcp", srv.Addr(), 50*time.Millisecond)
+  if err != nil {
+    t.Fatalf("ConnectTimeout() failed: %v", err)
+  }
+  defer s.Close()
+  time.Sleep(100*time.Millisecond)
+  if out, err := s.BufferRequest("ping", nil); err != nil || string(out) != "pong" {
+    t.Errorf("BufferRequest() => (%q, %v), expected \"pong\"", out, err)
+  }
+}
+
+
+func TestIdleTimeout(t *testing.T) {
+  c1, c2 := net.Pipe()
+  defer c2.Close()
+  s := NewSock(NewHandlers())
+  s.Adopt(c1)
+  s.SetIdleTimeout(50*time.Millisecond)
+  errch := make(chan error, 1)
+  go func() { errch <- s.Read() }()
+
+  // Complete messages within the timeout keep the socket open
+  for i := 0; i < 3; i++ {
+    time.Sleep(20*time.Millisecond)
+    c2.Write(MakeHeartbeatMsg(0, time.Now()))
+  }
+
+  // A message which isn't completed in time closes it
+  c2.Write([]byte("r00"))
+  select {
+  case err := <-errch:
+    if err != ErrIdleTimeout {
+      t.Errorf("Read() => %v, expected %v", err, ErrIdleTimeout)
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("socket was not closed by the idle timeout")
+  }
+}
+
+
+func TestSetDeadline(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  if err := s.SetWriteDeadline(time.Now().Add(-time.Second)); err != nil {
+    t.Fatalf("SetWriteDeadline() failed: %v", err)
+  }
+  if err := s.BufferNotify("n", nil); err == nil {
+    t.Errorf("BufferNotify() succeeded after the write deadline")
+  }
+
+  // Connections without deadlines
+  s2 := NewSock(NewHandlers())
+  s2.Adopt(struct{ io.ReadWriteCloser }{c})
+  if err := s2.SetReadDeadline(time.Time{}); err == nil {
+    t.Errorf("SetReadDeadline() succeeded on a connection without deadlines")
+  }
+}
+
+
+func TestHandshakeContext(t *testing.T) {
+  // An exchange of our own on the raw connection, before the sockets adopt it
+  c1, c2 := relayedPipe()
+  go c1.Write([]byte("token"))
+  buf := make([]byte, 5)
+  if err := readn(c2, buf); err != nil || string(buf) != "token" {
+    t.Fatalf("readn() => (%q, %v)", buf, err)
+  }
+  s1, s2 := NewSock(NewHandlers()), NewSock(NewHandlers())
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+  defer cancel()
+  errc := make(chan error, 1)
+  go func() { errc <- s1.HandshakeContext(ctx) }()
+  if err := s2.HandshakeContext(ctx); err != nil {
+    t.Fatalf("HandshakeContext() failed: %v", err)
+  }
+  if err := <-errc; err != nil {
+    t.Fatalf("HandshakeContext() failed: %v", err)
+  }
+  s1.Close()
+  s2.Close()
+
+  // A peer which never answers
+  c3, c4 := net.Pipe()
+  defer c4.Close()
+  go io.Copy(io.Discard, c4)
+  s := NewSock(NewHandlers())
+  s.Adopt(c3)
+  ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+  defer cancel()
+  if err := s.HandshakeContext(ctx); err != context.DeadlineExceeded {
+    t.Errorf("HandshakeContext() => %v, expected %v", err, context.DeadlineExceeded)
+  }
+  if !s.Closed() {
+    t.Errorf("socket not closed after the handshake was given up")
+  }
+}
+
+
+func TestSetTCPKeepAlive(t *testing.T) {
+  s1, s2, err1, err2 := handshakeTCPWith(t, NewHandlers(), func(Sock) {}, func(Sock) {})
+  if err1 != nil || err2 != nil {
+    t.Fatalf("Handshake() failed: %v, %v", err1, err2)
+  }
+  defer s1.Close()
+  defer s2.Close()
+  if err := s1.SetTCPKeepAlive(time.Second); err != nil {
+    t.Errorf("SetTCPKeepAlive() failed: %v", err)
+  }
+  if err := s1.SetTCPKeepAlive(0); err != nil {
+    t.Errorf("SetTCPKeepAlive(0) failed: %v", err)
+  }
+
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  if err := s.SetTCPKeepAlive(time.Second); err == nil {
+    t.Errorf("SetTCPKeepAlive() succeeded on a connection other than TCP")
+  }
+}
+
+
+func TestStreamFuncHandler(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("count", func(p struct{ N int }, write func(interface{}) error) error {
+    for i := 0; i < p.N; i++ {
+      if err := write(i); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  h.HandleRequest("fail", func(s Sock, p int, write func(interface{}) error) error {
+    write(p)
+    return Errorf(7, "failed")
+  })
+  s, c := pipeRaw(t, h)
+  defer c.Close()
+  s.SetStreamReqLimit(1)
+
+  writeReq := func(id, op string, parts ...string) {
+    c.Write(MakeMsg(MsgTypeStreamReq, id, op, len(parts[0])))
+    c.Write([]byte(parts[0]))
+    for _, part := range append(parts[1:], "") {
+      c.Write(MakeMsg(MsgTypeStreamReqPart, id, "", len(part)))
+      c.Write([]byte(part))
+    }
+  }
+
+  // Parameters are decoded from all parts of the request
+  writeReq("001", "count", `{"N":`, `3}`)
+  for _, expected := range []string{"0", "1", "2", ""} {
+    ty, id, _, payload := readRawMsg(t, c)
+    if ty != MsgTypeStreamRes || id != "001" || string(payload) != expected {
+      t.Fatalf("got message %c %q %q, expected %c %q %q",
+        byte(ty), id, payload, byte(MsgTypeStreamRes), "001", expected)
+    }
+  }
+
+  // An error replaces the end of the stream
+  writeReq("002", "fail", `1`)
+  if ty, _, _, payload := readRawMsg(t, c); ty != MsgTypeStreamRes || string(payload) != "1" {
+    t.Fatalf("got message %c %q", byte(ty), payload)
+  }
+  ty, id, _, payload := readRawMsg(t, c)
+  if e := decodeError(payload); ty != MsgTypeErrorRes || id != "002" || e.Code() != 7 {
+    t.Fatalf("got message %c %q %q, expected error result", byte(ty), id, payload)
+  }
+
+  // Completed requests don't count towards the stream request limit
+  writeReq("003", "count", `{"N":0}`)
+  if ty, id, _, payload := readRawMsg(t, c); ty != MsgTypeStreamRes || id != "003" || len(payload) != 0 {
+    t.Errorf("got message %c %q %q, expected end of stream", byte(ty), id, payload)
+  }
+}
+
+
+func TestStreamReqLimit(t *testing.T) {
+  h := NewHandlers()
+  release := make(chan struct{})
+  h.HandleStreamRequest("wait", func(s Sock, op string, rch chan []byte, write StreamWriter) error {
+    for b := <-rch; b != nil; b = <-rch {
+    }
+    <-release
+    return nil
+  })
+  s, c := pipeRaw(t, h)
+  defer c.Close()
+  s.SetStreamReqLimit(1)
+
+  c.Write(MakeMsg(MsgTypeStreamReq, "001", "wait", 0))
+  c.Write(MakeMsg(MsgTypeStreamReqPart, "001", "", 0))
+  c.Write(MakeMsg(MsgTypeStreamReq, "002", "wait", 1))
+  c.Write([]byte("x"))
+  ty, id, _, payload := readRawMsg(t, c)
+  if e := decodeError(payload); ty != MsgTypeErrorRes || id != "002" || e.Code() != ErrCodeOverloaded {
+    t.Fatalf("got message %c %q %q, expected overloaded error for \"002\"", byte(ty), id, payload)
+  }
+  if n := s.Stats().StreamsActive; n != 1 {
+    t.Errorf("Stats().StreamsActive => %d, expected 1", n)
+  }
+
+  // Once the first request has ended, another one may start
+  close(release)
+  if ty, id, _, _ := readRawMsg(t, c); ty != MsgTypeStreamRes || id != "001" {
+    t.Fatalf("got message %c %q, expected end of \"001\"", byte(ty), id)
+  }
+  c.Write(MakeMsg(MsgTypeStreamReq, "003", "wait", 0))
+  c.Write(MakeMsg(MsgTypeStreamReqPart, "003", "", 0))
+  if ty, id, _, _ := readRawMsg(t, c); ty != MsgTypeStreamRes || id != "003" {
+    t.Errorf("got message %c %q, expected end of \"003\"", byte(ty), id)
+  }
+}
+
+func TestStreamFuncHandlerChan(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("double", func(s Sock, in <-chan int, write func(string) error) error {
+    for n := range in {
+      if err := write(strings.Repeat("x", n*2)); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  s, c := pipeRaw(t, h)
+  defer c.Close()
+  s.SetStreamReqLimit(1)
+
+  // Results are written as parts of the request arrive
+  c.Write(MakeMsg(MsgTypeStreamReq, "001", "double", 1))
+  c.Write([]byte("1"))
+  if ty, _, _, payload := readRawMsg(t, c); ty != MsgTypeStreamRes || string(payload) != `"xx"` {
+    t.Fatalf("got message %c %q", byte(ty), payload)
+  }
+  c.Write(MakeMsg(MsgTypeStreamReqPart, "001", "", 1))
+  c.Write([]byte("2"))
+  if ty, _, _, payload := readRawMsg(t, c); ty != MsgTypeStreamRes || string(payload) != `"xxxx"` {
+    t.Fatalf("got message %c %q", byte(ty), payload)
+  }
+  c.Write(MakeMsg(MsgTypeStreamReqPart, "001", "", 0))
+  if ty, _, _, payload := readRawMsg(t, c); ty != MsgTypeStreamRes || len(payload) != 0 {
+    t.Fatalf("got message %c %q, expected end of stream", byte(ty), payload)
+  }
+
+  // A part which can't be decoded causes an error result
+  c.Write(MakeMsg(MsgTypeStreamReq, "002", "double", 3))
+  c.Write([]byte(`"a"`))
+  c.Write(MakeMsg(MsgTypeStreamReqPart, "002", "", 1))
+  c.Write([]byte("1"))
+  c.Write(MakeMsg(MsgTypeStreamReqPart, "002", "", 0))
+  ty, id, _, payload := readRawMsg(t, c)
+  if ty == MsgTypeSingleRes && id == StreamStopID {
+    // The handler returned before the end of the request was read
+    ty, id, _, payload = readRawMsg(t, c)
+  }
+  if ty != MsgTypeErrorRes || id != "002" {
+    t.Errorf("got message %c %q %q, expected error result", byte(ty), id, payload)
+  }
+}
+
+
+func TestStreamFuncHandlerChanEarlyReturn(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("first", func(in <-chan int, write func(int) error) error {
+    <-in
+    return Errorf(7, "stop")
+  })
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  s, c := pipeRaw(t, h)
+  defer c.Close()
+  s.SetStreamReqLimit(1)
+
+  // The result is sent when the handler returns, without waiting for more parts, after telling
+  // the requestor to stop sending parts
+  c.Write(MakeMsg(MsgTypeStreamReq, "001", "first", 1))
+  c.Write([]byte("1"))
+  ty, id, _, payload := readRawMsg(t, c)
+  if ty != MsgTypeSingleRes || id != StreamStopID || string(payload) != "001" {
+    t.Fatalf("got message %c %q %q, expected stream stop for \"001\"", byte(ty), id, payload)
+  }
+  ty, id, _, payload = readRawMsg(t, c)
+  if e := decodeError(payload); ty != MsgTypeErrorRes || id != "001" || e.Code() != 7 {
+    t.Fatalf("got message %c %q %q, expected error result", byte(ty), id, payload)
+  }
+
+  // Parts arriving after that are discarded, and don't keep other requests from being handled
+  for _, part := range []string{"2", "3", ""} {
+    c.Write(MakeMsg(MsgTypeStreamReqPart, "001", "", len(part)))
+    c.Write([]byte(part))
+  }
+  c.Write(MakeMsg(MsgTypeSingleReq, "002", "echo", 4))
+  c.Write([]byte(`"hi"`))
+  if ty, id, _, payload := readRawMsg(t, c); ty != MsgTypeSingleRes || id != "002" || string(payload) != `"hi"` {
+    t.Errorf("got message %c %q %q, expected result for \"002\"", byte(ty), id, payload)
+  }
+  if n := s.Stats().StreamsActive; n != 0 {
+    t.Errorf("Stats().StreamsActive => %d, expected 0", n)
+  }
+}
+
+
+func TestStreamRequestHandlerReturnedEarly(t *testing.T) {
+  h := NewHandlers()
+  h.HandleStreamRequest("first", func(s Sock, op string, rch chan []byte, write StreamWriter) error {
+    <-rch
+    return Errorf(7, "enough")
+  })
+  s1, s2, err := PipeHandlers(NewHandlers(), h)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s1.Close()
+  defer s2.Close()
+  s2.SetStreamReqLimit(1)
+
+  // The requestor stops sending once the handler has returned, and still gets the result
+  r := s1.StreamRequest("first")
+  if err := r.Write([]byte("1")); err != nil {
+    t.Fatal(err)
+  }
+  deadline := time.Now().Add(time.Second)
+  for r.Write([]byte("2")) != ErrStreamEnded {
+    if time.Now().After(deadline) {
+      t.Fatalf("Write() kept succeeding after the handler returned")
+    }
+    time.Sleep(time.Millisecond)
+  }
+  if _, err := r.Read(); err == nil || err.Error() != "enough" {
+    t.Errorf("Read() => %v, expected the error of the handler", err)
+  }
+  if n := s1.InFlightRequests(); n != 0 {
+    t.Errorf("InFlightRequests() => %d, expected 0", n)
+  }
+  if n := s2.Stats().StreamsActive; n != 0 {
+    t.Errorf("Stats().StreamsActive => %d, expected 0", n)
+  }
+}
+
+func TestStreamCancel(t *testing.T) {
+  h := NewHandlers()
+  errch := make(chan error, 1)
+  h.HandleRequest("count", func(_ int, write func(int) error) error {
+    for i := 0; ; i++ {
+      if err := write(i); err != nil {
+        errch <- err
+        return err
+      }
+    }
+  })
+  s, c := pipeRaw(t, h)
+  defer c.Close()
+  s.SetStreamReqLimit(1)
+
+  c.Write(MakeMsg(MsgTypeStreamReq, "001", "count", 1))
+  c.Write([]byte("0"))
+  c.Write(MakeMsg(MsgTypeStreamReqPart, "001", "", 0))
+  if ty, _, _, payload := readRawMsg(t, c); ty != MsgTypeStreamRes || string(payload) != "0" {
+    t.Fatalf("got message %c %q, expected first part", byte(ty), payload)
+  }
+
+  // Once cancelled, the handler can't write more parts
+  WriteCancelReq(c, "001")
+  go io.Copy(io.Discard, c)
+  select {
+  case err := <-errch:
+    if err != context.Canceled {
+      t.Errorf("write() => %v, expected %v", err, context.Canceled)
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("handler still writing after cancel")
+  }
+}
+
+
+func TestSockValues(t *testing.T) {
+  type userKey struct{}
+  h := NewHandlers()
+  h.HandleRequest("whoami", func(s Sock) (string, error) {
+    user, _ := s.Value(userKey{}).(string)
+    return user, nil
+  })
+  c1, c2 := net.Pipe()
+  defer c1.Close()
+  s1, s2 := NewSock(NewHandlers()), NewSock(h)
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  go s1.Read()
+  go s2.Read()
+
+  s2.SetValue(userKey{}, "alice")
+  var user string
+  if err := s1.Request("whoami", nil, &user); err != nil || user != "alice" {
+    t.Errorf("Request() => (%q, %v), expected (%q, nil)", user, err, "alice")
+  }
+
+  s2.SetValue("other", 1)
+  s2.SetValue("other", nil)
+  if v := s2.Value("other"); v != nil {
+    t.Errorf("Value() => %v after removal", v)
+  }
+
+  // Values are available to the close func and removed once it has returned
+  var closeValue interface{}
+  s2.SetCloseFunc(func(s Sock) { closeValue = s.Value(userKey{}) })
+  s2.Close()
+  if closeValue != "alice" {
+    t.Errorf("Value() => %v in close func, expected %q", closeValue, "alice")
+  }
+  if v := s2.Value(userKey{}); v != nil {
+    t.Errorf("Value() => %v after close", v)
+  }
+}
+
+
+func TestOnClose(t *testing.T) {
+  onClose := func(s Sock) chan error {
+    errs := make(chan error, 2)
+    s.OnClose(func(err error) { errs <- err })
+    return errs
+  }
+  checkClosed := func(what string, errs chan error, check func(error) bool) {
+    select {
+    case err := <-errs:
+      if !check(err) {
+        t.Errorf("%s: OnClose func called with %v", what, err)
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("%s: OnClose func not called", what)
+    }
+    select {
+    case err := <-errs:
+      t.Errorf("%s: OnClose func called again with %v", what, err)
+    case <-time.After(10*time.Millisecond):
+    }
+  }
+
+  // Closing the socket ourselves
+  s, c := pipeRaw(t, NewHandlers())
+  errs := onClose(s)
+  s.Close()
+  s.Close()
+  c.Close()
+  checkClosed("Close", errs, func(err error) bool { return err == nil })
+
+  // The peer closing the connection
+  s, c = pipeRaw(t, NewHandlers())
+  errs = onClose(s)
+  c.Close()
+  checkClosed("peer close", errs, func(err error) bool { return err == nil })
+
+  // The peer violating the protocol
+  s, c = pipeRaw(t, NewHandlers())
+  errs = onClose(s)
+  c.Write([]byte("?00100000000"))
+  c.Close()
+  checkClosed("protocol error", errs, func(err error) bool {
+    _, ok := err.(*ProtocolError)
+    return ok
+  })
+}
+
+
+func TestClosedAndDone(t *testing.T) {
+  // Closing the socket ourselves
+  s, c := pipeRaw(t, NewHandlers())
+  if s.Closed() {
+    t.Errorf("Closed() => true before closing")
+  }
+  select {
+  case <-s.Done():
+    t.Errorf("Done() channel closed before closing")
+  default:
+  }
+  s.Close()
+  s.Close()
+  c.Close()
+  <-s.Done()
+  if !s.Closed() {
+    t.Errorf("Closed() => false after Close")
+  }
+
+  // The peer closing the connection
+  s, c = pipeRaw(t, NewHandlers())
+  c.Close()
+  select {
+  case <-s.Done():
+  case <-time.After(time.Second):
+    t.Fatalf("Done() channel not closed when the peer closed the connection")
+  }
+  if !s.Closed() {
+    t.Errorf("Closed() => false after the peer closed the connection")
+  }
+}
+
+
+func TestConcurrentNotify(t *testing.T) {
+  const notifiers, notes = 200, 20
+  h := NewHandlers()
+  var mu sync.Mutex
+  received := make(map[string]int)
+  done := make(chan struct{})
+  h.HandleBufferNotification("n", func(s Sock, name string, b []byte) {
+    var i, j int
+    if _, err := fmt.Sscanf(string(b), "%d.%d:", &i, &j); err != nil ||
+       len(b) - strings.IndexByte(string(b), ':') - 1 != (i * j) % 1000 {
+      t.Errorf("received corrupt notification %q", b)
+    }
+    mu.Lock()
+    defer mu.Unlock()
+    received[string(b)]++
+    if len(received) == notifiers * notes {
+      close(done)
+    }
+  })
+  c1, c2 := net.Pipe()
+  defer c1.Close()
+  defer c2.Close()
+  s1, s2 := NewSock(NewHandlers()), NewSock(h)
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  go s1.Read()
+  go s2.Read()
+
+  // Notifications of varying sizes and requests from many goroutines arrive intact
+  var wg sync.WaitGroup
+  for i := 0; i < notifiers; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      for j := 0; j < notes; j++ {
+        payload := fmt.Sprintf("%d.%d:%s", i, j, strings.Repeat("x", (i * j) % 1000))
+        if err := s1.BufferNotify("n", []byte(payload)); err != nil {
+          t.Error(err)
+          return
+        }
+        if j % 5 == 0 {
+          s1.BufferRequest("nonexistent", nil)
+        }
+      }
+    }(i)
+  }
+  wg.Wait()
+  select {
+  case <-done:
+  case <-time.After(5*time.Second):
+  }
+  mu.Lock()
+  defer mu.Unlock()
+  if len(received) != notifiers * notes {
+    t.Fatalf("received %d distinct notifications, expected %d", len(received), notifiers * notes)
+  }
+  for payload, n := range received {
+    if n != 1 {
+      t.Errorf("notification %q received %d times", payload, n)
+    }
+  }
+}
+
+
+func TestWriteAfterClose(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  s.Close()
+  if err := s.BufferNotify("n", nil); err != ErrSockClosed {
+    t.Errorf("BufferNotify() => %v after Close, expected %v", err, ErrSockClosed)
+  }
+  if _, err := s.BufferRequest("op", nil); err != ErrSockClosed {
+    t.Errorf("BufferRequest() => %v after Close, expected %v", err, ErrSockClosed)
+  }
+}
+
+
+func TestNotifyContext(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+
+  // Nobody is reading from the connection, so the write blocks until the deadline
+  ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+  defer cancel()
+  if err := s.NotifyContext(ctx, "hello", 1); err != context.DeadlineExceeded {
+    t.Errorf("NotifyContext() => %v, expected %v", err, context.DeadlineExceeded)
+  }
+
+  // The abandoned notification is still written in one piece
+  if ty, _, name, payload := readRawMsg(t, c); ty != MsgTypeNotification || name != "hello" ||
+     string(payload) != "1" {
+    t.Errorf("got message %c %q %q", byte(ty), name, payload)
+  }
+
+  errch := make(chan error, 1)
+  go func() { errch <- s.NotifyContext(context.Background(), "hello", 2) }()
+  if _, _, _, payload := readRawMsg(t, c); string(payload) != "2" {
+    t.Errorf("got payload %q, expected %q", payload, "2")
+  }
+  if err := <-errch; err != nil {
+    t.Errorf("NotifyContext() failed: %v", err)
+  }
+
+  // Write errors are returned
+  c.Close()
+  if err := s.NotifyContext(context.Background(), "hello", 3); err == nil {
+    t.Errorf("NotifyContext() succeeded on a closed connection")
+  }
+}
+
+
+// Logger recording messages, for tests
+type recLogger struct {
+  mu     sync.Mutex
+  errors []string
+  debug  []string
+}
+
+func (l *recLogger) Errorf(format string, args ...interface{}) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+func (l *recLogger) Debugf(format string, args ...interface{}) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  l.debug = append(l.debug, fmt.Sprintf(format, args...))
+}
+
+func (l *recLogger) messages() ([]string, []string) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  return append([]string(nil), l.errors...), append([]string(nil), l.debug...)
+}
+
+
+func TestLoggerAndHandlerPanic(t *testing.T) {
+  h := NewHandlers()
+  h.HandleBufferRequest("crash", func(Sock, string, []byte) ([]byte, error) {
+    var m map[string]int
+    m["x"] = 1
+    return nil, nil
+  })
+  h.HandleBufferRequest("ok", func(Sock, string, []byte) ([]byte, error) {
+    return []byte("1"), nil
+  })
+  h.HandleBufferNotification("crash", func(Sock, string, []byte) {
+    panic("boom")
+  })
+  l := &recLogger{}
+  s, c := pipeRaw(t, h)
+  s.SetLogger(l)
+  defer c.Close()
+
+  // A panicking handler results in an error result and the socket stays alive
+  c.Write(MakeMsg(MsgTypeSingleReq, "001", "crash", 0))
+  if ty, id, _, _ := readRawMsg(t, c); ty != MsgTypeErrorRes || id != "001" {
+    t.Errorf("got message %c %q, expected error result", byte(ty), id)
+  }
+  c.Write(MakeMsg(MsgTypeNotification, "", "crash", 0))
+  c.Write(MakeMsg(MsgTypeNotification, "", "nobody", 0))
+  c.Write(MakeMsg(MsgTypeSingleReq, "002", "ok", 0))
+  if ty, id, _, _ := readRawMsg(t, c); ty != MsgTypeSingleRes || id != "002" {
+    t.Errorf("got message %c %q, expected result", byte(ty), id)
+  }
+
+  errs, debug := l.messages()
+  if len(errs) != 2 || !strings.Contains(errs[0], "crash") || !strings.Contains(errs[1], "boom") {
+    t.Errorf("unexpected errors logged: %q", errs)
+  }
+  if len(debug) != 1 || !strings.Contains(debug[0], "nobody") {
+    t.Errorf("unexpected debug messages logged: %q", debug)
+  }
+}
+
+
+func TestNotificationFuncHandlerPanic(t *testing.T) {
+  h := NewHandlers()
+  h.HandleNotification("crash", func(n int) {
+    panic(fmt.Sprintf("boom %d", n))
+  })
+  received := make(chan int, 1)
+  h.HandleNotification("ok", func(n int) { received <- n })
+  l := &recLogger{}
+  s, c := pipeRaw(t, h)
+  s.SetLogger(l)
+  defer c.Close()
+
+  // The panic is logged and later messages are still handled
+  c.Write(append(MakeMsg(MsgTypeNotification, "", "crash", 1), '1'))
+  c.Write(append(MakeMsg(MsgTypeNotification, "", "ok", 1), '2'))
+  select {
+  case n := <-received:
+    if n != 2 {
+      t.Errorf("received %d, expected 2", n)
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("notification after panic was not handled")
+  }
+  if errs, _ := l.messages(); len(errs) != 1 || !strings.Contains(errs[0], "boom 1") {
+    t.Errorf("unexpected errors logged: %q", errs)
+  }
+}
+
+
+func TestRequestTimeout(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  WriteFeatures(c, "cancel")
+  s.SetRequestTimeout(20*time.Millisecond)
+
+  errch := make(chan error, 1)
+  go func() { errch <- s.Request("echo", "hello", nil) }()
+
+  // The timeout starts once the request has been written, i.e. read by us
+  time.Sleep(40*time.Millisecond)
+  _, id, _, _ := readRawMsg(t, c)
+  if ty, id2, _, _ := readRawMsg(t, c); ty != MsgTypeCancelReq || id2 != id {
+    t.Errorf("got message %c %q, expected %c %q", byte(ty), id2, byte(MsgTypeCancelReq), id)
+  }
+  if err := <-errch; err != ErrTimeout {
+    t.Errorf("Request() => %v, expected %v", err, ErrTimeout)
+  }
+  if rc := s.(*socket).getResChan(id); rc != nil {
+    t.Errorf("pending response %q was not freed", id)
+  }
+
+  // Requests with a context are not affected
+  ctx, cancel := context.WithCancel(context.Background())
+  go func() { errch <- s.RequestContext(ctx, "echo", "hello", nil) }()
+  _, id, _, _ = readRawMsg(t, c)
+  time.Sleep(40*time.Millisecond)
+  cancel()
+  readRawMsg(t, c)  // cancel
+  if err := <-errch; err != context.Canceled {
+    t.Errorf("RequestContext() => %v, expected %v", err, context.Canceled)
+  }
+}
+
+
+func TestRequestTimeoutBaselinePeer(t *testing.T) {
+  c1, c2 := net.Pipe()
+  unknown := baselinePeer(c2)
+  s := NewSock(NewHandlers())
+  s.Adopt(c1)
+  defer s.Close()
+  if err := s.Handshake(); err != nil {
+    t.Fatalf("Handshake() failed: %v", err)
+  }
+  go s.Read()
+
+  // Requests to peers which don't announce canceling requests time out without canceling
+  s.SetRequestTimeout(20*time.Millisecond)
+  if err := s.Request("echo", "hello", nil); err != ErrTimeout {
+    t.Errorf("Request() => %v, expected %v", err, ErrTimeout)
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+  defer cancel()
+  if err := s.RequestContext(ctx, "echo", "hello", nil); err != context.DeadlineExceeded {
+    t.Errorf("RequestContext() => %v, expected %v", err, context.DeadlineExceeded)
+  }
+  select {
+  case ty, ok := <-unknown:
+    if ok {
+      t.Errorf("peer was sent a message of unknown type %c", byte(ty))
+    } else {
+      t.Errorf("connection closed")
+    }
+  case <-time.After(50*time.Millisecond):
+  }
+}
+
+
+func TestHeartbeat(t *testing.T) {
+  s1, s2, err := PipeHandlers(NewHandlers(), NewHandlers())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s1.Close()
+  defer s2.Close()
+  loads := make(chan int, 10)
+  s2.OnHeartbeat(func(load int, tm time.Time) {
+    if time.Since(tm) > time.Minute {
+      t.Errorf("heartbeat with time %v", tm)
+    }
+    select {
+    case loads <- load:
+    default:
+    }
+  })
+  s1.SetHeartbeat(5*time.Millisecond)
+
+  // Heartbeats are only sent once both ends have enabled them
+  time.Sleep(30*time.Millisecond)
+  select {
+  case <-loads:
+    t.Errorf("heartbeat sent to a peer which hasn't enabled heartbeats")
+  default:
+  }
+  s2.SetHeartbeat(time.Hour)
+  if load := <-loads; load != 0 {
+    t.Errorf("heartbeat with load %v, expected 0", load)
+  }
+  s1.SetHeartbeat(0)
+}
+
+
+func TestHeartbeatTimeout(t *testing.T) {
+  c1, c2 := net.Pipe()
+  defer c2.Close()
+  s := NewSock(NewHandlers())
+  s.Adopt(c1)
+
+  // The peer wants heartbeats and reads ours, but never sends anything
+  go func() {
+    WriteFeatures(c2, "heartbeat")
+    io.Copy(io.Discard, c2)
+  }()
+  s.SetHeartbeatMaxMissed(2)
+  s.SetHeartbeat(5*time.Millisecond)
+  if err := s.Read(); err != ErrHeartbeatTimeout {
+    t.Errorf("Read() => %v, expected %v", err, ErrHeartbeatTimeout)
+  }
+}
+
+
+func TestHeartbeatBaselinePeer(t *testing.T) {
+  c1, c2 := net.Pipe()
+  unknown := baselinePeer(c2)
+  s := NewSock(NewHandlers())
+  s.Adopt(c1)
+  defer s.Close()
+  if err := s.Handshake(); err != nil {
+    t.Fatalf("Handshake() failed: %v", err)
+  }
+  readErr := make(chan error, 1)
+  go func() { readErr <- s.Read() }()
+
+  // A peer which can't send heartbeats is neither sent any nor timed out for not sending any
+  s.SetHeartbeatMaxMissed(2)
+  s.SetHeartbeat(5*time.Millisecond)
+  select {
+  case ty, ok := <-unknown:
+    if ok {
+      t.Errorf("peer was sent a message of unknown type %c", byte(ty))
+    } else {
+      t.Errorf("connection closed")
+    }
+  case err := <-readErr:
+    t.Errorf("Read() => %v, expected the connection to stay open", err)
+  case <-time.After(50*time.Millisecond):
+  }
+}
+
+
+func TestRequestFailsOnClose(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+  errch := make(chan error, 1)
+  go func() { errch <- s.Request("echo", "hello", nil) }()
+  readRawMsg(t, c)
+  c.Close()
+  if err := <-errch; err != ErrSockClosed {
+    t.Errorf("Request() => %v, expected %v", err, ErrSockClosed)
+  }
+}
+
+
+func TestRequestMeta(t *testing.T) {
+  h := NewHandlers()
+  var handlerSock Sock
+  h.HandleRequest("whoami", func(ctx context.Context, s Sock) (string, error) {
+    handlerSock = s
+    meta := RequestMetaFromContext(ctx)
+    if meta["token"] != "secret" {
+      return "", Errorf(401, "unauthorized")
+    }
+    return meta["user"], nil
+  })
+  c1, c2 := net.Pipe()
+  defer c1.Close()
+  defer c2.Close()
+  s1, s2 := NewSock(NewHandlers()), NewSock(h)
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  go s1.Read()
+  go s2.Read()
+
+  var out string
+  err := s1.RequestWithMeta("whoami", nil, &out, map[string]string{"user":"bob", "token":"secret"})
+  if err != nil || out != "bob" {
+    t.Errorf("RequestWithMeta() => (%q, %v), expected %q", out, err, "bob")
+  }
+  if handlerSock != s2 {
+    t.Errorf("handler got socket %v, expected %v", handlerSock, s2)
+  }
+
+  // Metadata only applies to the request it was sent with
+  if e, ok := s1.Request("whoami", nil, &out).(*RequestError); !ok || e.Code() != 401 {
+    t.Errorf("Request() => %v, expected error with code 401", e)
+  }
+}
+
+
+func TestRequestMetaWire(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  go s.RequestWithMeta("echo", 1, nil, map[string]string{"trace":"abc"})
+  ty, id, _, payload := readRawMsg(t, c)
+  if ty != MsgTypeSingleRes || id != RequestMetaID || string(payload[3:]) != `{"trace":"abc"}` {
+    t.Errorf("got message %c %q %q, expected request metadata", byte(ty), id, payload)
+  }
+  if ty, id2, name, _ := readRawMsg(t, c); ty != MsgTypeSingleReq || id2 != string(payload[:3]) || name != "echo" {
+    t.Errorf("got message %c %q %q, expected request %q", byte(ty), id2, name, payload[:3])
+  }
+}
+
+
+func TestRequestMetaInvalid(t *testing.T) {
+  h := NewHandlers()
+  h.HandleBufferRequest("echo", func(s Sock, op string, b []byte) ([]byte, error) {
+    return b, nil
+  })
+  _, c := pipeRaw(t, h)
+  defer c.Close()
+
+  // Metadata with non-string values fails the request but not the connection
+  meta := `001{"n":1}`
+  c.Write(append(MakeMsg(MsgTypeSingleRes, RequestMetaID, "", len(meta)), meta...))
+  c.Write(append(MakeMsg(MsgTypeSingleReq, "001", "echo", 2), "hi"...))
+  if ty, id, _, payload := readRawMsg(t, c); ty != MsgTypeErrorRes || id != "001" {
+    t.Errorf("got message %c %q %q, expected error result", byte(ty), id, payload)
+  }
+  c.Write(append(MakeMsg(MsgTypeSingleReq, "002", "echo", 2), "hi"...))
+  if ty, id, _, payload := readRawMsg(t, c); ty != MsgTypeSingleRes || id != "002" || string(payload) != "hi" {
+    t.Errorf("got message %c %q %q, expected result \"hi\"", byte(ty), id, payload)
+  }
+}
+
+
+func TestResultMeta(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("", func(ctx context.Context, s Sock, op string, in string) (string, error) {
+    SetResultMeta(ctx, "op", op)
+    if in == "fail" {
+      return "", Errorf(400, "bad input")
+    }
+    return in, nil
+  })
+  c1, c2 := net.Pipe()
+  defer c1.Close()
+  defer c2.Close()
+  s1, s2 := NewSock(NewHandlers()), NewSock(h)
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  go s1.Read()
+  go s2.Read()
+
+  var out string
+  meta, err := s1.RequestWithResultMeta("echo", "hello", &out, nil)
+  if err != nil || out != "hello" || meta["op"] != "echo" {
+    t.Errorf("RequestWithResultMeta() => (%q, %v, %v), expected (%q, op=echo)", out, meta, err, "hello")
+  }
+
+  // Metadata also rides along with errors
+  meta, err = s1.RequestWithResultMeta("check", "fail", &out, nil)
+  if e, ok := err.(*RequestError); !ok || e.Code() != 400 || meta["op"] != "check" {
+    t.Errorf("RequestWithResultMeta() => (%v, %v), expected error with code 400 and op=check", meta, err)
+  }
+
+  // Requests not asking for metadata are unaffected
+  if err := s1.Request("echo", "hi", &out); err != nil || out != "hi" {
+    t.Errorf("Request() => (%q, %v), expected %q", out, err, "hi")
+  }
+}
+
+
+func TestResultMetaWire(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("op", func(ctx context.Context) (int, error) {
+    SetResultMeta(ctx, "k", "v")
+    return 1, nil
+  })
+  _, c := pipeRaw(t, h)
+  c.Write(MakeMsg(MsgTypeSingleReq, "001", "op", 0))
+  ty, id, _, payload := readRawMsg(t, c)
+  if ty != MsgTypeSingleRes || id != ResultMetaID || string(payload) != `001{"k":"v"}` {
+    t.Fatalf("got %c %q %q, expected result metadata", byte(ty), id, payload)
+  }
+  ty, id, _, payload = readRawMsg(t, c)
+  if ty != MsgTypeSingleRes || id != "001" || string(payload) != "1" {
+    t.Errorf("got %c %q %q, expected result", byte(ty), id, payload)
+  }
+}
+
+
+func TestPipeHandlers(t *testing.T) {
+  h1, h2 := NewHandlers(), NewHandlers()
+  notes := make(chan string, 2)
+  for i, h := range []Handlers{h1, h2} {
+    side := string(byte('1' + i))
+    h.HandleRequest("whoami", func() (string, error) { return side, nil })
+    h.HandleNotification("note", func(s Sock, name string, in string) { notes <- side + in })
+    h.HandleStreamRequest("sum", func(s Sock, op string, rch chan []byte, write StreamWriter) error {
+      n := 0
+      for b := <-rch; b != nil; b = <-rch {
+        n += len(b)
+      }
+      return write([]byte(strconv.Itoa(n)))
+    })
+  }
+  s1, s2, err := PipeHandlers(h1, h2)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s1.Close()
+  defer s2.Close()
+  s1.SetStreamReqLimit(1)
+  s2.SetStreamReqLimit(1)
+  if v := s1.ProtocolVersion(); v != int(ProtocolVersion) {
+    t.Errorf("ProtocolVersion() => %d, expected the handshake to be done", v)
+  }
+
+  for _, c := range []struct{ s Sock; peer string }{{s1, "2"}, {s2, "1"}} {
+    var out string
+    if err := c.s.Request("whoami", nil, &out); err != nil || out != c.peer {
+      t.Errorf("Request() => (%q, %v), expected %q", out, err, c.peer)
+    }
+    if err := c.s.Notify("note", "x"); err != nil {
+      t.Fatal(err)
+    }
+    if n := <-notes; n != c.peer+"x" {
+      t.Errorf("got notification %q, expected %q", n, c.peer+"x")
+    }
+    r := c.s.StreamRequest("sum")
+    for _, part := range []string{"abc", "de"} {
+      if err := r.Write([]byte(part)); err != nil {
+        t.Fatal(err)
+      }
+    }
+    r.End()
+    if b, err := r.Read(); err != nil || string(b) != "5" {
+      t.Errorf("StreamRequest Read() => (%q, %v), expected \"5\"", b, err)
+    }
+    if b, err := r.Read(); err != nil || len(b) != 0 {
+      t.Errorf("StreamRequest Read() => (%q, %v), expected the end of the result", b, err)
+    }
+  }
+}
+
+
+func TestRequestIDFunc(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  s.SetRequestIDFunc(func() string { return "t01" })
+
+  errch := make(chan error, 1)
+  go func() {
+    _, err := s.BufferRequest("echo", nil)
+    errch <- err
+  }()
+  if ty, id, _, _ := readRawMsg(t, c); ty != MsgTypeSingleReq || id != "t01" {
+    t.Errorf("got message %c %q, expected request \"t01\"", byte(ty), id)
+  }
+
+  // The ID can't be reused while the request is waiting for its result
+  if _, err := s.BufferRequest("echo", nil); err == nil {
+    t.Errorf("BufferRequest() succeeded with a request ID in use")
+  }
+  c.Write(MakeMsg(MsgTypeSingleRes, "t01", "", 0))
+  if err := <-errch; err != nil {
+    t.Errorf("BufferRequest() failed: %v", err)
+  }
+
+  for _, id := range []string{"t0", "t001", "---"} {
+    s.SetRequestIDFunc(func() string { return id })
+    if _, err := s.BufferRequest("echo", nil); err == nil {
+      t.Errorf("BufferRequest() succeeded with request ID %q", id)
+    }
+  }
+}
+
+
+func TestRequestDeadline(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("deadline", func(ctx context.Context) (time.Duration, error) {
+    deadline, ok := ctx.Deadline()
+    if !ok {
+      return 0, nil
+    }
+    return time.Until(deadline), nil
+  })
+  _, c := pipeRaw(t, h)
+  defer c.Close()
+
+  c.Write(MakeRequestDeadlineMsg("001", time.Minute))
+  c.Write(MakeMsg(MsgTypeSingleReq, "001", "deadline", 0))
+  ty, id, _, payload := readRawMsg(t, c)
+  if ty != MsgTypeSingleRes || id != "001" {
+    t.Fatalf("got message %c %q %q, expected result for \"001\"", byte(ty), id, payload)
+  }
+  var d time.Duration
+  if err := json.Unmarshal(payload, &d); err != nil || d <= 0 || d > time.Minute {
+    t.Errorf("handler saw deadline in %v (%v), expected at most 1m", d, err)
+  }
+
+  // The deadline only applies to the request which follows
+  c.Write(MakeRequestDeadlineMsg("002", time.Minute))
+  c.Write(MakeMsg(MsgTypeSingleReq, "003", "deadline", 0))
+  if ty, id, _, payload := readRawMsg(t, c); ty != MsgTypeSingleRes || id != "003" || string(payload) != "0" {
+    t.Errorf("got message %c %q %q, expected result 0 for \"003\"", byte(ty), id, payload)
+  }
+}
+
+
+func TestRequestDeadlineWire(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+  defer cancel()
+  go s.RequestContext(ctx, "echo", 1, nil)
+  ty, id, _, payload := readRawMsg(t, c)
+  if ty != MsgTypeSingleRes || id != RequestDeadlineID {
+    t.Fatalf("got message %c %q %q, expected request deadline", byte(ty), id, payload)
+  }
+  reqID, timeout, err := ParseRequestDeadline(payload)
+  if err != nil || timeout <= 0 || timeout > time.Minute {
+    t.Errorf("ParseRequestDeadline() => (%q, %v, %v), expected a timeout of at most 1m", reqID, timeout, err)
+  }
+  if ty, id, name, _ := readRawMsg(t, c); ty != MsgTypeSingleReq || id != reqID || name != "echo" {
+    t.Errorf("got message %c %q %q, expected request %q", byte(ty), id, name, reqID)
+  }
+
+  // Requests without a deadline don't send one
+  go s.Request("echo", 1, nil)
+  if ty, _, name, _ := readRawMsg(t, c); ty != MsgTypeSingleReq || name != "echo" {
+    t.Errorf("got message %c %q, expected request", byte(ty), name)
+  }
+}
+
+
+func TestLocalHandlers(t *testing.T) {
+  h := NewHandlers()
+  h.HandleBufferRequest("whoami", func(Sock, string, []byte) ([]byte, error) {
+    return []byte("anonymous"), nil
+  })
+  h.HandleBufferRequest("ping", func(Sock, string, []byte) ([]byte, error) {
+    return []byte("pong"), nil
+  })
+  var wrapped int32
+  h.Use(func(next BufferReqHandler) BufferReqHandler {
+    return func(s Sock, op string, b []byte) ([]byte, error) {
+      atomic.AddInt32(&wrapped, 1)
+      return next(s, op, b)
+    }
+  })
+  c1, c2 := net.Pipe()
+  defer c1.Close()
+  defer c2.Close()
+  s1, s2 := NewSock(NewHandlers()), NewSock(h)
+  s2.LocalHandlers().HandleBufferRequest("whoami", func(Sock, string, []byte) ([]byte, error) {
+    return []byte("bob"), nil
+  })
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  go s1.Read()
+  go s2.Read()
+
+  // Local handlers take precedence, falling back to the shared handlers
+  for _, r := range []struct{ op, expected string }{{"whoami", "bob"}, {"ping", "pong"}} {
+    if out, err := s1.BufferRequest(r.op, nil); err != nil || string(out) != r.expected {
+      t.Errorf("BufferRequest(%q) => (%q, %v), expected %q", r.op, out, err, r.expected)
+    }
+  }
+  if n := atomic.LoadInt32(&wrapped); n != 2 {
+    t.Errorf("middleware called %d times, expected 2", n)
+  }
+
+}
+
+
+func TestBufferReuse(t *testing.T) {
+  h := NewHandlers()
+  h.HandleBufferRequest("echo", func(s Sock, op string, b []byte) ([]byte, error) {
+    return b, nil
+  })
+  notes := make(chan string, 10)
+  h.HandleBufferNotification("note", func(s Sock, name string, b []byte) {
+    notes <- string(b)
+  })
+  c1, c2 := net.Pipe()
+  defer c1.Close()
+  defer c2.Close()
+  s1, s2 := NewSock(NewHandlers()), NewSock(h)
+  s2.SetBufferReuse(true)
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  go s1.Read()
+  go s2.Read()
+
+  // Results which are the payload itself are written before the buffer is reused
+  var wg sync.WaitGroup
+  for i := 0; i < 20; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      in := []byte(strings.Repeat(fmt.Sprint(i % 10), 100 + i))
+      out, err := s1.BufferRequest("echo", in)
+      if err != nil || string(out) != string(in) {
+        t.Errorf("BufferRequest() => (%q, %v), expected %q", out, err, in)
+      }
+    }(i)
+  }
+  wg.Wait()
+
+  for i := 0; i < 3; i++ {
+    s1.BufferNotify("note", []byte(fmt.Sprint(i)))
+    if n := <-notes; n != fmt.Sprint(i) {
+      t.Errorf("notification %q, expected %q", n, fmt.Sprint(i))
+    }
+  }
+}
+
+
+func benchmarkBufferRequest(b *testing.B, reuse bool) {
+  h := NewHandlers()
+  h.HandleBufferRequest("sum", func(s Sock, op string, p []byte) ([]byte, error) {
+    n := 0
+    for _, c := range p {
+      n += int(c)
+    }
+    return []byte(fmt.Sprint(n)), nil
+  })
+  c1, c2 := net.Pipe()
+  defer c1.Close()
+  defer c2.Close()
+  s1, s2 := NewSock(NewHandlers()), NewSock(h)
+  s2.SetBufferReuse(reuse)
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  go s1.Read()
+  go s2.Read()
+
+  in := make([]byte, 16 * 1024)
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    if _, err := s1.BufferRequest("sum", in); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
+
+func BenchmarkBufferRequest(b *testing.B)      { benchmarkBufferRequest(b, false) }
+func BenchmarkBufferRequestReuse(b *testing.B) { benchmarkBufferRequest(b, true) }
+
+
+func TestBufferRequestRaw(t *testing.T) {
+  h := NewHandlers()
+  h.HandleBufferRequest("reverse", func(s Sock, op string, in []byte) ([]byte, error) {
+    out := make([]byte, len(in))
+    for i, b := range in {
+      out[len(in)-1-i] = b
+    }
+    return out, nil
+  })
+  s1, s2, err := PipeHandlers(NewHandlers(), h)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s1.Close()
+  defer s2.Close()
+
+  // Neither the input nor the result is encoded
+  out, err := s1.BufferRequest("reverse", []byte{0, 1, 0xff, '"'})
+  if err != nil || string(out) != "\"\xff\x01\x00" {
+    t.Errorf("BufferRequest() => (%q, %v), expected %q", out, err, "\"\xff\x01\x00")
+  }
+}
+
+
+func TestOutOfOrderResults(t *testing.T) {
+  h := NewHandlers()
+  // Results are sent in a different order than requests, depending on their input
+  h.HandleRequest("echo", func(n int) (int, error) {
+    time.Sleep(time.Duration((n * 7919) % 20) * time.Millisecond)
+    return n, nil
+  })
+  s1, s2, err := PipeHandlers(NewHandlers(), h)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s1.Close()
+  defer s2.Close()
+
+  const N = 200
+  var wg sync.WaitGroup
+  var maxInFlight int32
+  for i := 0; i < N; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      var out int
+      if err := s1.Request("echo", i, &out); err != nil || out != i {
+        t.Errorf("Request(%d) => (%d, %v)", i, out, err)
+      }
+    }(i)
+  }
+  done := make(chan struct{})
+  go func() {
+    for {
+      if n := int32(s1.InFlightRequests()); n > atomic.LoadInt32(&maxInFlight) {
+        atomic.StoreInt32(&maxInFlight, n)
+      }
+      select {
+      case <-done:
+        return
+      case <-time.After(time.Millisecond):
+      }
+    }
+  }()
+  wg.Wait()
+  close(done)
+  if n := atomic.LoadInt32(&maxInFlight); n < 2 {
+    t.Errorf("at most %d requests were in flight, expected requests to be pipelined", n)
+  }
+  if n := s1.InFlightRequests(); n != 0 {
+    t.Errorf("InFlightRequests() => %d after all results were received, expected 0", n)
+  }
+
+  // Streaming requests are in flight until their result has ended
+  s2.SetStreamReqLimit(1)
+  h.HandleStreamRequest("stream", func(s Sock, op string, rch chan []byte, write StreamWriter) error {
+    for <-rch != nil {
+    }
+    return write([]byte("1"))
+  })
+  r := s1.StreamRequest("stream")
+  r.Write([]byte("x"))
+  if n := s1.InFlightRequests(); n != 1 {
+    t.Errorf("InFlightRequests() => %d during a streaming request, expected 1", n)
+  }
+  r.End()
+  for {
+    b, err := r.Read()
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(b) == 0 {
+      break
+    }
+  }
+  if n := s1.InFlightRequests(); n != 0 {
+    t.Errorf("InFlightRequests() => %d after a streaming result ended, expected 0", n)
+  }
+}
+
+
+func TestDrain(t *testing.T) {
+  h := NewHandlers()
+  started := make(chan struct{}, 1)
+  release := make(chan struct{})
+  h.HandleRequest("work", func() (string, error) {
+    started <- struct{}{}
+    <-release
+    return "done", nil
+  })
+  s1, s2, err := PipeHandlers(NewHandlers(), h)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s1.Close()
+  goingAway := make(chan string, 1)
+  s1.SetGoingAwayFunc(func(_ Sock, reason string) { goingAway <- reason })
+  closeErr := make(chan error, 1)
+  s2.OnClose(func(err error) { closeErr <- err })
+
+  reqerr := make(chan error, 1)
+  go func() {
+    var out string
+    reqerr <- s1.Request("work", nil, &out)
+  }()
+  <-started
+  drained := make(chan error, 1)
+  go func() { drained <- s2.Drain(context.Background()) }()
+  if reason := <-goingAway; reason != "drain" {
+    t.Errorf("going away with reason %q, expected %q", reason, "drain")
+  }
+
+  // New requests are refused while the running one is allowed to complete
+  if e, ok := s1.Request("work", nil, nil).(*RequestError); !ok || e.Code() != ErrCodeGoingAway {
+    t.Errorf("Request() => %v, expected error with code ErrCodeGoingAway", e)
+  }
+  select {
+  case err := <-drained:
+    t.Fatalf("Drain() => %v while a request was being handled", err)
+  default:
+  }
+  close(release)
+  if err := <-reqerr; err != nil {
+    t.Errorf("Request() failed: %v", err)
+  }
+  if err := <-drained; err != nil {
+    t.Errorf("Drain() => %v, expected nil", err)
+  }
+  if err := <-closeErr; err != nil {
+    t.Errorf("OnClose got %v, expected nil", err)
+  }
+}
+
+
+func TestDrainTimeout(t *testing.T) {
+  h := NewHandlers()
+  started := make(chan struct{}, 1)
+  h.HandleRequest("work", func(ctx context.Context) error {
+    started <- struct{}{}
+    <-ctx.Done()
+    return nil
+  })
+  s1, s2, err := PipeHandlers(NewHandlers(), h)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s1.Close()
+  go s1.Request("work", nil, nil)
+  <-started
+  ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+  defer cancel()
+  if err := s2.Drain(ctx); err != context.DeadlineExceeded {
+    t.Errorf("Drain() => %v, expected %v", err, context.DeadlineExceeded)
+  }
+  if !s2.Closed() {
+    t.Errorf("socket not closed after Drain()")
+  }
+}
@@ -0,0 +1,87 @@
+package gotalk
+
+import (
+  "io"
+  "sync/atomic"
+)
+
+// Snapshot of the counters of a socket, or the sum of those of the sockets of a server
+type Stats struct {
+  RequestsSent           uint64  // single and streaming requests
+  RequestsReceived       uint64
+  StreamRequestsSent     uint64  // streaming requests, also counted in RequestsSent
+  StreamRequestsReceived uint64
+  NotificationsSent      uint64
+  NotificationsReceived  uint64
+  NotificationsDropped   uint64  // dropped from the notification queue
+  BytesRead              uint64
+  BytesWritten           uint64
+
+  RequestsInFlight       int  // requests received and being handled
+  ResultsPending         int  // requests sent and waiting for a result
+  StreamsActive          int  // streaming requests received and being handled
+  SendsPending           int  // messages waiting to be written (see Sock.PendingSendCount)
+}
+
+// Returns the sum of `s` and `b`
+func (s Stats) Add(b Stats) Stats {
+  s.RequestsSent += b.RequestsSent
+  s.RequestsReceived += b.RequestsReceived
+  s.StreamRequestsSent += b.StreamRequestsSent
+  s.StreamRequestsReceived += b.StreamRequestsReceived
+  s.NotificationsSent += b.NotificationsSent
+  s.NotificationsReceived += b.NotificationsReceived
+  s.NotificationsDropped += b.NotificationsDropped
+  s.BytesRead += b.BytesRead
+  s.BytesWritten += b.BytesWritten
+  s.RequestsInFlight += b.RequestsInFlight
+  s.ResultsPending += b.ResultsPending
+  s.StreamsActive += b.StreamsActive
+  s.SendsPending += b.SendsPending
+  return s
+}
+
+// Counters of a socket, updated atomically
+type sockStats struct {
+  requestsSent           uint64
+  requestsReceived       uint64
+  streamRequestsSent     uint64
+  streamRequestsReceived uint64
+  notificationsSent      uint64
+  notificationsReceived  uint64
+  notificationsDropped   uint64
+  bytesRead              uint64
+  bytesWritten           uint64
+}
+
+func (c *sockStats) snapshot() Stats {
+  return Stats{
+    RequestsSent:           atomic.LoadUint64(&c.requestsSent),
+    RequestsReceived:       atomic.LoadUint64(&c.requestsReceived),
+    StreamRequestsSent:     atomic.LoadUint64(&c.streamRequestsSent),
+    StreamRequestsReceived: atomic.LoadUint64(&c.streamRequestsReceived),
+    NotificationsSent:      atomic.LoadUint64(&c.notificationsSent),
+    NotificationsReceived:  atomic.LoadUint64(&c.notificationsReceived),
+    NotificationsDropped:   atomic.LoadUint64(&c.notificationsDropped),
+    BytesRead:              atomic.LoadUint64(&c.bytesRead),
+    BytesWritten:           atomic.LoadUint64(&c.bytesWritten),
+  }
+}
+
+// Counts bytes read from and written to a connection
+type countingConn struct {
+  io.ReadWriteCloser
+  stats *sockStats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+  n, err := c.ReadWriteCloser.Read(b)
+  atomic.AddUint64(&c.stats.bytesRead, uint64(n))
+  return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+  n, err := c.ReadWriteCloser.Write(b)
+  atomic.AddUint64(&c.stats.bytesWritten, uint64(n))
+  return n, err
+}
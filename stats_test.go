@@ -0,0 +1,115 @@
+package gotalk
+import (
+  "net"
+  "testing"
+  "time"
+)
+
+
+func TestStats(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  notified := make(chan struct{})
+  h.HandleNotification("hello", func(s string) { close(notified) })
+
+  c1, c2 := net.Pipe()
+  defer c1.Close()
+  defer c2.Close()
+  s1, s2 := NewSock(h), NewSock(h)
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  go s1.Read()
+  go s2.Read()
+
+  var out string
+  if err := s1.Request("echo", "hi", &out); err != nil {
+    t.Fatal(err)
+  }
+  if err := s1.Notify("hello", "there"); err != nil {
+    t.Fatal(err)
+  }
+  <-notified
+
+  // Wait for the responder to finish the request and to account for the result it wrote
+  st1, st2 := s1.Stats(), s2.Stats()
+  for deadline := time.Now().Add(time.Second); st2.RequestsInFlight != 0 || st2.BytesWritten != st1.BytesRead; {
+    if time.Now().After(deadline) {
+      t.Fatalf("request still in flight")
+    }
+    time.Sleep(time.Millisecond)
+    st2 = s2.Stats()
+  }
+  if st1.RequestsSent != 1 || st1.NotificationsSent != 1 || st1.RequestsReceived != 0 {
+    t.Errorf("unexpected stats of requestor: %+v", st1)
+  }
+  if st2.RequestsReceived != 1 || st2.NotificationsReceived != 1 || st2.RequestsSent != 0 {
+    t.Errorf("unexpected stats of responder: %+v", st2)
+  }
+  // `r001004echo00000004"hi"` + `n005hello00000007"there"`
+  if st1.BytesWritten != 23+24 || st2.BytesRead != st1.BytesWritten {
+    t.Errorf("%v bytes written and %v bytes read, expected %v",
+      st1.BytesWritten, st2.BytesRead, 23+24)
+  }
+  if st1.BytesRead != st2.BytesWritten || st1.ResultsPending != 0 || st2.RequestsInFlight != 0 {
+    t.Errorf("unexpected stats: %+v, %+v", st1, st2)
+  }
+}
+
+
+func TestServerStats(t *testing.T) {
+  h := NewHandlers()
+  h.HandleRequest("echo", func(s string) (string, error) { return s, nil })
+  srv := listenTCP(t, h)
+  defer srv.Close()
+
+  for i := 0; i < 2; i++ {
+    s, err := Connect("tcp", srv.Addr())
+    if err != nil {
+      t.Fatal(err)
+    }
+    defer s.Close()
+    var out string
+    if err := s.Request("echo", "hi", &out); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if st := srv.Stats(); st.RequestsReceived != 2 || st.BytesRead == 0 {
+    t.Errorf("unexpected stats: %+v", st)
+  }
+}
+
+
+func TestPendingSendCount(t *testing.T) {
+  s, c := pipeRaw(t, NewHandlers())
+  defer c.Close()
+  sock := s.(*socket)
+
+  // Notifications wait for the writer while it is blocked, like with a slow consumer
+  sock.wmu.Lock()
+  errc := make(chan error, 2)
+  for i := 0; i < 2; i++ {
+    go func() { errc <- s.BufferNotify("note", []byte("x")) }()
+  }
+  for deadline := time.Now().Add(time.Second); s.PendingSendCount() != 2; {
+    if time.Now().After(deadline) {
+      t.Fatalf("PendingSendCount() => %d, expected 2", s.PendingSendCount())
+    }
+    time.Sleep(time.Millisecond)
+  }
+  if n := s.Stats().SendsPending; n != 2 {
+    t.Errorf("Stats().SendsPending => %d, expected 2", n)
+  }
+
+  sock.wmu.Unlock()
+  for i := 0; i < 2; i++ {
+    readRawMsg(t, c)
+  }
+  for i := 0; i < 2; i++ {
+    if err := <-errc; err != nil {
+      t.Fatal(err)
+    }
+  }
+  if n := s.PendingSendCount(); n != 0 {
+    t.Errorf("PendingSendCount() => %d after the writes completed, expected 0", n)
+  }
+}
@@ -0,0 +1,67 @@
+package gotalk
+
+import (
+  "sync"
+)
+
+// A part of the result of a streaming request started with StreamRequestChan: either the
+// payload of a part, encoded with the socket's codec, or the error which ended the result.
+type StreamPart struct {
+  Data []byte
+  Err  error
+}
+
+// Starts a streaming request for operation `op` with `in` as its first part, giving the handler
+// parts on its input channel and the result as parts on a channel, like the handler's side of
+// a StreamReqHandler.
+//
+// `send` encodes a value with the socket's codec and sends it as the next part of the request.
+// Calling it with nil ends the request, after which it fails with ErrStreamEnded. It is safe to
+// call from multiple goroutines.
+//
+// `recv` receives the parts of the result in order. It is closed once the result has ended,
+// after a part with Err set if the result ended with an error or the socket was closed. The
+// socket doesn't read other messages while a part is waiting to be received, so `recv` must be
+// drained until closed.
+func StreamRequestChan(s Sock, op string, in interface{}) (send func(interface{}) error, recv <-chan StreamPart, err error) {
+  codec := codecOf(s)
+  buf, err := encodeValue(codec, in)
+  if err != nil {
+    return nil, nil, err
+  }
+  r := s.StreamRequest(op)
+  if err := r.Write(buf); err != nil {
+    return nil, nil, err
+  }
+
+  var mu sync.Mutex
+  send = func(v interface{}) error {
+    mu.Lock()
+    defer mu.Unlock()
+    if v == nil {
+      return r.CloseSend()
+    }
+    buf, err := encodeValue(codec, v)
+    if err != nil {
+      return err
+    }
+    return r.Write(buf)
+  }
+
+  ch := make(chan StreamPart)
+  go func() {
+    defer close(ch)
+    for {
+      b, err := r.Read()
+      if err != nil {
+        ch <- StreamPart{Err:err}
+        return
+      }
+      if len(b) == 0 {
+        return  // end of the result
+      }
+      ch <- StreamPart{Data:b}
+    }
+  }()
+  return send, ch, nil
+}
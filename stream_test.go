@@ -0,0 +1,74 @@
+package gotalk
+
+import (
+  "encoding/json"
+  "testing"
+)
+
+
+func TestStreamRequestChan(t *testing.T) {
+  h := NewHandlers()
+  // Echoes each part doubled, ending the result once the request ends
+  h.HandleStreamRequest("double", func(s Sock, op string, rch chan []byte, write StreamWriter) error {
+    for b := <-rch; b != nil; b = <-rch {
+      var n int
+      if err := json.Unmarshal(b, &n); err != nil {
+        return err
+      }
+      if n < 0 {
+        return Errorf(400, "negative")
+      }
+      out, _ := json.Marshal(n * 2)
+      if err := write(out); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  s1, s2, err := PipeHandlers(NewHandlers(), h)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s1.Close()
+  defer s2.Close()
+  s2.SetStreamReqLimit(2)
+
+  send, recv, err := StreamRequestChan(s1, "double", 1)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, n := range []int{2, 3} {
+    if err := send(n); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := send(nil); err != nil {
+    t.Fatal(err)
+  }
+  if err := send(4); err != ErrStreamEnded {
+    t.Errorf("send() => %v after the end of the request, expected ErrStreamEnded", err)
+  }
+  var got []string
+  for part := range recv {
+    if part.Err != nil {
+      t.Fatalf("received error %v", part.Err)
+    }
+    got = append(got, string(part.Data))
+  }
+  if len(got) != 3 || got[0] != "2" || got[1] != "4" || got[2] != "6" {
+    t.Errorf("received %q, expected [2 4 6]", got)
+  }
+
+  // A handler error ends the result with an error part
+  send, recv, err = StreamRequestChan(s1, "double", -1)
+  if err != nil {
+    t.Fatal(err)
+  }
+  part, ok := <-recv
+  if e, isReqErr := part.Err.(*RequestError); !ok || !isReqErr || e.Code() != 400 {
+    t.Errorf("received %+v, expected error with code 400", part)
+  }
+  if _, ok := <-recv; ok {
+    t.Errorf("recv not closed after an error")
+  }
+}
@@ -0,0 +1,187 @@
+package gotalk
+
+import (
+  "context"
+  "fmt"
+  "sync"
+)
+
+// A notification sent with a TestSock
+type SentNotification struct {
+  Name    string
+  Payload []byte  // encoded with the socket's codec
+}
+
+// A request sent with a TestSock
+type SentRequest struct {
+  Op      string
+  Payload []byte  // encoded with the socket's codec
+  Meta    map[string]string
+}
+
+type testResult struct {
+  buf  []byte
+  err  error
+  meta map[string]string
+}
+
+// An in-memory socket for unit testing handlers which call back on their socket. Notifications
+// and requests are recorded instead of being sent, and requests get the results set with
+// SetRequestResult. All other methods behave like those of a socket which is not connected.
+type TestSock struct {
+  Sock  // unconnected socket providing the remaining methods
+
+  mu            sync.Mutex
+  notifications []SentNotification
+  requests      []SentRequest
+  results       map[string]testResult
+}
+
+// Creates a TestSock with its own, empty handlers
+func NewTestSock() *TestSock {
+  return &TestSock{Sock:NewSock(NewHandlers()), results:make(map[string]testResult)}
+}
+
+// Sets the result of requests for `op`. `result` is encoded with the socket's codec and decoded
+// into the output of the request, unless `err` is not nil, in which case requests fail with it.
+// Requests for ops without a result fail with an error.
+func (s *TestSock) SetRequestResult(op string, result interface{}, err error) error {
+  var buf []byte
+  if err == nil {
+    var encerr error
+    if buf, encerr = s.Codec().Marshal(result); encerr != nil {
+      return encerr
+    }
+  }
+  s.SetBufferRequestResult(op, buf, err)
+  return nil
+}
+
+// Like SetRequestResult but with a result which is already encoded
+func (s *TestSock) SetBufferRequestResult(op string, result []byte, err error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.results[op] = testResult{result, err, s.results[op].meta}
+}
+
+// Sets the metadata of the result of requests for `op`, as returned by RequestWithResultMeta
+func (s *TestSock) SetRequestResultMeta(op string, meta map[string]string) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  res := s.results[op]
+  res.meta = meta
+  s.results[op] = res
+}
+
+// Returns the notifications sent so far, in the order they were sent
+func (s *TestSock) SentNotifications() []SentNotification {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return append([]SentNotification(nil), s.notifications...)
+}
+
+// Returns the requests sent so far, in the order they were sent
+func (s *TestSock) SentRequests() []SentRequest {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return append([]SentRequest(nil), s.requests...)
+}
+
+// Forgets the notifications and requests sent so far. Request results are kept.
+func (s *TestSock) Reset() {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.notifications = nil
+  s.requests = nil
+}
+
+func (s *TestSock) BufferNotify(name string, buf []byte) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.notifications = append(s.notifications, SentNotification{name, buf})
+  return nil
+}
+
+func (s *TestSock) Notify(name string, in interface{}) error {
+  buf, err := s.Codec().Marshal(in)
+  if err != nil {
+    return err
+  }
+  return s.BufferNotify(name, buf)
+}
+
+func (s *TestSock) NotifyContext(ctx context.Context, name string, in interface{}) error {
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+  return s.Notify(name, in)
+}
+
+func (s *TestSock) bufferRequest(op string, buf []byte, meta map[string]string) (testResult, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.requests = append(s.requests, SentRequest{op, buf, meta})
+  res, ok := s.results[op]
+  if !ok {
+    return res, fmt.Errorf("no result set for op %q", op)
+  }
+  return res, res.err
+}
+
+func (s *TestSock) BufferRequest(op string, buf []byte) ([]byte, error) {
+  res, err := s.bufferRequest(op, buf, nil)
+  return res.buf, err
+}
+
+func (s *TestSock) request(op string, in, out interface{}, meta map[string]string) (map[string]string, error) {
+  codec := s.Codec()
+  inbuf, err := codec.Marshal(in)
+  if err != nil {
+    return nil, err
+  }
+  res, err := s.bufferRequest(op, inbuf, meta)
+  if err != nil {
+    return res.meta, err
+  }
+  return res.meta, codec.Unmarshal(res.buf, out)
+}
+
+// Records the request like any other, as a request without metadata
+func (s *TestSock) RequestNoReply(op string, in interface{}) error {
+  buf, err := s.Codec().Marshal(in)
+  if err != nil {
+    return err
+  }
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.requests = append(s.requests, SentRequest{op, buf, nil})
+  return nil
+}
+
+// Records the request with its key in the metadata, without retrying failures
+func (s *TestSock) RequestIdempotent(op string, in, out interface{}, key string) error {
+  _, err := s.request(op, in, out, map[string]string{IdempotencyKeyMeta: key})
+  return err
+}
+
+func (s *TestSock) Request(op string, in, out interface{}) error {
+  _, err := s.request(op, in, out, nil)
+  return err
+}
+
+func (s *TestSock) RequestContext(ctx context.Context, op string, in, out interface{}) error {
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+  _, err := s.request(op, in, out, nil)
+  return err
+}
+
+func (s *TestSock) RequestWithMeta(op string, in, out interface{}, meta map[string]string) error {
+  _, err := s.request(op, in, out, meta)
+  return err
+}
+
+func (s *TestSock) RequestWithResultMeta(op string, in, out interface{}, meta map[string]string) (map[string]string, error) {
+  return s.request(op, in, out, meta)
+}
@@ -0,0 +1,62 @@
+package gotalk
+
+import (
+  "context"
+  "testing"
+)
+
+
+func TestTestSock(t *testing.T) {
+  // A handler calling back on its socket, like one greeting new connections
+  greet := func(s Sock, name string) (int, error) {
+    if err := s.Notify("greeting", "hello "+name); err != nil {
+      return 0, err
+    }
+    var n int
+    err := s.Request("visits", name, &n)
+    return n + 1, err
+  }
+
+  s := NewTestSock()
+  if err := s.SetRequestResult("visits", 41, nil); err != nil {
+    t.Fatal(err)
+  }
+  n, err := greet(s, "bob")
+  if err != nil || n != 42 {
+    t.Errorf("greet() => (%v, %v), expected 42", n, err)
+  }
+
+  notes := s.SentNotifications()
+  if len(notes) != 1 || notes[0].Name != "greeting" || string(notes[0].Payload) != `"hello bob"` {
+    t.Errorf("SentNotifications() => %+v", notes)
+  }
+  reqs := s.SentRequests()
+  if len(reqs) != 1 || reqs[0].Op != "visits" || string(reqs[0].Payload) != `"bob"` {
+    t.Errorf("SentRequests() => %+v", reqs)
+  }
+
+  // Injected errors
+  s.SetRequestResult("visits", nil, Errorf(404, "unknown visitor"))
+  if _, err := greet(s, "eve"); err == nil || err.Error() != "unknown visitor" {
+    t.Errorf("greet() => %v, expected \"unknown visitor\"", err)
+  }
+
+  // Requests for ops without a result fail
+  if err := s.RequestContext(context.Background(), "other", nil, nil); err == nil {
+    t.Errorf("RequestContext() succeeded for op without a result")
+  }
+
+  s.Reset()
+  if len(s.SentNotifications()) != 0 || len(s.SentRequests()) != 0 {
+    t.Errorf("Reset() kept sent messages")
+  }
+
+  // Result metadata, like a cursor for the next page
+  s.SetRequestResult("list", []string{"a", "b"}, nil)
+  s.SetRequestResultMeta("list", map[string]string{"next": "c"})
+  var page []string
+  meta, err := s.RequestWithResultMeta("list", nil, &page, nil)
+  if err != nil || len(page) != 2 || meta["next"] != "c" {
+    t.Errorf("RequestWithResultMeta() => (%v, %v, %v), expected next=c", page, meta, err)
+  }
+}
@@ -0,0 +1,40 @@
+package gotalk
+
+import (
+  "crypto/tls"
+)
+
+// Start a `how` server listening for TLS connections at `addr`. See ListenServer
+func ListenTLS(how, addr string, config *tls.Config) (*Server, error) {
+  s, err := ListenServer(how, addr)
+  if err != nil {
+    return nil, err
+  }
+  s.listener = tls.NewListener(s.listener, config)
+  return s, nil
+}
+
+// Start a `how` server accepting TLS connections at `addr`. See Serve
+func ServeTLS(how, addr string, config *tls.Config, handler SockHandler) error {
+  s, err := ListenTLS(how, addr, config)
+  if err != nil {
+    return err
+  }
+  return s.Accept(handler)
+}
+
+// Connect to a TLS server via `how` at `addr`. The protocol handshake is performed once the TLS
+// handshake has completed. Unless there's an error, the returned socket is already reading in
+// a different goroutine and is ready to be used.
+func ConnectTLS(how, addr string, config *tls.Config) (Sock, error) {
+  c, err := tls.Dial(how, addr, config)
+  if err != nil {
+    return nil, err
+  }
+  s, err := adoptConn(c, DefaultHandlers)
+  if err != nil {
+    return nil, err
+  }
+  go s.Read()
+  return s, nil
+}
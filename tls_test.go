@@ -0,0 +1,88 @@
+package gotalk
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "math/big"
+  "net"
+  "testing"
+  "time"
+)
+
+
+// Returns a self-signed certificate for 127.0.0.1
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+  tmpl := &x509.Certificate{
+    SerialNumber: big.NewInt(1),
+    Subject:      pkix.Name{CommonName: "gotalk test"},
+    NotBefore:    time.Now().Add(-time.Hour),
+    NotAfter:     time.Now().Add(time.Hour),
+    IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+    KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+    ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    IsCA:         true,
+    BasicConstraintsValid: true,
+  }
+  der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+  if err != nil {
+    t.Fatal(err)
+  }
+  cert, err := x509.ParseCertificate(der)
+  if err != nil {
+    t.Fatal(err)
+  }
+  pool := x509.NewCertPool()
+  pool.AddCert(cert)
+  return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+
+func TestTLS(t *testing.T) {
+  cert, pool := selfSignedCert(t)
+  srv, err := ListenTLS("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer srv.Close()
+  h := NewHandlers()
+  h.HandleRequest("secure", func(s Sock) (bool, error) {
+    return s.ConnectionState() != nil && s.ConnectionState().HandshakeComplete, nil
+  })
+  srv.handlers = h
+  go srv.Accept(nil)
+
+  s, err := ConnectTLS("tcp", srv.Addr(), &tls.Config{RootCAs: pool})
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s.Close()
+  if cs := s.ConnectionState(); cs == nil || !cs.HandshakeComplete {
+    t.Errorf("ConnectionState() => %v, expected a completed handshake", cs)
+  }
+  var secure bool
+  if err := s.Request("secure", nil, &secure); err != nil || !secure {
+    t.Errorf("Request() => (%v, %v), expected the server side to use TLS", secure, err)
+  }
+
+  // Untrusted certificate
+  if _, err := ConnectTLS("tcp", srv.Addr(), &tls.Config{}); err == nil {
+    t.Errorf("ConnectTLS() succeeded with an untrusted certificate")
+  }
+
+  // Plain connections don't have a TLS state
+  s1, _, err := Pipe()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s1.Close()
+  if cs := s1.ConnectionState(); cs != nil {
+    t.Errorf("ConnectionState() => %v, expected nil", cs)
+  }
+}
@@ -0,0 +1,159 @@
+package gotalk
+
+import (
+  "sort"
+  "sync"
+  "sync/atomic"
+)
+
+// Registry of sockets subscribed to topics, for publishing notifications to all subscribers of
+// a topic. Sockets are unsubscribed from all topics when they close. The zero value is not
+// usable; create a registry with NewTopics.
+type Topics struct {
+  mu     sync.Mutex
+  topics map[string]map[Sock]struct{}  // subscribers, keyed by topic
+  socks  map[Sock]map[string]struct{}  // topics, keyed by subscriber
+}
+
+func NewTopics() *Topics {
+  return &Topics{
+    topics: make(map[string]map[Sock]struct{}),
+    socks:  make(map[Sock]map[string]struct{}),
+  }
+}
+
+// Subscribe `s` to `topic`. Returns false if `s` is closed.
+func (t *Topics) Subscribe(s Sock, topic string) bool {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  if s2, ok := s.(*socket); ok && !s2.watchTopics(t) {
+    return false
+  }
+  subs := t.topics[topic]
+  if subs == nil {
+    subs = make(map[Sock]struct{})
+    t.topics[topic] = subs
+  }
+  subs[s] = struct{}{}
+  topics := t.socks[s]
+  if topics == nil {
+    topics = make(map[string]struct{})
+    t.socks[s] = topics
+  }
+  topics[topic] = struct{}{}
+  return true
+}
+
+// Unsubscribe `s` from `topic`. Returns false if `s` wasn't subscribed to `topic`.
+func (t *Topics) Unsubscribe(s Sock, topic string) bool {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  topics := t.socks[s]
+  if _, ok := topics[topic]; !ok {
+    return false
+  }
+  t.unsubscribeLocked(s, topic)
+  if len(topics) == 0 {
+    delete(t.socks, s)
+    if s2, ok := s.(*socket); ok {
+      s2.unwatchTopics(t)
+    }
+  }
+  return true
+}
+
+// Unsubscribe `s` from all topics
+func (t *Topics) UnsubscribeAll(s Sock) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  t.removeLocked(s)
+  if s2, ok := s.(*socket); ok {
+    s2.unwatchTopics(t)
+  }
+}
+
+// Called when `s` closes
+func (t *Topics) remove(s Sock) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  t.removeLocked(s)
+}
+
+func (t *Topics) removeLocked(s Sock) {
+  for topic := range t.socks[s] {
+    t.unsubscribeLocked(s, topic)
+  }
+  delete(t.socks, s)
+}
+
+func (t *Topics) unsubscribeLocked(s Sock, topic string) {
+  delete(t.socks[s], topic)
+  subs := t.topics[topic]
+  delete(subs, s)
+  if len(subs) == 0 {
+    delete(t.topics, topic)
+  }
+}
+
+// Returns the sockets subscribed to `topic`
+func (t *Topics) Subscribers(topic string) []Sock {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  subs := t.topics[topic]
+  socks := make([]Sock, 0, len(subs))
+  for s := range subs {
+    socks = append(socks, s)
+  }
+  return socks
+}
+
+// Returns the sorted names of topics with at least one subscriber
+func (t *Topics) Names() []string {
+  t.mu.Lock()
+  names := make([]string, 0, len(t.topics))
+  for topic := range t.topics {
+    names = append(names, topic)
+  }
+  t.mu.Unlock()
+  sort.Strings(names)
+  return names
+}
+
+// Send a notification to the subscribers of `topic`, encoding `v` once like Server.Broadcast.
+// Returns the number of subscribers notified.
+func (t *Topics) Publish(topic, name string, v interface{}) (int, error) {
+  return broadcast(t.Subscribers(topic), name, v)
+}
+
+// -------------------------------------------------------------------------------------
+
+// Registers `t` to be told when the socket closes. Returns false if the socket is closed.
+func (s *socket) watchTopics(t *Topics) bool {
+  s.topicsMu.Lock()
+  defer s.topicsMu.Unlock()
+  if atomic.LoadInt32(&s.closed) != 0 {
+    return false
+  }
+  if s.topics == nil {
+    s.topics = make(map[*Topics]struct{})
+  }
+  s.topics[t] = struct{}{}
+  return true
+}
+
+func (s *socket) unwatchTopics(t *Topics) {
+  s.topicsMu.Lock()
+  defer s.topicsMu.Unlock()
+  delete(s.topics, t)
+}
+
+// Unsubscribes the socket from all topics. Called when the socket closes.
+func (s *socket) leaveTopics() {
+  s.topicsMu.Lock()
+  topics := s.topics
+  s.topics = nil
+  s.topicsMu.Unlock()
+  for t := range topics {
+    t.remove(s)
+  }
+}
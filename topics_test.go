@@ -0,0 +1,88 @@
+package gotalk
+
+import (
+  "net"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestTopics(t *testing.T) {
+  h := NewHandlers()
+  h.HandleBufferRequest("ping", func(Sock, string, []byte) ([]byte, error) { return nil, nil })
+  srv := listenTCP(t, h)
+  defer srv.Close()
+
+  received := make(chan string, 2)
+  ch := NewHandlers()
+  ch.HandleNotification("news", func(s string) { received <- s })
+  for i := 0; i < 2; i++ {
+    s, err := dial("tcp", srv.Addr(), ch)
+    if err != nil {
+      t.Fatal(err)
+    }
+    defer s.Close()
+    go s.Read()
+    if _, err := s.BufferRequest("ping", nil); err != nil {
+      t.Fatal(err)
+    }
+  }
+  socks := srv.Socks()
+
+  topics := NewTopics()
+  topics.Subscribe(socks[0], "a")
+  topics.Subscribe(socks[0], "b")
+  topics.Subscribe(socks[1], "b")
+  if names := topics.Names(); strings.Join(names, ",") != "a,b" {
+    t.Errorf("Names() => %v, expected [a b]", names)
+  }
+
+  if n, err := topics.Publish("b", "news", "hi"); n != 2 || err != nil {
+    t.Errorf("Publish() = (%d, %v), expected (2, nil)", n, err)
+  }
+  for i := 0; i < 2; i++ {
+    select {
+    case s := <-received:
+      if s != "hi" {
+        t.Errorf("received %q, expected \"hi\"", s)
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("notification was not received by all subscribers")
+    }
+  }
+
+  if !topics.Unsubscribe(socks[1], "b") || topics.Unsubscribe(socks[1], "b") {
+    t.Errorf("Unsubscribe() should succeed once")
+  }
+  if n := len(topics.Subscribers("b")); n != 1 {
+    t.Errorf("len(Subscribers(\"b\")) = %d, expected 1", n)
+  }
+
+  // Closed sockets are removed from all topics
+  socks[0].Close()
+  if names := topics.Names(); len(names) != 0 {
+    t.Errorf("Names() => %v after close, expected none", names)
+  }
+  if topics.Subscribe(socks[0], "a") {
+    t.Errorf("Subscribe() succeeded with a closed socket")
+  }
+}
+
+
+func TestTopicsUnsubscribeAll(t *testing.T) {
+  c1, c2 := net.Pipe()
+  defer c2.Close()
+  s := NewSock(NewHandlers())
+  s.Adopt(c1)
+  topics := NewTopics()
+  topics.Subscribe(s, "a")
+  topics.Subscribe(s, "b")
+  topics.UnsubscribeAll(s)
+  if names := topics.Names(); len(names) != 0 {
+    t.Errorf("Names() => %v after UnsubscribeAll, expected none", names)
+  }
+  if n := len(s.(*socket).topics); n != 0 {
+    t.Errorf("socket still refers to %d registries", n)
+  }
+  s.Close()
+}
@@ -0,0 +1,37 @@
+package gotalk
+
+// Sends a request with parameters `in` for operation `op` and waits for its result, decoded as
+// a value of type Out. Like Sock.Request but without the need for a pointer to the result.
+func Request[In, Out any](s Sock, op string, in In) (Out, error) {
+  var out Out
+  err := s.Request(op, in, &out)
+  return out, err
+}
+
+// Handle operation `op` with `fn`, which takes parameters of type In and returns a result of
+// type Out. Like Handlers.HandleRequest but type-checked at compile time, and the parameters
+// are decoded without reflection. Parameters implementing Validator are validated. If `h` is
+// nil, DefaultHandlers is used.
+func HandleTyped[In, Out any](h Handlers, op string, fn func(Sock, In) (Out, error)) {
+  if h == nil {
+    h = DefaultHandlers
+  }
+  h.HandleBufferRequest(op, func(s Sock, _ string, inbuf []byte) (outbuf []byte, err error) {
+    var in In
+    codec := codecOf(s)
+    if err := codec.Unmarshal(inbuf, &in); err != nil {
+      return nil, paramTypeError(err)
+    }
+    if v, ok := interface{}(&in).(Validator); ok {
+      if err := v.Validate(); err != nil {
+        return nil, NewRequestError(ErrCodeInvalidParams, err.Error(), nil)
+      }
+    }
+    defer recoverHandlerPanic(&err)
+    out, err := fn(s, in)
+    if err != nil {
+      return nil, err
+    }
+    return encodeValue(codec, out)
+  })
+}
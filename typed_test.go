@@ -0,0 +1,50 @@
+package gotalk
+import (
+  "net"
+  "testing"
+)
+
+
+type typedParams struct {
+  A, B int
+}
+
+func (p *typedParams) Validate() error {
+  if p.B == 0 {
+    return Errorf(0, "division by zero")
+  }
+  return nil
+}
+
+
+func TestTyped(t *testing.T) {
+  h := NewHandlers()
+  HandleTyped(h, "div", func(s Sock, p typedParams) (int, error) {
+    return p.A / p.B, nil
+  })
+  HandleTyped(h, "crash", func(s Sock, p []int) (int, error) {
+    return p[10], nil
+  })
+  c1, c2 := net.Pipe()
+  defer c1.Close()
+  defer c2.Close()
+  s1, s2 := NewSock(NewHandlers()), NewSock(h)
+  s1.Adopt(c1)
+  s2.Adopt(c2)
+  go s1.Read()
+  go s2.Read()
+
+  if n, err := Request[typedParams, int](s1, "div", typedParams{6, 3}); err != nil || n != 2 {
+    t.Errorf("Request() => (%v, %v), expected 2", n, err)
+  }
+  _, err := Request[typedParams, int](s1, "div", typedParams{6, 0})
+  if e, ok := err.(*RequestError); !ok || e.Code() != ErrCodeInvalidParams {
+    t.Errorf("Request() => %v, expected invalid params error", err)
+  }
+  if _, err := Request[string, int](s1, "div", "x"); err == nil {
+    t.Errorf("Request() with unexpected parameters succeeded")
+  }
+  if _, err := Request[[]int, int](s1, "crash", nil); err == nil {
+    t.Errorf("Request() to panicking handler succeeded")
+  }
+}
@@ -1,26 +1,217 @@
 package gotalk
 
 import (
+  "bufio"
+  "io"
+  "net"
+  "net/http"
+  "net/url"
+  "strings"
   "golang.org/x/net/websocket"
 )
 
-// Handler that can be used with the http package
+// Handler that can be used with the http package.
+//
+// Connections are accepted from any origin, meaning that any web page visited by a user can
+// connect with the user's cookies. Use WebSocketServer to restrict the origins allowed to connect.
 func WebSocketHandler(h Handlers, handler SockHandler) websocket.Handler {
+  return websocket.Handler(webSocketAccept(h, handler, nil))
+}
+
+// Subprotocols choosing the type of frames written to web sockets, which carry the same
+// messages either way. List these in WebSocketOptions.Subprotocols to let clients choose, e.g.
+// binary frames for browsers reading messages into ArrayBuffers.
+const (
+  WebSocketBinaryProtocol = "gotalk.binary"
+  WebSocketTextProtocol   = "gotalk.text"
+)
+
+// Options of WebSocketServer
+type WebSocketOptions struct {
+  // Origins allowed to connect, e.g. "https://example.com", compared case-insensitively with
+  // the Origin header sent by web browsers. "*" allows any origin. When empty and CheckOrigin
+  // is nil, only pages served from the same host as the web socket may connect.
+  AllowedOrigins []string
+
+  // Called to decide whether to accept a connection, in place of checking AllowedOrigins.
+  // Connections which aren't accepted are refused with "403 Forbidden."
+  CheckOrigin func(r *http.Request) bool
+
+  // Subprotocols supported, in order of preference. The first of these offered by a client in
+  // its Sec-WebSocket-Protocol header is chosen and available from Sock.Subprotocol.
+  Subprotocols []string
+
+  // Refuse connections which don't offer any of Subprotocols with "403 Forbidden," rather than
+  // accepting them without a subprotocol
+  RequireSubprotocol bool
+
+  // Sizes of buffers for reading and writing web socket frames. When zero (the default) reads
+  // and writes are unbuffered, with each message written in two frames or more. A write buffer
+  // makes it likelier for a message to be written in one frame.
+  ReadBufferSize  int
+  WriteBufferSize int
+
+  // Limit of the payload size of messages received, as with Sock.SetMaxMessageSize. Zero means
+  // no limit. The connection is closed with a ProtocolError when a larger message is received,
+  // before its payload has been read.
+  MaxMessageSize int
+
+  // Write text frames rather than binary frames, unless the subprotocol chosen is
+  // WebSocketBinaryProtocol. Frames of either type are read.
+  TextFrames bool
+}
+
+// Handler that can be used with the http package, like WebSocketHandler, which only accepts
+// connections allowed by `opts`. Requests without an Origin header, which aren't made by web
+// browsers, are accepted unless refused by opts.CheckOrigin. If `opts` is nil, only pages
+// served from the same host may connect, without a subprotocol.
+func WebSocketServer(h Handlers, handler SockHandler, opts *WebSocketOptions) websocket.Server {
+  if opts == nil {
+    opts = &WebSocketOptions{}
+  }
+  return websocket.Server{
+    Handshake: func(config *websocket.Config, r *http.Request) error {
+      if !opts.allowOrigin(r) {
+        return websocket.ErrBadWebSocketOrigin
+      }
+      config.Origin, _ = websocket.Origin(config, r)
+      protocol := opts.chooseSubprotocol(config.Protocol)
+      if protocol == "" && opts.RequireSubprotocol {
+        return websocket.ErrBadWebSocketProtocol
+      }
+      config.Protocol = nil
+      if protocol != "" {
+        config.Protocol = []string{protocol}
+      }
+      return nil
+    },
+    Handler: webSocketAccept(h, handler, opts),
+  }
+}
+
+func (o *WebSocketOptions) allowOrigin(r *http.Request) bool {
+  if o.CheckOrigin != nil {
+    return o.CheckOrigin(r)
+  }
+  origin := r.Header.Get("Origin")
+  if origin == "" {
+    return true
+  }
+  if len(o.AllowedOrigins) == 0 {
+    u, err := url.Parse(origin)
+    return err == nil && strings.EqualFold(u.Host, r.Host)
+  }
+  for _, allowed := range o.AllowedOrigins {
+    if allowed == "*" || strings.EqualFold(allowed, origin) {
+      return true
+    }
+  }
+  return false
+}
+
+// Returns the most preferred of Subprotocols which is `offered`, or "" if there is none
+func (o *WebSocketOptions) chooseSubprotocol(offered []string) string {
+  for _, protocol := range o.Subprotocols {
+    for _, p := range offered {
+      if p == protocol {
+        return protocol
+      }
+    }
+  }
+  return ""
+}
+
+func webSocketAccept(h Handlers, handler SockHandler, opts *WebSocketOptions) func(*websocket.Conn) {
   if h == nil {
     h = DefaultHandlers
   }
-  return websocket.Handler(
-    func (ws *websocket.Conn) {
-      s := NewSock(h)
-      ws.PayloadType = websocket.BinaryFrame; // websocket.TextFrame;
+  if opts == nil {
+    opts = &WebSocketOptions{}
+  }
+  return func (ws *websocket.Conn) {
+    s := NewSock(h)
+    ws.PayloadType = webSocketPayloadType(ws, opts)
+    s.SetMaxMessageSize(opts.MaxMessageSize)
+    if opts.ReadBufferSize > 0 || opts.WriteBufferSize > 0 {
+      s.Adopt(newWebSocketConn(ws, opts.ReadBufferSize, opts.WriteBufferSize))
+    } else {
       s.Adopt(ws)
-      if err := s.Handshake(); err != nil {
-        s.Close()
-      } else {
-        if handler != nil {
-          handler(s)
-        }
-        s.Read()
+    }
+    if err := s.Handshake(); err != nil {
+      s.Close()
+    } else {
+      if handler != nil {
+        handler(s)
       }
-    })
+      s.Read()
+    }
+  }
+}
+
+// Returns the type of frames to write to `ws`
+func webSocketPayloadType(ws *websocket.Conn, opts *WebSocketOptions) byte {
+  if protocols := ws.Config().Protocol; len(protocols) == 1 {
+    switch protocols[0] {
+    case WebSocketBinaryProtocol:
+      return websocket.BinaryFrame
+    case WebSocketTextProtocol:
+      return websocket.TextFrame
+    }
+  }
+  if opts.TextFrames {
+    return websocket.TextFrame
+  }
+  return websocket.BinaryFrame
+}
+
+// A web socket with buffered reads and writes. The write buffer is flushed by the socket after
+// each message.
+type webSocketConn struct {
+  *websocket.Conn
+  r io.Reader
+  w *bufio.Writer  // nil when writes are unbuffered
+}
+
+func newWebSocketConn(ws *websocket.Conn, readBufSize, writeBufSize int) *webSocketConn {
+  c := &webSocketConn{Conn: ws, r: ws}
+  if readBufSize > 0 {
+    c.r = bufio.NewReaderSize(ws, readBufSize)
+  }
+  if writeBufSize > 0 {
+    c.w = bufio.NewWriterSize(ws, writeBufSize)
+  }
+  return c
+}
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+  return c.r.Read(b)
+}
+
+func (c *webSocketConn) Write(b []byte) (int, error) {
+  if c.w == nil {
+    return c.Conn.Write(b)
+  }
+  return c.w.Write(b)
+}
+
+func (c *webSocketConn) Flush() error {
+  if c.w == nil {
+    return nil
+  }
+  return c.w.Flush()
+}
+
+// Returns the addresses of the HTTP connection of a web socket accepted by a server, as the
+// addresses of the web socket itself are the origin and location URLs.
+func webSocketAddrs(ws *websocket.Conn) (remote, local net.Addr) {
+  remote, local = ws.RemoteAddr(), ws.LocalAddr()
+  if r := ws.Request(); r != nil {
+    if a, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+      remote = a
+    }
+    if a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+      local = a
+    }
+  }
+  return
 }
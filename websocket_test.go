@@ -0,0 +1,298 @@
+package gotalk
+import (
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+  "golang.org/x/net/websocket"
+)
+
+
+func TestWebSocketAddrs(t *testing.T) {
+  socks := make(chan Sock, 1)
+  srv := httptest.NewServer(WebSocketHandler(NewHandlers(), func(s Sock) { socks <- s }))
+  defer srv.Close()
+
+  url := "ws" + strings.TrimPrefix(srv.URL, "http")
+  ws, err := websocket.Dial(url, "", srv.URL)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer ws.Close()
+  c := NewSock(NewHandlers())
+  c.Adopt(ws)
+  if err := c.Handshake(); err != nil {
+    t.Fatal(err)
+  }
+  s := <-socks
+
+  // The addresses are those of the HTTP connection rather than the web socket URLs
+  remote, ok := s.RemoteAddr().(*net.TCPAddr)
+  if !ok || !remote.IP.IsLoopback() || remote.Port == 0 {
+    t.Errorf("RemoteAddr() => %v, expected a loopback TCP address", s.RemoteAddr())
+  }
+  if local := s.LocalAddr(); local == nil || local.String() != srv.Listener.Addr().String() {
+    t.Errorf("LocalAddr() => %v, expected %v", local, srv.Listener.Addr())
+  }
+  if s.Addr() != remote.String() {
+    t.Errorf("Addr() => %q, expected %q", s.Addr(), remote.String())
+  }
+
+  // Sockets without a connection have no addresses
+  if a := NewSock(nil).RemoteAddr(); a != nil {
+    t.Errorf("RemoteAddr() => %v without a connection", a)
+  }
+}
+
+
+func TestWebSocketHTTPRequest(t *testing.T) {
+  socks := make(chan Sock, 1)
+  srv := httptest.NewServer(WebSocketHandler(NewHandlers(), func(s Sock) { socks <- s }))
+  defer srv.Close()
+
+  url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/gotalk?user=bob"
+  config, err := websocket.NewConfig(url, srv.URL)
+  if err != nil {
+    t.Fatal(err)
+  }
+  config.Header.Set("Cookie", "session=123")
+  ws, err := websocket.DialConfig(config)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer ws.Close()
+  c := NewSock(NewHandlers())
+  c.Adopt(ws)
+  if err := c.Handshake(); err != nil {
+    t.Fatal(err)
+  }
+  s := <-socks
+
+  r := s.HTTPRequest()
+  if r == nil {
+    t.Fatalf("HTTPRequest() => nil for a web socket accepted by a server")
+  }
+  if user := r.URL.Query().Get("user"); user != "bob" {
+    t.Errorf("HTTPRequest().URL has user %q, expected \"bob\"", user)
+  }
+  if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "123" {
+    t.Errorf("HTTPRequest().Cookie(\"session\") => (%v, %v), expected \"123\"", cookie, err)
+  }
+
+  // Other connections have no HTTP request
+  if r := c.HTTPRequest(); r != nil {
+    t.Errorf("HTTPRequest() => %v for a client web socket", r)
+  }
+  if r := NewSock(nil).HTTPRequest(); r != nil {
+    t.Errorf("HTTPRequest() => %v without a connection", r)
+  }
+}
+
+
+func TestWebSocketOrigin(t *testing.T) {
+  for _, test := range []struct {
+    opts    *WebSocketOptions
+    origin  string
+    allowed bool
+  }{
+    {nil, "", true},  // same origin
+    {nil, "http://evil.example", false},
+    {&WebSocketOptions{AllowedOrigins: []string{"http://good.example"}}, "http://GOOD.example", true},
+    {&WebSocketOptions{AllowedOrigins: []string{"http://good.example"}}, "http://evil.example", false},
+    {&WebSocketOptions{AllowedOrigins: []string{"*"}}, "http://evil.example", true},
+    {&WebSocketOptions{CheckOrigin: func(*http.Request) bool { return false }}, "", false},
+  } {
+    srv := httptest.NewServer(WebSocketServer(NewHandlers(), nil, test.opts))
+    origin := test.origin
+    if origin == "" {
+      origin = srv.URL
+    }
+    req, _ := http.NewRequest("GET", srv.URL, nil)
+    req.Header.Set("Upgrade", "websocket")
+    req.Header.Set("Connection", "Upgrade")
+    req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+    req.Header.Set("Sec-WebSocket-Version", "13")
+    req.Header.Set("Origin", origin)
+    res, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatal(err)
+    }
+    res.Body.Close()
+    expected := http.StatusSwitchingProtocols
+    if !test.allowed {
+      expected = http.StatusForbidden
+    }
+    if res.StatusCode != expected {
+      t.Errorf("connecting from %q => status %d, expected %d", origin, res.StatusCode, expected)
+    }
+    srv.Close()
+  }
+}
+
+
+func TestWebSocketSubprotocol(t *testing.T) {
+  socks := make(chan Sock, 1)
+  opts := &WebSocketOptions{Subprotocols: []string{"v2", "v1"}, RequireSubprotocol: true}
+  srv := httptest.NewServer(WebSocketServer(NewHandlers(), func(s Sock) { socks <- s }, opts))
+  defer srv.Close()
+
+  url := "ws" + strings.TrimPrefix(srv.URL, "http")
+  for _, test := range []struct {
+    offered  []string
+    expected string
+  }{
+    {[]string{"v1", "v2"}, "v2"},
+    {[]string{"v1"}, "v1"},
+    {[]string{"v3"}, ""},
+    {nil, ""},
+  } {
+    config, err := websocket.NewConfig(url, srv.URL)
+    if err != nil {
+      t.Fatal(err)
+    }
+    config.Protocol = test.offered
+    ws, err := websocket.DialConfig(config)
+    if test.expected == "" {
+      if err == nil {
+        ws.Close()
+        t.Errorf("connected offering %q, expected the upgrade to be refused", test.offered)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("connecting offering %q failed: %v", test.offered, err)
+      continue
+    }
+    c := NewSock(NewHandlers())
+    c.Adopt(ws)
+    if err := c.Handshake(); err != nil {
+      t.Fatal(err)
+    }
+    if p := (<-socks).Subprotocol(); p != test.expected {
+      t.Errorf("Subprotocol() => %q offering %q, expected %q", p, test.offered, test.expected)
+    }
+    c.Close()
+  }
+
+  // Without RequireSubprotocol, clients not offering a supported subprotocol are accepted
+  opts.RequireSubprotocol = false
+  ws, err := websocket.Dial(url, "v3", srv.URL)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer ws.Close()
+  c := NewSock(NewHandlers())
+  c.Adopt(ws)
+  if err := c.Handshake(); err != nil {
+    t.Fatal(err)
+  }
+  if p := (<-socks).Subprotocol(); p != "" {
+    t.Errorf("Subprotocol() => %q, expected none", p)
+  }
+}
+
+
+func TestWebSocketBuffers(t *testing.T) {
+  h := NewHandlers()
+  h.HandleBufferRequest("echo", func(s Sock, op string, b []byte) ([]byte, error) {
+    return b, nil
+  })
+  opts := &WebSocketOptions{ReadBufferSize: 4096, WriteBufferSize: 4096, MaxMessageSize: 100}
+  srv := httptest.NewServer(WebSocketServer(h, nil, opts))
+  defer srv.Close()
+
+  ws, err := websocket.Dial("ws" + strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer ws.Close()
+  if _, err := WriteVersion(ws); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := ReadVersion(ws); err != nil {
+    t.Fatal(err)
+  }
+
+  // With a write buffer, messages are written in one frame
+  ws.Write(append(MakeMsg(MsgTypeSingleReq, "001", "echo", 5), "hello"...))
+  var frame []byte
+  if err := websocket.Message.Receive(ws, &frame); err != nil {
+    t.Fatal(err)
+  }
+  if expected := string(MakeMsg(MsgTypeSingleRes, "001", "", 5)) + "hello"; string(frame) != expected {
+    t.Errorf("received frame %q, expected %q", frame, expected)
+  }
+
+  // Messages larger than MaxMessageSize close the connection
+  ws.Write(MakeMsg(MsgTypeSingleReq, "002", "echo", 1000))
+  ws.SetReadDeadline(time.Now().Add(time.Second))
+  for {
+    if err = websocket.Message.Receive(ws, &frame); err != nil {
+      break
+    }
+  }
+  if e, ok := err.(net.Error); ok && e.Timeout() {
+    t.Errorf("connection was not closed after receiving an oversized message")
+  }
+}
+
+
+func TestWebSocketFrameType(t *testing.T) {
+  h := NewHandlers()
+  h.HandleBufferRequest("echo", func(s Sock, op string, b []byte) ([]byte, error) {
+    return b, nil
+  })
+  opts := &WebSocketOptions{
+    Subprotocols: []string{WebSocketBinaryProtocol, WebSocketTextProtocol},
+    TextFrames:   true,
+  }
+  srv := httptest.NewServer(WebSocketServer(h, nil, opts))
+  defer srv.Close()
+
+  // Receives a frame along with its type
+  frames := websocket.Codec{Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+    *v.(*[]byte) = append([]byte{payloadType}, data...)
+    return nil
+  }}
+
+  url := "ws" + strings.TrimPrefix(srv.URL, "http")
+  for _, test := range []struct {
+    protocol string
+    expected byte
+  }{
+    {WebSocketBinaryProtocol, websocket.BinaryFrame},
+    {WebSocketTextProtocol, websocket.TextFrame},
+    {"", websocket.TextFrame},
+  } {
+    ws, err := websocket.Dial(url, test.protocol, srv.URL)
+    if err != nil {
+      t.Fatal(err)
+    }
+    // A text frame written by a client is read like a binary frame
+    ws.PayloadType = websocket.TextFrame
+    WriteVersion(ws)
+    var frame []byte
+    if err := frames.Receive(ws, &frame); err != nil {
+      t.Fatal(err)
+    }
+    ws.Write(append(MakeMsg(MsgTypeSingleReq, "001", "echo", 5), "hello"...))
+    expected := string(MakeMsg(MsgTypeSingleRes, "001", "", 5)) + "hello"
+    var res []byte
+    for len(res) < len(expected) {
+      if err := frames.Receive(ws, &frame); err != nil {
+        t.Fatal(err)
+      }
+      if frame[0] != test.expected {
+        t.Errorf("received frame of type %d with subprotocol %q, expected %d",
+          frame[0], test.protocol, test.expected)
+      }
+      res = append(res, frame[1:]...)
+    }
+    if string(res) != expected {
+      t.Errorf("received %q with subprotocol %q, expected %q", res, test.protocol, expected)
+    }
+    ws.Close()
+  }
+}
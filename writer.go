@@ -0,0 +1,75 @@
+package gotalk
+
+import (
+  "errors"
+  "sync/atomic"
+)
+
+// Writes to the connection of a socket are made by a single goroutine, the writer, which runs
+// write jobs one at a time, in the order they were sent, with wmu held. Sending a job waits for
+// it to complete, so that callers see the errors of their writes and may reuse their buffers.
+
+// Returned when writing to a socket which hasn't adopted a connection
+var errNotConnected = errors.New("socket is not connected")
+
+// Number of write jobs which can be waiting for the writer
+const sendQueueSize = 64
+
+type writeJob struct {
+  f    func() error
+  done chan error
+}
+
+// Starts the writer. Called by Adopt.
+func (s *socket) startWriter() {
+  s.sendq = make(chan writeJob, sendQueueSize)
+  s.writerDone = make(chan struct{})
+  go s.writeLoop()
+}
+
+func (s *socket) writeLoop() {
+  defer close(s.writerDone)
+  for {
+    select {
+    case j := <-s.sendq:
+      if s.ctx.Err() != nil {
+        j.done <- ErrSockClosed
+        return
+      }
+      s.wmu.Lock()
+      err := j.f()
+      s.wmu.Unlock()
+      j.done <- err
+    case <-s.ctx.Done():
+      return
+    }
+  }
+}
+
+// Runs `f` on the writer and returns its error, or ErrSockClosed if the socket closed before
+// `f` ran. `f` must not send write jobs itself.
+func (s *socket) write(f func() error) error {
+  if s.sendq == nil {
+    return errNotConnected
+  }
+  atomic.AddInt32(&s.pendingSends, 1)
+  defer atomic.AddInt32(&s.pendingSends, -1)
+  j := writeJob{f, make(chan error, 1)}
+  select {
+  case s.sendq <- j:
+  case <-s.writerDone:
+    return ErrSockClosed
+  }
+  select {
+  case err := <-j.done:
+    return err
+  case <-s.writerDone:
+    // The writer might have run `f` just before stopping
+    select {
+    case err := <-j.done:
+      return err
+    default:
+      return ErrSockClosed
+    }
+  }
+}